@@ -17,6 +17,7 @@ package lb
 import (
 	"bytes"
 	"fmt"
+	"math"
 	"net/http"
 	"reflect"
 	"sort"
@@ -44,7 +45,7 @@ func (j *jsonToCBORWriter) WriteHeader(statusCode int) {
 	if j.isSendingJSON {
 		return
 	}
-	if j.Header().Get("Content-Type") == "application/json" {
+	if IsJSONContentType(j.Header().Get("Content-Type")) {
 		j.isSendingJSON = true
 		j.Header().Set("Content-Type", "application/cbor")
 	}
@@ -110,6 +111,28 @@ func jsonInterfaceToCBORInterface(jsonInt interface{}, lookup map[string]int) in
 	}
 }
 
+// cborIntegers converts the JSON numbers in the output of jsonInterfaceToCBORInterface which are
+// integers to int64, for v2 codecs only as it changes the bytes v1 peers expect. JSON has no integers,
+// but CBOR does and small ones are a single byte rather than 9, which matters for counts, indexes and
+// ranges. Only integers which a float64 holds exactly are converted.
+func cborIntegers(cborInt interface{}) interface{} {
+	switch v := cborInt.(type) {
+	case []interface{}:
+		for i, element := range v {
+			v[i] = cborIntegers(element)
+		}
+	case map[interface{}]interface{}:
+		for k, element := range v {
+			v[k] = cborIntegers(element)
+		}
+	case float64:
+		if v == math.Trunc(v) && math.Abs(v) <= 1<<53 {
+			return int64(v)
+		}
+	}
+	return cborInt
+}
+
 func cborInterfaceToJSONInterface(cborInt interface{}, lookup map[int]string) interface{} {
 	// CBOR.Unmarshal maps to:
 	// CBOR booleans decode to bool.
@@ -30,6 +30,8 @@ type CBORCodec struct {
 	// - CBORToJSON emits Canonical JSON: https://matrix.org/docs/spec/appendices#canonical-json
 	// - JSONToCBOR emits Canonical CBOR: RFC 7049 Section 3.9
 	canonical bool
+	// If set, JSONToCBOR emits JSON numbers which are integers as CBOR integers. Only set for v2.
+	integers bool
 }
 
 // NewCBORCodec creates a CBOR codec which will map the enum keys given. If canonical is set,
@@ -55,6 +57,15 @@ func NewCBORCodec(keys map[string]int, canonical bool) (*CBORCodec, error) {
 	return c, nil
 }
 
+// Keys returns a copy of the enum keys this codec maps.
+func (c *CBORCodec) Keys() map[string]int {
+	keys := make(map[string]int, len(c.keys))
+	for k, v := range c.keys {
+		keys[k] = v
+	}
+	return keys
+}
+
 // CBORToJSON converts a single CBOR object into a single JSON object
 func (c *CBORCodec) CBORToJSON(input io.Reader) ([]byte, error) {
 	var intermediate interface{}
@@ -80,6 +91,9 @@ func (c *CBORCodec) JSONToCBOR(input io.Reader) ([]byte, error) {
 		return nil, fmt.Errorf("JSONToCBOR: unmarshalling json: %w", err)
 	}
 	intermediate = jsonInterfaceToCBORInterface(intermediate, c.keys)
+	if c.integers {
+		intermediate = cborIntegers(intermediate)
+	}
 	if c.canonical {
 		enc, err := cbor.CanonicalEncOptions().EncMode()
 		if err != nil {
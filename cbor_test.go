@@ -220,3 +220,25 @@ func TestJSONToCBORWriter(t *testing.T) {
 		t.Errorf("wrong response body, got %s want %s", gotBody, wantBody)
 	}
 }
+
+func TestCBORSlidingSyncListOps(t *testing.T) {
+	codec := NewCBORCodecV2(true)
+	input := `{"count":3,"ops":[{"op":"SYNC","range":[0,2],"room_ids":["!a:b","!c:d","!e:f"]},{"index":0,"op":"DELETE"}]}`
+	output, err := codec.JSONToCBOR(bytes.NewBufferString(input))
+	if err != nil {
+		t.Fatalf("JSONToCBOR: %s", err)
+	}
+	// keys are integers, and so are counts, indexes and ranges
+	gotBody := hex.EncodeToString(output)
+	wantBody := "a2188082a318816453594e4318828200021883836421613a626421633a646421653a66a218816644454c455445188400188503"
+	if gotBody != wantBody {
+		t.Errorf("wrong CBOR, got %s want %s", gotBody, wantBody)
+	}
+	roundTrip, err := codec.CBORToJSON(bytes.NewReader(output))
+	if err != nil {
+		t.Fatalf("CBORToJSON: %s", err)
+	}
+	if string(roundTrip) != input {
+		t.Errorf("round trip: got %s want %s", roundTrip, input)
+	}
+}
@@ -17,6 +17,9 @@ package main
 import (
 	"bytes"
 	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/hex"
 	"flag"
 	"fmt"
 	"io"
@@ -32,7 +35,11 @@ import (
 	"github.com/matrix-org/lb"
 	piondtls "github.com/pion/dtls/v2"
 	"github.com/matrix-org/go-coap/v2/dtls"
+	"github.com/matrix-org/go-coap/v2/message/codes"
+	basepool "github.com/matrix-org/go-coap/v2/message/pool"
 	"github.com/matrix-org/go-coap/v2/net/blockwise"
+	"github.com/matrix-org/go-coap/v2/tcp"
+	tcppool "github.com/matrix-org/go-coap/v2/tcp/message/pool"
 	"github.com/matrix-org/go-coap/v2/udp/message/pool"
 )
 
@@ -43,6 +50,14 @@ var (
 	flagVerbose  bool
 	flagInclude  bool
 	flagHeaders  stringFlags
+	flagDiscover bool
+
+	flagPSK         string
+	flagPSKIdentity string
+	flagServerKey   string
+
+	flagOSCOREServerKey string
+	flagOSCOREAlg       int
 )
 
 type stringFlags []string
@@ -70,6 +85,56 @@ func init() {
 	flag.BoolVar(&flagVerbose, "v", false, "Verbose mode (shorthand of --verbose)")
 	flag.Var(&flagHeaders, "header", "HTTP Header")
 	flag.Var(&flagHeaders, "H", "HTTP Header (shorthand of --header)")
+	flag.BoolVar(&flagDiscover, "discover", false, "List the enum paths and options the proxy supports from /.well-known/core, ignoring the path of the URL")
+	flag.StringVar(&flagPSK, "psk", "", "Authenticate DTLS with this hex encoded pre-shared key instead of a certificate")
+	flag.StringVar(&flagPSKIdentity, "psk-identity", "", "The PSK identity to send with --psk")
+	flag.StringVar(&flagServerKey, "server-key", "", "Only accept a proxy with this hex encoded Ed25519 public key (raw public key mode)")
+	flag.StringVar(&flagOSCOREServerKey, "oscore-server-key", "", "Protect the request with OSCORE, using EDHOC to establish a security context with the proxy which has this hex encoded public key")
+	flag.IntVar(&flagOSCOREAlg, "oscore-alg", lb.DefaultOSCOREAlgorithm, "The COSE AEAD algorithm to use with OSCORE: 10 (AES-CCM-16-64-128) or 24 (ChaCha20/Poly1305)")
+}
+
+// verifyServerKeyFromFlags returns a function which checks the proxy has the pinned public key, or nil.
+func verifyServerKeyFromFlags() func(rawCerts [][]byte, verifiedChains [][]*x509.Certificate) error {
+	if flagServerKey == "" {
+		return nil
+	}
+	pub, err := lb.ParseEd25519PublicKey(flagServerKey)
+	if err != nil {
+		log.Printf("FATAL: invalid --server-key: %s\n", err)
+		os.Exit(1)
+	}
+	return lb.VerifyPinnedPublicKey(pub)
+}
+
+// makeOSCOREContextFromFlags returns the OSCORE security context to protect the request with, or nil.
+// `post` sends an EDHOC message to the proxy.
+func makeOSCOREContextFromFlags(post func(payload []byte) ([]byte, error)) *lb.OSCOREContext {
+	var oscore *lb.OSCOREContext
+	var err error
+	if flagOSCOREServerKey != "" {
+		var serverKey []byte
+		if serverKey, err = hex.DecodeString(flagOSCOREServerKey); err != nil {
+			log.Printf("FATAL: -oscore-server-key must be hex encoded: %s\n", err)
+			os.Exit(1)
+		}
+		oscore, err = lb.EDHOCHandshake(flagOSCOREAlg, serverKey, post)
+	}
+	if err != nil {
+		log.Printf("FATAL: failed to make OSCORE security context: %s\n", err)
+		os.Exit(1)
+	}
+	return oscore
+}
+
+// edhocResponse returns the payload of the response to an EDHOC message.
+func edhocResponse(res *basepool.Message) ([]byte, error) {
+	if res.Code() != codes.Changed {
+		return nil, fmt.Errorf("EDHOC request failed: %v", res.Code())
+	}
+	if res.Body() == nil {
+		return nil, nil
+	}
+	return res.ReadBody()
 }
 
 func makeHTTPRequestFromFlags(targetURL string) *http.Request {
@@ -139,6 +204,17 @@ func printResponse(res *http.Response) {
 			fmt.Printf("%s", string(data))
 		}
 	}
+	if flagDiscover && res.StatusCode == 200 {
+		links, err := lb.ParseLinkFormat(string(body))
+		if err != nil {
+			log.Printf("FATAL parsing /.well-known/core: %s\n", err.Error())
+			os.Exit(1)
+		}
+		for _, link := range links {
+			fmt.Println(link.String())
+		}
+		return
+	}
 	fmt.Printf("%s", string(body))
 }
 
@@ -154,6 +230,22 @@ func mainDTLS(targetURL string, keyLogWriter io.Writer) {
 		InsecureSkipVerify: flagInsecure,
 		KeyLogWriter:       keyLogWriter,
 	}
+	if flagPSK != "" {
+		key, err := hex.DecodeString(flagPSK)
+		if err != nil {
+			log.Printf("FATAL: --psk must be hex encoded: %s\n", err)
+			os.Exit(1)
+		}
+		dtlsConfig.PSK = func(hint []byte) ([]byte, error) {
+			return key, nil
+		}
+		dtlsConfig.PSKIdentityHint = []byte(flagPSKIdentity)
+		dtlsConfig.CipherSuites = lb.PSKCipherSuites
+	} else if verify := verifyServerKeyFromFlags(); verify != nil {
+		dtlsConfig.InsecureSkipVerify = true
+		dtlsConfig.VerifyPeerCertificate = verify
+		dtlsConfig.CipherSuites = lb.RawPublicKeyCipherSuites
+	}
 	co, err := dtls.Dial(turl.Host, dtlsConfig,
 		dtls.WithTransmission(1*time.Second, 60*time.Second, 4),
 		dtls.WithBlockwise(true, blockwise.SZX1024, 2*time.Minute),
@@ -170,13 +262,32 @@ func mainDTLS(targetURL string, keyLogWriter io.Writer) {
 		os.Exit(1)
 	}
 
+	oscore := makeOSCOREContextFromFlags(func(payload []byte) ([]byte, error) {
+		res, err := co.Post(context.Background(), lb.EDHOCPath, lb.EDHOCRequestContentFormat, bytes.NewReader(payload))
+		if err != nil {
+			return nil, err
+		}
+		defer pool.ReleaseMessage(res)
+		return edhocResponse(res.Message)
+	})
+
 	// make the low bandwidth mapping
 	lbcoap := lb.NewCoAPHTTP(lb.NewCoAPPathV1())
+	lbcoap.Queries = lb.NewCoAPQueryV1()
 
 	var coapres *pool.Message
 	err = lbcoap.HTTPRequestToCoAP(req, func(msg *pool.Message) error {
+		var protected *lb.OSCORERequest
+		if oscore != nil {
+			if protected, err = oscore.ProtectRequest(msg.Message); err != nil {
+				return err
+			}
+		}
 		coapres, err = co.Do(msg)
-		return err
+		if err != nil || protected == nil {
+			return err
+		}
+		return protected.UnprotectResponse(coapres.Message)
 	})
 	if err != nil {
 		log.Printf("FATAL: Failed to perform CoAP request: %s", err)
@@ -195,6 +306,100 @@ func mainDTLS(targetURL string, keyLogWriter io.Writer) {
 	}
 }
 
+// mainTCP sends the request using CoAP over TLS (coaps+tcp://) or over secure WebSockets (coaps+ws://)
+func mainTCP(targetURL string, keyLogWriter io.Writer) {
+	req := makeHTTPRequestFromFlags(targetURL)
+	verbosePrintRequest(req)
+	turl, err := url.Parse(targetURL)
+	if err != nil {
+		log.Printf("FATAL: target url is invalid %s : %s", targetURL, err)
+		os.Exit(1)
+	}
+	tlsConfig := &tls.Config{
+		InsecureSkipVerify: flagInsecure,
+		KeyLogWriter:       keyLogWriter,
+	}
+	if verify := verifyServerKeyFromFlags(); verify != nil {
+		tlsConfig.InsecureSkipVerify = true
+		tlsConfig.VerifyPeerCertificate = verify
+	}
+	opts := []tcp.DialOption{
+		// the transport is reliable so use BERT to send large bodies in fewer messages
+		tcp.WithBlockwise(true, blockwise.SZXBERT, 2*time.Minute),
+		tcp.WithMaxMessageSize(lb.TCPMaxMessageSize),
+		tcp.WithHeartBeat(60 * time.Second),
+	}
+	var co *tcp.ClientConn
+	if turl.Scheme == "coaps+ws" {
+		conn, err := lb.DialWebSocket(turl, tlsConfig)
+		if err != nil {
+			log.Printf("FATAL: failed to dial WebSocket %s", err)
+			os.Exit(1)
+		}
+		co = tcp.Client(conn, opts...)
+	} else {
+		tlsConfig.NextProtos = []string{"coap"}
+		co, err = tcp.Dial(turl.Host, append(opts, tcp.WithTLS(tlsConfig))...)
+		if err != nil {
+			log.Printf("FATAL: failed to dial TLS addr %s", err)
+			os.Exit(1)
+		}
+	}
+	defer co.Close()
+	if err = lb.SendBlockwiseCSM(co); err != nil {
+		log.Printf("FATAL: failed to send CSM %s", err)
+		os.Exit(1)
+	}
+	// wait for the server's CSM, which it sends before the pong, so large bodies use blockwise transfers
+	if err = co.Ping(context.Background()); err != nil {
+		log.Printf("FATAL: failed to ping %s", err)
+		os.Exit(1)
+	}
+
+	oscore := makeOSCOREContextFromFlags(func(payload []byte) ([]byte, error) {
+		res, err := co.Post(context.Background(), lb.EDHOCPath, lb.EDHOCRequestContentFormat, bytes.NewReader(payload))
+		if err != nil {
+			return nil, err
+		}
+		defer tcppool.ReleaseMessage(res)
+		return edhocResponse(res.Message)
+	})
+
+	// make the low bandwidth mapping
+	lbcoap := lb.NewCoAPHTTP(lb.NewCoAPPathV1())
+	lbcoap.Queries = lb.NewCoAPQueryV1()
+
+	var coapres *tcppool.Message
+	err = lbcoap.HTTPRequestToCoAPTCP(req, func(msg *tcppool.Message) error {
+		var protected *lb.OSCORERequest
+		if oscore != nil {
+			if protected, err = oscore.ProtectRequest(msg.Message); err != nil {
+				return err
+			}
+		}
+		coapres, err = co.Do(msg)
+		if err != nil || protected == nil {
+			return err
+		}
+		return protected.UnprotectResponse(coapres.Message)
+	})
+	if err != nil {
+		log.Printf("FATAL: Failed to perform CoAP request: %s", err)
+		os.Exit(1)
+	}
+	defer tcppool.ReleaseMessage(coapres)
+
+	httpRes := lbcoap.CoAPTCPToHTTPResponse(coapres)
+	if httpRes == nil {
+		log.Printf("FATAL: cannot convert CoAP to HTTP")
+		os.Exit(1)
+	}
+	printResponse(httpRes)
+	if httpRes.StatusCode >= 300 || httpRes.StatusCode < 200 {
+		os.Exit(1)
+	}
+}
+
 func main() {
 	flag.Parse()
 	flag.Usage = func() {
@@ -203,6 +408,12 @@ func main() {
 		fmt.Println("Example:                     ./coap -X POST -d '{}' -k https://localhost:8008/_matrix/client/r0/register")
 		fmt.Println("Example (stdin): echo '{}' | ./coap -X POST -d '-' -k https://localhost:8008/_matrix/client/r0/register")
 		fmt.Println("Example (file):              ./coap -X POST -d '@empty.json' -k https://localhost:8008/_matrix/client/r0/register")
+		fmt.Println("Example (TLS):               ./coap -k coaps+tcp://localhost:8449/_matrix/client/versions")
+		fmt.Println("Example (WebSockets):        ./coap -k coaps+ws://localhost:8450/_matrix/client/versions")
+		fmt.Println("Example (PSK):               ./coap --psk 0102...0f --psk-identity alice https://localhost:8008/_matrix/client/versions")
+		fmt.Println("Example (raw public key):    ./coap --server-key 3d4017...1a https://localhost:8008/_matrix/client/versions")
+		fmt.Println("Example (OSCORE):            ./coap -k -oscore-server-key 8f40...c3 https://localhost:8008/_matrix/client/versions")
+		fmt.Println("Example (discovery):         ./coap -k -discover https://localhost:8008")
 		fmt.Println("Also supports the environment variable SSLKEYLOGFILE= to write session secrets for decrypting DTLS traffic in Wireshark")
 	}
 
@@ -211,6 +422,17 @@ func main() {
 		os.Exit(1)
 	}
 	flagURL := flag.Arg(0)
+	if flagDiscover {
+		u, err := url.Parse(flagURL)
+		if err != nil {
+			log.Printf("FATAL: target url is invalid %s : %s", flagURL, err)
+			os.Exit(1)
+		}
+		u.Path = lb.WellKnownCorePath
+		flagURL = u.String()
+		flagMethod = "GET"
+		flagData = ""
+	}
 
 	var keyLogWriter io.Writer
 	var err error
@@ -220,5 +442,9 @@ func main() {
 			panic(err)
 		}
 	}
-	mainDTLS(flagURL, keyLogWriter)
+	if strings.HasPrefix(flagURL, "coaps+tcp://") || strings.HasPrefix(flagURL, "coaps+ws://") {
+		mainTCP(flagURL, keyLogWriter)
+	} else {
+		mainDTLS(flagURL, keyLogWriter)
+	}
 }
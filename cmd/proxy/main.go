@@ -15,11 +15,18 @@
 package main
 
 import (
+	"context"
+	"crypto/ed25519"
 	"crypto/tls"
+	"encoding/hex"
 	"flag"
+	"fmt"
 	"io"
+	"io/ioutil"
 	"os"
+	"os/signal"
 	"strings"
+	"syscall"
 
 	"github.com/matrix-org/lb"
 	"github.com/sirupsen/logrus"
@@ -27,12 +34,28 @@ import (
 
 var (
 	dtlsBindAddr = flag.String("dtls-bind-addr", ":8008", "The DTLS UDP listening port for the server")
+	tcpBindAddr  = flag.String("tcp-bind-addr", fmt.Sprintf(":%d", lb.DefaultTCPPort), "The TCP listening port for CoAP over TLS (coaps+tcp://), which clients fall back to if DTLS is blocked. Empty to disable")
+	wsBindAddr   = flag.String("ws-bind-addr", fmt.Sprintf(":%d", lb.DefaultWebSocketPort), "The TCP listening port for CoAP over secure WebSockets (coaps+ws://), which clients fall back to if DTLS is blocked. Empty to disable")
 	localAddr    = flag.String("local", "", "The HTTP server to forward inbound CoAP requests to e.g http://localhost:8008")
 	advertise    = flag.String("advertise", "",
 		"Optional: the public address of this proxy. If set, sniffs logins/registrations for homeserver discovery information and replaces the base_url with this advertising address. "+
 			"This is useful when the local server is not on the same machine as the proxy.")
 	certFile = flag.String("tls-cert", "", "The PEM formatted X509 certificate to use for TLS")
 	keyFile  = flag.String("tls-key", "", "The PEM private key to use for TLS")
+	pskFile  = flag.String("psk-file", "", "Optional: authenticate DTLS clients with pre-shared keys instead of the TLS certificate. "+
+		"Each line of the file is a PSK identity and a hex encoded key separated by a space")
+	sessionTicketKey = flag.String("session-ticket-key", "", "Optional: hex encoded 32 byte key which lets clients resume DTLS sessions without a full handshake. "+
+		"Keep it secret, and persist it so clients can resume after the proxy restarts")
+	routesFile = flag.String("routes", "", "Optional: a file of virtual hosts which requests are routed to by their Uri-Host option or TLS server name. "+
+		"Each line is a host, its local address, and optionally its advertise address (- for none), certificate and key, separated by spaces")
+	proxyHosts = flag.String("forward-proxy-hosts", "", "Optional: comma separated hosts which clients may send requests to with the CoAP Proxy-Uri or Proxy-Scheme options e.g matrix.org,example.com:8448")
+	rpkKey     = flag.String("rpk-key", "", "Optional: authenticate DTLS with this hex encoded Ed25519 private key instead of the TLS certificate. Clients pin the public key")
+
+	edhocKey       = flag.String("edhoc-key", "", "Optional: hex encoded X25519 private key which lets clients establish OSCORE contexts using EDHOC")
+	oscoreRequired = flag.Bool("oscore-required", false, "Reject CoAP requests which are not protected by OSCORE")
+	internIDs      = flag.Bool("intern-ids", false, "Issue short per-session handles for room, user and event IDs in responses, which clients can send in paths instead of the IDs")
+	observeStore   = flag.String("observe-store", "", "Optional: a file to persist OBSERVE registrations in, so they resume when clients register again after the proxy restarts. "+
+		"The file holds access tokens")
 )
 
 func main() {
@@ -46,13 +69,59 @@ func main() {
 		if err != nil {
 			logrus.WithError(err).Panicf("failed to load TLS certificate")
 		}
-	} else {
-		logrus.Panicf("TLS certificate/key must be set")
+	} else if *pskFile == "" && *rpkKey == "" {
+		logrus.Panicf("TLS certificate/key, -psk-file or -rpk-key must be set")
+	}
+
+	if len(certs) == 0 && *rpkKey == "" {
+		// the TLS listeners need a certificate, so only fail if they were asked for
+		flag.Visit(func(f *flag.Flag) {
+			if (f.Name == "tcp-bind-addr" || f.Name == "ws-bind-addr") && f.Value.String() != "" {
+				logrus.Panicf("-%s needs a TLS certificate/key or -rpk-key", f.Name)
+			}
+		})
+		logrus.Warnf("No TLS certificate/key or -rpk-key: not listening for CoAP over TLS or WebSockets, so clients can't fall back to them")
+		*tcpBindAddr = ""
+		*wsBindAddr = ""
+	}
+
+	var psk func(identity []byte) ([]byte, error)
+	if *pskFile != "" {
+		keys, err := loadPSKFile(*pskFile)
+		if err != nil {
+			logrus.WithError(err).Panicf("failed to load PSK file")
+		}
+		psk = func(identity []byte) ([]byte, error) {
+			key, ok := keys[string(identity)]
+			if !ok {
+				return nil, fmt.Errorf("unknown PSK identity %q", identity)
+			}
+			return key, nil
+		}
+	}
+	var rawPublicKey ed25519.PrivateKey
+	if *rpkKey != "" {
+		rawPublicKey, err = lb.ParseEd25519PrivateKey(*rpkKey)
+		if err != nil {
+			logrus.WithError(err).Panicf("invalid -rpk-key")
+		}
+		logrus.Infof("Raw public key mode enabled, clients should pin the public key %x", []byte(rawPublicKey.Public().(ed25519.PublicKey)))
 	}
 
 	if *localAddr == "" {
 		logrus.Panicf("Must specify HTTP local address")
 	}
+	var routes map[string]Route
+	if *routesFile != "" {
+		routes, err = loadRoutesFile(*routesFile)
+		if err != nil {
+			logrus.WithError(err).Panicf("failed to load routes file")
+		}
+	}
+	advertiseOnHTTPS := strings.HasPrefix(*advertise, "https://")
+	for _, route := range routes {
+		advertiseOnHTTPS = advertiseOnHTTPS || strings.HasPrefix(route.Advertise, "https://")
+	}
 
 	var keyLogWriter io.Writer
 	if keylogfile := os.Getenv("SSLKEYLOGFILE"); keylogfile != "" {
@@ -62,17 +131,149 @@ func main() {
 		}
 	}
 
+	// clients negotiate v1 or v2, which decode the same with v2 paths and queries
+	coapHTTP := lb.NewCoAPHTTP(lb.NewCoAPPathV2())
+	coapHTTP.NonConfirmable = lb.NonConfirmableV1()
+	coapHTTP.Queries = lb.NewCoAPQueryV2()
+	coapHTTP.Dictionary = lb.DictionaryV2
+	coapHTTP.InternIDs = *internIDs
+	if *proxyHosts != "" {
+		coapHTTP.ProxyHosts = strings.Split(*proxyHosts, ",")
+	}
+	if *sessionTicketKey != "" {
+		key, err := hex.DecodeString(*sessionTicketKey)
+		if err != nil {
+			logrus.WithError(err).Panicf("-session-ticket-key must be hex encoded")
+		}
+		coapHTTP.SessionTickets, err = lb.NewSessionTickets(key, lb.DefaultSessionTicketLifetime)
+		if err != nil {
+			logrus.WithError(err).Panicf("invalid -session-ticket-key")
+		}
+	}
+	if *edhocKey != "" {
+		coapHTTP.OSCORE = newOSCOREServer()
+	} else if *oscoreRequired {
+		logrus.Panicf("-oscore-required needs -edhoc-key")
+	}
+
+	var observationStore lb.ObservationStore
+	if *observeStore != "" {
+		observationStore, err = lb.NewFileObservationStore(*observeStore)
+		if err != nil {
+			logrus.WithError(err).Panicf("failed to load -observe-store")
+		}
+	}
+
+	// shut down gracefully, so clients are told to register their observations again
+	ctx, cancel := context.WithCancel(context.Background())
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGINT, syscall.SIGTERM)
+	go func() {
+		sig := <-signals
+		logrus.Infof("Received %s, shutting down", sig)
+		cancel()
+	}()
+
 	err = RunProxyServer(&Config{
 		ListenDTLS:       *dtlsBindAddr,
+		ListenTCP:        *tcpBindAddr,
+		ListenWS:         *wsBindAddr,
 		LocalAddr:        *localAddr,
 		Certificates:     certs,
+		PSK:              psk,
+		RawPublicKey:     rawPublicKey,
+		Routes:           routes,
 		KeyLogWriter:     keyLogWriter,
 		Advertise:        *advertise,
-		AdvertiseOnHTTPS: *advertise != "" && strings.HasPrefix(*advertise, "https://"),
+		AdvertiseOnHTTPS: advertiseOnHTTPS,
 		CBORCodec:        lb.NewCBORCodecV1(false),
-		CoAPHTTP:         lb.NewCoAPHTTP(lb.NewCoAPPathV1()),
+		CoAPHTTP:         coapHTTP,
+		CBORCodecs: map[int]*lb.CBORCodec{
+			lb.DictionaryV1: lb.NewCBORCodecV1(false),
+			lb.DictionaryV2: lb.NewCBORCodecV2(false),
+		},
+		ObservationStore: observationStore,
+		Context:          ctx,
 	})
 	if err != nil {
 		logrus.Panicf("RunProxyServer: %s", err)
 	}
 }
+
+// loadPSKFile reads PSK identities and their hex encoded keys, one per line separated by a space.
+func loadPSKFile(path string) (map[string][]byte, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	keys := make(map[string][]byte)
+	for i, line := range strings.Split(string(data), "\n") {
+		line = strings.TrimSpace(line)
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		fields := strings.Fields(line)
+		if len(fields) != 2 {
+			return nil, fmt.Errorf("line %d: want 'identity hexkey'", i+1)
+		}
+		key, err := hex.DecodeString(fields[1])
+		if err != nil {
+			return nil, fmt.Errorf("line %d: key is not hex encoded: %w", i+1, err)
+		}
+		keys[fields[0]] = key
+	}
+	return keys, nil
+}
+
+// loadRoutesFile reads virtual hosts, one per line: the host, its local address, and optionally its
+// advertise address (- for none), certificate file and key file, separated by spaces.
+func loadRoutesFile(path string) (map[string]Route, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	routes := make(map[string]Route)
+	for i, line := range strings.Split(string(data), "\n") {
+		line = strings.TrimSpace(line)
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		fields := strings.Fields(line)
+		if len(fields) != 2 && len(fields) != 3 && len(fields) != 5 {
+			return nil, fmt.Errorf("line %d: want 'host local [advertise [cert key]]'", i+1)
+		}
+		route := Route{
+			LocalAddr: fields[1],
+		}
+		if len(fields) > 2 && fields[2] != "-" {
+			route.Advertise = fields[2]
+		}
+		if len(fields) == 5 {
+			cert, err := tls.LoadX509KeyPair(fields[3], fields[4])
+			if err != nil {
+				return nil, fmt.Errorf("line %d: failed to load certificate: %w", i+1, err)
+			}
+			route.Certificates = []tls.Certificate{cert}
+		}
+		routes[fields[0]] = route
+	}
+	return routes, nil
+}
+
+func newOSCOREServer() *lb.OSCOREServer {
+	server := lb.NewOSCOREServer(lb.DefaultOSCOREContexts)
+	server.Required = *oscoreRequired
+	if *edhocKey != "" {
+		priv, err := hex.DecodeString(*edhocKey)
+		if err != nil {
+			logrus.WithError(err).Panicf("-edhoc-key must be hex encoded")
+		}
+		key, err := lb.EDHOCKeyFromPrivate(priv)
+		if err != nil {
+			logrus.WithError(err).Panicf("invalid EDHOC key")
+		}
+		server.SetEDHOCKey(key)
+		logrus.Infof("EDHOC enabled, clients should pin the public key %x", key.Public)
+	}
+	return server
+}
@@ -18,12 +18,16 @@ package main
 import (
 	"bytes"
 	"context"
+	"crypto/ed25519"
 	"crypto/tls"
+	"fmt"
 	"io"
 	"io/ioutil"
+	gonet "net"
 	"net/http"
 	"net/http/httputil"
 	"net/url"
+	"strings"
 	"sync/atomic"
 	"time"
 
@@ -34,6 +38,7 @@ import (
 	coapmux "github.com/matrix-org/go-coap/v2/mux"
 	"github.com/matrix-org/go-coap/v2/net"
 	"github.com/matrix-org/go-coap/v2/net/blockwise"
+	"github.com/matrix-org/go-coap/v2/tcp"
 	"github.com/matrix-org/go-coap/v2/udp/client"
 	udpMessage "github.com/matrix-org/go-coap/v2/udp/message"
 	"github.com/matrix-org/go-coap/v2/udp/message/pool"
@@ -50,6 +55,17 @@ type Config struct {
 	LocalAddr    string            // http://localhost:1234
 	Certificates []tls.Certificate // Certs to use
 	Advertise    string            // optional: Where this proxy is running publicly
+	ListenTCP    string            // optional: CoAP over TLS (coaps+tcp://) e.g :8449
+	ListenWS     string            // optional: CoAP over secure WebSockets (coaps+ws://) e.g :8450
+	// Optional: authenticate DTLS clients with pre-shared keys instead of Certificates. Called with the
+	// PSK identity of the client, returning its key. CoAP over TLS and WebSockets still use Certificates.
+	PSK func(identity []byte) ([]byte, error)
+	// Optional: authenticate to DTLS clients with this Ed25519 key, which clients pin, instead of
+	// Certificates. Also used for TLS and WebSockets if Certificates is empty.
+	RawPublicKey ed25519.PrivateKey
+	// Optional: virtual hosts, keyed by the host clients ask for in the Uri-Host option or TLS server
+	// name. Requests for any other host go to LocalAddr.
+	Routes map[string]Route
 	// how long to wait for the server to send a response before sending an ACK back
 	// If this is too short, the proxy server will send more packets than it should (1x ACK, 1x Response)
 	// and not do any piggybacking.
@@ -62,17 +78,161 @@ type Config struct {
 	CoAPHTTP          *lb.CoAPHTTP
 	KeyLogWriter      io.Writer
 	Client            *http.Client
+	// Optional: the codecs of the dictionary versions clients can negotiate (see lb.CoAPHTTP.Dictionary),
+	// keyed by version. CBORCodec is used for clients which don't negotiate a version.
+	CBORCodecs map[int]*lb.CBORCodec
+	// Optional: the cache used to deduplicate retransmitted requests. Default: lb.DefaultDedupCacheSize entries
+	DedupCache *lb.DedupCache
+	// Optional: where OBSERVE registrations are persisted, so they resume when clients register again
+	// after the proxy restarts. Default: lb.NewMemoryObservationStore()
+	ObservationStore lb.ObservationStore
+	// Optional: when this context is cancelled the proxy shuts down, cancelling all in-flight requests
+	// to LocalAddr. Default: context.Background()
+	Context context.Context
+}
+
+// codec returns the CBOR codec of the dictionary version the client of this request negotiated.
+func (cfg *Config) codec(req *http.Request) *lb.CBORCodec {
+	if codec, ok := cfg.CBORCodecs[lb.RequestDictionary(req)]; ok {
+		return codec
+	}
+	return cfg.CBORCodec
+}
+
+// newestCodec returns the CBOR codec of the newest dictionary version, which can decode CBOR from
+// clients of every version.
+func (cfg *Config) newestCodec() *lb.CBORCodec {
+	codec, newest := cfg.CBORCodec, 0
+	for version, c := range cfg.CBORCodecs {
+		if version > newest {
+			codec, newest = c, version
+		}
+	}
+	return codec
+}
+
+// Route is where requests for a virtual host are sent.
+type Route struct {
+	LocalAddr    string            // http://localhost:1234
+	Advertise    string            // optional: Where this host is running publicly
+	Certificates []tls.Certificate // optional: Certs for this host, picked by TLS server name. Not used for DTLS
+}
+
+// upstream is a parsed Route.
+type upstream struct {
+	localURL  *url.URL
+	advertise string
+}
+
+// router picks the upstream for the host in a request.
+type router struct {
+	fallback upstream
+	hosts    map[string]upstream
+}
+
+func newRouter(cfg *Config) (*router, error) {
+	localURL, err := url.Parse(cfg.LocalAddr)
+	if err != nil {
+		return nil, fmt.Errorf("cannot parse local addr URL: %s", err)
+	}
+	rt := &router{
+		fallback: upstream{
+			localURL:  localURL,
+			advertise: cfg.Advertise,
+		},
+		hosts: make(map[string]upstream),
+	}
+	for host, route := range cfg.Routes {
+		localURL, err := url.Parse(route.LocalAddr)
+		if err != nil {
+			return nil, fmt.Errorf("cannot parse local addr URL for %s: %s", host, err)
+		}
+		up := upstream{
+			localURL:  localURL,
+			advertise: route.Advertise,
+		}
+		rt.hosts[strings.ToLower(host)] = up
+		// clients use the advertised address once they have discovered it
+		if route.Advertise != "" {
+			advertiseURL, err := url.Parse(route.Advertise)
+			if err != nil {
+				return nil, fmt.Errorf("cannot parse advertise URL for %s: %s", host, err)
+			}
+			rt.hosts[strings.ToLower(advertiseURL.Hostname())] = up
+		}
+	}
+	return rt, nil
+}
+
+// route returns the upstream for this host, which may include a port.
+func (rt *router) route(host string) upstream {
+	if h, _, err := gonet.SplitHostPort(host); err == nil {
+		host = h
+	}
+	if up, ok := rt.hosts[strings.ToLower(host)]; ok {
+		return up
+	}
+	return rt.fallback
+}
+
+// advertising returns true if any host has a public address, so the HTTP reverse proxy is needed.
+func (rt *router) advertising() bool {
+	if rt.fallback.advertise != "" {
+		return true
+	}
+	for _, up := range rt.hosts {
+		if up.advertise != "" {
+			return true
+		}
+	}
+	return false
 }
 
 type handler interface {
 	ServeCOAP(w client.ResponseWriter, r *message.Message, udpMsg *pool.Message)
 }
 
+// observationsEndTimeout is how long the proxy waits for clients to ACK the notifications which end
+// their observations when it shuts down.
+const observationsEndTimeout = 10 * time.Second
+
+// maxCachedBodySize is the largest response body which is cached for duplicate requests.
+const maxCachedBodySize = 64 * 1024
+
 type muxResponseWriter struct {
 	w *client.ResponseWriter
+	// the last response set, so it can be cached for duplicate requests
+	response *lb.CachedResponse
 }
 
 func (w *muxResponseWriter) SetResponse(code codes.Code, contentFormat message.MediaType, d io.ReadSeeker, opts ...message.Option) error {
+	w.response = &lb.CachedResponse{
+		Code:          code,
+		ContentFormat: contentFormat,
+		Options:       append(message.Options{}, opts...),
+	}
+	if d != nil {
+		size, err := d.Seek(0, io.SeekEnd)
+		if err != nil {
+			return err
+		}
+		if _, err = d.Seek(0, io.SeekStart); err != nil {
+			return err
+		}
+		if size > maxCachedBodySize {
+			// e.g media: duplicate requests will go to the local address again rather than hold this in memory
+			w.response = nil
+			return w.w.SetResponse(code, contentFormat, d, opts...)
+		}
+		body, err := ioutil.ReadAll(d)
+		if err != nil {
+			return err
+		}
+		if _, err = d.Seek(0, io.SeekStart); err != nil {
+			return err
+		}
+		w.response.Body = body
+	}
 	return w.w.SetResponse(code, contentFormat, d, opts...)
 }
 
@@ -80,74 +240,110 @@ func (w *muxResponseWriter) Client() mux.Client {
 	return w.w.ClientConn().Client()
 }
 
-func forwardToLocalAddr(cfg *Config) http.HandlerFunc {
-	localURL, err := url.Parse(cfg.LocalAddr)
-	if err != nil {
-		panic("cannot parse local addr URL: " + err.Error())
-	}
+func forwardToLocalAddr(cfg *Config, rt *router) http.HandlerFunc {
 	return func(w http.ResponseWriter, req *http.Request) {
-		body, err := ioutil.ReadAll(req.Body)
-		if err != nil {
-			logrus.WithError(err).Error("failed to read incoming request body")
-			w.WriteHeader(500)
-			w.Write([]byte(`Failed to read request body: ` + err.Error()))
-			return
-		}
-		if req.Header.Get("Content-Type") == "application/cbor" {
-			body, err = cfg.CBORCodec.CBORToJSON(bytes.NewBuffer(body))
+		up := rt.route(req.Host)
+		// binary bodies such as media uploads are streamed to the local address untouched
+		body := req.Body
+		contentLength := req.ContentLength
+		isCBOR := req.Header.Get("Content-Type") == "application/cbor"
+		if isCBOR {
+			cborBody, err := ioutil.ReadAll(req.Body)
+			if err != nil {
+				logrus.WithError(err).Error("failed to read incoming request body")
+				w.WriteHeader(500)
+				w.Write([]byte(`Failed to read request body: ` + err.Error()))
+				return
+			}
+			jsonBody, err := cfg.codec(req).CBORToJSON(bytes.NewBuffer(cborBody))
 			if err != nil {
 				logrus.WithError(err).Error("failed to convert incoming request body from JSON to CBOR")
 				w.WriteHeader(500)
 				w.Write([]byte(`Failed to convert CBOR to JSON: ` + err.Error()))
 				return
 			}
+			body = ioutil.NopCloser(bytes.NewReader(jsonBody))
+			contentLength = int64(len(jsonBody))
 		}
 		reqURL := *req.URL
-		reqURL.Scheme = localURL.Scheme
-		reqURL.Host = localURL.Host
+		if lb.IsForwardProxyRequest(req) {
+			// the client asked for this homeserver, which CoAPHTTP has checked is allowed
+			up = upstream{
+				localURL: &url.URL{Scheme: reqURL.Scheme, Host: reqURL.Host},
+			}
+		}
+		reqURL.Scheme = up.localURL.Scheme
+		reqURL.Host = up.localURL.Host
 
-		newReq, err := http.NewRequest(req.Method, reqURL.String(), bytes.NewBuffer(body))
+		// use the request context so if the CoAP exchange is abandoned we stop waiting for the local address
+		newReq, err := http.NewRequestWithContext(req.Context(), req.Method, reqURL.String(), body)
 		if err != nil {
 			logrus.WithError(err).Error("failed to form proxy HTTP request")
 			w.WriteHeader(500)
 			w.Write([]byte("failed to form corresponding HTTP request"))
 			return
 		}
+		newReq.ContentLength = contentLength
 		// copy headers
 		for k, vs := range req.Header {
 			for _, v := range vs {
 				newReq.Header.Add(k, v)
 			}
 		}
+		if isCBOR {
+			newReq.Header.Set("Content-Type", "application/json")
+		}
 		res, err := cfg.Client.Do(newReq)
 		if err != nil {
+			if req.Context().Err() != nil {
+				logrus.WithError(err).Infof("%s %s cancelled", newReq.Method, reqURL.String())
+				w.WriteHeader(http.StatusGatewayTimeout)
+				w.Write([]byte("Request cancelled"))
+				return
+			}
 			logrus.WithError(err).Error("failed to contact local address")
 			w.WriteHeader(http.StatusBadGateway)
 			w.Write([]byte("Failed to contact local address"))
 			return
 		}
-		resBody := writeResponse(cfg, res, w)
+		size, jsonBody := writeResponse(cfg.codec(req), up.advertise, res, w)
 		if res.StatusCode != 200 {
 			logrus.Warnf("%s %s returned %d from local address with body: %s",
-				newReq.Method, reqURL.String(), res.StatusCode, string(resBody))
+				newReq.Method, reqURL.String(), res.StatusCode, string(jsonBody))
 		} else {
-			logrus.Infof("%s %s - 200 OK (%d bytes)", newReq.Method, reqURL.String(), len(resBody))
+			logrus.Infof("%s %s - 200 OK (%d bytes)", newReq.Method, reqURL.String(), size)
 		}
 	}
 }
 
-func writeResponse(cfg *Config, res *http.Response, w http.ResponseWriter) []byte {
-	var resBody []byte
+// writeResponse writes the response from the local address. JSON bodies are converted to CBOR with the codec, after
+// replacing the homeserver base_url with advertise if it is set. Anything else (e.g media) is streamed
+// untouched. Returns the size of the body written, and the JSON body if there was one.
+func writeResponse(codec *lb.CBORCodec, advertise string, res *http.Response, w http.ResponseWriter) (int64, []byte) {
 	if res.Body != nil {
 		defer res.Body.Close()
-		jsonBody, err := ioutil.ReadAll(res.Body)
+	}
+	contentType := res.Header.Get("Content-Type")
+	if res.Body != nil && contentType != "" && !lb.IsJSONContentType(contentType) {
+		copyHeaders(w, res)
+		w.WriteHeader(res.StatusCode)
+		size, err := io.Copy(w, res.Body)
+		if err != nil {
+			logrus.WithError(err).Error("failed to copy local response body")
+		}
+		return size, nil
+	}
+	var resBody, jsonBody []byte
+	if res.Body != nil {
+		var err error
+		jsonBody, err = ioutil.ReadAll(res.Body)
 		if err != nil {
 			logrus.WithError(err).Error("failed to read local response body")
 			w.WriteHeader(http.StatusBadGateway)
 			w.Write([]byte("Failed to read local response body"))
-			return resBody
+			return 0, nil
 		}
-		if cfg.Advertise != "" {
+		if advertise != "" {
 			keys := []string{
 				`well_known.m\.homeserver.base_url`, // from login
 				`m\.homeserver.base_url`,            // from well-known
@@ -155,34 +351,41 @@ func writeResponse(cfg *Config, res *http.Response, w http.ResponseWriter) []byt
 			for _, k := range keys {
 				baseURL := gjson.GetBytes(jsonBody, k)
 				if baseURL.Exists() {
-					jsonBody2, err := sjson.SetBytes(jsonBody, k, cfg.Advertise)
+					jsonBody2, err := sjson.SetBytes(jsonBody, k, advertise)
 					if err != nil {
 						logrus.WithError(err).Error("failed to replace advertise URL")
 					} else {
 						jsonBody = jsonBody2
-						logrus.Infof("Replaced homeserver base_url with %s", cfg.Advertise)
+						logrus.Infof("Replaced homeserver base_url with %s", advertise)
 					}
 				}
 			}
 		}
 		if len(jsonBody) > 0 {
-			resBody, err = cfg.CBORCodec.JSONToCBOR(bytes.NewBuffer(jsonBody))
+			resBody, err = codec.JSONToCBOR(bytes.NewBuffer(jsonBody))
 			if err != nil {
 				logrus.WithError(err).WithField("body", string(jsonBody)).Error("failed to convert response body from JSON to CBOR")
 				w.WriteHeader(http.StatusBadGateway)
 				w.Write([]byte("Failed to convert response body from JSON to CBOR"))
-				return resBody
+				return 0, jsonBody
 			}
 		}
 	}
+	copyHeaders(w, res)
+	if len(resBody) > 0 {
+		w.Header().Set("Content-Type", "application/cbor")
+	}
+	w.WriteHeader(res.StatusCode)
+	w.Write(resBody)
+	return int64(len(resBody)), jsonBody
+}
+
+func copyHeaders(w http.ResponseWriter, res *http.Response) {
 	for k, vs := range res.Header {
 		for _, v := range vs {
 			w.Header().Add(k, v)
 		}
 	}
-	w.WriteHeader(res.StatusCode)
-	w.Write(resBody)
-	return resBody
 }
 
 type logger struct{}
@@ -192,22 +395,88 @@ func (l *logger) Printf(format string, v ...interface{}) {
 }
 
 // listenAndServeDTLS Starts a server on address and network over DTLS specified Invoke handler
-// for incoming queries.
-func listenAndServeDTLS(network string, addr string, config *piondtls.Config, waitACK time.Duration, handler coapmux.Handler) error {
+// for incoming queries. The server stops when ctx is cancelled.
+func listenAndServeDTLS(ctx context.Context, network string, addr string, config *piondtls.Config, waitACK time.Duration, dedup *lb.DedupCache, tickets *lb.SessionTickets, observations *lb.Observations, handler coapmux.Handler) error {
 	l, err := net.NewDTLSListener(network, addr, config)
 	if err != nil {
 		return err
 	}
 	defer l.Close()
+	onNewClientConn := func(cc *client.ClientConn, dtlsConn *piondtls.Conn) {}
+	if tickets != nil {
+		onNewClientConn = func(cc *client.ClientConn, dtlsConn *piondtls.Conn) {
+			state := dtlsConn.ConnectionState()
+			if err := tickets.StartSession(cc, &state); err != nil {
+				// e.g two clients resumed with the same ticket at once
+				logrus.WithError(err).WithField("remote", cc.RemoteAddr()).Warn("Closing resumed session")
+				cc.Close()
+			}
+		}
+	}
 	s := dtls.NewServer(
+		// connection contexts are derived from this, so cancelling it cancels every exchange
+		dtls.WithContext(ctx),
+		dtls.WithOnNewClientConn(onNewClientConn),
 		dtls.WithHandlerFunc(func(w *client.ResponseWriter, r *pool.Message) {
+			if r.Type() == udpMessage.Reset {
+				// The client rejected a message we sent it. Responses are piggybacked on ACKs, so
+				// the only messages it can reject are notifications: stop long-polling for them.
+				//   "Rejecting a Confirmable message is effected by sending a matching
+				//    Reset message and otherwise ignoring it."
+				// https://datatracker.ietf.org/doc/html/rfc7252#section-4.2
+				if observations.HandleReset(w.ClientConn()) {
+					logrus.WithField("mid", r.MessageID()).Info("Client reset a notification, cancelling observation")
+				}
+				return
+			}
+			// Retransmitted requests must not be sent to the local address again, so reply with
+			// the response we sent the first time. go-coap answers retransmissions with the same
+			// message ID on this connection from its own response cache before they get here, but
+			// that cache has no size limit or counters: this one is bounded, matches the token too,
+			// and counts every request, duplicate and eviction.
+			// https://datatracker.ietf.org/doc/html/rfc7252#section-4.5
+			dedupKey := lb.DedupKey{
+				Session:   lb.SessionID(w.ClientConn()),
+				MessageID: r.MessageID(),
+				Token:     string(r.Token()),
+			}
+			cached, inFlight := dedup.Lookup(dedupKey)
+			if cached != nil {
+				stats := dedup.Stats()
+				logrus.WithField("mid", r.MessageID()).Infof(
+					"Duplicate request, replying with cached response (hits=%d in-flight=%d misses=%d)", stats.Hits, stats.InFlight, stats.Misses,
+				)
+				var body io.ReadSeeker
+				if cached.Body != nil {
+					body = bytes.NewReader(cached.Body)
+				}
+				w.SetResponse(cached.Code, cached.ContentFormat, body, cached.Options...)
+				return
+			}
+			if inFlight {
+				// we're still processing the original, so just ACK this one (done automatically on return)
+				stats := dedup.Stats()
+				logrus.WithField("mid", r.MessageID()).Infof(
+					"Duplicate request whilst still processing the original (hits=%d in-flight=%d misses=%d)", stats.Hits, stats.InFlight, stats.Misses,
+				)
+				return
+			}
 			muxw := &muxResponseWriter{
 				w: w,
 			}
+			defer func() {
+				if muxw.response != nil {
+					dedup.Store(dedupKey, muxw.response)
+				} else {
+					dedup.Forget(dedupKey)
+				}
+			}()
 			muxr, err := pool.ConvertTo(r)
 			if err != nil {
 				return
 			}
+			// muxr has the context of the connection, so the exchange is cancelled when the connection closes
+
 			// wait up to waitACK time before sending an ACK back.
 			// If ServeCoAP has returned then we know the ACK has been sent.
 			// If it is still blocking then we need to send an ACK back.
@@ -243,15 +512,111 @@ func listenAndServeDTLS(network string, addr string, config *piondtls.Config, wa
 		// increase transfer time from 5s to 2min due to large inital sync responses
 		dtls.WithBlockwise(true, blockwise.SZX1024, 2*time.Minute),
 	)
+	go func() {
+		<-ctx.Done()
+		s.Stop()
+	}()
+	return s.Serve(l)
+}
+
+// The cipher suites pion/dtls uses by default, which are replaced when PSK suites are added.
+var defaultCertificateCipherSuites = []piondtls.CipherSuiteID{
+	piondtls.TLS_ECDHE_ECDSA_WITH_AES_128_GCM_SHA256,
+	piondtls.TLS_ECDHE_RSA_WITH_AES_128_GCM_SHA256,
+	piondtls.TLS_ECDHE_ECDSA_WITH_AES_256_CBC_SHA,
+	piondtls.TLS_ECDHE_RSA_WITH_AES_256_CBC_SHA,
+}
+
+// alpnCoAP is the ALPN protocol ID for CoAP over TLS. https://datatracker.ietf.org/doc/html/rfc8323#section-8.2
+const alpnCoAP = "coap"
+
+// serveTCP serves CoAP over TCP on this listener until ctx is cancelled. As the transport is reliable
+// there are no ACKs or retransmissions to worry about, and large responses can use BERT blocks.
+func serveTCP(ctx context.Context, l tcp.Listener, handler coapmux.Handler) error {
+	defer l.Close()
+	s := tcp.NewServer(
+		tcp.WithContext(ctx),
+		// route requests without a Uri-Host option by the server name the client asked for
+		tcp.WithOnNewClientConn(func(cc *tcp.ClientConn, tlsConn *tls.Conn) {
+			if tlsConn != nil {
+				lb.SetServerName(cc, tlsConn.ConnectionState().ServerName)
+			}
+			if err := lb.SendBlockwiseCSM(cc); err != nil {
+				logrus.WithError(err).Warn("failed to send CSM, so blockwise transfers are disabled")
+			}
+		}),
+		tcp.WithMux(handler),
+		// BERT allows many 1024 byte blocks per message, so large /sync responses need far fewer round trips
+		tcp.WithBlockwise(true, blockwise.SZXBERT, 2*time.Minute),
+		tcp.WithMaxMessageSize(lb.TCPMaxMessageSize),
+	)
+	go func() {
+		<-ctx.Done()
+		s.Stop()
+	}()
 	return s.Serve(l)
 }
 
 func RunProxyServer(cfg *Config) error {
-	// run the DTLS server
+	rt, err := newRouter(cfg)
+	if err != nil {
+		return err
+	}
+	// TLS picks the certificate for the server name the client asked for, falling back to the first
+	tlsCertificates := append([]tls.Certificate{}, cfg.Certificates...)
+	hasRouteCertificates := false
+	for _, route := range cfg.Routes {
+		tlsCertificates = append(tlsCertificates, route.Certificates...)
+		hasRouteCertificates = hasRouteCertificates || len(route.Certificates) > 0
+	}
+
+	// run the DTLS server. pion/dtls ignores the server name and always uses the first certificate,
+	// so the certificates of routes are never used: DTLS clients of other hosts must use a certificate
+	// which covers every host, or RawPublicKey.
 	dtlsConfig := &piondtls.Config{
 		Certificates: cfg.Certificates,
 		KeyLogWriter: cfg.KeyLogWriter,
 	}
+	switch {
+	case cfg.PSK != nil:
+		dtlsConfig.Certificates = nil
+		dtlsConfig.PSK = cfg.PSK
+		dtlsConfig.CipherSuites = lb.PSKCipherSuites
+	case cfg.RawPublicKey != nil:
+		cert, err := lb.NewRawPublicKeyCertificate(cfg.RawPublicKey)
+		if err != nil {
+			return err
+		}
+		dtlsConfig.Certificates = []tls.Certificate{cert}
+		dtlsConfig.CipherSuites = lb.RawPublicKeyCipherSuites
+		if len(tlsCertificates) == 0 {
+			tlsCertificates = dtlsConfig.Certificates
+		}
+	case len(cfg.Certificates) == 0 && hasRouteCertificates:
+		return fmt.Errorf("DTLS needs Certificates, RawPublicKey or PSK: the certificates of routes are not used for DTLS")
+	case hasRouteCertificates:
+		logrus.Warnf("The certificates of routes are only used for TLS: DTLS always presents the first of Certificates")
+	}
+	if tickets := cfg.CoAPHTTP.SessionTickets; tickets != nil {
+		// clients resume sessions with a PSK handshake, so accept PSKs as well as the configured mode
+		staticPSK := dtlsConfig.PSK
+		dtlsConfig.PSK = func(identity []byte) ([]byte, error) {
+			psk, err := tickets.PSK(identity)
+			if err != nil && staticPSK != nil {
+				return staticPSK(identity)
+			}
+			return psk, err
+		}
+		if dtlsConfig.CipherSuites == nil {
+			dtlsConfig.CipherSuites = defaultCertificateCipherSuites
+		}
+		if staticPSK == nil {
+			dtlsConfig.CipherSuites = append(append([]piondtls.CipherSuiteID{}, dtlsConfig.CipherSuites...), lb.PSKCipherSuites...)
+		}
+	}
+	if (cfg.ListenTCP != "" || cfg.ListenWS != "" || cfg.AdvertiseOnHTTPS) && len(tlsCertificates) == 0 {
+		return fmt.Errorf("TLS listeners need Certificates or RawPublicKey")
+	}
 
 	if cfg.Client == nil {
 		cfg.Client = &http.Client{
@@ -262,53 +627,137 @@ func RunProxyServer(cfg *Config) error {
 	if cfg.WaitTimeBeforeACK == 0 {
 		cfg.WaitTimeBeforeACK = 5 * time.Second
 	}
+	if cfg.Context == nil {
+		cfg.Context = context.Background()
+	}
+	if cfg.DedupCache == nil {
+		cfg.DedupCache = lb.NewDedupCache(lb.DefaultDedupCacheSize, lb.ExchangeLifetime)
+	}
 
+	r := coapmux.NewRouter()
+	handler := http.HandlerFunc(forwardToLocalAddr(cfg, rt))
+	// long-poll responses are encoded with the dictionary of each client, which the newest can decode
+	observations := lb.NewSyncObservations(handler, cfg.CoAPHTTP.Paths, cfg.newestCodec())
+	observations.Log = &logger{}
+	if cfg.ObservationStore != nil {
+		observations.Store = cfg.ObservationStore
+	}
+	resumable, err := observations.PruneStore()
+	if err != nil {
+		return fmt.Errorf("failed to prune observation store: %w", err)
+	}
+	logrus.Infof("%d observations can be resumed", resumable)
+	// The listeners stop once the clients have been told their observations ended, so they know to
+	// register again when the proxy is back.
+	serveCtx, stopServing := context.WithCancel(context.Background())
+	go func() {
+		<-cfg.Context.Done()
+		stats := cfg.DedupCache.Stats()
+		logrus.Infof(
+			"Shutting down: duplicate requests hits=%d in-flight=%d misses=%d evictions=%d",
+			stats.Hits, stats.InFlight, stats.Misses, stats.Evictions,
+		)
+		logrus.Infof("Shutting down: ending observations")
+		ctx, cancel := context.WithTimeout(context.Background(), observationsEndTimeout)
+		observations.EndAll(ctx, codes.ServiceUnavailable)
+		cancel()
+		if store, ok := observations.Store.(*lb.FileObservationStore); ok {
+			if err := store.Flush(); err != nil {
+				logrus.WithError(err).Errorf("Failed to write observation store")
+			}
+		}
+		stopServing()
+	}()
+	cfg.CoAPHTTP.Log = &logger{}
+	r.DefaultHandle(cfg.CoAPHTTP.CoAPHTTPHandler(
+		handler, observations,
+	))
 	go func() {
-		r := coapmux.NewRouter()
-		handler := http.HandlerFunc(forwardToLocalAddr(cfg))
-		observations := lb.NewSyncObservations(handler, cfg.CoAPHTTP.Paths, cfg.CBORCodec)
-		observations.Log = &logger{}
-		cfg.CoAPHTTP.Log = &logger{}
-		r.DefaultHandle(cfg.CoAPHTTP.CoAPHTTPHandler(
-			handler, observations,
-		))
 		logrus.Infof("Listening for DTLS on %s - ACK piggyback period: %v", cfg.ListenDTLS, cfg.WaitTimeBeforeACK)
-		if err := listenAndServeDTLS("udp", cfg.ListenDTLS, dtlsConfig, cfg.WaitTimeBeforeACK, r); err != nil {
+		if err := listenAndServeDTLS(serveCtx, "udp", cfg.ListenDTLS, dtlsConfig, cfg.WaitTimeBeforeACK, cfg.DedupCache, cfg.CoAPHTTP.SessionTickets, observations, r); err != nil {
 			logrus.WithError(err).Panicf("Failed to ListenAndServeDTLS")
 		}
 	}()
 
-	if cfg.Advertise != "" {
-		logrus.Infof("Listening on %s/tcp to reverse proxy from %s to %s - HTTPS enabled: %v", cfg.ListenDTLS, cfg.Advertise, cfg.LocalAddr, cfg.AdvertiseOnHTTPS)
-		localURL, err := url.Parse(cfg.LocalAddr)
+	if cfg.ListenTCP != "" {
+		tlsConfig := &tls.Config{
+			Certificates: tlsCertificates,
+			KeyLogWriter: cfg.KeyLogWriter,
+			NextProtos:   []string{alpnCoAP},
+		}
+		l, err := net.NewTLSListener("tcp", cfg.ListenTCP, tlsConfig)
 		if err != nil {
-			panic(err)
+			return err
 		}
-		rp2 := httputil.NewSingleHostReverseProxy(localURL)
+		go func() {
+			logrus.Infof("Listening for CoAP over TLS on %s", cfg.ListenTCP)
+			if err := serveTCP(serveCtx, l, r); err != nil {
+				logrus.WithError(err).Panicf("Failed to serve CoAP over TLS")
+			}
+		}()
+	}
+
+	if cfg.ListenWS != "" {
+		l := lb.NewWebSocketListener()
+		httpMux := http.NewServeMux()
+		httpMux.Handle(lb.WebSocketPath, l)
+		wsServer := &http.Server{
+			Addr:    cfg.ListenWS,
+			Handler: httpMux,
+			TLSConfig: &tls.Config{
+				Certificates: tlsCertificates,
+				KeyLogWriter: cfg.KeyLogWriter,
+			},
+		}
+		go func() {
+			<-serveCtx.Done()
+			wsServer.Close()
+		}()
+		go func() {
+			logrus.Infof("Listening for CoAP over WebSockets on %s%s", cfg.ListenWS, lb.WebSocketPath)
+			if err := serveTCP(serveCtx, l, r); err != nil {
+				logrus.WithError(err).Panicf("Failed to serve CoAP over WebSockets")
+			}
+		}()
+		go func() {
+			if err := wsServer.ListenAndServeTLS("", ""); err != nil && err != http.ErrServerClosed {
+				logrus.WithError(err).Panicf("failed to ListenAndServeTLS for WebSockets")
+			}
+		}()
+	}
+
+	if rt.advertising() {
+		logrus.Infof("Listening on %s/tcp to reverse proxy from %s to %s - HTTPS enabled: %v", cfg.ListenDTLS, cfg.Advertise, cfg.LocalAddr, cfg.AdvertiseOnHTTPS)
 		rp := &httputil.ReverseProxy{
 			Director: func(req *http.Request) {
-				rp2.Director(req)
+				localURL := rt.route(req.Host).localURL
+				httputil.NewSingleHostReverseProxy(localURL).Director(req)
 				logrus.Infof("TCP proxy %v", req.URL.String())
 				req.Host = localURL.Host
 			},
 		}
+		tcpServer := &http.Server{
+			Addr:    cfg.ListenDTLS,
+			Handler: rp,
+		}
+		go func() {
+			<-serveCtx.Done()
+			tcpServer.Close()
+		}()
 		if cfg.AdvertiseOnHTTPS {
-			tlsServer := &http.Server{
-				Addr:    cfg.ListenDTLS,
-				Handler: rp,
-				TLSConfig: &tls.Config{
-					Certificates: cfg.Certificates,
-				},
+			tcpServer.TLSConfig = &tls.Config{
+				Certificates: tlsCertificates,
 			}
-			if err := tlsServer.ListenAndServeTLS("", ""); err != nil {
+			if err := tcpServer.ListenAndServeTLS("", ""); err != nil && err != http.ErrServerClosed {
 				logrus.WithError(err).Panicf("failed to ListenAndServeTLS")
 			}
 		} else {
-			if err := http.ListenAndServe(cfg.ListenDTLS, rp); err != nil {
+			if err := tcpServer.ListenAndServe(); err != nil && err != http.ErrServerClosed {
 				logrus.WithError(err).Panicf("failed to ListenAndServe")
 			}
 		}
 	}
 
-	select {} // block forever
+	<-serveCtx.Done()
+	return nil
 }
@@ -0,0 +1,119 @@
+// Copyright 2021 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"fmt"
+	"go/ast"
+	"go/parser"
+	"go/token"
+	"strconv"
+	"strings"
+)
+
+// loadTables reads the tables from map literals in Go files: variables named *pathMappings are enum
+// paths, *QueryKeys are query keys and cbor*Keys are CBOR keys.
+func loadTables(files []string) (*tables, error) {
+	t := &tables{
+		paths: make(map[string]string),
+		keys:  make(map[string]int),
+		query: make(map[string]string),
+	}
+	fset := token.NewFileSet()
+	for _, file := range files {
+		f, err := parser.ParseFile(fset, file, nil, 0)
+		if err != nil {
+			return nil, err
+		}
+		for _, decl := range f.Decls {
+			gen, ok := decl.(*ast.GenDecl)
+			if !ok || gen.Tok != token.VAR {
+				continue
+			}
+			for _, spec := range gen.Specs {
+				vs := spec.(*ast.ValueSpec)
+				for i, name := range vs.Names {
+					if i >= len(vs.Values) {
+						continue
+					}
+					lit, ok := vs.Values[i].(*ast.CompositeLit)
+					if !ok {
+						continue
+					}
+					switch {
+					case strings.HasSuffix(name.Name, "pathMappings"):
+						err = readStrings(lit, t.paths)
+					case strings.HasSuffix(name.Name, "QueryKeys"):
+						err = readStrings(lit, t.query)
+					case strings.HasPrefix(name.Name, "cbor") && strings.HasSuffix(name.Name, "Keys"):
+						err = readInts(lit, t.keys)
+					}
+					if err != nil {
+						return nil, fmt.Errorf("%s: %s: %s", file, name.Name, err)
+					}
+				}
+			}
+		}
+	}
+	return t, nil
+}
+
+func readStrings(lit *ast.CompositeLit, m map[string]string) error {
+	return readLiteral(lit, func(k string, v *ast.BasicLit) error {
+		if v.Kind != token.STRING {
+			return fmt.Errorf("%s is not a string", v.Value)
+		}
+		val, err := strconv.Unquote(v.Value)
+		m[k] = val
+		return err
+	})
+}
+
+func readInts(lit *ast.CompositeLit, m map[string]int) error {
+	return readLiteral(lit, func(k string, v *ast.BasicLit) error {
+		if v.Kind != token.INT {
+			return fmt.Errorf("%s is not an int", v.Value)
+		}
+		val, err := strconv.Atoi(v.Value)
+		m[k] = val
+		return err
+	})
+}
+
+// readLiteral calls fn for each string key of a map literal whose value is a basic literal.
+func readLiteral(lit *ast.CompositeLit, fn func(k string, v *ast.BasicLit) error) error {
+	for _, elt := range lit.Elts {
+		kv, ok := elt.(*ast.KeyValueExpr)
+		if !ok {
+			return fmt.Errorf("not a map literal")
+		}
+		key, ok := kv.Key.(*ast.BasicLit)
+		if !ok || key.Kind != token.STRING {
+			return fmt.Errorf("keys must be string literals")
+		}
+		val, ok := kv.Value.(*ast.BasicLit)
+		if !ok {
+			return fmt.Errorf("values must be literals")
+		}
+		k, err := strconv.Unquote(key.Value)
+		if err != nil {
+			return err
+		}
+		if err = fn(k, val); err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,10 @@
+module github.com/matrix-org/lb/cmd/specgen
+
+go 1.14
+
+replace github.com/matrix-org/lb => ../../
+
+require (
+	github.com/matrix-org/lb v0.0.0-20210916112413-984a54a5343a
+	gopkg.in/yaml.v2 v2.4.0
+)
@@ -0,0 +1,364 @@
+// Copyright 2021 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"bytes"
+	"flag"
+	"fmt"
+	"go/format"
+	"io"
+	"io/ioutil"
+	"log"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/matrix-org/lb"
+)
+
+var (
+	flagSpec    = flag.String("spec", "", "Directory of the client-server API files in a matrix-spec checkout, e.g matrix-spec/data/api/client-server")
+	flagBase    = flag.String("base", "", "Comma separated Go files with the tables to keep the codes of, e.g a previous output. Defaults to the v1 tables.")
+	flagDiff    = flag.Bool("diff", false, "Print what the spec has which the base tables are missing, rather than generating tables")
+	flagVersion = flag.String("version", "2", "Version in the names of the generated tables e.g coapv2pathMappings")
+	flagMinUses = flag.Int("min-uses", 2, "Only add CBOR keys used by at least this many endpoints")
+	flagOutput  = flag.String("out", "-", "Output file to write to. If '-' prints to stdout")
+)
+
+// The alphabet of path enum codes, in the order they are allocated. Codes are one character, then two.
+const pathCodeAlphabet = "0123456789ABCDEFGHIJKLMNOPQRSTUVWXYZabcdefghijklmnopqrstuvwxyz"
+
+const licenseHeader = `// Copyright 2021 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+`
+
+// tables are the enum paths, CBOR keys and query keys.
+type tables struct {
+	// enum code -> HTTP path template
+	paths map[string]string
+	// key -> integer
+	keys map[string]int
+	// enum code -> query key
+	query map[string]string
+}
+
+func main() {
+	flag.Usage = func() {
+		fmt.Fprintf(flag.CommandLine.Output(), "Usage of specgen:\n")
+		flag.PrintDefaults()
+		fmt.Println("\nGenerates candidate enum paths, CBOR keys and query keys from the Matrix client-server API.")
+		fmt.Println(`Example tables for v2:           ./specgen -spec matrix-spec/data/api/client-server -out coap_v2.go`)
+		fmt.Println(`Example regenerate keeping codes: ./specgen -spec matrix-spec/data/api/client-server -base coap_v2.go -out coap_v2.go`)
+		fmt.Println(`Example what v1 is missing:      ./specgen -spec matrix-spec/data/api/client-server -diff`)
+	}
+	flag.Parse()
+	if *flagSpec == "" {
+		flag.Usage()
+		os.Exit(1)
+	}
+
+	base := v1Tables()
+	if *flagBase != "" {
+		var err error
+		base, err = loadTables(strings.Split(*flagBase, ","))
+		if err != nil {
+			log.Printf("FATAL: failed to load base tables: %s", err)
+			os.Exit(1)
+		}
+	}
+	eps, err := newSpec(*flagSpec).endpoints()
+	if err != nil {
+		log.Printf("FATAL: failed to load spec: %s", err)
+		os.Exit(1)
+	}
+	if len(eps) == 0 {
+		log.Printf("FATAL: no paths found in %s", *flagSpec)
+		os.Exit(1)
+	}
+
+	var output bytes.Buffer
+	if *flagDiff {
+		err = diff(&output, base, eps)
+	} else {
+		err = generate(&output, base, eps)
+	}
+	if err != nil {
+		log.Printf("FATAL: %s", err)
+		os.Exit(1)
+	}
+	if *flagOutput == "-" {
+		os.Stdout.Write(output.Bytes())
+		return
+	}
+	if err = ioutil.WriteFile(*flagOutput, output.Bytes(), 0644); err != nil {
+		log.Printf("FATAL: failed to write output: %s", err)
+		os.Exit(1)
+	}
+}
+
+// v1Tables returns the tables of NewCoAPPathV1, NewCBORCodecV1 and NewCoAPQueryV1.
+func v1Tables() *tables {
+	return &tables{
+		paths: lb.NewCoAPPathV1().Mappings(),
+		keys:  lb.NewCBORCodecV1(false).Keys(),
+		query: lb.NewCoAPQueryV1().Keys(),
+	}
+}
+
+// matches maps each endpoint to the enum code of the base template it matches. Base templates can use
+// any spec version and any variable names. Each code is used at most once.
+func matches(base *tables, eps []*endpoint) (map[*endpoint]string, error) {
+	paths, err := lb.NewCoAPPath(base.paths)
+	if err != nil {
+		return nil, err
+	}
+	codes := make(map[string]string, len(base.paths))
+	for code, tpl := range base.paths {
+		codes[tpl] = code
+	}
+	used := make(map[string]bool)
+	result := make(map[*endpoint]string)
+	for _, ep := range eps {
+		code, ok := codes[paths.Template(ep.template)]
+		if !ok || used[code] {
+			continue
+		}
+		used[code] = true
+		result[ep] = code
+	}
+	return result, nil
+}
+
+// keyUses returns how many endpoints use each body property and each query parameter.
+func keyUses(eps []*endpoint) (props, query map[string]int) {
+	props = make(map[string]int)
+	query = make(map[string]int)
+	for _, ep := range eps {
+		for p := range ep.properties {
+			props[p]++
+		}
+		for q := range ep.query {
+			query[q]++
+		}
+	}
+	return props, query
+}
+
+// byUses returns the names which aren't in `have`, sorted by most uses then by name.
+func byUses(uses map[string]int, have func(string) bool, minUses int) []string {
+	var names []string
+	for name, n := range uses {
+		if n >= minUses && !have(name) {
+			names = append(names, name)
+		}
+	}
+	sort.Slice(names, func(i, j int) bool {
+		if uses[names[i]] != uses[names[j]] {
+			return uses[names[i]] > uses[names[j]]
+		}
+		return names[i] < names[j]
+	})
+	return names
+}
+
+// codeLess orders codes by length, then character by character.
+func codeLess(a, b string) bool {
+	if len(a) != len(b) {
+		return len(a) < len(b)
+	}
+	return a < b
+}
+
+// nextPathCode returns the first code in the alphabet which isn't used.
+func nextPathCode(used map[string]bool) string {
+	codes := []string{""}
+	for {
+		var next []string
+		for _, prefix := range codes {
+			for _, c := range pathCodeAlphabet {
+				code := prefix + string(c)
+				if !used[code] {
+					return code
+				}
+				next = append(next, code)
+			}
+		}
+		codes = next
+	}
+}
+
+// generate writes Go source with the base tables plus everything in the spec they are missing. Codes
+// in the base tables are kept, and templates are updated to the spec's.
+func generate(w io.Writer, base *tables, eps []*endpoint) error {
+	matched, err := matches(base, eps)
+	if err != nil {
+		return err
+	}
+	out := &tables{
+		paths: make(map[string]string),
+		keys:  make(map[string]int),
+		query: make(map[string]string),
+	}
+	comments := make(map[string]string)
+	usedCodes := make(map[string]bool)
+	for code := range base.paths {
+		// codes are never reused, even if the spec no longer has the path
+		usedCodes[code] = true
+	}
+	inSpec := make(map[string]bool)
+	for _, ep := range eps {
+		code, ok := matched[ep]
+		if !ok {
+			code = nextPathCode(usedCodes)
+			usedCodes[code] = true
+		}
+		inSpec[code] = true
+		out.paths[code] = ep.template
+		comments[code] = strings.Join(ep.methods, ", ")
+	}
+	for code, tpl := range base.paths {
+		if !inSpec[code] {
+			out.paths[code] = tpl
+			comments[code] = "not in the spec"
+		}
+	}
+	if _, err = lb.NewCoAPPath(out.paths); err != nil {
+		return err
+	}
+
+	props, query := keyUses(eps)
+	maxKey := 0
+	for k, v := range base.keys {
+		out.keys[k] = v
+		if v > maxKey {
+			maxKey = v
+		}
+	}
+	for _, k := range byUses(props, func(k string) bool { _, ok := out.keys[k]; return ok }, *flagMinUses) {
+		maxKey++
+		out.keys[k] = maxKey
+	}
+	queryCodes := make(map[string]string)
+	maxQuery := -1
+	for code, key := range base.query {
+		out.query[code] = key
+		queryCodes[key] = code
+		if n, err := strconv.Atoi(code); err == nil && n > maxQuery {
+			maxQuery = n
+		}
+	}
+	for _, key := range byUses(query, func(k string) bool { _, ok := queryCodes[k]; return ok }, 1) {
+		maxQuery++
+		out.query[strconv.Itoa(maxQuery)] = key
+	}
+	if _, err = lb.NewCoAPQuery(out.query, nil); err != nil {
+		return err
+	}
+
+	var b bytes.Buffer
+	b.WriteString(licenseHeader)
+	b.WriteString("\n// Generated by specgen from the Matrix client-server API. Codes which are in use must never change.\n\n")
+	b.WriteString("package lb\n\n")
+	fmt.Fprintf(&b, "var coapv%spathMappings = map[string]string{\n", *flagVersion)
+	for _, code := range sortedCodes(out.paths) {
+		fmt.Fprintf(&b, "%q: %q, // %s\n", code, out.paths[code], comments[code])
+	}
+	b.WriteString("}\n\n")
+	fmt.Fprintf(&b, "var cborv%sKeys = map[string]int{\n", *flagVersion)
+	keys := make([]string, 0, len(out.keys))
+	for k := range out.keys {
+		keys = append(keys, k)
+	}
+	sort.Slice(keys, func(i, j int) bool {
+		return out.keys[keys[i]] < out.keys[keys[j]]
+	})
+	for _, k := range keys {
+		fmt.Fprintf(&b, "%q: %d,\n", k, out.keys[k])
+	}
+	b.WriteString("}\n\n")
+	fmt.Fprintf(&b, "var coapv%sQueryKeys = map[string]string{\n", *flagVersion)
+	for _, code := range sortedCodes(out.query) {
+		fmt.Fprintf(&b, "%q: %q,\n", code, out.query[code])
+	}
+	b.WriteString("}\n")
+	src, err := format.Source(b.Bytes())
+	if err != nil {
+		return err
+	}
+	_, err = w.Write(src)
+	return err
+}
+
+// diff writes what the spec has which the base tables are missing, and what the base tables have which
+// the spec doesn't.
+func diff(w io.Writer, base *tables, eps []*endpoint) error {
+	matched, err := matches(base, eps)
+	if err != nil {
+		return err
+	}
+	fmt.Fprintln(w, "Paths missing from the base tables:")
+	inSpec := make(map[string]bool)
+	for _, ep := range eps {
+		if code, ok := matched[ep]; ok {
+			inSpec[code] = true
+			continue
+		}
+		fmt.Fprintf(w, "  %s (%s) %s\n", ep.template, strings.Join(ep.methods, ", "), ep.file)
+	}
+	fmt.Fprintln(w, "Paths in the base tables which are not in the spec:")
+	for _, code := range sortedCodes(base.paths) {
+		if !inSpec[code] {
+			fmt.Fprintf(w, "  %s: %s\n", code, base.paths[code])
+		}
+	}
+	props, query := keyUses(eps)
+	fmt.Fprintf(w, "CBOR keys missing from the base tables, used by at least %d endpoints:\n", *flagMinUses)
+	for _, k := range byUses(props, func(k string) bool { _, ok := base.keys[k]; return ok }, *flagMinUses) {
+		fmt.Fprintf(w, "  %s (%d)\n", k, props[k])
+	}
+	queryKeys := make(map[string]bool)
+	for _, key := range base.query {
+		queryKeys[key] = true
+	}
+	fmt.Fprintln(w, "Query keys missing from the base tables:")
+	for _, k := range byUses(query, func(k string) bool { return queryKeys[k] }, 1) {
+		fmt.Fprintf(w, "  %s (%d)\n", k, query[k])
+	}
+	return nil
+}
+
+func sortedCodes(m map[string]string) []string {
+	codes := make([]string, 0, len(m))
+	for code := range m {
+		codes = append(codes, code)
+	}
+	sort.Slice(codes, func(i, j int) bool {
+		return codeLess(codes[i], codes[j])
+	})
+	return codes
+}
@@ -0,0 +1,208 @@
+// Copyright 2021 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strconv"
+	"strings"
+	"testing"
+)
+
+const (
+	fixtureSync    = "/_matrix/client/v3/sync"
+	fixtureThreads = "/_matrix/client/v1/rooms/{roomId}/threads"
+)
+
+// fixtureEndpoints loads testdata/api, which has an OpenAPI 2 file and an OpenAPI 3 file with a $ref
+// to another file.
+func fixtureEndpoints(t *testing.T) []*endpoint {
+	t.Helper()
+	eps, err := newSpec(filepath.Join("testdata", "api")).endpoints()
+	if err != nil {
+		t.Fatalf("endpoints: %s", err)
+	}
+	return eps
+}
+
+// generateTables runs generate and reads the tables back from its output.
+func generateTables(t *testing.T, base *tables, eps []*endpoint) (*tables, []byte) {
+	t.Helper()
+	var out bytes.Buffer
+	if err := generate(&out, base, eps); err != nil {
+		t.Fatalf("generate: %s", err)
+	}
+	dir, err := ioutil.TempDir("", "specgen")
+	if err != nil {
+		t.Fatalf("TempDir: %s", err)
+	}
+	defer os.RemoveAll(dir)
+	file := filepath.Join(dir, "coap_v2.go")
+	if err = ioutil.WriteFile(file, out.Bytes(), 0644); err != nil {
+		t.Fatalf("WriteFile: %s", err)
+	}
+	got, err := loadTables([]string{file})
+	if err != nil {
+		t.Fatalf("loadTables: %s\n%s", err, out.String())
+	}
+	return got, out.Bytes()
+}
+
+func TestSpecEndpoints(t *testing.T) {
+	eps := fixtureEndpoints(t)
+	if len(eps) != 2 {
+		t.Fatalf("got %d endpoints, want 2", len(eps))
+	}
+	// sorted by template
+	threads, sync := eps[0], eps[1]
+	if threads.template != fixtureThreads || sync.template != fixtureSync {
+		t.Fatalf("got templates %s %s, want %s %s", threads.template, sync.template, fixtureThreads, fixtureSync)
+	}
+	if threads.file != "threads.yaml" || !reflect.DeepEqual(threads.methods, []string{"GET"}) {
+		t.Errorf("threads: got file %s methods %v", threads.file, threads.methods)
+	}
+	wantProps := map[string]bool{"chunk": true, "org.example.shared": true, "org.example.once": true}
+	if !reflect.DeepEqual(threads.properties, wantProps) {
+		t.Errorf("threads: got properties %v want %v", threads.properties, wantProps)
+	}
+	wantQuery := map[string]bool{"since": true, "use_state_after": true}
+	if !reflect.DeepEqual(sync.query, wantQuery) {
+		t.Errorf("sync: got query %v want %v", sync.query, wantQuery)
+	}
+}
+
+func TestGenerateKeepsCodes(t *testing.T) {
+	eps := fixtureEndpoints(t)
+	v1 := v1Tables()
+	got, src := generateTables(t, v1, eps)
+
+	// every v1 code is kept, and the sync path is updated to the spec's version
+	for code, tpl := range v1.paths {
+		want := tpl
+		if tpl == "/_matrix/client/r0/sync" {
+			want = fixtureSync
+		}
+		if got.paths[code] != want {
+			t.Errorf("path %s: got %s want %s", code, got.paths[code], want)
+		}
+	}
+	usedCodes := make(map[string]bool)
+	for code := range v1.paths {
+		usedCodes[code] = true
+	}
+	newCode := nextPathCode(usedCodes)
+	if got.paths[newCode] != fixtureThreads || len(got.paths) != len(v1.paths)+1 {
+		t.Errorf("got %d paths with %s: %s, want %d with %s: %s", len(got.paths), newCode, got.paths[newCode], len(v1.paths)+1, newCode, fixtureThreads)
+	}
+
+	maxKey := 0
+	for k, v := range v1.keys {
+		if got.keys[k] != v {
+			t.Errorf("key %s: got %d want %d", k, got.keys[k], v)
+		}
+		if v > maxKey {
+			maxKey = v
+		}
+	}
+	// org.example.once is only used by one endpoint, which is less than -min-uses
+	if got.keys["org.example.shared"] != maxKey+1 || len(got.keys) != len(v1.keys)+1 {
+		t.Errorf("got %d keys with org.example.shared: %d, want %d with %d", len(got.keys), got.keys["org.example.shared"], len(v1.keys)+1, maxKey+1)
+	}
+
+	for code, key := range v1.query {
+		if got.query[code] != key {
+			t.Errorf("query %s: got %s want %s", code, got.query[code], key)
+		}
+	}
+	// the most used query key comes first
+	next := len(v1.query)
+	if got.query[strconv.Itoa(next)] != "use_state_after" || got.query[strconv.Itoa(next+1)] != "include" {
+		t.Errorf("got new query keys %s %s, want use_state_after include", got.query[strconv.Itoa(next)], got.query[strconv.Itoa(next+1)])
+	}
+
+	// regenerating from the output changes nothing
+	_, again := generateTables(t, got, eps)
+	if !bytes.Equal(src, again) {
+		t.Errorf("regenerating with the output as the base changed it:\n%s\nwant\n%s", again, src)
+	}
+}
+
+func TestGenerateRemovedPath(t *testing.T) {
+	base := &tables{
+		paths: map[string]string{
+			"0": "/_matrix/client/r0/rooms/{roomId}/state",
+			// other versions and variable names match the spec's template
+			"Z": "/_matrix/client/unstable/rooms/{rid}/threads",
+		},
+		keys:  map[string]int{"chunk": 1},
+		query: map[string]string{"0": "since"},
+	}
+	got, src := generateTables(t, base, fixtureEndpoints(t))
+	want := map[string]string{
+		"0": "/_matrix/client/r0/rooms/{roomId}/state",
+		"1": fixtureSync,
+		"Z": fixtureThreads,
+	}
+	if !reflect.DeepEqual(got.paths, want) {
+		t.Errorf("got paths %v want %v", got.paths, want)
+	}
+	for _, line := range strings.Split(string(src), "\n") {
+		if strings.Contains(line, `"0": "/_matrix`) && !strings.HasSuffix(line, "// not in the spec") {
+			t.Errorf("path which isn't in the spec isn't marked: got %s", line)
+		}
+	}
+}
+
+func TestDiff(t *testing.T) {
+	var out bytes.Buffer
+	if err := diff(&out, v1Tables(), fixtureEndpoints(t)); err != nil {
+		t.Fatalf("diff: %s", err)
+	}
+	// the lines under each heading
+	var sections [][]string
+	for _, line := range strings.Split(strings.TrimSuffix(out.String(), "\n"), "\n") {
+		if strings.HasPrefix(line, "  ") {
+			sections[len(sections)-1] = append(sections[len(sections)-1], strings.TrimPrefix(line, "  "))
+			continue
+		}
+		sections = append(sections, []string{})
+	}
+	if len(sections) != 4 {
+		t.Fatalf("got %d sections:\n%s", len(sections), out.String())
+	}
+	if want := []string{fixtureThreads + " (GET) threads.yaml"}; !reflect.DeepEqual(sections[0], want) {
+		t.Errorf("missing paths: got %v want %v", sections[0], want)
+	}
+	// every v1 path except sync isn't in the fixture
+	if len(sections[1]) != len(v1Tables().paths)-1 {
+		t.Errorf("got %d paths which aren't in the spec, want %d", len(sections[1]), len(v1Tables().paths)-1)
+	}
+	for _, line := range sections[1] {
+		if strings.HasSuffix(line, "/sync") {
+			t.Errorf("sync is in the spec: got %s", line)
+		}
+	}
+	// org.example.once is only used by one endpoint, which is less than -min-uses
+	if want := []string{"org.example.shared (2)"}; !reflect.DeepEqual(sections[2], want) {
+		t.Errorf("keys: got %v want %v", sections[2], want)
+	}
+	if want := []string{"use_state_after (2)", "include (1)"}; !reflect.DeepEqual(sections[3], want) {
+		t.Errorf("query keys: got %v want %v", sections[3], want)
+	}
+}
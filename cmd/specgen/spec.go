@@ -0,0 +1,329 @@
+// Copyright 2021 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"gopkg.in/yaml.v2"
+)
+
+// endpoint is an HTTP path in the spec, with the methods, query parameters and body properties of
+// every operation on it.
+type endpoint struct {
+	// the full path template e.g /_matrix/client/v3/rooms/{roomId}/send/{eventType}/{txnId}
+	template string
+	// the API file which defines it, relative to the spec directory
+	file    string
+	methods []string
+	// query parameter names
+	query map[string]bool
+	// property names of request and response bodies, at any depth
+	properties map[string]bool
+}
+
+var httpMethods = map[string]bool{
+	"get": true, "put": true, "post": true, "delete": true, "patch": true, "head": true, "options": true,
+}
+
+// spec loads API files and the files they refer to with $ref.
+type spec struct {
+	dir   string
+	files map[string]interface{}
+}
+
+func newSpec(dir string) *spec {
+	return &spec{
+		dir:   dir,
+		files: make(map[string]interface{}),
+	}
+}
+
+// load returns the parsed YAML file, with every map keyed by string.
+func (s *spec) load(file string) (interface{}, error) {
+	if doc, ok := s.files[file]; ok {
+		return doc, nil
+	}
+	data, err := ioutil.ReadFile(file)
+	if err != nil {
+		return nil, err
+	}
+	var doc interface{}
+	if err = yaml.Unmarshal(data, &doc); err != nil {
+		return nil, fmt.Errorf("%s: %s", file, err)
+	}
+	doc = stringKeys(doc)
+	s.files[file] = doc
+	return doc, nil
+}
+
+// stringKeys converts the map[interface{}]interface{} values yaml.v2 produces into map[string]interface{}.
+func stringKeys(v interface{}) interface{} {
+	switch val := v.(type) {
+	case map[interface{}]interface{}:
+		m := make(map[string]interface{}, len(val))
+		for k, v := range val {
+			m[fmt.Sprint(k)] = stringKeys(v)
+		}
+		return m
+	case []interface{}:
+		for i := range val {
+			val[i] = stringKeys(val[i])
+		}
+	}
+	return v
+}
+
+// resolve follows $ref until it reaches a node which isn't a reference. `file` is the file the node
+// is in. Returns the node, the file it is in, and a key which identifies it.
+func (s *spec) resolve(file string, node interface{}) (interface{}, string, string, error) {
+	key := ""
+	for i := 0; i < 32; i++ {
+		m, ok := node.(map[string]interface{})
+		if !ok {
+			return node, file, key, nil
+		}
+		ref, ok := m["$ref"].(string)
+		if !ok {
+			return node, file, key, nil
+		}
+		refFile, pointer := ref, ""
+		if i := strings.IndexByte(ref, '#'); i != -1 {
+			refFile, pointer = ref[:i], ref[i+1:]
+		}
+		if refFile != "" {
+			file = filepath.Join(filepath.Dir(file), refFile)
+		}
+		doc, err := s.load(file)
+		if err != nil {
+			return nil, "", "", err
+		}
+		node, err = jsonPointer(doc, pointer)
+		if err != nil {
+			return nil, "", "", fmt.Errorf("%s: %s", ref, err)
+		}
+		key = file + "#" + pointer
+	}
+	return nil, "", "", fmt.Errorf("%s: too many levels of $ref", file)
+}
+
+// jsonPointer returns the node at the pointer e.g /components/schemas/Event
+func jsonPointer(doc interface{}, pointer string) (interface{}, error) {
+	if pointer == "" || pointer == "/" {
+		return doc, nil
+	}
+	node := doc
+	for _, token := range strings.Split(strings.TrimPrefix(pointer, "/"), "/") {
+		token = strings.NewReplacer("~1", "/", "~0", "~").Replace(token)
+		m, ok := node.(map[string]interface{})
+		if !ok {
+			return nil, fmt.Errorf("%s is not an object", token)
+		}
+		if node, ok = m[token]; !ok {
+			return nil, fmt.Errorf("%s not found", token)
+		}
+	}
+	return node, nil
+}
+
+// basePath returns the prefix of every path in the API file, from basePath (OpenAPI 2) or the
+// basePath variable of the server URL (OpenAPI 3).
+func basePath(doc map[string]interface{}) string {
+	if bp, ok := doc["basePath"].(string); ok {
+		return bp
+	}
+	servers, _ := doc["servers"].([]interface{})
+	for _, server := range servers {
+		server, _ := server.(map[string]interface{})
+		vars, _ := server["variables"].(map[string]interface{})
+		bp, _ := vars["basePath"].(map[string]interface{})
+		if def, ok := bp["default"].(string); ok {
+			return def
+		}
+	}
+	return ""
+}
+
+// endpoints returns every path in the API files in the spec directory, sorted by template.
+func (s *spec) endpoints() ([]*endpoint, error) {
+	files, err := filepath.Glob(filepath.Join(s.dir, "*.yaml"))
+	if err != nil {
+		return nil, err
+	}
+	byTemplate := make(map[string]*endpoint)
+	for _, file := range files {
+		doc, err := s.load(file)
+		if err != nil {
+			return nil, err
+		}
+		root, _ := doc.(map[string]interface{})
+		paths, ok := root["paths"].(map[string]interface{})
+		if !ok {
+			continue
+		}
+		rel, _ := filepath.Rel(s.dir, file)
+		base := strings.TrimSuffix(basePath(root), "/")
+		for path, ops := range paths {
+			tpl := base + path
+			ep := byTemplate[tpl]
+			if ep == nil {
+				ep = &endpoint{
+					template:   tpl,
+					file:       rel,
+					query:      make(map[string]bool),
+					properties: make(map[string]bool),
+				}
+				byTemplate[tpl] = ep
+			}
+			ops, _ := ops.(map[string]interface{})
+			for method, op := range ops {
+				op, _ := op.(map[string]interface{})
+				if !httpMethods[method] || op == nil {
+					// e.g parameters shared by every operation
+					continue
+				}
+				ep.methods = append(ep.methods, strings.ToUpper(method))
+				if err := s.operation(file, op, ep); err != nil {
+					return nil, fmt.Errorf("%s %s %s: %s", rel, strings.ToUpper(method), path, err)
+				}
+			}
+			sort.Strings(ep.methods)
+		}
+	}
+	eps := make([]*endpoint, 0, len(byTemplate))
+	for _, ep := range byTemplate {
+		eps = append(eps, ep)
+	}
+	sort.Slice(eps, func(i, j int) bool {
+		return eps[i].template < eps[j].template
+	})
+	return eps, nil
+}
+
+// operation adds the query parameters and the properties of the request and response bodies of the
+// operation to the endpoint.
+func (s *spec) operation(file string, op map[string]interface{}, ep *endpoint) error {
+	seen := make(map[string]bool)
+	params, _ := op["parameters"].([]interface{})
+	for _, param := range params {
+		param, paramFile, _, err := s.resolve(file, param)
+		if err != nil {
+			return err
+		}
+		p, _ := param.(map[string]interface{})
+		name, _ := p["name"].(string)
+		switch p["in"] {
+		case "query":
+			ep.query[name] = true
+		case "body":
+			// OpenAPI 2
+			if err := s.properties(paramFile, p["schema"], seen, ep.properties); err != nil {
+				return err
+			}
+		}
+	}
+	// OpenAPI 3
+	if body, ok := op["requestBody"]; ok {
+		body, bodyFile, _, err := s.resolve(file, body)
+		if err != nil {
+			return err
+		}
+		if err := s.content(bodyFile, body, seen, ep.properties); err != nil {
+			return err
+		}
+	}
+	responses, _ := op["responses"].(map[string]interface{})
+	for _, res := range responses {
+		res, resFile, _, err := s.resolve(file, res)
+		if err != nil {
+			return err
+		}
+		m, _ := res.(map[string]interface{})
+		if err := s.properties(resFile, m["schema"], seen, ep.properties); err != nil {
+			return err
+		}
+		if err := s.content(resFile, res, seen, ep.properties); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// content adds the properties of the JSON schemas of an OpenAPI 3 request or response body.
+func (s *spec) content(file string, body interface{}, seen, props map[string]bool) error {
+	m, _ := body.(map[string]interface{})
+	content, _ := m["content"].(map[string]interface{})
+	for mediaType, media := range content {
+		if !strings.Contains(mediaType, "json") {
+			continue
+		}
+		media, _ := media.(map[string]interface{})
+		if err := s.properties(file, media["schema"], seen, props); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// properties adds the property names in the JSON schema, and in the schemas it contains, to props.
+// `seen` are the keys of referenced schemas which have already been walked, which stops cycles.
+func (s *spec) properties(file string, schema interface{}, seen, props map[string]bool) error {
+	if schema == nil {
+		return nil
+	}
+	schema, file, key, err := s.resolve(file, schema)
+	if err != nil {
+		return err
+	}
+	if key != "" {
+		if seen[key] {
+			return nil
+		}
+		seen[key] = true
+	}
+	m, ok := schema.(map[string]interface{})
+	if !ok {
+		return nil
+	}
+	var children []interface{}
+	for _, name := range []string{"properties", "patternProperties"} {
+		p, _ := m[name].(map[string]interface{})
+		for prop, child := range p {
+			if name == "properties" {
+				props[prop] = true
+			}
+			children = append(children, child)
+		}
+	}
+	for _, name := range []string{"items", "additionalProperties"} {
+		if child, ok := m[name].(map[string]interface{}); ok {
+			children = append(children, child)
+		}
+	}
+	for _, name := range []string{"allOf", "oneOf", "anyOf"} {
+		list, _ := m[name].([]interface{})
+		children = append(children, list...)
+	}
+	for _, child := range children {
+		if err := s.properties(file, child, seen, props); err != nil {
+			return err
+		}
+	}
+	return nil
+}
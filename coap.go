@@ -15,8 +15,8 @@
 package lb
 
 import (
-	"bytes"
 	"net/http"
+	"strings"
 
 	"github.com/matrix-org/go-coap/v2/message"
 	"github.com/matrix-org/go-coap/v2/message/codes"
@@ -43,9 +43,8 @@ func init() {
 	for k, v := range statusCodes {
 		responseCodes[v] = k
 	}
-	for k, v := range contentTypeToContentFormat {
-		contentFormatToContentType[v] = k
-	}
+	// sent by forward proxies, see Table 2
+	responseCodes[codes.ProxyingNotSupported] = http.StatusBadGateway
 }
 
 // https://tools.ietf.org/html/rfc8075#section-7
@@ -98,21 +97,30 @@ var statusCodes = map[int]codes.Code{
 }
 var responseCodes = map[codes.Code]int{}
 
-var contentTypeToContentFormat = map[string]message.MediaType{
-	"application/json":         message.AppJSON,
-	"application/cbor":         message.AppCBOR,
-	"application/octet-stream": message.AppOctets,
-	"text/plain":               message.TextPlain,
-}
-var contentFormatToContentType = map[message.MediaType]string{}
-
-// coapResponseWriter is a http.ResponseWriter which actually writes CoAP instead (lossy)
+// coapResponseWriter is a http.ResponseWriter which actually writes CoAP instead (lossy). The response
+// is sent when finish is called.
 type coapResponseWriter struct {
 	coapmux.ResponseWriter
 	headers    http.Header
-	body       *bytes.Reader
+	body       spool
 	logger     Logger
 	statusCode int
+	// the access tokens and aliases for this session, the host of the request and the access token used for it
+	auth        *sessionAuth
+	aliases     *accessTokenAliases
+	host        string
+	accessToken string
+	// the alias to return to the client, if any
+	alias []byte
+	// true if this request logs out the access token
+	isLogout bool
+
+	// the ID handles for this session, if IDs in responses are interned
+	idHandles *idHandleTable
+	// the dictionary version picked for the session, if the request offered one
+	dictionary int
+	// the No-Response option of the request: responses it suppresses are not sent
+	noResponse uint32
 }
 
 func (w *coapResponseWriter) Header() http.Header {
@@ -127,25 +135,82 @@ func (w *coapResponseWriter) log(format string, v ...interface{}) {
 }
 
 func (w *coapResponseWriter) Write(b []byte) (int, error) {
-	w.body = bytes.NewReader(b)
+	if w.statusCode == 0 {
+		w.statusCode = http.StatusOK
+	}
+	return w.body.Write(b)
+}
 
+// finish sends the response written by the HTTP handler.
+func (w *coapResponseWriter) finish() {
+	if w.statusCode == 0 {
+		w.statusCode = http.StatusOK
+	}
+	body, err := w.body.reader()
+	if err != nil {
+		w.log("failed to read response body: %s", err)
+		if !isNoResponseCode(w.noResponse, codes.InternalServerError) {
+			w.ResponseWriter.SetResponse(codes.InternalServerError, message.TextPlain, nil)
+		}
+		return
+	}
 	code, ok := statusCodes[w.statusCode]
 	if !ok {
 		w.log("cannot map HTTP status %d to CoAP code, using codes.Empty", w.statusCode)
 		code = codes.Empty
 	}
-	// check content-type header for media type
-	// TODO: Parse mime type correctly and use the registry at https://tools.ietf.org/html/rfc7252#section-12.3
-	cType := w.headers.Get("Content-Type")
-	contentFormat, ok := contentTypeToContentFormat[cType]
-	if !ok {
-		contentFormat = message.AppOctets
-	}
+	contentFormat, optContentType := contentTypeToFormat(w.headers.Get("Content-Type"))
 	// TODO: convert HTTP headers to options?
-	w.ResponseWriter.SetResponse(code, contentFormat, w.body)
-	return len(b), nil
+	var opts []message.Option
+	if optContentType != "" {
+		opts = append(opts, message.Option{
+			ID:    OptionIDContentType,
+			Value: []byte(optContentType),
+		})
+	}
+	if w.aliases != nil && w.accessToken != "" {
+		switch {
+		case w.statusCode == http.StatusUnauthorized:
+			// the token is no longer valid so neither is the alias
+			w.aliases.revoke(w.accessToken)
+		case w.isLogout && w.statusCode == http.StatusOK:
+			// later requests which don't send an access token mustn't get the logged out one from the
+			// session. A 401 keeps it, as it may only be asking for user-interactive auth.
+			w.aliases.revoke(w.accessToken)
+			w.auth.clearAccessToken(w.host, w.accessToken)
+		case w.alias != nil && w.statusCode >= 200 && w.statusCode < 300:
+			opts = append(opts, message.Option{
+				ID:    OptionIDAccessTokenAlias,
+				Value: w.alias,
+			})
+		}
+	}
+	if w.idHandles != nil && w.statusCode >= 200 && w.statusCode < 300 {
+		opts = append(opts, issueIDHandles(w.idHandles, contentFormat, body)...)
+	}
+	if w.dictionary != 0 {
+		opts = append(opts, message.Option{
+			ID:    OptionIDDictionary,
+			Value: []byte{byte(w.dictionary)},
+		})
+	}
+	if isNoResponseCode(w.noResponse, code) {
+		// the client isn't waiting for it e.g a Non-confirmable typing notification
+		// https://datatracker.ietf.org/doc/html/rfc7967
+		if f, ok := body.(*spoolFile); ok {
+			f.close()
+		}
+		return
+	}
+	w.ResponseWriter.SetResponse(code, contentFormat, body, opts...)
 }
 
 func (w *coapResponseWriter) WriteHeader(statusCode int) {
 	w.statusCode = statusCode
 }
+
+// IsLogoutPath returns true if this HTTP path invalidates the access token used to call it, so aliases
+// of the access token must be forgotten.
+func IsLogoutPath(path string) bool {
+	return strings.HasSuffix(path, "/logout") || strings.HasSuffix(path, "/logout/all")
+}
@@ -0,0 +1,145 @@
+// Copyright 2021 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package lb
+
+import (
+	"encoding/binary"
+	"strings"
+	"sync"
+
+	"github.com/matrix-org/go-coap/v2/message"
+)
+
+// The CoAP Option ID corresponding to a short per-session alias of the access_token. The server
+// returns this option on the first successful response to a request which included the full
+// access_token (OptionIDAccessToken). Clients can then send this option instead of the full
+// access_token to the same host for the lifetime of the DTLS session.
+var OptionIDAccessTokenAlias = message.OptionID(260)
+
+// accessTokenAliases maps short aliases to access tokens for a single DTLS session and host. Access
+// tokens are stored as the complete Authorization header value.
+type accessTokenAliases struct {
+	mu      sync.Mutex
+	next    uint64
+	aliases map[string]string // alias -> access token
+	tokens  map[string]string // access token -> alias
+}
+
+func newAccessTokenAliases() *accessTokenAliases {
+	return &accessTokenAliases{
+		aliases: make(map[string]string),
+		tokens:  make(map[string]string),
+	}
+}
+
+// assign returns the alias for this access token, making a new one if required.
+func (a *accessTokenAliases) assign(accessToken string) []byte {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	if alias, ok := a.tokens[accessToken]; ok {
+		return []byte(alias)
+	}
+	// aliases are never reused within a session, so a revoked alias cannot suddenly
+	// authenticate as a different user.
+	a.next++
+	buf := make([]byte, binary.MaxVarintLen64)
+	alias := string(buf[:binary.PutUvarint(buf, a.next)])
+	a.aliases[alias] = accessToken
+	a.tokens[accessToken] = alias
+	return []byte(alias)
+}
+
+// resolve returns the access token for this alias, or the empty string if the alias is unknown.
+func (a *accessTokenAliases) resolve(alias []byte) string {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	return a.aliases[string(alias)]
+}
+
+// revoke removes the alias for this access token, if one exists.
+func (a *accessTokenAliases) revoke(accessToken string) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	alias, ok := a.tokens[accessToken]
+	if !ok {
+		return
+	}
+	delete(a.tokens, accessToken)
+	delete(a.aliases, alias)
+}
+
+var sessionAuthMu sync.Mutex
+
+// sessionAuth holds the access token a DTLS session last sent to each host, and the aliases issued for the
+// access tokens sent to each host. Hosts are those of the HTTP requests e.g from the Uri-Host option, so a
+// session which switches between homeservers never sends the access token of one to another.
+type sessionAuth struct {
+	mu      sync.Mutex
+	tokens  map[string]string              // host -> access token
+	aliases map[string]*accessTokenAliases // host -> aliases
+}
+
+// sessionAuthFor returns the access tokens and aliases of this client's DTLS session, creating them if needed.
+func sessionAuthFor(cc SessionClient) *sessionAuth {
+	sessionAuthMu.Lock()
+	defer sessionAuthMu.Unlock()
+	auth, ok := cc.Context().Value(ctxValAccessToken).(*sessionAuth)
+	if !ok {
+		auth = &sessionAuth{
+			tokens:  make(map[string]string),
+			aliases: make(map[string]*accessTokenAliases),
+		}
+		cc.SetContextValue(ctxValAccessToken, auth)
+	}
+	return auth
+}
+
+// accessToken returns the access token the session last sent to this host, or the empty string.
+func (s *sessionAuth) accessToken(host string) string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.tokens[strings.ToLower(host)]
+}
+
+// setAccessToken remembers the access token sent to this host, for requests which don't send one.
+func (s *sessionAuth) setAccessToken(host, accessToken string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.tokens[strings.ToLower(host)] = accessToken
+}
+
+// clearAccessToken forgets the access token sent to this host if it is still this one, e.g after it is
+// logged out, so later requests without one aren't sent with a token which no longer works.
+func (s *sessionAuth) clearAccessToken(host, accessToken string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	host = strings.ToLower(host)
+	if s.tokens[host] == accessToken {
+		delete(s.tokens, host)
+	}
+}
+
+// hostAliases returns the aliases of access tokens sent to this host, creating them if needed.
+func (s *sessionAuth) hostAliases(host string) *accessTokenAliases {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	host = strings.ToLower(host)
+	aliases, ok := s.aliases[host]
+	if !ok {
+		aliases = newAccessTokenAliases()
+		s.aliases[host] = aliases
+	}
+	return aliases
+}
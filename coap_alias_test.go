@@ -0,0 +1,183 @@
+// Copyright 2021 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package lb
+
+import (
+	"bytes"
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"sync"
+	"testing"
+
+	"github.com/matrix-org/go-coap/v2/message"
+	"github.com/matrix-org/go-coap/v2/message/codes"
+	coapmux "github.com/matrix-org/go-coap/v2/mux"
+	"github.com/matrix-org/go-coap/v2/tcp"
+	tcppool "github.com/matrix-org/go-coap/v2/tcp/message/pool"
+)
+
+func TestAccessTokenAliases(t *testing.T) {
+	a := newAccessTokenAliases()
+	alice := "Bearer " + string(bytes.Repeat([]byte("a"), 300))
+	bob := "Bearer bob"
+
+	aliceAlias := a.assign(alice)
+	if len(aliceAlias) != 1 {
+		t.Errorf("assign: want 1 byte alias, got %x", aliceAlias)
+	}
+	if got := a.assign(alice); !bytes.Equal(got, aliceAlias) {
+		t.Errorf("assign: same token got different alias, got %x want %x", got, aliceAlias)
+	}
+	bobAlias := a.assign(bob)
+	if bytes.Equal(bobAlias, aliceAlias) {
+		t.Errorf("assign: different tokens got the same alias %x", bobAlias)
+	}
+	if got := a.resolve(aliceAlias); got != alice {
+		t.Errorf("resolve: got %s want %s", got, alice)
+	}
+	if got := a.resolve([]byte("nope")); got != "" {
+		t.Errorf("resolve: unknown alias got %s want ''", got)
+	}
+
+	// revoked aliases must not resolve and must not be handed out again
+	a.revoke(alice)
+	if got := a.resolve(aliceAlias); got != "" {
+		t.Errorf("resolve: revoked alias got %s want ''", got)
+	}
+	if got := a.resolve(bobAlias); got != bob {
+		t.Errorf("resolve: revoking alice revoked bob, got %s want %s", got, bob)
+	}
+	newAliceAlias := a.assign(alice)
+	if bytes.Equal(newAliceAlias, aliceAlias) || bytes.Equal(newAliceAlias, bobAlias) {
+		t.Errorf("assign: reused alias %x after revocation", newAliceAlias)
+	}
+}
+
+// TestAccessTokenAliasesHandler checks that CoAPHTTPHandler issues aliases, resolves them, rejects
+// unknown ones and revokes them when the access token stops working, forgetting the session's access token
+// when it is logged out.
+func TestAccessTokenAliasesHandler(t *testing.T) {
+	var mu sync.Mutex
+	var gotAuth []string
+	unauthorized := false
+	server := NewCoAPHTTP(NewCoAPPathV1())
+	router := coapmux.NewRouter()
+	router.DefaultHandle(server.CoAPHTTPHandler(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		mu.Lock()
+		defer mu.Unlock()
+		gotAuth = append(gotAuth, req.Header.Get("Authorization"))
+		if unauthorized {
+			w.WriteHeader(401)
+			return
+		}
+		w.WriteHeader(200)
+	}), nil))
+
+	l := NewWebSocketListener()
+	defer l.Close()
+	srv := httptest.NewServer(l)
+	defer srv.Close()
+	ignoreErrors := tcp.WithErrors(func(err error) {})
+	coapServer := tcp.NewServer(tcp.WithMux(router), ignoreErrors)
+	defer coapServer.Stop()
+	go coapServer.Serve(l)
+	srvURL, _ := url.Parse(srv.URL)
+	conn, err := DialWebSocket(&url.URL{Scheme: "coap+ws", Host: srvURL.Host}, nil)
+	if err != nil {
+		t.Fatalf("DialWebSocket: %s", err)
+	}
+	cc := tcp.Client(conn, ignoreErrors)
+	defer cc.Close()
+
+	// do sends the request, returning the response code, the alias issued if any, and the
+	// Authorization header the HTTP handler got, if it was called
+	do := func(method codes.Code, path string, opts ...message.Option) (code codes.Code, alias []byte, auth string) {
+		t.Helper()
+		mu.Lock()
+		gotAuth = nil
+		mu.Unlock()
+		var res *tcppool.Message
+		var err error
+		if method == codes.POST {
+			res, err = cc.Post(context.Background(), path, message.AppCBOR, bytes.NewReader([]byte{0xa0}), opts...)
+		} else {
+			res, err = cc.Get(context.Background(), path, opts...)
+		}
+		if err != nil {
+			t.Fatalf("%v %s: %s", method, path, err)
+		}
+		defer tcppool.ReleaseMessage(res)
+		if a, err := res.GetOptionBytes(OptionIDAccessTokenAlias); err == nil {
+			alias = append([]byte{}, a...)
+		}
+		mu.Lock()
+		defer mu.Unlock()
+		if len(gotAuth) > 0 {
+			auth = gotAuth[0]
+		}
+		return res.Code(), alias, auth
+	}
+	const whoami = "/_matrix/client/r0/account/whoami"
+
+	// the full access token gets an alias, which the handler resolves to the access token
+	code, alias, auth := do(codes.GET, whoami, message.Option{ID: OptionIDAccessToken, Value: []byte("abc")})
+	if code != codes.Content || alias == nil || auth != "Bearer abc" {
+		t.Fatalf("full access token: got %v alias %x auth %q", code, alias, auth)
+	}
+	code, _, auth = do(codes.GET, whoami, message.Option{ID: OptionIDAccessTokenAlias, Value: alias})
+	if code != codes.Content || auth != "Bearer abc" {
+		t.Errorf("alias: got %v auth %q want %v Bearer abc", code, auth, codes.Content)
+	}
+	// unknown aliases are rejected without calling the handler
+	code, _, auth = do(codes.GET, whoami, message.Option{ID: OptionIDAccessTokenAlias, Value: []byte{0x7f}})
+	if code != codes.Unauthorized || auth != "" {
+		t.Errorf("unknown alias: got %v auth %q want %v and no request", code, auth, codes.Unauthorized)
+	}
+
+	// a 401 revokes the alias
+	mu.Lock()
+	unauthorized = true
+	mu.Unlock()
+	if code, _, _ = do(codes.GET, whoami, message.Option{ID: OptionIDAccessTokenAlias, Value: alias}); code != codes.Unauthorized {
+		t.Errorf("expired access token: got %v want %v", code, codes.Unauthorized)
+	}
+	mu.Lock()
+	unauthorized = false
+	mu.Unlock()
+	code, _, auth = do(codes.GET, whoami, message.Option{ID: OptionIDAccessTokenAlias, Value: alias})
+	if code != codes.Unauthorized || auth != "" {
+		t.Errorf("alias revoked by a 401: got %v auth %q want %v and no request", code, auth, codes.Unauthorized)
+	}
+
+	// and so does logging out
+	_, alias, _ = do(codes.GET, whoami, message.Option{ID: OptionIDAccessToken, Value: []byte("def")})
+	if alias == nil {
+		t.Fatalf("no alias issued for a new access token")
+	}
+	code, _, auth = do(codes.POST, "/_matrix/client/r0/logout", message.Option{ID: OptionIDAccessTokenAlias, Value: alias})
+	if code>>5 != 2 || auth != "Bearer def" {
+		t.Errorf("logout: got %v auth %q", code, auth)
+	}
+	code, _, auth = do(codes.GET, whoami, message.Option{ID: OptionIDAccessTokenAlias, Value: alias})
+	if code != codes.Unauthorized || auth != "" {
+		t.Errorf("alias revoked by logging out: got %v auth %q want %v and no request", code, auth, codes.Unauthorized)
+	}
+	// requests without an access token no longer get the session's one
+	if code, _, auth = do(codes.GET, whoami); code != codes.Content || auth != "" {
+		t.Errorf("access token cleared by logging out: got %v auth %q want %v and no access token", code, auth, codes.Content)
+	}
+}
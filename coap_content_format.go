@@ -0,0 +1,156 @@
+// Copyright 2021 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package lb
+
+import (
+	"mime"
+	"strings"
+
+	"github.com/matrix-org/go-coap/v2/message"
+)
+
+// ContentFormatPrivate is the Content-Format of bodies whose Content-Type has no registered
+// Content-Format, e.g image/webp. The Content-Type is sent in OptionIDContentType. It is in the
+// range reserved for experimental use.
+const ContentFormatPrivate = message.MediaType(65000)
+
+// OptionIDContentType is the Content-Type of a body with ContentFormatPrivate. This option is
+// elective and safe to forward.
+var OptionIDContentType = message.OptionID(264)
+
+// The CoAP Content-Formats registry. Content codings (e.g 11050 application/json with deflate) are not
+// included as HTTP Content-Encoding is not converted.
+// https://www.iana.org/assignments/core-parameters/core-parameters.xhtml#content-formats
+var contentFormatRegistry = map[message.MediaType]string{
+	0:     "text/plain; charset=utf-8",
+	16:    `application/cose; cose-type="cose-encrypt0"`,
+	17:    `application/cose; cose-type="cose-mac0"`,
+	18:    `application/cose; cose-type="cose-sign1"`,
+	19:    "application/ace+cbor",
+	21:    "image/gif",
+	22:    "image/jpeg",
+	23:    "image/png",
+	40:    "application/link-format",
+	41:    "application/xml",
+	42:    "application/octet-stream",
+	47:    "application/exi",
+	50:    "application/json",
+	51:    "application/json-patch+json",
+	52:    "application/merge-patch+json",
+	60:    "application/cbor",
+	61:    "application/cwt",
+	62:    "application/multipart-core",
+	63:    "application/cbor-seq",
+	96:    `application/cose; cose-type="cose-encrypt"`,
+	97:    `application/cose; cose-type="cose-mac"`,
+	98:    `application/cose; cose-type="cose-sign"`,
+	101:   "application/cose-key",
+	102:   "application/cose-key-set",
+	110:   "application/senml+json",
+	111:   "application/sensml+json",
+	112:   "application/senml+cbor",
+	113:   "application/sensml+cbor",
+	114:   "application/senml-exi",
+	115:   "application/sensml-exi",
+	140:   "application/yang-data+cbor; id=sid",
+	256:   "application/coap-group+json",
+	257:   "application/concise-problem-details+cbor",
+	258:   "application/swid+cbor",
+	271:   "application/dots+cbor",
+	272:   "application/missing-blocks+cbor-seq",
+	280:   "application/pkcs7-mime; smime-type=server-generated-key",
+	281:   "application/pkcs7-mime; smime-type=certs-only",
+	284:   "application/pkcs8",
+	285:   "application/csrattrs",
+	286:   "application/pkcs10",
+	287:   "application/pkix-cert",
+	290:   "application/aif+cbor",
+	291:   "application/aif+json",
+	310:   "application/senml+xml",
+	311:   "application/sensml+xml",
+	320:   "application/senml-etch+json",
+	322:   "application/senml-etch+cbor",
+	340:   "application/yang-data+cbor",
+	341:   "application/yang-data+cbor; id=name",
+	432:   "application/td+json",
+	433:   "application/tm+json",
+	10000: "application/vnd.ocf+cbor",
+	10001: "application/oscore",
+	10002: "application/javascript",
+	11542: "application/vnd.oma.lwm2m+tlv",
+	11543: "application/vnd.oma.lwm2m+json",
+	11544: "application/vnd.oma.lwm2m+cbor",
+	20000: "text/css",
+	30000: "image/svg+xml",
+}
+
+// normalised media type and parameters -> Content-Format
+var mediaTypeToContentFormat = map[string]message.MediaType{}
+
+func init() {
+	for format, contentType := range contentFormatRegistry {
+		key, ok := normaliseMediaType(contentType)
+		if !ok {
+			panic("bad Content-Format registry entry: " + contentType)
+		}
+		mediaTypeToContentFormat[key] = format
+	}
+}
+
+// normaliseMediaType lowercases the media type and sorts its parameters. A UTF-8 charset is dropped
+// as every textual Content-Format is UTF-8 (and JSON has no charset parameter at all). This also
+// maps text/plain, which is US-ASCII, to text/plain; charset=utf-8.
+func normaliseMediaType(contentType string) (string, bool) {
+	mediaType, params, err := mime.ParseMediaType(contentType)
+	if err != nil {
+		return "", false
+	}
+	if strings.EqualFold(params["charset"], "utf-8") {
+		delete(params, "charset")
+	}
+	return mime.FormatMediaType(mediaType, params), true
+}
+
+// contentTypeToFormat returns the Content-Format for this Content-Type header. If there is no
+// registered Content-Format then ContentFormatPrivate is returned along with the Content-Type to send
+// in OptionIDContentType.
+func contentTypeToFormat(contentType string) (format message.MediaType, optContentType string) {
+	if contentType == "" {
+		return message.AppOctets, ""
+	}
+	key, ok := normaliseMediaType(contentType)
+	if !ok {
+		// not a valid media type, which can't be trusted to mean anything
+		return message.AppOctets, ""
+	}
+	if format, ok := mediaTypeToContentFormat[key]; ok {
+		return format, ""
+	}
+	return ContentFormatPrivate, contentType
+}
+
+// contentTypeFromOptions returns the Content-Type header for the Content-Format in these options, or
+// "" if there isn't one or it isn't known.
+func contentTypeFromOptions(opts message.Options) string {
+	format, err := opts.ContentFormat()
+	if err != nil {
+		return ""
+	}
+	if format == ContentFormatPrivate {
+		contentType, _ := opts.GetString(OptionIDContentType)
+		return contentType
+	}
+	return contentFormatRegistry[format]
+}
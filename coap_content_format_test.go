@@ -0,0 +1,81 @@
+// Copyright 2021 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package lb
+
+import (
+	"net/http"
+	"testing"
+
+	"github.com/matrix-org/go-coap/v2/message"
+	"github.com/matrix-org/go-coap/v2/udp/message/pool"
+)
+
+func TestContentFormats(t *testing.T) {
+	cases := []struct {
+		contentType string
+		wantFormat  message.MediaType
+		// the Content-Type after a round trip
+		want string
+	}{
+		{contentType: "application/json", wantFormat: message.AppJSON, want: "application/json"},
+		{contentType: "application/json; charset=utf-8", wantFormat: message.AppJSON, want: "application/json"},
+		{contentType: "Application/JSON; charset=UTF-8", wantFormat: message.AppJSON, want: "application/json"},
+		{contentType: "application/cbor", wantFormat: message.AppCBOR, want: "application/cbor"},
+		{contentType: "text/plain", wantFormat: message.TextPlain, want: "text/plain; charset=utf-8"},
+		{contentType: "text/plain; charset=utf-8", wantFormat: message.TextPlain, want: "text/plain; charset=utf-8"},
+		{contentType: "image/png", wantFormat: 23, want: "image/png"},
+		{contentType: "image/jpeg", wantFormat: 22, want: "image/jpeg"},
+		{contentType: `application/cose; cose-type="cose-sign1"`, wantFormat: 18, want: `application/cose; cose-type="cose-sign1"`},
+		{contentType: "application/cose; cose-type=cose-sign1", wantFormat: 18, want: `application/cose; cose-type="cose-sign1"`},
+		// no registered Content-Format, so the Content-Type is sent as is
+		{contentType: "image/webp", wantFormat: ContentFormatPrivate, want: "image/webp"},
+		{contentType: "text/plain; charset=iso-8859-1", wantFormat: ContentFormatPrivate, want: "text/plain; charset=iso-8859-1"},
+		{contentType: "application/cose; cose-type=unknown", wantFormat: ContentFormatPrivate, want: "application/cose; cose-type=unknown"},
+		{contentType: "", wantFormat: message.AppOctets, want: "application/octet-stream"},
+		{contentType: "not a media type", wantFormat: message.AppOctets, want: "application/octet-stream"},
+	}
+	co := NewCoAPHTTP(NewCoAPPathV1())
+	for _, tc := range cases {
+		req, _ := http.NewRequest("POST", "https://example.com/_matrix/media/r0/upload", nil)
+		if tc.contentType != "" {
+			req.Header.Set("Content-Type", tc.contentType)
+		}
+		err := co.HTTPRequestToCoAP(req, func(msg *pool.Message) error {
+			format, err := msg.ContentFormat()
+			if err != nil {
+				t.Fatalf("%q: no Content-Format: %s", tc.contentType, err)
+			}
+			if format != tc.wantFormat {
+				t.Errorf("%q: got Content-Format %v want %v", tc.contentType, format, tc.wantFormat)
+			}
+			_, err = msg.Options().GetString(OptionIDContentType)
+			if hasOpt := err == nil; hasOpt != (tc.wantFormat == ContentFormatPrivate) {
+				t.Errorf("%q: got Content-Type option %v", tc.contentType, hasOpt)
+			}
+			r, err := pool.ConvertTo(msg)
+			if err != nil {
+				t.Fatalf("ConvertTo: %s", err)
+			}
+			httpReq := co.CoAPToHTTPRequest(r)
+			if got := httpReq.Header.Get("Content-Type"); got != tc.want {
+				t.Errorf("%q: got Content-Type %q want %q", tc.contentType, got, tc.want)
+			}
+			return nil
+		})
+		if err != nil {
+			t.Fatalf("HTTPRequestToCoAP: %s", err)
+		}
+	}
+}
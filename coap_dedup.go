@@ -0,0 +1,174 @@
+// Copyright 2021 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package lb
+
+import (
+	"container/list"
+	"sync"
+	"time"
+
+	"github.com/matrix-org/go-coap/v2/message"
+	"github.com/matrix-org/go-coap/v2/message/codes"
+)
+
+// ExchangeLifetime is the time from starting to send a Confirmable message to the time when an
+// acknowledgement is no longer expected, using the default transmission parameters.
+// https://datatracker.ietf.org/doc/html/rfc7252#section-4.8.2
+const ExchangeLifetime = 247 * time.Second
+
+// DefaultDedupCacheSize is a sensible number of responses for a DedupCache to hold.
+const DefaultDedupCacheSize = 10000
+
+// DedupKey identifies a CoAP request for the purposes of deduplication. The RFC matches duplicates
+// on the Message ID and source endpoint. The token is also included so a reused Message ID for
+// a different request is never mistaken for a duplicate.
+type DedupKey struct {
+	// The session the request arrived on, see SessionID
+	Session   string
+	MessageID uint16
+	Token     string
+}
+
+// CachedResponse is a CoAP response held by a DedupCache.
+type CachedResponse struct {
+	Code          codes.Code
+	ContentFormat message.MediaType
+	Body          []byte
+	Options       message.Options
+}
+
+// DedupStats are counters of how often the DedupCache has been used.
+type DedupStats struct {
+	// Requests which were not duplicates
+	Misses uint64
+	// Duplicates which were answered from the cache
+	Hits uint64
+	// Duplicates which arrived whilst the original request was still being processed
+	InFlight uint64
+	// Responses which were dropped to keep the cache within its size limit
+	Evictions uint64
+}
+
+type dedupEntry struct {
+	key      DedupKey
+	expires  time.Time
+	response *CachedResponse // nil whilst in-flight
+}
+
+// DedupCache is a bounded cache of responses to CoAP requests, used to ensure that retransmitted
+// requests are not processed more than once:
+//    The recipient SHOULD acknowledge each duplicate copy of a Confirmable message using the
+//    same Acknowledgement or Reset message but SHOULD process any request or response in the
+//    message only once.
+// https://datatracker.ietf.org/doc/html/rfc7252#section-4.5
+//
+// This matters for non-idempotent requests such as POST /keys/upload, where processing the
+// request twice has side effects.
+type DedupCache struct {
+	maxEntries int
+	lifetime   time.Duration
+	mu         sync.Mutex
+	entries    map[DedupKey]*list.Element
+	order      *list.List // oldest first
+	stats      DedupStats
+	now        func() time.Time
+}
+
+// NewDedupCache makes a cache which holds up to `maxEntries` responses, each for `lifetime`. The
+// lifetime should be at least ExchangeLifetime, after which clients will no longer retransmit.
+func NewDedupCache(maxEntries int, lifetime time.Duration) *DedupCache {
+	return &DedupCache{
+		maxEntries: maxEntries,
+		lifetime:   lifetime,
+		entries:    make(map[DedupKey]*list.Element),
+		order:      list.New(),
+		now:        time.Now,
+	}
+}
+
+// Lookup checks if this request is a duplicate. If the original request has been answered, the cached
+// response is returned. If the original request is still being processed, inFlight is true. Otherwise
+// this is a new request: it is marked as in-flight, and the caller MUST call Store or Forget when
+// processing completes.
+func (c *DedupCache) Lookup(key DedupKey) (res *CachedResponse, inFlight bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	now := c.now()
+	c.expire(now)
+	if el, ok := c.entries[key]; ok {
+		entry := el.Value.(*dedupEntry)
+		if entry.response == nil {
+			c.stats.InFlight++
+			return nil, true
+		}
+		c.stats.Hits++
+		return entry.response, false
+	}
+	c.stats.Misses++
+	for len(c.entries) >= c.maxEntries && c.order.Len() > 0 {
+		c.remove(c.order.Front())
+		c.stats.Evictions++
+	}
+	c.entries[key] = c.order.PushBack(&dedupEntry{
+		key:     key,
+		expires: now.Add(c.lifetime),
+	})
+	return nil, false
+}
+
+// Store the response to a request previously passed to Lookup.
+func (c *DedupCache) Store(key DedupKey, res *CachedResponse) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	el, ok := c.entries[key]
+	if !ok {
+		// evicted whilst in-flight
+		return
+	}
+	entry := el.Value.(*dedupEntry)
+	entry.response = res
+	entry.expires = c.now().Add(c.lifetime)
+	c.order.MoveToBack(el)
+}
+
+// Forget a request previously passed to Lookup e.g because it did not produce a response.
+func (c *DedupCache) Forget(key DedupKey) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if el, ok := c.entries[key]; ok {
+		c.remove(el)
+	}
+}
+
+// Stats returns a snapshot of the cache counters.
+func (c *DedupCache) Stats() DedupStats {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.stats
+}
+
+func (c *DedupCache) expire(now time.Time) {
+	for el := c.order.Front(); el != nil; el = c.order.Front() {
+		if el.Value.(*dedupEntry).expires.After(now) {
+			return
+		}
+		c.remove(el)
+	}
+}
+
+func (c *DedupCache) remove(el *list.Element) {
+	entry := c.order.Remove(el).(*dedupEntry)
+	delete(c.entries, entry.key)
+}
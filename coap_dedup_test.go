@@ -0,0 +1,68 @@
+// Copyright 2021 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package lb
+
+import (
+	"testing"
+	"time"
+
+	"github.com/matrix-org/go-coap/v2/message/codes"
+)
+
+func TestDedupCache(t *testing.T) {
+	now := time.Now()
+	c := NewDedupCache(2, ExchangeLifetime)
+	c.now = func() time.Time { return now }
+
+	keyA := DedupKey{Session: "1.2.3.4:5", MessageID: 1, Token: "a"}
+	// same message ID, different token: not a duplicate
+	keyB := DedupKey{Session: "1.2.3.4:5", MessageID: 1, Token: "b"}
+	keyC := DedupKey{Session: "1.2.3.4:5", MessageID: 2, Token: "c"}
+
+	if res, inFlight := c.Lookup(keyA); res != nil || inFlight {
+		t.Fatalf("Lookup: new request got res=%v inFlight=%v", res, inFlight)
+	}
+	if res, inFlight := c.Lookup(keyA); res != nil || !inFlight {
+		t.Fatalf("Lookup: retransmission whilst in-flight got res=%v inFlight=%v", res, inFlight)
+	}
+	c.Store(keyA, &CachedResponse{Code: codes.Changed, Body: []byte("ok")})
+	res, inFlight := c.Lookup(keyA)
+	if res == nil || inFlight || string(res.Body) != "ok" {
+		t.Fatalf("Lookup: retransmission after response got res=%v inFlight=%v", res, inFlight)
+	}
+	if res, _ := c.Lookup(keyB); res != nil {
+		t.Fatalf("Lookup: different token was treated as a duplicate")
+	}
+	c.Forget(keyB)
+
+	// fill the cache past its limit to evict keyA
+	c.Lookup(keyC)
+	c.Lookup(keyB)
+	if res, inFlight := c.Lookup(keyA); res != nil || inFlight {
+		t.Fatalf("Lookup: evicted request got res=%v inFlight=%v", res, inFlight)
+	}
+
+	// expire everything
+	now = now.Add(ExchangeLifetime + time.Second)
+	if res, inFlight := c.Lookup(keyC); res != nil || inFlight {
+		t.Fatalf("Lookup: expired request got res=%v inFlight=%v", res, inFlight)
+	}
+
+	stats := c.Stats()
+	want := DedupStats{Misses: 6, Hits: 1, InFlight: 1, Evictions: 2}
+	if stats != want {
+		t.Errorf("Stats: got %+v want %+v", stats, want)
+	}
+}
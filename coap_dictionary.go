@@ -0,0 +1,135 @@
+// Copyright 2021 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package lb
+
+import (
+	"net/http"
+	"sync"
+
+	"github.com/matrix-org/go-coap/v2/message"
+	"github.com/matrix-org/go-coap/v2/message/codes"
+	basepool "github.com/matrix-org/go-coap/v2/message/pool"
+	coapmux "github.com/matrix-org/go-coap/v2/mux"
+)
+
+const ctxValDictionary = "ctxValDictionary"
+
+// The versions of the dictionary: the enum paths, CBOR keys and query keys. Each version is a superset
+// of the previous one which never changes its codes, so anything encoded with an older version decodes
+// the same with a newer one. Only encoding needs the version the peer knows.
+const (
+	// NewCoAPPathV1, NewCBORCodecV1 and NewCoAPQueryV1
+	DictionaryV1 = 1
+	// NewCoAPPathV2, NewCBORCodecV2 and NewCoAPQueryV2
+	DictionaryV2 = 2
+)
+
+// The CoAP Option ID of the newest dictionary version a client knows. Clients send it in requests
+// until the server responds with the option set to the version of the session, which is the newest
+// version both know. Clients encode requests with v1 until then, as servers which don't know this
+// option ignore it and use v1. The server encodes responses with the version of the session. This
+// option is elective and safe to forward.
+var OptionIDDictionary = message.OptionID(272)
+
+// sessionDictionary returns the dictionary version of this client's DTLS session, negotiating it if
+// the request has OptionIDDictionary. Returns true if the request did, in which case the response
+// must say which version was picked.
+func (co *CoAPHTTP) sessionDictionary(cc coapmux.Client, opts message.Options) (int, bool) {
+	co.aliasesMu.Lock()
+	defer co.aliasesMu.Unlock()
+	version, ok := cc.Context().Value(ctxValDictionary).(int)
+	if !ok {
+		version = DictionaryV1
+	}
+	offer, err := opts.GetUint32(OptionIDDictionary)
+	if err != nil {
+		return version, false
+	}
+	version = int(offer)
+	if version > co.Dictionary {
+		version = co.Dictionary
+	}
+	if version < DictionaryV1 {
+		version = DictionaryV1
+	}
+	cc.SetContextValue(ctxValDictionary, version)
+	return version, true
+}
+
+// RequestDictionary returns the dictionary version to encode the response to this HTTP request with,
+// for HTTP requests made by CoAPHTTP. Returns DictionaryV1 if the client didn't negotiate a version.
+func RequestDictionary(req *http.Request) int {
+	if version, ok := req.Context().Value(ctxValDictionary).(int); ok {
+		return version
+	}
+	return DictionaryV1
+}
+
+// DictionaryNegotiation is the client side of negotiating the dictionary version of a connection, see
+// OptionIDDictionary. Clients should keep one per connection, and make a new one when they reconnect.
+type DictionaryNegotiation struct {
+	mu     sync.Mutex
+	newest int
+	// the version the server picked, or 0 if it hasn't yet
+	version int
+}
+
+// NewDictionaryNegotiation returns a negotiation which offers the newest version the client knows.
+func NewDictionaryNegotiation(newest int) *DictionaryNegotiation {
+	return &DictionaryNegotiation{
+		newest: newest,
+	}
+}
+
+// Version returns the dictionary version to encode requests with. This is DictionaryV1 until the
+// server has picked a version.
+func (d *DictionaryNegotiation) Version() int {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if d.version == 0 {
+		return DictionaryV1
+	}
+	return d.version
+}
+
+// Offer adds OptionIDDictionary to the request if the server hasn't picked a version yet. Returns
+// true if it was added.
+func (d *DictionaryNegotiation) Offer(msg *basepool.Message) bool {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if d.version != 0 || d.newest <= DictionaryV1 {
+		return false
+	}
+	msg.SetOptionUint32(OptionIDDictionary, uint32(d.newest))
+	return true
+}
+
+// Learn picks the version from the response to a request which had an offer. A successful response
+// without OptionIDDictionary is from a server which doesn't negotiate, so the version is DictionaryV1.
+func (d *DictionaryNegotiation) Learn(code codes.Code, opts message.Options) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if d.version != 0 {
+		return
+	}
+	version, err := opts.GetUint32(OptionIDDictionary)
+	switch {
+	case err == nil && int(version) >= DictionaryV1 && int(version) <= d.newest:
+		d.version = int(version)
+	case err != nil && code>>5 == 2:
+		// any 2.xx code
+		d.version = DictionaryV1
+	}
+}
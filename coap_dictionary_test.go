@@ -0,0 +1,353 @@
+// Copyright 2021 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package lb
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"reflect"
+	"sort"
+	"strings"
+	"testing"
+
+	"github.com/matrix-org/go-coap/v2/message"
+	"github.com/matrix-org/go-coap/v2/message/codes"
+	coapmux "github.com/matrix-org/go-coap/v2/mux"
+	"github.com/matrix-org/go-coap/v2/tcp"
+	tcppool "github.com/matrix-org/go-coap/v2/tcp/message/pool"
+)
+
+// v1DictionaryDigest is the digest of the v1 tables as released. Peers which only know v1 decode codes
+// which aren't in these tables as strings, or forward them, so new codes must go in the newest version.
+const v1DictionaryDigest = "f90957f8fca0fef87aef5f41bd12bd652262dbb78c52cf8588f3fd36cd8b860f"
+
+// TestDictionaryV1Frozen checks that the v1 tables haven't changed since they were released, so the
+// interop tests below are against what v1 peers really send.
+func TestDictionaryV1Frozen(t *testing.T) {
+	var lines []string
+	for code, tpl := range coapv1pathMappings {
+		lines = append(lines, fmt.Sprintf("path %s %s", code, tpl))
+	}
+	for key, n := range cborv1Keys {
+		lines = append(lines, fmt.Sprintf("key %s %d", key, n))
+	}
+	for code, key := range coapv1QueryKeys {
+		lines = append(lines, fmt.Sprintf("query %s %s", code, key))
+	}
+	for key, values := range coapv1QueryValues {
+		for code, value := range values {
+			lines = append(lines, fmt.Sprintf("value %s %s %s", key, code, value))
+		}
+	}
+	sort.Strings(lines)
+	digest := sha256.Sum256([]byte(strings.Join(lines, "\n")))
+	if got := hex.EncodeToString(digest[:]); got != v1DictionaryDigest {
+		t.Errorf("the v1 dictionary has changed (digest %s): add new codes to v2 instead", got)
+	}
+}
+
+// TestDictionaryV2IsSupersetOfV1 checks that v1 codes mean the same in v2, which is what lets v2 peers
+// decode anything from v1 peers.
+func TestDictionaryV2IsSupersetOfV1(t *testing.T) {
+	for code, tpl := range coapv1pathMappings {
+		if coapv2pathMappings[code] != tpl {
+			t.Errorf("path %s is %s in v1 but %s in v2", code, tpl, coapv2pathMappings[code])
+		}
+	}
+	for key, n := range cborv1Keys {
+		if v2, ok := cborv2Keys[key]; !ok || v2 != n {
+			t.Errorf("key %s is %d in v1 but %d in v2", key, n, v2)
+		}
+	}
+	for code, key := range coapv1QueryKeys {
+		if coapv2QueryKeys[code] != key {
+			t.Errorf("query key %s is %s in v1 but %s in v2", code, key, coapv2QueryKeys[code])
+		}
+	}
+	v1, v2 := NewCoAPQueryV1(), NewCoAPQueryV2()
+	for key, values := range coapv1QueryValues {
+		for _, value := range values {
+			encoded := v1.Encode(key, value)
+			if gotKey, gotValue, _ := v2.Decode(encoded); gotKey != key || gotValue != value {
+				t.Errorf("query %s=%s is %s in v1 which v2 decodes as %s=%s", key, value, encoded, gotKey, gotValue)
+			}
+		}
+	}
+	v1Paths, v2Paths := NewCoAPPathV1(), NewCoAPPathV2()
+	for _, httpPath := range []string{
+		"/_matrix/client/v3/sync",
+		"/_matrix/client/r0/rooms/!foo:bar/send/m.room.message/txn1",
+	} {
+		want := strings.Replace(httpPath, "!", "%21", 1)
+		if got := v2Paths.CoAPPathToHTTPPath(v1Paths.HTTPPathToCoapPath(httpPath)); got != want {
+			t.Errorf("v1 encoded %s, v2 decoded %s", httpPath, got)
+		}
+	}
+}
+
+func TestDictionaryV2Paths(t *testing.T) {
+	paths := NewCoAPPathV2()
+	for _, tc := range []struct {
+		http string
+		code string
+	}{
+		{http: "/_matrix/client/v3/account/whoami", code: "/02"},
+		{http: "/_matrix/client/v3/user/@alice:example.org/openid/request_token", code: "/03/@alice:example.org"},
+		{http: "/_matrix/client/v3/rooms/!foo:bar/aliases", code: "/04/!foo:bar"},
+		{http: "/_matrix/client/v1/rooms/!foo:bar/relations/$abc", code: "/05/!foo:bar/$abc"},
+		{http: "/_matrix/client/v1/rooms/!foo:bar/relations/$abc/m.thread", code: "/06/!foo:bar/$abc/m.thread"},
+		{http: "/_matrix/client/v1/rooms/!foo:bar/relations/$abc/m.annotation/m.reaction", code: "/07/!foo:bar/$abc/m.annotation/m.reaction"},
+		{http: "/_matrix/client/v1/rooms/!foo:bar/threads", code: "/08/!foo:bar"},
+		{http: "/_matrix/client/v1/rooms/!foo:bar/hierarchy", code: "/09/!foo:bar"},
+		// other spec versions use a marker, as with v1
+		{http: "/_matrix/client/r0/account/whoami", code: "/02~r"},
+		// v1 enum paths are unchanged
+		{http: "/_matrix/client/r0/sync", code: "/7"},
+	} {
+		if got := paths.HTTPPathToCoapPath(tc.http); got != tc.code {
+			t.Errorf("HTTPPathToCoapPath(%s) got %s want %s", tc.http, got, tc.code)
+		}
+		if got := paths.CoAPPathToHTTPPath(tc.code); got != strings.Replace(tc.http, "!", "%21", 1) {
+			t.Errorf("CoAPPathToHTTPPath(%s) got %s want %s", tc.code, got, tc.http)
+		}
+	}
+	codec := NewCBORCodecV2(true)
+	for _, key := range []string{"m.relates_to", "rel_type", "event_id"} {
+		if _, ok := codec.Keys()[key]; !ok {
+			t.Errorf("v2 codec has no key for %s", key)
+		}
+	}
+}
+
+// dictionaryServer runs a CoAP server which records the HTTP path and dictionary version of each
+// request, and responds with a body which uses a v2 key, encoded with the dictionary of the session.
+type dictionaryServer struct {
+	paths    []string
+	versions []int
+}
+
+func (s *dictionaryServer) start(t *testing.T, co *CoAPHTTP) (*tcp.ClientConn, func()) {
+	codecs := map[int]*CBORCodec{
+		DictionaryV1: NewCBORCodecV1(true),
+		DictionaryV2: NewCBORCodecV2(true),
+	}
+	router := coapmux.NewRouter()
+	router.DefaultHandle(co.CoAPHTTPHandler(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		s.paths = append(s.paths, req.URL.EscapedPath())
+		version := RequestDictionary(req)
+		s.versions = append(s.versions, version)
+		body, err := codecs[version].JSONToCBOR(strings.NewReader(`{"m.relates_to":{"rel_type":"m.thread"}}`))
+		if err != nil {
+			t.Errorf("JSONToCBOR: %s", err)
+		}
+		w.Header().Set("Content-Type", "application/cbor")
+		w.WriteHeader(200)
+		w.Write(body)
+	}), nil))
+	l := NewWebSocketListener()
+	srv := httptest.NewServer(l)
+	ignoreErrors := tcp.WithErrors(func(err error) {})
+	coapServer := tcp.NewServer(tcp.WithMux(router), ignoreErrors)
+	go coapServer.Serve(l)
+	srvURL, _ := url.Parse(srv.URL)
+	conn, err := DialWebSocket(&url.URL{Scheme: "coap+ws", Host: srvURL.Host}, nil)
+	if err != nil {
+		t.Fatalf("DialWebSocket: %s", err)
+	}
+	cc := tcp.Client(conn, ignoreErrors)
+	return cc, func() {
+		cc.Close()
+		coapServer.Stop()
+		srv.Close()
+		l.Close()
+	}
+}
+
+// dictionaryClient sends requests as a client which knows the dictionaries in `clients`, keyed by version.
+type dictionaryClient struct {
+	clients     map[int]*CoAPHTTP
+	negotiation *DictionaryNegotiation
+}
+
+// do sends the request, encoded with the negotiated version, and returns the response body as JSON
+// decoded with the newest version the client knows.
+func (c *dictionaryClient) do(t *testing.T, cc *tcp.ClientConn, httpPath string) (coapPath string, jsonBody string) {
+	t.Helper()
+	req, _ := http.NewRequest("GET", "https://localhost"+httpPath, nil)
+	newest := NewCBORCodecV1(true)
+	if c.negotiation != nil && c.clients[DictionaryV2] != nil {
+		newest = NewCBORCodecV2(true)
+	}
+	co := c.clients[DictionaryV1]
+	if c.negotiation != nil {
+		co = c.clients[c.negotiation.Version()]
+	}
+	err := co.HTTPRequestToCoAPTCP(req, func(msg *tcppool.Message) error {
+		offered := c.negotiation != nil && c.negotiation.Offer(msg.Message)
+		path, _ := msg.Options().Path()
+		coapPath = "/" + path
+		res, err := cc.Do(msg)
+		if err != nil {
+			return err
+		}
+		if res.Code() != codes.Content {
+			t.Errorf("%s: got code %v want %v", httpPath, res.Code(), codes.Content)
+		}
+		if offered {
+			c.negotiation.Learn(res.Code(), res.Options())
+		} else if res.HasOption(OptionIDDictionary) {
+			t.Errorf("%s: got a dictionary version without offering one", httpPath)
+		}
+		body, err := newest.CBORToJSON(res.Body())
+		jsonBody = string(body)
+		return err
+	})
+	if err != nil {
+		t.Fatalf("%s: %s", httpPath, err)
+	}
+	return coapPath, jsonBody
+}
+
+// TestDictionaryNegotiation checks that v1 and v2 peers interoperate in every combination.
+func TestDictionaryNegotiation(t *testing.T) {
+	newV1 := func() *CoAPHTTP {
+		co := NewCoAPHTTP(NewCoAPPathV1())
+		co.Queries = NewCoAPQueryV1()
+		return co
+	}
+	newV2 := func() *CoAPHTTP {
+		co := NewCoAPHTTP(NewCoAPPathV2())
+		co.Queries = NewCoAPQueryV2()
+		return co
+	}
+	v2Server := func() *CoAPHTTP {
+		co := newV2()
+		co.Dictionary = DictionaryV2
+		return co
+	}
+	v1Client := func() *dictionaryClient {
+		return &dictionaryClient{clients: map[int]*CoAPHTTP{DictionaryV1: newV1()}}
+	}
+	v2Client := func() *dictionaryClient {
+		return &dictionaryClient{
+			clients:     map[int]*CoAPHTTP{DictionaryV1: newV1(), DictionaryV2: newV2()},
+			negotiation: NewDictionaryNegotiation(DictionaryV2),
+		}
+	}
+	const relations = "/_matrix/client/v1/rooms/%21foo:bar/relations/$abc/m.thread"
+	v1Body := `{"m.relates_to":{"rel_type":"m.thread"}}`
+
+	for _, tc := range []struct {
+		name        string
+		server      *CoAPHTTP
+		client      *dictionaryClient
+		wantVersion int
+		// the CoAP paths the client sends for /sync and /relations
+		wantPaths []string
+	}{
+		{
+			name:        "v1 client, v2 server",
+			server:      v2Server(),
+			client:      v1Client(),
+			wantVersion: DictionaryV1,
+			wantPaths:   []string{"/7", "/_matrix/client/v1/rooms/!foo:bar/relations/$abc/m.thread"},
+		},
+		{
+			name:        "v2 client, v1 server",
+			server:      newV1(),
+			client:      v2Client(),
+			wantVersion: DictionaryV1,
+			wantPaths:   []string{"/7", "/_matrix/client/v1/rooms/!foo:bar/relations/$abc/m.thread"},
+		},
+		{
+			name:        "v2 client, v2 server without negotiation",
+			server:      newV2(),
+			client:      v2Client(),
+			wantVersion: DictionaryV1,
+			wantPaths:   []string{"/7", "/_matrix/client/v1/rooms/!foo:bar/relations/$abc/m.thread"},
+		},
+		{
+			name:        "v2 client, v2 server",
+			server:      v2Server(),
+			client:      v2Client(),
+			wantVersion: DictionaryV2,
+			wantPaths:   []string{"/7", "/06/!foo:bar/$abc/m.thread"},
+		},
+	} {
+		s := &dictionaryServer{}
+		cc, stop := s.start(t, tc.server)
+		var gotPaths []string
+		for _, httpPath := range []string{"/_matrix/client/r0/sync", relations} {
+			coapPath, body := tc.client.do(t, cc, httpPath)
+			gotPaths = append(gotPaths, coapPath)
+			if body != v1Body {
+				t.Errorf("%s: %s got body %s want %s", tc.name, httpPath, body, v1Body)
+			}
+		}
+		// a v1 client's session stays v1 even if the server knows v2
+		tc.client.do(t, cc, "/_matrix/client/r0/sync")
+		stop()
+		if tc.client.negotiation != nil && tc.client.negotiation.Version() != tc.wantVersion {
+			t.Errorf("%s: negotiated v%d want v%d", tc.name, tc.client.negotiation.Version(), tc.wantVersion)
+		}
+		if !reflect.DeepEqual(gotPaths, tc.wantPaths) {
+			t.Errorf("%s: client sent %v want %v", tc.name, gotPaths, tc.wantPaths)
+		}
+		wantHTTPPaths := []string{"/_matrix/client/r0/sync", relations, "/_matrix/client/r0/sync"}
+		if !reflect.DeepEqual(s.paths, wantHTTPPaths) {
+			t.Errorf("%s: server got %v want %v", tc.name, s.paths, wantHTTPPaths)
+		}
+		// the first request is encoded with v1, and its response with the version the server picked
+		for i, version := range s.versions {
+			if version != tc.wantVersion && tc.server.Dictionary > 0 {
+				t.Errorf("%s: request %d encoded with v%d want v%d", tc.name, i, version, tc.wantVersion)
+			}
+		}
+	}
+}
+
+// TestDictionaryNegotiationOption checks the values of OptionIDDictionary.
+func TestDictionaryNegotiationOption(t *testing.T) {
+	d := NewDictionaryNegotiation(DictionaryV2)
+	msg := tcppool.AcquireMessage(nil)
+	defer tcppool.ReleaseMessage(msg)
+	if !d.Offer(msg.Message) {
+		t.Fatalf("Offer did not offer a version")
+	}
+	if v, err := msg.GetOptionUint32(OptionIDDictionary); err != nil || v != DictionaryV2 {
+		t.Errorf("Offer set %d (%v) want %d", v, err, DictionaryV2)
+	}
+	// errors don't say whether the server negotiates
+	d.Learn(codes.Unauthorized, nil)
+	if !d.Offer(msg.Message) {
+		t.Errorf("Offer stopped offering after an error")
+	}
+	// servers can't pick a version the client doesn't know
+	d.Learn(codes.Content, message.Options{{ID: OptionIDDictionary, Value: []byte{3}}})
+	if d.Version() != DictionaryV1 || !d.Offer(msg.Message) {
+		t.Errorf("Learn accepted an unknown version")
+	}
+	d.Learn(codes.Content, message.Options{{ID: OptionIDDictionary, Value: []byte{DictionaryV2}}})
+	if d.Version() != DictionaryV2 || d.Offer(msg.Message) {
+		t.Errorf("Learn did not pick v2")
+	}
+	if NewDictionaryNegotiation(DictionaryV1).Offer(msg.Message) {
+		t.Errorf("v1 client offered a version")
+	}
+}
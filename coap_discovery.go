@@ -0,0 +1,287 @@
+// Copyright 2021 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package lb
+
+import (
+	"bytes"
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/matrix-org/go-coap/v2/message"
+	"github.com/matrix-org/go-coap/v2/message/codes"
+	coapmux "github.com/matrix-org/go-coap/v2/mux"
+)
+
+// WellKnownCorePath lists the resources the server supports in the CoRE Link Format.
+// https://datatracker.ietf.org/doc/html/rfc6690#section-4
+const WellKnownCorePath = "/.well-known/core"
+
+// The resource type of the link to the server itself, whose opt attribute lists the CoAP options it
+// understands, and whose dict attribute lists the dictionary versions clients can negotiate, if any.
+const linkResourceTypeServer = "matrix.lb"
+
+// Link is a link in the CoRE Link Format. Each enum path is a link with these attributes:
+//
+//	tpl: the HTTP path template the enum path maps to, e.g /_matrix/client/r0/sync
+//	obs: present if the resource can be observed
+//	ct:  the Content-Formats of request and response bodies, if they are not arbitrary media
+type Link struct {
+	// The URI of the resource e.g /7
+	Target string
+	// Attributes of the link. Attributes without a value, such as obs, map to "".
+	Attrs map[string]string
+}
+
+// String returns the link in the CoRE Link Format, with the attributes sorted by name.
+func (l Link) String() string {
+	var b strings.Builder
+	b.WriteString("<" + l.Target + ">")
+	names := make([]string, 0, len(l.Attrs))
+	for name := range l.Attrs {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		b.WriteString(";" + name)
+		if val := l.Attrs[name]; val != "" {
+			b.WriteString("=" + quoteLinkValue(val))
+		}
+	}
+	return b.String()
+}
+
+// ParseLinkFormat parses a document in the CoRE Link Format, as returned from WellKnownCorePath.
+func ParseLinkFormat(doc string) ([]Link, error) {
+	var links []Link
+	s := strings.TrimSpace(doc)
+	for s != "" {
+		if s[0] != '<' {
+			return nil, fmt.Errorf("link-format: expected '<' at %q", s)
+		}
+		end := strings.IndexByte(s, '>')
+		if end == -1 {
+			return nil, fmt.Errorf("link-format: unterminated target at %q", s)
+		}
+		link := Link{
+			Target: s[1:end],
+			Attrs:  make(map[string]string),
+		}
+		s = s[end+1:]
+		for strings.HasPrefix(s, ";") {
+			s = s[1:]
+			nameEnd := strings.IndexAny(s, "=;,")
+			if nameEnd == -1 {
+				nameEnd = len(s)
+			}
+			name := s[:nameEnd]
+			s = s[nameEnd:]
+			if !strings.HasPrefix(s, "=") {
+				link.Attrs[name] = ""
+				continue
+			}
+			s = s[1:]
+			var val string
+			if strings.HasPrefix(s, `"`) {
+				var n int
+				if val, n = unquoteLinkValue(s); n == 0 {
+					return nil, fmt.Errorf("link-format: unterminated value for %s", name)
+				}
+				s = s[n:]
+			} else {
+				valEnd := strings.IndexAny(s, ";,")
+				if valEnd == -1 {
+					valEnd = len(s)
+				}
+				val = s[:valEnd]
+				s = s[valEnd:]
+			}
+			link.Attrs[name] = val
+		}
+		links = append(links, link)
+		if s != "" && s[0] != ',' {
+			return nil, fmt.Errorf("link-format: expected ',' at %q", s)
+		}
+		s = strings.TrimSpace(strings.TrimPrefix(s, ","))
+	}
+	return links, nil
+}
+
+// quoteLinkValue returns the attribute value as a quoted-string.
+func quoteLinkValue(val string) string {
+	return `"` + strings.NewReplacer(`\`, `\\`, `"`, `\"`).Replace(val) + `"`
+}
+
+// unquoteLinkValue reads the quoted-string at the start of s. Returns the value and the length of the
+// quoted-string, which is 0 if it is not terminated.
+func unquoteLinkValue(s string) (string, int) {
+	var b strings.Builder
+	for i := 1; i < len(s); i++ {
+		switch s[i] {
+		case '\\':
+			i++
+			if i < len(s) {
+				b.WriteByte(s[i])
+			}
+		case '"':
+			return b.String(), i + 1
+		default:
+			b.WriteByte(s[i])
+		}
+	}
+	return "", 0
+}
+
+// Links returns a link for each enum path, sorted by enum path. `observable` are the HTTP paths which
+// can be observed.
+func (c *CoAPPath) Links(observable []string) []Link {
+	obs := make(map[string]bool, len(observable))
+	for _, path := range observable {
+		obs[path] = true
+	}
+	enums := make([]string, 0, len(c.pathMappings))
+	for code := range c.pathMappings {
+		enums = append(enums, code)
+	}
+	sort.Strings(enums)
+	links := make([]Link, 0, len(enums))
+	for _, code := range enums {
+		tpl := c.pathMappings[code]
+		link := Link{
+			Target: "/" + code,
+			Attrs: map[string]string{
+				"tpl": tpl,
+			},
+		}
+		if obs[tpl] {
+			link.Attrs["obs"] = ""
+		}
+		if !isMediaTemplate(tpl) {
+			// JSON bodies are sent as CBOR, but JSON is accepted too
+			link.Attrs["ct"] = fmt.Sprintf("%d %d", message.AppCBOR, message.AppJSON)
+		}
+		links = append(links, link)
+	}
+	return links
+}
+
+// isMediaTemplate returns true if bodies on this path are media rather than JSON.
+func isMediaTemplate(tpl string) bool {
+	if !strings.HasPrefix(tpl, "/_matrix/media/") && !strings.HasPrefix(tpl, "/_matrix/client/v1/media/") {
+		return false
+	}
+	return !strings.HasSuffix(tpl, "/config") && !strings.HasSuffix(tpl, "/preview_url") && !strings.HasSuffix(tpl, "/create")
+}
+
+// wellKnownCore returns the links served on WellKnownCorePath: one for the server itself and one for
+// each enum path.
+func (co *CoAPHTTP) wellKnownCore(ob *Observations) []Link {
+	opts := []message.OptionID{OptionIDAccessToken, OptionIDAccessTokenAlias, OptionIDContentType, message.NoResponse}
+	if co.OSCORE != nil {
+		opts = append(opts, OptionIDOSCORE)
+	}
+	if co.InternIDs {
+		opts = append(opts, OptionIDIDHandle)
+	}
+	if co.Dictionary > 0 {
+		opts = append(opts, OptionIDDictionary)
+	}
+	sort.Slice(opts, func(i, j int) bool {
+		return opts[i] < opts[j]
+	})
+	optStrs := make([]string, len(opts))
+	for i := range opts {
+		optStrs[i] = strconv.Itoa(int(opts[i]))
+	}
+	links := []Link{{
+		Target: "/",
+		Attrs: map[string]string{
+			"rt":  linkResourceTypeServer,
+			"opt": strings.Join(optStrs, " "),
+		},
+	}}
+	if co.Dictionary > 0 {
+		versions := make([]string, co.Dictionary)
+		for i := range versions {
+			versions[i] = strconv.Itoa(DictionaryV1 + i)
+		}
+		links[0].Attrs["dict"] = strings.Join(versions, " ")
+	}
+	var observable []string
+	if ob != nil {
+		observable = ob.ObservablePaths
+	}
+	return append(links, co.Paths.Links(observable)...)
+}
+
+// matchLinkQuery returns true if the link matches a query filter like href=/7 or tpl=/_matrix/media/*.
+// Attribute values which are space separated lists match if any value matches.
+// https://datatracker.ietf.org/doc/html/rfc6690#section-4.1
+func matchLinkQuery(link Link, query string) bool {
+	name, want := query, ""
+	if i := strings.IndexByte(query, '='); i != -1 {
+		name, want = query[:i], query[i+1:]
+	}
+	var vals []string
+	if name == "href" {
+		vals = []string{link.Target}
+	} else {
+		val, ok := link.Attrs[name]
+		if !ok {
+			return false
+		}
+		vals = strings.Fields(val)
+		if len(vals) == 0 {
+			vals = []string{val}
+		}
+	}
+	for _, val := range vals {
+		if strings.HasSuffix(want, "*") && strings.HasPrefix(val, strings.TrimSuffix(want, "*")) {
+			return true
+		}
+		if val == want {
+			return true
+		}
+	}
+	return false
+}
+
+// handleWellKnownCore serves WellKnownCorePath. Returns false if the request is for a different path.
+func (co *CoAPHTTP) handleWellKnownCore(w coapmux.ResponseWriter, r *coapmux.Message, ob *Observations) bool {
+	if path, _ := r.Options.Path(); "/"+path != WellKnownCorePath {
+		return false
+	}
+	if r.Code != codes.GET {
+		w.SetResponse(codes.MethodNotAllowed, message.TextPlain, nil)
+		return true
+	}
+	queries, _ := r.Options.Queries()
+	var doc []string
+	for _, link := range co.wellKnownCore(ob) {
+		matched := true
+		for _, q := range queries {
+			if !matchLinkQuery(link, q) {
+				matched = false
+				break
+			}
+		}
+		if matched {
+			doc = append(doc, link.String())
+		}
+	}
+	w.SetResponse(codes.Content, message.AppLinkFormat, bytes.NewReader([]byte(strings.Join(doc, ","))))
+	return true
+}
@@ -0,0 +1,182 @@
+// Copyright 2021 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package lb
+
+import (
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"reflect"
+	"regexp"
+	"strings"
+	"testing"
+
+	"github.com/matrix-org/go-coap/v2/message"
+	coapmux "github.com/matrix-org/go-coap/v2/mux"
+	"github.com/matrix-org/go-coap/v2/tcp"
+	tcppool "github.com/matrix-org/go-coap/v2/tcp/message/pool"
+)
+
+// templateVariable matches the variables in a path template e.g {roomId}
+var templateVariable = regexp.MustCompile(`\{[^}]*\}`)
+
+func TestLinkFormat(t *testing.T) {
+	links := []Link{
+		{Target: "/", Attrs: map[string]string{"rt": "matrix.lb", "opt": "256 260"}},
+		{Target: "/7", Attrs: map[string]string{"tpl": "/_matrix/client/r0/sync", "obs": "", "ct": "60 50"}},
+		{Target: "/x", Attrs: map[string]string{"tpl": `quote " and \ backslash`}},
+		// only quotes and backslashes are escaped in a quoted-string
+		{Target: "/y", Attrs: map[string]string{"tpl": "tab\tand é"}},
+	}
+	var doc string
+	for i, l := range links {
+		if i > 0 {
+			doc += ","
+		}
+		doc += l.String()
+	}
+	want := `</>;opt="256 260";rt="matrix.lb",</7>;ct="60 50";obs;tpl="/_matrix/client/r0/sync",</x>;tpl="quote \" and \\ backslash",</y>;tpl="tab` + "\t" + `and é"`
+	if doc != want {
+		t.Errorf("got  %s\nwant %s", doc, want)
+	}
+	got, err := ParseLinkFormat(doc)
+	if err != nil {
+		t.Fatalf("ParseLinkFormat: %s", err)
+	}
+	if !reflect.DeepEqual(got, links) {
+		t.Errorf("ParseLinkFormat got %+v want %+v", got, links)
+	}
+	// unquoted values and whitespace between links are allowed
+	got, err = ParseLinkFormat("</a>;ct=40;if=core.b, </b>")
+	if err != nil {
+		t.Fatalf("ParseLinkFormat: %s", err)
+	}
+	if len(got) != 2 || got[0].Attrs["ct"] != "40" || got[0].Attrs["if"] != "core.b" || got[1].Target != "/b" {
+		t.Errorf("ParseLinkFormat got %+v", got)
+	}
+	for _, bad := range []string{"/a", "</a", `</a>;tpl="unterminated`, "</a> </b>"} {
+		if _, err = ParseLinkFormat(bad); err == nil {
+			t.Errorf("ParseLinkFormat(%q) did not fail", bad)
+		}
+	}
+}
+
+func TestWellKnownCore(t *testing.T) {
+	paths := NewCoAPPathV1()
+	server := NewCoAPHTTP(paths)
+	ob := NewSyncObservations(http.NotFoundHandler(), paths, NewCBORCodecV1(true))
+	router := coapmux.NewRouter()
+	router.DefaultHandle(server.CoAPHTTPHandler(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		t.Errorf("request for %s was passed to the HTTP handler", req.URL)
+	}), ob))
+
+	l := NewWebSocketListener()
+	defer l.Close()
+	srv := httptest.NewServer(l)
+	defer srv.Close()
+	ignoreErrors := tcp.WithErrors(func(err error) {})
+	coapServer := tcp.NewServer(tcp.WithMux(router), ignoreErrors)
+	defer coapServer.Stop()
+	go coapServer.Serve(l)
+	srvURL, _ := url.Parse(srv.URL)
+	conn, err := DialWebSocket(&url.URL{Scheme: "coap+ws", Host: srvURL.Host}, nil)
+	if err != nil {
+		t.Fatalf("DialWebSocket: %s", err)
+	}
+	cc := tcp.Client(conn, ignoreErrors)
+	defer cc.Close()
+
+	discover := func(query string) []Link {
+		t.Helper()
+		req, _ := http.NewRequest("GET", "https://example.com"+WellKnownCorePath+query, nil)
+		var links []Link
+		err := server.HTTPRequestToCoAPTCP(req, func(msg *tcppool.Message) error {
+			res, err := cc.Do(msg)
+			if err != nil {
+				return err
+			}
+			if format, _ := res.ContentFormat(); format != message.AppLinkFormat {
+				t.Errorf("got Content-Format %v want %v", format, message.AppLinkFormat)
+			}
+			body, err := ioutil.ReadAll(res.Body())
+			if err != nil {
+				return err
+			}
+			links, err = ParseLinkFormat(string(body))
+			return err
+		})
+		if err != nil {
+			t.Fatalf("%s: %s", query, err)
+		}
+		return links
+	}
+
+	links := discover("")
+	if len(links) != len(paths.pathMappings)+1 {
+		t.Fatalf("got %d links want %d", len(links), len(paths.pathMappings)+1)
+	}
+	if links[0].Target != "/" || links[0].Attrs["rt"] != "matrix.lb" || links[0].Attrs["opt"] != "256 258 260 264" {
+		t.Errorf("bad server link %+v", links[0])
+	}
+	for _, link := range links[1:] {
+		tpl := link.Attrs["tpl"]
+		// the link maps to its template, with the variables left empty
+		if want, got := templateVariable.ReplaceAllString(tpl, ""), paths.CoAPPathToHTTPPath(link.Target); got != want {
+			t.Errorf("%s: tpl is %s but maps to %s", link.Target, tpl, got)
+		}
+		// and a path which fills in the template maps to the link and back
+		i := 0
+		httpPath := templateVariable.ReplaceAllStringFunc(tpl, func(string) string {
+			i++
+			return fmt.Sprintf("v%d", i)
+		})
+		coapPath := paths.HTTPPathToCoapPath(httpPath)
+		if coapPath != link.Target && !strings.HasPrefix(coapPath, link.Target+"/") {
+			t.Errorf("%s: %s maps to %s", link.Target, httpPath, coapPath)
+		} else if got := paths.CoAPPathToHTTPPath(coapPath); got != httpPath {
+			t.Errorf("%s: %s maps to %s which maps back to %s", link.Target, httpPath, coapPath, got)
+		}
+		_, obs := link.Attrs["obs"]
+		if _, wantObs := syncPositions[link.Attrs["tpl"]]; obs != wantObs {
+			t.Errorf("%s: got obs %v want %v", link.Target, obs, wantObs)
+		}
+	}
+
+	// filtering
+	links = discover("?tpl=/_matrix/client/r0/sync")
+	if len(links) != 1 || links[0].Target != "/7" {
+		t.Errorf("tpl filter: got %+v", links)
+	}
+	links = discover("?tpl=/_matrix/media/*&ct=60")
+	if len(links) != 1 || links[0].Attrs["tpl"] != "/_matrix/media/r0/config" {
+		t.Errorf("tpl and ct filter: got %+v", links)
+	}
+	links = discover("?href=/w")
+	if len(links) != 1 || links[0].Attrs["ct"] != "" {
+		t.Errorf("href filter: got %+v", links)
+	}
+
+	// servers which negotiate dictionary versions advertise them
+	if _, ok := discover("?href=/")[0].Attrs["dict"]; ok {
+		t.Errorf("dict advertised without negotiation")
+	}
+	server.Dictionary = DictionaryV2
+	links = discover("?href=/")
+	if len(links) != 1 || links[0].Attrs["dict"] != "1 2" || !strings.Contains(links[0].Attrs["opt"], "272") {
+		t.Errorf("server link with dictionary negotiation: got %+v", links)
+	}
+}
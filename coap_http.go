@@ -17,17 +17,21 @@ package lb
 import (
 	"bytes"
 	"context"
-	"encoding/binary"
 	"fmt"
 	"io"
 	"io/ioutil"
 	"net/http"
 	"net/url"
+	"strconv"
 	"strings"
+	"sync"
 
 	"github.com/matrix-org/go-coap/v2/message"
+	"github.com/matrix-org/go-coap/v2/message/codes"
+	basepool "github.com/matrix-org/go-coap/v2/message/pool"
 	coapmux "github.com/matrix-org/go-coap/v2/mux"
-	"github.com/matrix-org/go-coap/v2/udp/client"
+	"github.com/matrix-org/go-coap/v2/tcp"
+	tcppool "github.com/matrix-org/go-coap/v2/tcp/message/pool"
 	udpmessage "github.com/matrix-org/go-coap/v2/udp/message"
 	"github.com/matrix-org/go-coap/v2/udp/message/pool"
 )
@@ -38,14 +42,61 @@ type Logger interface {
 	Printf(format string, v ...interface{})
 }
 
+// noResponseAll is the No-Response option value which suppresses all responses: 2.xx, 4.xx and 5.xx
+const noResponseAll = 2 | 8 | 16
+
+// isNoResponseCode returns true if the No-Response option value suppresses responses with this code.
+// Each bit suppresses a class: 2 suppresses 2.xx, 8 suppresses 4.xx and 16 suppresses 5.xx.
+// https://datatracker.ietf.org/doc/html/rfc7967#section-2.1
+func isNoResponseCode(noResponse uint32, code codes.Code) bool {
+	class := uint32(code) >> 5
+	return class > 0 && noResponse&(1<<(class-1)) != 0
+}
+
 // CoAPHTTP provides many ways to convert to and from HTTP/CoAP.
 type CoAPHTTP struct {
 	// Optional logger if you want to debug request/responses
 	Log Logger
 	// Which set of CoAP enum paths to use (e.g v1)
 	Paths *CoAPPath
-	// Custom generator for CoAP tokens. NewCoAPHTTP uses a monotonically increasing integer.
+	// Optional: which set of CoAP enum query keys and values to use (e.g v1). If this is nil, query
+	// parameters are sent as they are. Both ends must use the same set.
+	Queries *CoAPQuery
+	// Custom generator for CoAP tokens. If this is nil, tokens are acquired from Tokens instead.
 	NextToken func() message.Token
+	// Which requests are sent as Non-confirmable messages, keyed by CoAP enum path code with the HTTP methods
+	// as values, e.g { "Y": ["PUT"] }. All other requests are sent as Confirmable messages. See NonConfirmableV1.
+	NonConfirmable map[string][]string
+	// Allocator for CoAP tokens used by HTTPRequestToCoAP, unless the request has its own allocator (see
+	// WithTokenAllocator). NewCoAPHTTP makes an allocator with tokens of DefaultTokenLength bytes. Tokens
+	// are released when HTTPRequestToCoAP returns.
+	Tokens *TokenAllocator
+	// Optional: decrypts requests and encrypts responses protected with OSCORE, so they can travel
+	// through untrusted CoAP proxies. Works alongside DTLS, which only protects a single hop.
+	OSCORE *OSCOREServer
+	// Optional: issues tickets which let clients resume their DTLS session with a PSK handshake.
+	// The DTLS server must also call SessionTickets.StartSession for each new session.
+	SessionTickets *SessionTickets
+	// Send the host of the request URL in the Uri-Host option, for proxies which serve several
+	// homeservers. CoAPToHTTPRequest uses the Uri-Host option, or the TLS server name, as the host.
+	SendURIHost bool
+	// Send the scheme and host of the request URL in the Proxy-Scheme and Uri-Host options, so the
+	// server forwards the request to that homeserver.
+	SendProxyScheme bool
+	// Optional: hosts which clients may forward requests to with the Proxy-Uri or Proxy-Scheme options,
+	// with an optional port e.g "matrix.org" or "example.com:8448". Other forward proxy requests are
+	// rejected with 5.05 Proxying Not Supported.
+	ProxyHosts []string
+	// Issue short handles for the room, user and event IDs in responses, which clients can send in path
+	// segments instead of the IDs for the rest of the DTLS session. See OptionIDIDHandle.
+	InternIDs bool
+	// The newest dictionary version (see OptionIDDictionary) which Paths, Queries and the CBOR codecs of
+	// the server know. If set, clients can negotiate the version of their session, and the HTTP handler
+	// should encode responses with the version from RequestDictionary. Optional: if 0 there is no
+	// negotiation and clients use v1.
+	Dictionary int
+
+	aliasesMu sync.Mutex
 }
 
 // NewCoAPHTTP returns various mapping functions and a wrapped HTTP handler for transparently
@@ -53,21 +104,18 @@ type CoAPHTTP struct {
 //
 // To aid debugging, you can set `CoAPHTTP.Log` after creation to log when things go wrong.
 func NewCoAPHTTP(paths *CoAPPath) *CoAPHTTP {
+	tokens, err := NewTokenAllocator(DefaultTokenLength)
+	if err != nil {
+		// this should never happen as the token length is static
+		panic("failed to create token allocator: " + err.Error())
+	}
 	return &CoAPHTTP{
-		Log:       nil,
-		Paths:     paths,
-		NextToken: counter,
+		Log:    nil,
+		Paths:  paths,
+		Tokens: tokens,
 	}
 }
 
-var count = 0
-
-func counter() message.Token {
-	count++
-	buf := make([]byte, 8, 8)
-	return buf[:binary.PutUvarint(buf, uint64(count))]
-}
-
 func (co *CoAPHTTP) log(format string, v ...interface{}) {
 	if co.Log == nil {
 		return
@@ -82,6 +130,18 @@ func (co *CoAPHTTP) log(format string, v ...interface{}) {
 func (co *CoAPHTTP) CoAPHTTPHandler(next http.Handler, ob *Observations) coapmux.Handler {
 	return coapmux.HandlerFunc(func(w coapmux.ResponseWriter, r *coapmux.Message) {
 		co.log("ClientAddress %v, %v\n", w.Client().RemoteAddr(), r.String())
+		if co.OSCORE != nil {
+			var ok bool
+			if w, r, ok = co.handleOSCORE(w, r); !ok {
+				return
+			}
+		}
+		if co.SessionTickets != nil && co.handleSessionTicket(w, r) {
+			return
+		}
+		if co.handleWellKnownCore(w, r, ob) {
+			return
+		}
 
 		// we always expect clients to ask for confirmable messages as we want to replicate
 		// a reliable transport. However, when blockwise xfer is used in conjunction with
@@ -93,34 +153,83 @@ func (co *CoAPHTTP) CoAPHTTPHandler(next http.Handler, ob *Observations) coapmux
 		// non-confirmable only because the request for more blocks is piggy-backed off
 		// an ACK from the first block. TODO: Actually I think the fact that it's non-con is
 		// due to a go-coap bug
-		if !r.IsConfirmable {
+		//
+		// The exception is requests which are deliberately sent non-confirmable because the
+		// client doesn't care if they are lost (e.g typing notifications). These are served
+		// as normal.
+		//
+		// Messages have no type over reliable transports (TCP, TLS, WebSockets) so there is nothing
+		// to check: blockwise transfers are handled by the transport.
+		if !r.IsConfirmable && !isReliableTransport(w.Client()) && !co.isNonConfirmableRequest(r.Message) {
 			if ob != nil {
 				ob.HandleBlockwise(w, r)
 			}
 			return
 		}
+		if scheme, host, ok := forwardProxyTarget(r.Options); ok && !co.forwardProxyAllowed(scheme, host) {
+			co.log("rejecting request to forward proxy to %s://%s", scheme, host)
+			w.SetResponse(codes.ProxyingNotSupported, message.TextPlain, nil)
+			return
+		}
+		var idHandles *idHandleTable
+		if co.InternIDs {
+			// make the table before the request is converted, so it can resolve handles
+			idHandles = co.sessionIDHandles(w.Client())
+		}
 		req := co.CoAPToHTTPRequest(r.Message)
 		if req == nil {
 			co.log("failed to map coap request to http, ignoring")
 			return
 		}
-		// set an access token if we know it and one hasn't been given
+		var dictionary int
+		if co.Dictionary > 0 {
+			version, offered := co.sessionDictionary(w.Client(), r.Options)
+			req = req.WithContext(context.WithValue(req.Context(), ctxValDictionary, version))
+			if offered {
+				// tell the client which version the response is encoded with
+				dictionary = version
+			}
+		}
+		if hasUnknownIDHandle(req) {
+			co.log("unknown ID handle in path, rejecting request")
+			w.SetResponse(codes.PreconditionFailed, message.TextPlain, nil)
+			return
+		}
+		// set an access token if we know it and one hasn't been given. Tokens and aliases are per host, so
+		// they are only ever sent to the homeserver they were sent for.
+		auth := sessionAuthFor(w.Client())
+		aliases := auth.hostAliases(req.URL.Host)
+		var issuedAlias []byte
 		authHeader := req.Header.Get("Authorization")
-		if authHeader == "" {
-			// look for one on the connection
-			udpConn, ok := w.Client().ClientConn().(*client.ClientConn)
-			if ok {
-				token := udpConn.Context().Value(ctxValAccessToken)
-				if token != nil {
-					req.Header.Set("Authorization", token.(string))
+		if IsForwardProxyRequest(req) {
+			// The session's access token and aliases are for the server which received the request, so
+			// they must not be sent to another homeserver. Forwarded requests always send the full token.
+			if r.Options.HasOption(OptionIDAccessTokenAlias) {
+				co.log("access token alias sent to forward proxy, rejecting request")
+				w.SetResponse(codes.Unauthorized, message.TextPlain, nil)
+				return
+			}
+			aliases = nil
+		} else if authHeader == "" {
+			if alias, err := r.Options.GetBytes(OptionIDAccessTokenAlias); err == nil {
+				// the client is using a short alias for an access token it sent earlier on this session
+				authHeader = aliases.resolve(alias)
+				if authHeader == "" {
+					co.log("unknown access token alias %x, rejecting request", alias)
+					w.SetResponse(codes.Unauthorized, message.TextPlain, nil)
+					return
 				}
+				req.Header.Set("Authorization", authHeader)
+				auth.setAccessToken(req.URL.Host, authHeader)
+			} else if token := auth.accessToken(req.URL.Host); token != "" {
+				// look for one on the connection
+				req.Header.Set("Authorization", token)
 			}
 		} else {
 			//set the auth header
-			udpConn, ok := w.Client().ClientConn().(*client.ClientConn)
-			if ok {
-				udpConn.SetContextValue(ctxValAccessToken, authHeader)
-			}
+			auth.setAccessToken(req.URL.Host, authHeader)
+			// the client sent the full token, so tell them the alias they can use in future
+			issuedAlias = aliases.assign(authHeader)
 		}
 
 		//    "When included in a GET request, the Observe Option extends the GET
@@ -140,15 +249,60 @@ func (co *CoAPHTTP) CoAPHTTPHandler(next http.Handler, ob *Observations) coapmux
 			}
 			return
 		}
-		next.ServeHTTP(&coapResponseWriter{
+		crw := &coapResponseWriter{
 			ResponseWriter: w,
 			headers:        make(http.Header),
 			logger:         co.Log,
-		}, req)
+			auth:           auth,
+			aliases:        aliases,
+			host:           req.URL.Host,
+			accessToken:    req.Header.Get("Authorization"),
+			alias:          issuedAlias,
+			idHandles:      idHandles,
+			dictionary:     dictionary,
+			isLogout:       IsLogoutPath(req.URL.Path),
+		}
+		if noResponse, err := r.Options.GetUint32(message.NoResponse); err == nil {
+			crw.noResponse = noResponse
+		}
+		next.ServeHTTP(crw, req)
+		crw.finish()
 	})
 }
 
-// CoAPToHTTPRequest converts a coap message into an HTTP request for http.Handler (lossy)
+// isReliableTransport returns true if the client is connected over CoAP over TCP/TLS or WebSockets
+// rather than UDP/DTLS. https://datatracker.ietf.org/doc/html/rfc8323
+func isReliableTransport(c coapmux.Client) bool {
+	_, ok := c.ClientConn().(*tcp.ClientConn)
+	return ok
+}
+
+// IsNonConfirmable returns true if a request with this HTTP method to this CoAP path should be sent as a
+// Non-confirmable message, according to NonConfirmable.
+func (co *CoAPHTTP) IsNonConfirmable(method, coapPath string) bool {
+	code := strings.SplitN(strings.TrimPrefix(coapPath, "/"), "/", 2)[0]
+	// other spec versions of the path have the same policy e.g /Y~3
+	if i := strings.IndexByte(code, versionMarkerSeparator); i != -1 {
+		code = code[:i]
+	}
+	for _, m := range co.NonConfirmable[code] {
+		if m == method {
+			return true
+		}
+	}
+	return false
+}
+
+func (co *CoAPHTTP) isNonConfirmableRequest(r *message.Message) bool {
+	path, err := r.Options.Path()
+	if err != nil {
+		return false
+	}
+	return co.IsNonConfirmable(methodCodes[r.Code], path)
+}
+
+// CoAPToHTTPRequest converts a coap message into an HTTP request for http.Handler (lossy).
+// The context of the HTTP request is the context of the coap message.
 // Conversion expects the following coap options: (message body is not modified)
 //   Uri-Host = "example.net"
 //   Uri-Path = "_matrix"
@@ -157,20 +311,28 @@ func (co *CoAPHTTP) CoAPHTTPHandler(next http.Handler, ob *Observations) coapmux
 //   Uri-Query = "access_token=foobar"
 //   Uri-Query = "limit=5"
 //   => example.net/_matrix/client/versions?access_token=foobar&limit=5
+// Without a Uri-Host option the host is the TLS server name (see SetServerName), or localhost.
+// Enum query keys and values are expanded with Queries e.g Uri-Query = "8=5" => limit=5.
+// The body of a blockwise (Block1) request has already been reassembled in memory by go-coap, which
+// has no way to hand the blocks to a handler as they arrive, so uploads are not streamed.
 func (co *CoAPHTTP) CoAPToHTTPRequest(r *message.Message) *http.Request {
 	method, ok := methodCodes[r.Code]
 	if !ok {
 		co.log("CoAPToHTTPRequest: bad code %v", r.Code)
 		return nil
 	}
-	// go-coap combines path segments for us
-	optPath, err := r.Options.Path()
-	if err != nil {
+	optPath, err := uriPath(r.Options)
+	if err != nil && !(err == message.ErrOptionNotFound && r.Options.HasOption(message.ProxyURI)) {
 		co.log("failed to extract Uri-Path option: %s", err)
 		return nil
 	}
-	if !strings.HasPrefix(optPath, "/") {
-		optPath = "/" + optPath
+	knownIDHandles := true
+	if co.InternIDs {
+		var handles *idHandleTable
+		if r.Context != nil {
+			handles, _ = r.Context.Value(ctxValIDHandles).(*idHandleTable)
+		}
+		optPath, knownIDHandles = co.resolveIDHandles(optPath, handles)
 	}
 	path := co.Paths.CoAPPathToHTTPPath(optPath)
 	if strings.HasPrefix(path, "/") {
@@ -184,35 +346,60 @@ func (co *CoAPHTTP) CoAPToHTTPRequest(r *message.Message) *http.Request {
 	}
 	query := make(url.Values)
 	for _, qs := range queries {
-		kvs := strings.SplitN(qs, "=", 2)
-		if len(kvs) != 2 {
+		key, val, ok := co.Queries.Decode(qs)
+		if !ok {
 			co.log("ignoring malformed query string: %s", qs)
 			continue
 		}
 		// allow repeating query params e.g ?foo=1&foo=2 => { "foo": [ "1", "2" ]}
-		q := query[kvs[0]]
-		q = append(q, kvs[1])
-		query[kvs[0]] = q
+		query[key] = append(query[key], val)
 	}
-	var body []byte
+	// pass the body on without copying it, as media uploads can be large
+	var body io.ReadSeeker = bytes.NewReader(nil)
+	var bodySize int64
 	if r.Body != nil {
-		body, err = ioutil.ReadAll(r.Body)
+		bodySize, err = r.Body.Seek(0, io.SeekEnd)
+		if err == nil {
+			_, err = r.Body.Seek(0, io.SeekStart)
+		}
 		if err != nil {
 			co.log("failed to read CoAP body: %s", err)
 			return nil
 		}
+		body = r.Body
+	}
+	// tie the HTTP request to the lifetime of the CoAP exchange, so if the exchange is abandoned
+	// the HTTP request is cancelled.
+	ctx := r.Context
+	if ctx == nil {
+		ctx = context.Background()
+	}
+	if !knownIDHandles {
+		ctx = context.WithValue(ctx, ctxValUnknownIDHandle, true)
+	}
+	base := "https://" + requestHost(r.Options, ctx)
+	rawQuery := query.Encode()
+	if proxyURI, err := r.Options.GetString(message.ProxyURI); err == nil {
+		base, path, rawQuery, err = co.forwardProxyURL(proxyURI)
+		if err != nil {
+			co.log("failed to parse Proxy-Uri option: %s", err)
+			return nil
+		}
+		path = strings.TrimPrefix(path, "/")
+		ctx = context.WithValue(ctx, ctxValForwardProxy, true)
+	} else if scheme, hostport, ok := forwardProxyTarget(r.Options); ok {
+		base = scheme + "://" + hostport
+		ctx = context.WithValue(ctx, ctxValForwardProxy, true)
 	}
-	req, err := http.NewRequest(method, "https://localhost/"+path+"?"+query.Encode(), bytes.NewReader(body))
+	req, err := http.NewRequestWithContext(ctx, method, base+"/"+path+"?"+rawQuery, body)
 	if err != nil {
 		co.log("CoAPToHTTPRequest: failed to create HTTP request: %s", err)
+		return nil
 	}
+	req.ContentLength = bodySize
 
-	format, err := r.Options.ContentFormat()
-	if err == nil {
-		contentType := contentFormatToContentType[format]
-		if contentType != "" {
-			req.Header.Set("Content-Type", contentType)
-		}
+	if contentType := contentTypeFromOptions(r.Options); contentType != "" {
+		req.Header.Set("Content-Type", contentType)
 	}
 
 	accessToken, _ := r.Options.GetString(OptionIDAccessToken)
@@ -222,20 +409,49 @@ func (co *CoAPHTTP) CoAPToHTTPRequest(r *message.Message) *http.Request {
 	return req
 }
 
+// requestHost returns the host a CoAP request is for: the Uri-Host option, or the TLS server name of the
+// session, or localhost.
+func requestHost(opts message.Options, ctx context.Context) string {
+	host, err := opts.GetString(message.URIHost)
+	if err != nil {
+		// not every transport has a server name, e.g pion/dtls does not expose SNI
+		host, _ = ctx.Value(ctxValServerName).(string)
+	}
+	if host == "" {
+		host = "localhost"
+	}
+	return host
+}
+
+// CoAPToHTTPResponse converts a CoAP response received over UDP/DTLS into an HTTP response (lossy).
 func (co *CoAPHTTP) CoAPToHTTPResponse(r *pool.Message) *http.Response {
-	resCode, ok := responseCodes[r.Code()]
+	return co.coapToHTTPResponse(r.Code(), r.Options(), r.Body())
+}
+
+// CoAPTCPToHTTPResponse converts a CoAP response received over TCP/TLS or WebSockets into an HTTP
+// response (lossy).
+func (co *CoAPHTTP) CoAPTCPToHTTPResponse(r *tcppool.Message) *http.Response {
+	return co.coapToHTTPResponse(r.Code(), r.Options(), r.Body())
+}
+
+func (co *CoAPHTTP) coapToHTTPResponse(code codes.Code, opts message.Options, resBody io.ReadSeeker) *http.Response {
+	resCode, ok := responseCodes[code]
 	if !ok {
-		co.log("CoAPToHTTPResponse: bad code %v", r.Code())
+		co.log("CoAPToHTTPResponse: bad code %v", code)
 		return nil
 	}
-	// TODO: HTTP Response headers
+	// TODO: other HTTP Response headers
+	header := make(http.Header)
+	if contentType := contentTypeFromOptions(opts); contentType != "" {
+		header.Set("Content-Type", contentType)
+	}
 	var body io.ReadCloser
-	resBody := r.Body()
 	if resBody != nil {
 		body = ioutil.NopCloser(resBody)
 	}
 	res := &http.Response{
 		StatusCode: resCode,
+		Header:     header,
 		Body:       body,
 	}
 	return res
@@ -247,37 +463,134 @@ func (co *CoAPHTTP) CoAPToHTTPResponse(r *pool.Message) *http.Response {
 // if it wasn't possible to convert the HTTP request to CoAP, or if doFn returns an error.
 func (co *CoAPHTTP) HTTPRequestToCoAP(req *http.Request, doFn func(*pool.Message) error) error {
 	msg := pool.AcquireMessage(context.Background())
+	nonConfirmable, release, err := co.httpRequestToMessage(req, msg.Message)
+	defer release()
+	if err != nil {
+		return err
+	}
+	if nonConfirmable {
+		msg.SetType(udpmessage.NonConfirmable)
+	} else {
+		msg.SetType(udpmessage.Confirmable)
+	}
+	return doFn(msg)
+}
+
+// HTTPRequestToCoAPTCP is HTTPRequestToCoAP for CoAP over TCP/TLS and WebSockets. These transports
+// are reliable so there are no message types: requests which would be sent Non-confirmable over UDP
+// still carry the No-Response option, and callers should not wait for a response to them.
+// https://datatracker.ietf.org/doc/html/rfc8323#section-3.2
+func (co *CoAPHTTP) HTTPRequestToCoAPTCP(req *http.Request, doFn func(*tcppool.Message) error) error {
+	msg := tcppool.AcquireMessage(context.Background())
+	_, release, err := co.httpRequestToMessage(req, msg.Message)
+	defer release()
+	if err != nil {
+		return err
+	}
+	return doFn(msg)
+}
+
+// httpRequestToMessage fills in msg from the HTTP request. Returns true if the request should be sent
+// Non-confirmable, and a function which MUST be called once the request has been sent, even on error.
+func (co *CoAPHTTP) httpRequestToMessage(req *http.Request, msg *basepool.Message) (nonConfirmable bool, release func(), err error) {
+	release = func() {}
 	code, ok := methodToCodes[req.Method]
 	if !ok {
-		return fmt.Errorf("Unknown method: %s", req.Method)
+		return false, release, fmt.Errorf("Unknown method: %s", req.Method)
+	}
+	coapPath := co.Paths.HTTPPathToCoapPath(req.URL.EscapedPath())
+	if co.IsNonConfirmable(req.Method, coapPath) {
+		nonConfirmable = true
+		// the sender won't wait for the response, so don't send one
+		// https://datatracker.ietf.org/doc/html/rfc7967#section-2.1
+		msg.SetOptionUint32(message.NoResponse, noResponseAll)
+	}
+	if co.NextToken != nil {
+		msg.SetToken(co.NextToken())
+	} else {
+		tokens := co.Tokens
+		if t, ok := req.Context().Value(ctxValTokenAllocator).(*TokenAllocator); ok {
+			tokens = t
+		}
+		token, err := tokens.Acquire()
+		if err != nil {
+			return false, release, fmt.Errorf("Failed to acquire token: %s", err)
+		}
+		release = func() {
+			tokens.Release(token)
+		}
+		msg.SetToken(token)
 	}
-	msg.SetType(udpmessage.Confirmable)
-	msg.SetToken(co.NextToken())
 	msg.SetCode(code)
-	msg.SetPath(co.Paths.HTTPPathToCoapPath(req.URL.Path))
+	if (co.SendURIHost || co.SendProxyScheme) && req.URL.Hostname() != "" {
+		msg.SetOptionString(message.URIHost, req.URL.Hostname())
+	}
+	if co.SendProxyScheme {
+		msg.SetOptionString(message.ProxyScheme, req.URL.Scheme)
+		if port, err := strconv.ParseUint(req.URL.Port(), 10, 16); err == nil {
+			msg.SetOptionUint32(message.URIPort, uint32(port))
+		}
+	}
+	setURIPath(msg, coapPath)
 	queries := req.URL.Query()
 	for k, vs := range queries {
 		for _, v := range vs {
-			msg.AddQuery(k + "=" + v)
+			msg.AddQuery(co.Queries.Encode(k, v))
 		}
 	}
-	if req.Body != nil {
+	if rs, ok := req.Body.(io.ReadSeeker); ok {
+		// e.g a file being uploaded: blockwise transfers read it one block at a time
+		msg.SetBody(rs)
+	} else if req.Body != nil {
 		body, err := ioutil.ReadAll(req.Body)
 		if err != nil {
-			return fmt.Errorf("Failed to read request body: %s", err)
+			return false, release, fmt.Errorf("Failed to read request body: %s", err)
 		} else {
 			msg.SetBody(bytes.NewReader(body))
 		}
 	}
-	cType := req.Header.Get("Content-Type")
-	contentFormat, ok := contentTypeToContentFormat[cType]
-	if !ok {
-		contentFormat = message.AppOctets
-	}
+	contentFormat, optContentType := contentTypeToFormat(req.Header.Get("Content-Type"))
 	msg.SetContentFormat(contentFormat)
+	if optContentType != "" {
+		msg.SetOptionString(OptionIDContentType, optContentType)
+	}
 	authHeader := req.Header.Get("Authorization")
 	if strings.HasPrefix(authHeader, "Bearer ") {
 		msg.SetOptionString(OptionIDAccessToken, strings.TrimPrefix(authHeader, "Bearer "))
 	}
-	return doFn(msg)
+	return nonConfirmable, release, nil
+}
+
+// setURIPath sets a Uri-Path option for each segment of the CoAP path. Options hold the segments
+// unescaped, so a segment can contain a '/'.
+func setURIPath(msg *basepool.Message, coapPath string) {
+	msg.Remove(message.URIPath)
+	coapPath = strings.TrimPrefix(coapPath, "/")
+	if coapPath == "" {
+		return
+	}
+	for _, seg := range strings.Split(coapPath, "/") {
+		if unescaped, err := url.PathUnescape(seg); err == nil {
+			seg = unescaped
+		}
+		msg.AddOptionString(message.URIPath, seg)
+	}
+}
+
+// uriPath returns the CoAP path in the Uri-Path options, with each segment percent-encoded.
+func uriPath(opts message.Options) (string, error) {
+	segments := make([]string, 8)
+	n, err := opts.GetStrings(message.URIPath, segments)
+	if err == message.ErrTooSmall {
+		segments = make([]string, n)
+		n, err = opts.GetStrings(message.URIPath, segments)
+	}
+	if err != nil {
+		return "/", err
+	}
+	segments = segments[:n]
+	for i := range segments {
+		segments[i] = url.PathEscape(segments[i])
+	}
+	return "/" + strings.Join(segments, "/"), nil
 }
@@ -0,0 +1,321 @@
+// Copyright 2021 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package lb
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"net"
+	"net/http"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/matrix-org/go-coap/v2/message"
+	"github.com/matrix-org/go-coap/v2/message/codes"
+	coapmux "github.com/matrix-org/go-coap/v2/mux"
+	coapnet "github.com/matrix-org/go-coap/v2/net"
+	"github.com/matrix-org/go-coap/v2/udp"
+	udpmessage "github.com/matrix-org/go-coap/v2/udp/message"
+	"github.com/matrix-org/go-coap/v2/udp/message/pool"
+)
+
+func TestHTTPRequestToCoAPNonConfirmable(t *testing.T) {
+	co := NewCoAPHTTP(NewCoAPPathV1())
+	co.NonConfirmable = NonConfirmableV1()
+	cases := []struct {
+		method  string
+		path    string
+		wantNON bool
+	}{
+		{
+			method:  "PUT",
+			path:    "/_matrix/client/r0/rooms/!foo:bar/typing/@alice:bar",
+			wantNON: true,
+		},
+		{
+			method:  "POST",
+			path:    "/_matrix/client/r0/rooms/!foo:bar/receipt/m.read/$event",
+			wantNON: true,
+		},
+		// other spec versions have the same policy
+		{
+			method:  "PUT",
+			path:    "/_matrix/client/v3/rooms/!foo:bar/typing/@alice:bar",
+			wantNON: true,
+		},
+		{
+			method:  "POST",
+			path:    "/_matrix/client/v3/rooms/!foo:bar/receipt/m.read/$event",
+			wantNON: true,
+		},
+		// reading presence needs a response
+		{
+			method:  "GET",
+			path:    "/_matrix/client/r0/presence/@alice:bar/status",
+			wantNON: false,
+		},
+		{
+			method:  "PUT",
+			path:    "/_matrix/client/r0/rooms/!foo:bar/send/m.room.message/txn1",
+			wantNON: false,
+		},
+	}
+	for _, tc := range cases {
+		req, err := http.NewRequest(tc.method, "https://localhost"+tc.path, nil)
+		if err != nil {
+			t.Fatalf("NewRequest: %s", err)
+		}
+		err = co.HTTPRequestToCoAP(req, func(msg *pool.Message) error {
+			isNON := msg.Type() == udpmessage.NonConfirmable
+			if isNON != tc.wantNON {
+				t.Errorf("%s %s: got NON=%v want %v", tc.method, tc.path, isNON, tc.wantNON)
+			}
+			if hasNoResponse := msg.HasOption(message.NoResponse); hasNoResponse != tc.wantNON {
+				t.Errorf("%s %s: No-Response option set=%v want %v", tc.method, tc.path, hasNoResponse, tc.wantNON)
+			}
+			return nil
+		})
+		if err != nil {
+			t.Fatalf("HTTPRequestToCoAP: %s", err)
+		}
+	}
+}
+
+// testMuxClient is the connection of a request passed straight to CoAPHTTPHandler. It is a UDP
+// connection, as it isn't a *tcp.ClientConn.
+type testMuxClient struct {
+	coapmux.Client
+	sessionClient
+}
+
+func (c *testMuxClient) Context() context.Context {
+	return c.sessionClient.Context()
+}
+
+func (c *testMuxClient) SetContextValue(key interface{}, val interface{}) {
+	c.sessionClient.SetContextValue(key, val)
+}
+
+func (c *testMuxClient) RemoteAddr() net.Addr {
+	return &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1), Port: 5683}
+}
+
+func (c *testMuxClient) ClientConn() interface{} {
+	return nil
+}
+
+// recordingResponseWriter records the response set by a handler, if any.
+type recordingResponseWriter struct {
+	client    *testMuxClient
+	responded bool
+	code      codes.Code
+}
+
+func (w *recordingResponseWriter) SetResponse(code codes.Code, contentFormat message.MediaType, d io.ReadSeeker, opts ...message.Option) error {
+	w.responded = true
+	w.code = code
+	return nil
+}
+
+func (w *recordingResponseWriter) Client() coapmux.Client {
+	return w.client
+}
+
+func TestNoResponse(t *testing.T) {
+	status := 200
+	calls := 0
+	server := NewCoAPHTTP(NewCoAPPathV1())
+	server.NonConfirmable = NonConfirmableV1()
+	handler := server.CoAPHTTPHandler(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		calls++
+		w.WriteHeader(status)
+	}), nil)
+	typing := server.Paths.HTTPPathToCoapPath("/_matrix/client/r0/rooms/!foo:bar/typing/@alice:bar")
+	cases := []struct {
+		name          string
+		confirmable   bool
+		noResponse    *uint32
+		status        int
+		wantResponded bool
+		wantCode      codes.Code
+	}{
+		{name: "NON typing notification", noResponse: newUint32(noResponseAll), status: 200},
+		{name: "2.xx suppressed", confirmable: true, noResponse: newUint32(2), status: 200},
+		{name: "5.xx not suppressed", confirmable: true, noResponse: newUint32(2), status: 500, wantResponded: true, wantCode: codes.InternalServerError},
+		{name: "4.xx suppressed", confirmable: true, noResponse: newUint32(8 | 16), status: 403},
+		{name: "0 suppresses nothing", confirmable: true, noResponse: newUint32(0), status: 200, wantResponded: true, wantCode: codes.Content},
+		{name: "no option", confirmable: true, status: 200, wantResponded: true, wantCode: codes.Content},
+	}
+	for _, tc := range cases {
+		status = tc.status
+		calls = 0
+		buf := make([]byte, 256)
+		opts, n, err := message.Options{}.SetPath(buf, typing)
+		if err != nil {
+			t.Fatalf("SetPath: %s", err)
+		}
+		if tc.noResponse != nil {
+			opts, _, err = opts.SetUint32(buf[n:], message.NoResponse, *tc.noResponse)
+			if err != nil {
+				t.Fatalf("SetUint32: %s", err)
+			}
+		}
+		w := &recordingResponseWriter{
+			client: &testMuxClient{sessionClient: sessionClient{ctx: context.Background()}},
+		}
+		handler.ServeCOAP(w, &coapmux.Message{
+			Message: &message.Message{
+				Context: context.Background(),
+				Code:    codes.PUT,
+				Token:   message.Token{1, 2},
+				Options: opts,
+				Body:    bytes.NewReader([]byte{0xa0}),
+			},
+			IsConfirmable: tc.confirmable,
+		})
+		if calls != 1 {
+			t.Errorf("%s: HTTP handler called %d times want 1", tc.name, calls)
+		}
+		if w.responded != tc.wantResponded || w.code != tc.wantCode {
+			t.Errorf("%s: got responded=%v code %v want responded=%v code %v", tc.name, w.responded, w.code, tc.wantResponded, tc.wantCode)
+		}
+	}
+}
+
+func newUint32(v uint32) *uint32 {
+	return &v
+}
+
+func TestURIHost(t *testing.T) {
+	co := NewCoAPHTTP(NewCoAPPathV1())
+	// converts the HTTP request to CoAP and back again, with this connection context
+	roundTrip := func(rawURL string, ctx context.Context) *http.Request {
+		req, err := http.NewRequest("GET", rawURL, nil)
+		if err != nil {
+			t.Fatalf("NewRequest: %s", err)
+		}
+		var got *http.Request
+		err = co.HTTPRequestToCoAP(req, func(msg *pool.Message) error {
+			r, err := pool.ConvertTo(msg)
+			if err != nil {
+				return err
+			}
+			r.Context = ctx
+			got = co.CoAPToHTTPRequest(r)
+			return nil
+		})
+		if err != nil {
+			t.Fatalf("HTTPRequestToCoAP: %s", err)
+		}
+		return got
+	}
+	sni := &sessionClient{ctx: context.Background()}
+	SetServerName(sni, "sni.example.com")
+
+	if req := roundTrip("https://hs1.example.com:8008/_matrix/client/versions", context.Background()); req.Host != "localhost" {
+		t.Errorf("without SendURIHost: got host %s want localhost", req.Host)
+	}
+	if req := roundTrip("https://hs1.example.com:8008/_matrix/client/versions", sni.ctx); req.Host != "sni.example.com" {
+		t.Errorf("without SendURIHost: got host %s want the server name", req.Host)
+	}
+	co.SendURIHost = true
+	req := roundTrip("https://hs1.example.com:8008/_matrix/client/versions", sni.ctx)
+	if req.Host != "hs1.example.com" {
+		t.Errorf("with SendURIHost: got host %s want hs1.example.com", req.Host)
+	}
+	if req.URL.Path != "/_matrix/client/versions" {
+		t.Errorf("with SendURIHost: got path %s want /_matrix/client/versions", req.URL.Path)
+	}
+}
+
+// TestRetransmittedRequest checks that a retransmitted Confirmable request is not sent to the HTTP handler
+// again, whether it arrives whilst the original is being processed or after it was answered, and that
+// every copy gets the same response. go-coap deduplicates requests by message ID.
+func TestRetransmittedRequest(t *testing.T) {
+	var calls int32
+	server := NewCoAPHTTP(NewCoAPPathV1())
+	router := coapmux.NewRouter()
+	router.DefaultHandle(server.CoAPHTTPHandler(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		n := atomic.AddInt32(&calls, 1)
+		// long enough for a retransmission to arrive
+		time.Sleep(200 * time.Millisecond)
+		w.WriteHeader(200)
+		w.Write([]byte{byte(n)})
+	}), nil))
+	l, err := coapnet.NewListenUDP("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("NewListenUDP: %s", err)
+	}
+	defer l.Close()
+	coapServer := udp.NewServer(udp.WithMux(router), udp.WithErrors(func(err error) {}))
+	defer coapServer.Stop()
+	go coapServer.Serve(l)
+
+	conn, err := net.Dial("udp", l.LocalAddr().String())
+	if err != nil {
+		t.Fatalf("Dial: %s", err)
+	}
+	defer conn.Close()
+	req := pool.AcquireMessage(context.Background())
+	defer pool.ReleaseMessage(req)
+	req.SetCode(codes.PUT)
+	req.SetType(udpmessage.Confirmable)
+	req.SetMessageID(1234)
+	req.SetToken([]byte{1, 2, 3, 4})
+	req.SetPath("/_matrix/client/r0/rooms/!foo:bar/send/m.room.message/txn1")
+	req.SetBody(bytes.NewReader([]byte{0xa0}))
+	datagram, err := req.Marshal()
+	if err != nil {
+		t.Fatalf("Marshal: %s", err)
+	}
+	readResponse := func() *pool.Message {
+		t.Helper()
+		buf := make([]byte, 1500)
+		conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+		n, err := conn.Read(buf)
+		if err != nil {
+			t.Fatalf("Read: %s", err)
+		}
+		res := pool.AcquireMessage(context.Background())
+		if _, err = res.Unmarshal(buf[:n]); err != nil {
+			t.Fatalf("Unmarshal: %s", err)
+		}
+		return res
+	}
+
+	// the original, a retransmission whilst it is processed, and one after it was answered
+	for _, send := range []time.Duration{0, 50 * time.Millisecond, 500 * time.Millisecond} {
+		time.Sleep(send)
+		if _, err = conn.Write(datagram); err != nil {
+			t.Fatalf("Write: %s", err)
+		}
+	}
+	for i := 0; i < 3; i++ {
+		res := readResponse()
+		if res.Type() != udpmessage.Acknowledgement || res.MessageID() != 1234 || res.Code() != codes.Content {
+			t.Errorf("response %d got %v want a piggybacked 2.05 ACK", i, res)
+		}
+		body, _ := res.ReadBody()
+		if !bytes.Equal(body, []byte{1}) {
+			t.Errorf("response %d got body %v want the response to the first request", i, body)
+		}
+		pool.ReleaseMessage(res)
+	}
+	if n := atomic.LoadInt32(&calls); n != 1 {
+		t.Errorf("the HTTP handler was called %d times want 1", n)
+	}
+}
@@ -0,0 +1,334 @@
+// Copyright 2021 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package lb
+
+import (
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"sort"
+	"strings"
+	"sync"
+
+	cbor "github.com/fxamacker/cbor/v2"
+	"github.com/matrix-org/go-coap/v2/message"
+	basepool "github.com/matrix-org/go-coap/v2/message/pool"
+	coapmux "github.com/matrix-org/go-coap/v2/mux"
+)
+
+const (
+	ctxValIDHandles       = "ctxValIDHandles"
+	ctxValUnknownIDHandle = "ctxValUnknownIDHandle"
+)
+
+// The CoAP Option ID of a handle the server has issued for a room, user or event ID in the response.
+// The value is the handle and the ID separated by a space e.g "1a !abcdefghijkl:example.org". For the
+// rest of the DTLS session, clients can send "~" and the handle e.g "~1a" in place of the ID in
+// {roomId}, {userId} and {eventId} path segments. The server responds with 4.12 Precondition Failed
+// to requests with a handle it doesn't know, and the client should forget its handles and retry with
+// the full IDs. This option is elective and safe to forward.
+var OptionIDIDHandle = message.OptionID(268)
+
+const (
+	// path segments which begin with this are handles. IDs always begin with a sigil.
+	idHandlePrefix = "~"
+	// the most handles a session has, after which the oldest are forgotten
+	maxIDHandles = 1024
+	// the most handles issued in one response, so the options don't cost more than they save
+	maxIDHandlesPerResponse = 32
+	// IDs shorter than this aren't worth a handle
+	minInternedIDLength = 12
+	// bodies larger than this are not searched for IDs
+	maxInternedBodySize = 1 << 20
+)
+
+// The alphabet of handles. Handles are the number of the handle in base 62.
+const idHandleAlphabet = "0123456789ABCDEFGHIJKLMNOPQRSTUVWXYZabcdefghijklmnopqrstuvwxyz"
+
+// internedVars are the path variables whose values can be handles.
+var internedVars = map[string]bool{
+	"roomId":        true,
+	"userId":        true,
+	"eventId":       true,
+	"roomIdOrAlias": true,
+}
+
+// idHandleTable maps handles to IDs for a single DTLS session. Handles are never reused within a
+// session, so a forgotten handle can never resolve to a different ID.
+type idHandleTable struct {
+	mu      sync.Mutex
+	next    uint64
+	ids     map[string]string // handle -> ID
+	handles map[string]string // ID -> handle
+	// handles, oldest first
+	order []string
+}
+
+func newIDHandleTable() *idHandleTable {
+	return &idHandleTable{
+		ids:     make(map[string]string),
+		handles: make(map[string]string),
+	}
+}
+
+// assign returns the handle for this ID, making a new one if required. Returns true if the handle is new.
+func (t *idHandleTable) assign(id string) (string, bool) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if handle, ok := t.handles[id]; ok {
+		return handle, false
+	}
+	t.next++
+	var b []byte
+	for n := t.next; n > 0; n /= uint64(len(idHandleAlphabet)) {
+		b = append([]byte{idHandleAlphabet[n%uint64(len(idHandleAlphabet))]}, b...)
+	}
+	handle := string(b)
+	t.ids[handle] = id
+	t.handles[id] = handle
+	t.order = append(t.order, handle)
+	if len(t.order) > maxIDHandles {
+		oldest := t.order[0]
+		t.order = t.order[1:]
+		delete(t.handles, t.ids[oldest])
+		delete(t.ids, oldest)
+	}
+	return handle, true
+}
+
+// resolve returns the ID for this handle. Returns false if the handle is unknown, or the table is nil.
+func (t *idHandleTable) resolve(handle string) (string, bool) {
+	if t == nil {
+		return "", false
+	}
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	id, ok := t.ids[handle]
+	return id, ok
+}
+
+// sessionIDHandles returns the ID handles for this client's DTLS session, creating them if needed.
+func (co *CoAPHTTP) sessionIDHandles(cc coapmux.Client) *idHandleTable {
+	co.aliasesMu.Lock()
+	defer co.aliasesMu.Unlock()
+	handles, ok := cc.Context().Value(ctxValIDHandles).(*idHandleTable)
+	if !ok {
+		handles = newIDHandleTable()
+		cc.SetContextValue(ctxValIDHandles, handles)
+	}
+	return handles
+}
+
+// resolveIDHandles replaces the handles in the CoAP path with their IDs. Returns false if a handle
+// is unknown.
+func (co *CoAPHTTP) resolveIDHandles(coapPath string, handles *idHandleTable) (string, bool) {
+	known := true
+	coapPath = co.Paths.rewriteVars(coapPath, func(name, val string) string {
+		if !internedVars[name] || !strings.HasPrefix(val, idHandlePrefix) {
+			return val
+		}
+		id, ok := handles.resolve(val[len(idHandlePrefix):])
+		if !ok {
+			known = false
+			return val
+		}
+		return url.PathEscape(id)
+	})
+	return coapPath, known
+}
+
+// hasUnknownIDHandle returns true if the HTTP request made by CoAPToHTTPRequest had a handle in its path
+// which the session doesn't know.
+func hasUnknownIDHandle(req *http.Request) bool {
+	unknown, _ := req.Context().Value(ctxValUnknownIDHandle).(bool)
+	return unknown
+}
+
+// isInternableID returns true if s looks like a room, user or event ID which is long enough to intern.
+func isInternableID(s string) bool {
+	if len(s) < minInternedIDLength || strings.ContainsAny(s, " /") {
+		return false
+	}
+	switch s[0] {
+	case '!', '@':
+		return strings.Contains(s, ":")
+	case '$':
+		return true
+	}
+	return false
+}
+
+// findIDs adds the room, user and event IDs in the decoded JSON or CBOR value to ids, as keys or values.
+func findIDs(v interface{}, ids map[string]bool) {
+	switch val := v.(type) {
+	case string:
+		if isInternableID(val) {
+			ids[val] = true
+		}
+	case []interface{}:
+		for _, elem := range val {
+			findIDs(elem, ids)
+		}
+	case map[string]interface{}:
+		for k, elem := range val {
+			findIDs(k, ids)
+			findIDs(elem, ids)
+		}
+	case map[interface{}]interface{}:
+		for k, elem := range val {
+			findIDs(k, ids)
+			findIDs(elem, ids)
+		}
+	}
+}
+
+// issueIDHandles returns OptionIDIDHandle options for the IDs in the response body which don't have a
+// handle yet. Room IDs are preferred, then user IDs, then event IDs. The body is rewound.
+func issueIDHandles(handles *idHandleTable, contentFormat message.MediaType, body io.ReadSeeker) []message.Option {
+	if body == nil || (contentFormat != message.AppCBOR && contentFormat != message.AppJSON) {
+		return nil
+	}
+	size, err := body.Seek(0, io.SeekEnd)
+	if err != nil || size > maxInternedBodySize {
+		return nil
+	}
+	if _, err = body.Seek(0, io.SeekStart); err != nil {
+		return nil
+	}
+	data, err := ioutil.ReadAll(body)
+	_, _ = body.Seek(0, io.SeekStart)
+	if err != nil {
+		return nil
+	}
+	var v interface{}
+	if contentFormat == message.AppCBOR {
+		err = cbor.Unmarshal(data, &v)
+	} else {
+		err = json.Unmarshal(data, &v)
+	}
+	if err != nil {
+		return nil
+	}
+	found := make(map[string]bool)
+	findIDs(v, found)
+	ids := make([]string, 0, len(found))
+	for id := range found {
+		ids = append(ids, id)
+	}
+	sigilOrder := map[byte]int{'!': 0, '@': 1, '$': 2}
+	sort.Slice(ids, func(i, j int) bool {
+		if ids[i][0] != ids[j][0] {
+			return sigilOrder[ids[i][0]] < sigilOrder[ids[j][0]]
+		}
+		return ids[i] < ids[j]
+	})
+	var opts []message.Option
+	for _, id := range ids {
+		if len(opts) == maxIDHandlesPerResponse {
+			break
+		}
+		if handle, isNew := handles.assign(id); isNew {
+			opts = append(opts, message.Option{
+				ID:    OptionIDIDHandle,
+				Value: []byte(handle + " " + id),
+			})
+		}
+	}
+	return opts
+}
+
+// IDHandles are the handles a server has issued for room, user and event IDs on a single connection,
+// see OptionIDIDHandle. Clients should keep one per connection, and make a new one when they reconnect.
+type IDHandles struct {
+	mu      sync.Mutex
+	handles map[string]string // ID -> handle
+	// IDs, oldest first
+	order []string
+}
+
+// NewIDHandles returns an empty set of handles.
+func NewIDHandles() *IDHandles {
+	return &IDHandles{
+		handles: make(map[string]string),
+	}
+}
+
+// Learn remembers the handles issued in the OptionIDIDHandle options of a response.
+func (h *IDHandles) Learn(opts message.Options) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	for _, opt := range opts {
+		if opt.ID != OptionIDIDHandle {
+			continue
+		}
+		kv := strings.SplitN(string(opt.Value), " ", 2)
+		if len(kv) != 2 || kv[0] == "" || !isInternableID(kv[1]) {
+			continue
+		}
+		if _, ok := h.handles[kv[1]]; !ok {
+			h.order = append(h.order, kv[1])
+		}
+		h.handles[kv[1]] = kv[0]
+		if len(h.order) > maxIDHandles {
+			// the server has forgotten it too
+			delete(h.handles, h.order[0])
+			h.order = h.order[1:]
+		}
+	}
+}
+
+// Forget forgets every handle, e.g when the server responds with 4.12 Precondition Failed to a request
+// which used handles.
+func (h *IDHandles) Forget() {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.handles = make(map[string]string)
+	h.order = nil
+}
+
+func (h *IDHandles) get(id string) string {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	return h.handles[id]
+}
+
+// ApplyIDHandles replaces the IDs in the path of the CoAP request with the handles the server issued
+// for them. Returns true if any were replaced.
+func (co *CoAPHTTP) ApplyIDHandles(msg *basepool.Message, handles *IDHandles) bool {
+	coapPath, err := uriPath(msg.Options())
+	if err != nil {
+		return false
+	}
+	applied := false
+	coapPath = co.Paths.rewriteVars(coapPath, func(name, val string) string {
+		if !internedVars[name] {
+			return val
+		}
+		id, err := url.PathUnescape(val)
+		if err != nil {
+			return val
+		}
+		if handle := handles.get(id); handle != "" {
+			applied = true
+			return idHandlePrefix + handle
+		}
+		return val
+	})
+	if applied {
+		setURIPath(msg, coapPath)
+	}
+	return applied
+}
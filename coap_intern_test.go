@@ -0,0 +1,188 @@
+// Copyright 2021 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package lb
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"net/http"
+	"reflect"
+	"testing"
+
+	"github.com/matrix-org/go-coap/v2/message"
+	"github.com/matrix-org/go-coap/v2/udp/message/pool"
+)
+
+func TestIDHandleTable(t *testing.T) {
+	table := newIDHandleTable()
+	first, isNew := table.assign("!first:example.org")
+	if !isNew {
+		t.Fatalf("assign: first handle is not new")
+	}
+	if again, isNew := table.assign("!first:example.org"); isNew || again != first {
+		t.Errorf("assign: got %s (new=%v) for the same ID, want %s", again, isNew, first)
+	}
+	handles := map[string]bool{first: true}
+	for i := 0; i < maxIDHandles; i++ {
+		handle, _ := table.assign(fmt.Sprintf("!room%d:example.org", i))
+		if handles[handle] {
+			t.Fatalf("assign: handle %s was reused", handle)
+		}
+		handles[handle] = true
+	}
+	if _, ok := table.resolve(first); ok {
+		t.Errorf("resolve: oldest handle %s was not forgotten", first)
+	}
+	if _, isNew = table.assign("!first:example.org"); !isNew {
+		t.Errorf("assign: forgotten ID did not get a new handle")
+	}
+	var nilTable *idHandleTable
+	if _, ok := nilTable.resolve(first); ok {
+		t.Errorf("resolve: nil table resolved a handle")
+	}
+}
+
+func TestIssueIDHandles(t *testing.T) {
+	body := []byte(`{
+		"event_id": "$abcdefghijklmnop",
+		"sender": "@alice:example.org",
+		"rooms": {"!abcdefghij:example.org": {"short": "!a:b"}},
+		"not_an_id": "hello world, this is long"
+	}`)
+	table := newIDHandleTable()
+	r := bytes.NewReader(body)
+	opts := issueIDHandles(table, message.AppJSON, r)
+	var got []string
+	for _, opt := range opts {
+		if opt.ID != OptionIDIDHandle {
+			t.Errorf("got option %v want %v", opt.ID, OptionIDIDHandle)
+		}
+		got = append(got, string(opt.Value))
+	}
+	want := []string{
+		"1 !abcdefghij:example.org",
+		"2 @alice:example.org",
+		"3 $abcdefghijklmnop",
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("got handles %q want %q", got, want)
+	}
+	if r.Len() != len(body) {
+		t.Errorf("body was not rewound")
+	}
+	// handles are only issued once per session
+	if opts = issueIDHandles(table, message.AppJSON, bytes.NewReader(body)); len(opts) != 0 {
+		t.Errorf("got %d handles for IDs which already have handles", len(opts))
+	}
+	if opts = issueIDHandles(newIDHandleTable(), message.TextPlain, bytes.NewReader(body)); len(opts) != 0 {
+		t.Errorf("got %d handles for a text/plain body", len(opts))
+	}
+	cborBody, err := NewCBORCodecV1(false).JSONToCBOR(bytes.NewReader(body))
+	if err != nil {
+		t.Fatalf("JSONToCBOR: %s", err)
+	}
+	if opts = issueIDHandles(newIDHandleTable(), message.AppCBOR, bytes.NewReader(cborBody)); len(opts) != 3 {
+		t.Errorf("got %d handles for a CBOR body, want 3", len(opts))
+	}
+}
+
+func TestIDHandlesOverCoAP(t *testing.T) {
+	co := NewCoAPHTTP(NewCoAPPathV1())
+	co.InternIDs = true
+	server := newIDHandleTable()
+	clientHandles := NewIDHandles()
+	clientHandles.Learn(issueIDHandles(server, message.AppJSON, bytes.NewReader(
+		[]byte(`{"room_id":"!abcdefghij:example.org"}`),
+	)))
+
+	httpPath := "/_matrix/client/r0/rooms/%21abcdefghij:example.org/send/m.room.message/txn1"
+	for _, tc := range []struct {
+		name        string
+		handles     *IDHandles
+		server      *idHandleTable
+		wantOptions []string
+		wantUnknown bool
+	}{
+		{
+			name:        "no handles",
+			handles:     NewIDHandles(),
+			server:      server,
+			wantOptions: []string{"9", "!abcdefghij:example.org", "m.room.message", "txn1"},
+		},
+		{
+			name:        "known handle",
+			handles:     clientHandles,
+			server:      server,
+			wantOptions: []string{"9", "~1", "m.room.message", "txn1"},
+		},
+		{
+			name:        "unknown handle",
+			handles:     clientHandles,
+			server:      newIDHandleTable(),
+			wantOptions: []string{"9", "~1", "m.room.message", "txn1"},
+			wantUnknown: true,
+		},
+	} {
+		req, err := http.NewRequest("PUT", "https://localhost"+httpPath, nil)
+		if err != nil {
+			t.Fatalf("NewRequest: %s", err)
+		}
+		var got *http.Request
+		err = co.HTTPRequestToCoAP(req, func(msg *pool.Message) error {
+			co.ApplyIDHandles(msg.Message, tc.handles)
+			options := make([]string, 16)
+			n, err := msg.Options().GetStrings(message.URIPath, options)
+			if err != nil {
+				return err
+			}
+			if !reflect.DeepEqual(options[:n], tc.wantOptions) {
+				t.Errorf("%s: got Uri-Path %q want %q", tc.name, options[:n], tc.wantOptions)
+			}
+			r, err := pool.ConvertTo(msg)
+			if err != nil {
+				return err
+			}
+			r.Context = context.WithValue(context.Background(), ctxValIDHandles, tc.server)
+			got = co.CoAPToHTTPRequest(r)
+			return nil
+		})
+		if err != nil {
+			t.Fatalf("%s: HTTPRequestToCoAP: %s", tc.name, err)
+		}
+		if unknown := hasUnknownIDHandle(got); unknown != tc.wantUnknown {
+			t.Errorf("%s: got unknown handle %v want %v", tc.name, unknown, tc.wantUnknown)
+		}
+		if !tc.wantUnknown && got.URL.EscapedPath() != httpPath {
+			t.Errorf("%s: got path %s want %s", tc.name, got.URL.EscapedPath(), httpPath)
+		}
+	}
+
+	// forgotten handles are not sent
+	clientHandles.Forget()
+	req, err := http.NewRequest("PUT", "https://localhost"+httpPath, nil)
+	if err != nil {
+		t.Fatalf("NewRequest: %s", err)
+	}
+	err = co.HTTPRequestToCoAP(req, func(msg *pool.Message) error {
+		if co.ApplyIDHandles(msg.Message, clientHandles) {
+			t.Errorf("ApplyIDHandles: applied handles after Forget")
+		}
+		return nil
+	})
+	if err != nil {
+		t.Fatalf("HTTPRequestToCoAP: %s", err)
+	}
+}
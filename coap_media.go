@@ -0,0 +1,154 @@
+// Copyright 2021 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package lb
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"io/ioutil"
+	"mime"
+	"os"
+	"sync"
+	"time"
+)
+
+// SpoolMemoryLimit is how much of a response body is held in memory before the rest is written to a
+// temporary file. Responses are sent using blockwise transfers which read one block at a time, so
+// large media downloads are never held in memory.
+const SpoolMemoryLimit = 1 << 20 // 1MiB
+
+// SpoolIdleTimeout is how long the temporary file of a response body is kept after its last read, in
+// case the client asks for more blocks. It matches the blockwise transfer timeout of cmd/proxy.
+const SpoolIdleTimeout = 2 * time.Minute
+
+// spool buffers a response body in memory, moving it to a temporary file if it gets too large.
+type spool struct {
+	buf  bytes.Buffer
+	file *os.File
+}
+
+func (s *spool) Write(b []byte) (int, error) {
+	if s.file == nil && s.buf.Len()+len(b) > SpoolMemoryLimit {
+		f, err := ioutil.TempFile("", "lb-spool-")
+		if err != nil {
+			return 0, err
+		}
+		// the file is deleted once it is closed, see spoolFile
+		_ = os.Remove(f.Name())
+		if _, err = f.Write(s.buf.Bytes()); err != nil {
+			f.Close()
+			return 0, err
+		}
+		s.buf = bytes.Buffer{}
+		s.file = f
+	}
+	if s.file != nil {
+		return s.file.Write(b)
+	}
+	return s.buf.Write(b)
+}
+
+// reader returns the body written so far, or <nil> if nothing was written. If the body is in a file,
+// the file is closed after SpoolIdleTimeout without a read.
+func (s *spool) reader() (io.ReadSeeker, error) {
+	if s.file != nil {
+		size, err := s.file.Seek(0, io.SeekEnd)
+		if err != nil {
+			s.file.Close()
+			return nil, err
+		}
+		f := &spoolFile{
+			file: s.file,
+			size: size,
+		}
+		f.timer = time.AfterFunc(SpoolIdleTimeout, f.close)
+		return f, nil
+	}
+	if s.buf.Len() == 0 {
+		return nil, nil
+	}
+	return bytes.NewReader(s.buf.Bytes()), nil
+}
+
+var errSpoolClosed = errors.New("spool: body is no longer available")
+
+// spoolFile reads the temporary file of a spooled body. The file is closed when nothing has been read
+// for SpoolIdleTimeout, so that it is kept after the last block is sent in case the response is lost
+// and the client asks for that block again. It can still seek once closed, as go-coap seeks to find
+// the size of the body.
+type spoolFile struct {
+	mu     sync.Mutex
+	file   *os.File // nil once closed
+	size   int64
+	offset int64
+	timer  *time.Timer
+}
+
+func (f *spoolFile) Read(b []byte) (int, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if f.offset >= f.size {
+		return 0, io.EOF
+	}
+	if f.file == nil {
+		return 0, errSpoolClosed
+	}
+	n, err := f.file.ReadAt(b, f.offset)
+	f.offset += int64(n)
+	f.timer.Reset(SpoolIdleTimeout)
+	if err == io.EOF && n > 0 {
+		err = nil
+	}
+	return n, err
+}
+
+func (f *spoolFile) Seek(offset int64, whence int) (int64, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	switch whence {
+	case io.SeekCurrent:
+		offset += f.offset
+	case io.SeekEnd:
+		offset += f.size
+	}
+	if offset < 0 {
+		return 0, errors.New("spool: negative position")
+	}
+	f.offset = offset
+	return offset, nil
+}
+
+func (f *spoolFile) close() {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.closeLocked()
+}
+
+func (f *spoolFile) closeLocked() {
+	if f.file == nil {
+		return
+	}
+	f.timer.Stop()
+	f.file.Close()
+	f.file = nil
+}
+
+// IsJSONContentType returns true if this Content-Type header is for JSON, which is sent as CBOR.
+// Everything else is binary data such as media, which must be sent untouched.
+func IsJSONContentType(contentType string) bool {
+	mediaType, _, err := mime.ParseMediaType(contentType)
+	return err == nil && mediaType == "application/json"
+}
@@ -0,0 +1,254 @@
+// Copyright 2021 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package lb
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"crypto/tls"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"testing"
+	"time"
+
+	coapmux "github.com/matrix-org/go-coap/v2/mux"
+	coapnet "github.com/matrix-org/go-coap/v2/net"
+	"github.com/matrix-org/go-coap/v2/net/blockwise"
+	"github.com/matrix-org/go-coap/v2/tcp"
+	tcppool "github.com/matrix-org/go-coap/v2/tcp/message/pool"
+	"github.com/matrix-org/go-coap/v2/udp"
+	"github.com/matrix-org/go-coap/v2/udp/message/pool"
+)
+
+func TestSpool(t *testing.T) {
+	var s spool
+	if r, err := s.reader(); err != nil || r != nil {
+		t.Fatalf("empty spool: got %v %v want nil", r, err)
+	}
+	want := make([]byte, SpoolMemoryLimit+100)
+	if _, err := rand.Read(want); err != nil {
+		t.Fatalf("rand: %s", err)
+	}
+	// write in chunks like an HTTP handler would
+	for i := 0; i < len(want); i += 4096 {
+		end := i + 4096
+		if end > len(want) {
+			end = len(want)
+		}
+		if _, err := s.Write(want[i:end]); err != nil {
+			t.Fatalf("Write: %s", err)
+		}
+	}
+	if s.file == nil {
+		t.Fatalf("spool did not move to a file after %d bytes", len(want))
+	}
+	r, err := s.reader()
+	if err != nil {
+		t.Fatalf("reader: %s", err)
+	}
+	got, err := ioutil.ReadAll(r)
+	if err != nil {
+		t.Fatalf("ReadAll: %s", err)
+	}
+	if !bytes.Equal(got, want) {
+		t.Errorf("spooled body differs from written body")
+	}
+	// reading the last block doesn't close the file either, in case the client asks for it again
+	// because the response was lost
+	for i := 0; i < 2; i++ {
+		if _, err = r.Seek(int64(len(want)-100), io.SeekStart); err != nil {
+			t.Fatalf("Seek: %s", err)
+		}
+		if n, err := io.ReadFull(r, make([]byte, 1024)); n != 100 || err != io.ErrUnexpectedEOF {
+			t.Errorf("reading the last block got %d, %v want 100 bytes", n, err)
+		}
+	}
+	if _, err = s.file.Stat(); err != nil {
+		t.Errorf("the file was closed after the last block was read")
+	}
+	// the size is known
+	if size, err := r.Seek(0, io.SeekEnd); err != nil || size != int64(len(want)) {
+		t.Errorf("Seek got %d, %v want %d", size, err, len(want))
+	}
+
+	// it is closed once nothing reads it, e.g because the client has all the blocks or gave up
+	s = spool{}
+	if _, err = s.Write(want); err != nil {
+		t.Fatalf("Write: %s", err)
+	}
+	r, err = s.reader()
+	if err != nil {
+		t.Fatalf("reader: %s", err)
+	}
+	if _, err = r.Read(make([]byte, 1024)); err != nil {
+		t.Fatalf("Read: %s", err)
+	}
+	r.(*spoolFile).timer.Reset(time.Millisecond)
+	time.Sleep(50 * time.Millisecond)
+	if _, err = r.Read(make([]byte, 1024)); err != errSpoolClosed {
+		t.Errorf("Read after the idle timeout got %v want %v", err, errSpoolClosed)
+	}
+	if _, err = s.file.Stat(); err == nil {
+		t.Errorf("the file was not closed after the idle timeout")
+	}
+}
+
+func TestIsJSONContentType(t *testing.T) {
+	cases := map[string]bool{
+		"application/json":                true,
+		"application/json; charset=utf-8": true,
+		"Application/JSON":                true,
+		"application/cbor":                false,
+		"image/png":                       false,
+		"":                                false,
+	}
+	for contentType, want := range cases {
+		if got := IsJSONContentType(contentType); got != want {
+			t.Errorf("IsJSONContentType(%q) got %v want %v", contentType, got, want)
+		}
+	}
+}
+
+// mediaEchoHandler echoes binary bodies back, checking they are the length of media.
+func mediaEchoHandler(t *testing.T, media []byte) coapmux.Handler {
+	server := NewCoAPHTTP(NewCoAPPathV1())
+	router := coapmux.NewRouter()
+	router.DefaultHandle(server.CoAPHTTPHandler(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		if req.ContentLength != int64(len(media)) {
+			t.Errorf("got Content-Length %d want %d", req.ContentLength, len(media))
+		}
+		w.Header().Set("Content-Type", req.Header.Get("Content-Type"))
+		w.WriteHeader(200)
+		io.Copy(w, req.Body)
+	}), nil))
+	return router
+}
+
+// checkMediaResponse checks the response echoed the media back untouched.
+func checkMediaResponse(t *testing.T, res *http.Response, media []byte) {
+	t.Helper()
+	if res.StatusCode != 200 {
+		t.Fatalf("got status %d want 200", res.StatusCode)
+	}
+	if got := res.Header.Get("Content-Type"); got != "application/octet-stream" {
+		t.Errorf("got Content-Type %q want application/octet-stream", got)
+	}
+	got, err := ioutil.ReadAll(res.Body)
+	if err != nil {
+		t.Fatalf("ReadAll: %s", err)
+	}
+	if !bytes.Equal(got, media) {
+		t.Errorf("got %d bytes which differ from the %d bytes sent", len(got), len(media))
+	}
+}
+
+func newMediaUploadRequest(media []byte) *http.Request {
+	req, _ := http.NewRequest("POST", "https://example.com/_matrix/media/r0/upload", bytes.NewReader(media))
+	req.Header.Set("Content-Type", "application/octet-stream")
+	return req
+}
+
+// Test that binary bodies which need blockwise transfers in both directions, and which are large enough
+// to be spooled to a file, arrive untouched.
+func TestMediaPassthrough(t *testing.T) {
+	media := make([]byte, SpoolMemoryLimit+100*1024)
+	if _, err := rand.Read(media); err != nil {
+		t.Fatalf("rand: %s", err)
+	}
+	l, err := coapnet.NewListenUDP("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("NewListenUDP: %s", err)
+	}
+	defer l.Close()
+	ignoreErrors := udp.WithErrors(func(err error) {})
+	coapServer := udp.NewServer(udp.WithMux(mediaEchoHandler(t, media)), ignoreErrors)
+	defer coapServer.Stop()
+	go coapServer.Serve(l)
+	cc, err := udp.Dial(l.LocalAddr().String(), ignoreErrors)
+	if err != nil {
+		t.Fatalf("Dial: %s", err)
+	}
+	defer cc.Close()
+
+	client := NewCoAPHTTP(NewCoAPPathV1())
+	var res *http.Response
+	err = client.HTTPRequestToCoAP(newMediaUploadRequest(media), func(msg *pool.Message) error {
+		coapRes, err := cc.Do(msg)
+		if err != nil {
+			return err
+		}
+		res = client.CoAPToHTTPResponse(coapRes)
+		return nil
+	})
+	if err != nil {
+		t.Fatalf("HTTPRequestToCoAP: %s", err)
+	}
+	checkMediaResponse(t, res, media)
+}
+
+// Test that CoAP over TCP uses BERT blocks once both sides have sent SendBlockwiseCSM, so bodies
+// larger than a single message arrive untouched.
+func TestMediaPassthroughTCP(t *testing.T) {
+	media := make([]byte, SpoolMemoryLimit+100*1024)
+	if _, err := rand.Read(media); err != nil {
+		t.Fatalf("rand: %s", err)
+	}
+	l, err := coapnet.NewTCPListener("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("NewTCPListener: %s", err)
+	}
+	defer l.Close()
+	ignoreErrors := tcp.WithErrors(func(err error) {})
+	bert := tcp.WithBlockwise(true, blockwise.SZXBERT, time.Minute)
+	maxSize := tcp.WithMaxMessageSize(TCPMaxMessageSize)
+	coapServer := tcp.NewServer(tcp.WithMux(mediaEchoHandler(t, media)), ignoreErrors, bert, maxSize,
+		tcp.WithOnNewClientConn(func(cc *tcp.ClientConn, tlsConn *tls.Conn) {
+			if err := SendBlockwiseCSM(cc); err != nil {
+				t.Errorf("server SendBlockwiseCSM: %s", err)
+			}
+		}),
+	)
+	defer coapServer.Stop()
+	go coapServer.Serve(l)
+	cc, err := tcp.Dial(l.Addr().String(), ignoreErrors, bert, maxSize)
+	if err != nil {
+		t.Fatalf("Dial: %s", err)
+	}
+	defer cc.Close()
+	if err = SendBlockwiseCSM(cc); err != nil {
+		t.Fatalf("SendBlockwiseCSM: %s", err)
+	}
+	// the pong arrives after the server's CSM
+	if err = cc.Ping(context.Background()); err != nil {
+		t.Fatalf("Ping: %s", err)
+	}
+
+	client := NewCoAPHTTP(NewCoAPPathV1())
+	var res *http.Response
+	err = client.HTTPRequestToCoAPTCP(newMediaUploadRequest(media), func(msg *tcppool.Message) error {
+		coapRes, err := cc.Do(msg)
+		if err != nil {
+			return err
+		}
+		res = client.CoAPTCPToHTTPResponse(coapRes)
+		return nil
+	})
+	if err != nil {
+		t.Fatalf("HTTPRequestToCoAPTCP: %s", err)
+	}
+	checkMediaResponse(t, res, media)
+}
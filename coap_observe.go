@@ -16,9 +16,13 @@ package lb
 
 import (
 	"bytes"
+	"context"
 	"fmt"
+	"io"
 	"io/ioutil"
 	"net/http"
+	"net/url"
+	"strings"
 	"sync"
 	"time"
 
@@ -46,10 +50,26 @@ type Observations struct {
 	hasUpdatedFn  HasUpdatedFn
 	next          http.Handler
 	mu            *sync.Mutex
-	obs           map[string]*coapmux.Client // registration ID -> Client
-	accessTokens  map[string]int             // access_token -> num observations
+	obs           map[string]*coapmux.Client    // registration ID -> Client
+	cancels       map[string]context.CancelFunc // registration ID -> cancels in-flight long-polls
+	accessTokens  map[string]int                // access_token -> num observations
 	lastMu        *sync.Mutex
-	lastResponses map[string][]byte // remote addr + path -> last data
+	lastResponses map[string][]byte           // session ID + path -> last data
+	notifiers     map[string]*sessionNotifier // session ID -> notifications sent on the session
+	polls         *sync.WaitGroup             // in-flight long-polls
+	endCode       codes.Code                  // if set, the code of the notification which ends every observation
+
+	// HTTP path templates which are advertised as observable in /.well-known/core, e.g
+	// /_matrix/client/r0/sync
+	ObservablePaths []string
+
+	// Where registrations are persisted, so observations resume when clients register again after
+	// reconnecting. Use a FileObservationStore to resume them after the proxy restarts too. If nil,
+	// registrations are not persisted. Default: NewMemoryObservationStore()
+	Store ObservationStore
+	// How long after its last notification an observation can be resumed for.
+	// Default: DefaultObservationResumeWindow
+	ResumeWindow time.Duration
 }
 
 // NewObservations makes a new observations struct. `next` must be the normal HTTP handlers
@@ -64,10 +84,15 @@ func NewObservations(next http.Handler, codec *CBORCodec, hasUpdatedFn HasUpdate
 		updateFns:     fns,
 		hasUpdatedFn:  hasUpdatedFn,
 		obs:           make(map[string]*coapmux.Client),
+		cancels:       make(map[string]context.CancelFunc),
 		lastResponses: make(map[string][]byte),
 		accessTokens:  make(map[string]int),
+		notifiers:     make(map[string]*sessionNotifier),
+		polls:         &sync.WaitGroup{},
 		lastMu:        &sync.Mutex{},
 		Codec:         codec,
+		Store:         NewMemoryObservationStore(),
+		ResumeWindow:  DefaultObservationResumeWindow,
 	}
 }
 
@@ -78,21 +103,32 @@ func (o *Observations) log(format string, v ...interface{}) {
 	o.Log.Printf(format, v...)
 }
 
-// longPoll will begin long-polling on the client's behalf
-func (o *Observations) longPoll(regID, path string, token []byte, req *http.Request) {
+// longPoll will begin long-polling on the client's behalf. `rec` is the persisted registration, which
+// is updated whenever the client ACKs a notification, or nil if the registration is not persisted.
+func (o *Observations) longPoll(regID, path string, token []byte, req *http.Request, rec *ObservationRecord) {
 	accessToken := req.Header.Get("Authorization")
 	defer func() {
 		o.removeRegistration(regID, accessToken)
+		o.polls.Done()
 	}()
 	var lastRespBody []byte
 	var err error
 	seqNum := uint32(2)
+	if rec != nil {
+		seqNum = rec.Seq + 1
+	}
+	acked := false
 	for {
 		client := o.getRegistration(regID)
 		if client == nil {
 			o.log("LongPoll[%s]: no client for registration - stopping long poll", regID)
 			return
 		}
+		if req.Context().Err() != nil && o.ending() == 0 {
+			// e.g the client reset the last notification, so it mustn't count as ACKed
+			o.log("LongPoll[%s]: observation cancelled - stopping long poll: %s", regID, req.Context().Err())
+			return
+		}
 		// modify the request according to observe functions
 		// they expect to work with JSON but we send CBOR back, so let's convert the body now
 		if lastRespBody != nil && lastRespBody[0] != '{' {
@@ -104,12 +140,37 @@ func (o *Observations) longPoll(regID, path string, token []byte, req *http.Requ
 		for _, fn := range o.updateFns {
 			req = fn(path, lastRespBody, req)
 		}
+		if req.GetBody != nil {
+			// every long-poll sends the body of the OBSERVE request e.g sliding sync lists
+			if req.Body, err = req.GetBody(); err != nil {
+				o.log("LongPoll[%s]: failed to reset request body - stopping long poll: %s", regID, err)
+				return
+			}
+		}
+		if acked && rec != nil {
+			// the query now has the position of the notification the client ACKed
+			rec.Query = req.URL.RawQuery
+			rec.Seq = seqNum - 1
+			o.saveRecord(rec)
+			acked = false
+		}
+		if req.Context().Err() != nil {
+			// EndAll was called, so the last notification the client ACKed is saved above
+			o.log("LongPoll[%s]: observations ending - stopping long poll: %s", regID, req.Context().Err())
+			o.sendEnd(*client, regID, path, seqNum, token)
+			return
+		}
 		// create a sink to hold the HTTP response
 		w := &httpResponseSink{
 			headers: make(http.Header),
 		}
 		// pass the request to the HTTP handler - this will block potentially
 		o.next.ServeHTTP(w, req)
+		if req.Context().Err() != nil {
+			o.log("LongPoll[%s]: request cancelled - stopping long poll: %s", regID, req.Context().Err())
+			o.sendEnd(*client, regID, path, seqNum, token)
+			return
+		}
 
 		// set the last response so we can update `since` tokens
 		respBody, err := ioutil.ReadAll(w.body)
@@ -124,7 +185,9 @@ func (o *Observations) longPoll(regID, path string, token []byte, req *http.Requ
 			if c, ok := statusCodes[w.statusCode]; ok {
 				respCode = c
 			}
-			o.sendResponse(*client, path, seqNum, token, respCode, nil, message.AppCBOR)
+			// the error ends the observation, so the client must register again
+			o.sendResponse(*client, regID, path, seqNum, token, respCode, respBody, message.AppCBOR)
+			o.deleteRecord(rec)
 			return
 		}
 
@@ -148,12 +211,15 @@ func (o *Observations) longPoll(regID, path string, token []byte, req *http.Requ
 
 		// send the response back to the caller. We trust the client will NOT call OBSERVE
 		// again when they get this data, thus saving bandwidth. This will block until the client ACKs the response
-		err = o.sendResponse(*client, path, seqNum, token, codes.Content, lastRespBody, message.AppCBOR)
+		err = o.sendResponse(*client, regID, path, seqNum, token, codes.Content, lastRespBody, message.AppCBOR)
 		seqNum++
-		if err != nil {
+		if err == nil {
+			acked = true
+		} else {
 			// we will only remove this entry if there are >1 observations for this access token
 			if o.safeToRemove(accessToken) {
 				o.log("LongPoll[%s]: Removing registration due to error: %s", regID, err)
+				o.deleteRecord(rec)
 				return // removes registration in defer
 			} else {
 				o.log("LongPoll[%s]: Encountered error but keeping registration as only 1 stream is alive: %s", regID, err)
@@ -180,21 +246,129 @@ func (o *Observations) HandleRegistration(req *http.Request, w coapmux.ResponseW
 	}
 	regID := registrationID(w.Client(), path, r.Token)
 	// Handle the OBSERVE request itself:
+	if code := o.ending(); register && code != 0 {
+		// e.g the proxy is shutting down, so the client must register again later
+		w.SetResponse(code, message.TextPlain, nil)
+		return
+	}
 	if register {
-		added := o.addRegistration(w.Client(), regID, req.Header.Get("Authorization"))
+		// The long-poll outlives the OBSERVE request, so it cannot use the request context. Instead, tie
+		// it to the connection and cancel it when the registration is removed.
+		ctx, cancel := context.WithCancel(w.Client().Context())
+		var body []byte
+		if req.ContentLength > 0 {
+			// the body belongs to the OBSERVE request, which is released when this returns, so copy it
+			// for the long-polls.
+			body, err = ioutil.ReadAll(req.Body)
+			if err != nil {
+				cancel()
+				o.log("Ignoring observe request, failed to read body: %s", err)
+				return
+			}
+			req.GetBody = func() (io.ReadCloser, error) {
+				return ioutil.NopCloser(bytes.NewReader(body)), nil
+			}
+			req.Body, _ = req.GetBody()
+		}
+		added := o.addRegistration(w.Client(), regID, req.Header.Get("Authorization"), cancel)
 		if added {
-			go o.longPoll(regID, path, r.Token, req)
+			rec := o.record(path, r.Token, body, req)
+			o.polls.Add(1)
+			go o.longPoll(regID, path, r.Token, req.WithContext(ctx), rec)
+		} else {
+			cancel()
 		}
 		// send ACK
 		w.SetResponse(codes.Content, message.TextPlain, nil)
 	} else {
 		// if this is a deregister request, remove the observation and send an ACK to the client
 		o.removeRegistration(regID, req.Header.Get("Authorization"))
+		if accessToken := req.Header.Get("Authorization"); accessToken != "" {
+			o.deleteRecord(&ObservationRecord{Client: ObservationClient(accessToken), Path: path})
+		}
 		// send ACK
 		w.SetResponse(codes.Deleted, message.TextPlain, nil)
 	}
 }
 
+// record returns the persisted registration of this OBSERVE request, or nil if it is not persisted. If
+// the client has a stored observation of this path, it is resumed: query parameters the client didn't
+// send are taken from the stored query e.g the since token of the last notification the client ACKed,
+// and sequence numbers carry on from the last notification.
+func (o *Observations) record(path string, token, body []byte, req *http.Request) *ObservationRecord {
+	accessToken := req.Header.Get("Authorization")
+	if o.Store == nil || accessToken == "" {
+		return nil
+	}
+	rec := &ObservationRecord{
+		Client:      ObservationClient(accessToken),
+		Token:       token,
+		Path:        path,
+		AccessToken: accessToken,
+		Body:        body,
+		Seq:         1,
+	}
+	stored, err := o.Store.Get(rec.Client, path)
+	if err != nil {
+		o.log("OBSERVE: failed to load stored observation of %s for client %s: %s", path, rec.Client, err)
+	}
+	if stored != nil && stored.AccessToken == accessToken && time.Since(stored.Updated) < o.ResumeWindow {
+		o.log("OBSERVE: resuming observation of %s for client %s after seq %d", path, rec.Client, stored.Seq)
+		rec.Seq = stored.Seq
+		storedQuery, _ := url.ParseQuery(stored.Query)
+		query := req.URL.Query()
+		for k, v := range storedQuery {
+			if _, ok := query[k]; !ok {
+				query[k] = v
+			}
+		}
+		req.URL.RawQuery = query.Encode()
+	}
+	rec.Query = req.URL.RawQuery
+	o.saveRecord(rec)
+	return rec
+}
+
+func (o *Observations) saveRecord(rec *ObservationRecord) {
+	rec.Updated = time.Now()
+	if err := o.Store.Put(rec); err != nil {
+		o.log("OBSERVE: failed to store observation of %s for client %s: %s", rec.Path, rec.Client, err)
+	}
+}
+
+func (o *Observations) deleteRecord(rec *ObservationRecord) {
+	if o.Store == nil || rec == nil {
+		return
+	}
+	if err := o.Store.Delete(rec.Client, rec.Path); err != nil {
+		o.log("OBSERVE: failed to delete stored observation of %s for client %s: %s", rec.Path, rec.Client, err)
+	}
+}
+
+// PruneStore deletes stored observations which are too old to resume, and returns the number of
+// observations which can still be resumed. Records are otherwise only deleted when their observation
+// ends, so call this when the proxy starts.
+func (o *Observations) PruneStore() (int, error) {
+	if o.Store == nil {
+		return 0, nil
+	}
+	recs, err := o.Store.All()
+	if err != nil {
+		return 0, err
+	}
+	resumable := 0
+	for _, rec := range recs {
+		if time.Since(rec.Updated) < o.ResumeWindow {
+			resumable++
+			continue
+		}
+		if err = o.Store.Delete(rec.Client, rec.Path); err != nil {
+			return resumable, err
+		}
+	}
+	return resumable, nil
+}
+
 // HandleBlockwise MAY send back an entire response, if it can be determined that the request is part of
 // a blockwise request.
 func (o *Observations) HandleBlockwise(w coapmux.ResponseWriter, r *coapmux.Message) {
@@ -202,7 +376,7 @@ func (o *Observations) HandleBlockwise(w coapmux.ResponseWriter, r *coapmux.Mess
 	if err != nil {
 		return // no path
 	}
-	id := w.Client().RemoteAddr().String() + "/" + path
+	id := SessionID(w.Client()) + "/" + path
 	o.lastMu.Lock()
 	data := o.lastResponses[id]
 	o.lastMu.Unlock()
@@ -211,7 +385,7 @@ func (o *Observations) HandleBlockwise(w coapmux.ResponseWriter, r *coapmux.Mess
 	}
 }
 
-func (o *Observations) sendResponse(cc coapmux.Client, path string, seqNum uint32, token []byte, respCode codes.Code, data []byte, contentFormat message.MediaType) error {
+func (o *Observations) sendResponse(cc coapmux.Client, regID, path string, seqNum uint32, token []byte, respCode codes.Code, data []byte, contentFormat message.MediaType) error {
 	m := message.Message{
 		Code:    respCode,
 		Token:   token,
@@ -242,7 +416,7 @@ func (o *Observations) sendResponse(cc coapmux.Client, path string, seqNum uint3
 	// remember the last response in case it's big enough to mandate a blockwise xfer
 	// in which case a separate GET request will come in for it which we will need to
 	// satisfy
-	id := cc.RemoteAddr().String() + "/" + path
+	id := SessionID(cc) + "/" + path
 	o.lastMu.Lock()
 	o.lastResponses[id] = data
 	o.lastMu.Unlock()
@@ -257,10 +431,88 @@ func (o *Observations) sendResponse(cc coapmux.Client, path string, seqNum uint3
 	//    The entries in lists of observers are effectively "garbage collected"
 	//    by the server.
 	// https://tools.ietf.org/html/rfc7641#section-3.6
+	// Notifications on a session are sent one at a time, so HandleReset knows which one a Reset is for.
+	o.mu.Lock()
+	notifier := o.notifiers[registrationSession(regID)]
+	o.mu.Unlock()
+	if notifier != nil {
+		notifier.mu.Lock()
+		defer notifier.mu.Unlock()
+		o.mu.Lock()
+		notifier.regID = regID
+		o.mu.Unlock()
+	}
 	return cc.WriteMessage(&m)
 }
 
-func (o *Observations) addRegistration(client coapmux.Client, regID, accessToken string) bool {
+// EndAll ends every observation with a notification with this code, e.g codes.ServiceUnavailable when
+// the proxy is shutting down, which tells clients to register again. Stored registrations are kept, so
+// the observations resume from the last notification each client ACKed when they do. Returns once the
+// notifications have been sent, or when ctx is done.
+func (o *Observations) EndAll(ctx context.Context, code codes.Code) {
+	o.mu.Lock()
+	o.endCode = code
+	for _, cancel := range o.cancels {
+		cancel()
+	}
+	o.mu.Unlock()
+	done := make(chan struct{})
+	go func() {
+		o.polls.Wait()
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-ctx.Done():
+		o.log("OBSERVE: gave up waiting for observations to end: %s", ctx.Err())
+	}
+}
+
+// ending returns the code passed to EndAll, or 0 if it hasn't been called.
+func (o *Observations) ending() codes.Code {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	return o.endCode
+}
+
+// sendEnd sends the notification which ends the observation, if EndAll was called.
+func (o *Observations) sendEnd(cc coapmux.Client, regID, path string, seqNum uint32, token []byte) {
+	code := o.ending()
+	if code == 0 {
+		return
+	}
+	if err := o.sendResponse(cc, regID, path, seqNum, token, code, nil, message.TextPlain); err != nil {
+		o.log("LongPoll[%s]: failed to end observation: %s", regID, err)
+	}
+}
+
+// HandleReset ends the observation whose notification the client rejected with a Reset message, e.g
+// because it restarted and forgot the token. Returns false if no notification has been sent on the
+// session of `cc`.
+//
+// A Reset only has the message ID of the notification, which go-coap assigns when it sends it, so the
+// Reset is taken to be for the last notification sent on the session. Notifications on a session are
+// sent one at a time, and each waits for the client's ACK or Reset, so this is the notification it
+// rejects. The in-flight long-poll is cancelled, and the observation can be resumed if the client
+// registers again.
+func (o *Observations) HandleReset(cc SessionClient) bool {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	n := o.notifiers[SessionID(cc)]
+	if n == nil || n.regID == "" {
+		return false
+	}
+	cancel := o.cancels[n.regID]
+	if cancel == nil {
+		return false
+	}
+	o.log("OBSERVE: client reset a notification of %s - cancelling", n.regID)
+	cancel()
+	n.regID = ""
+	return true
+}
+
+func (o *Observations) addRegistration(client coapmux.Client, regID, accessToken string, cancel context.CancelFunc) bool {
 	o.mu.Lock()
 	defer o.mu.Unlock()
 	// if we already have an observation running, ignore
@@ -268,7 +520,13 @@ func (o *Observations) addRegistration(client coapmux.Client, regID, accessToken
 		return false
 	}
 	o.obs[regID] = &client
+	o.cancels[regID] = cancel
 	o.accessTokens[accessToken] += 1
+	session := SessionID(client)
+	if o.notifiers[session] == nil {
+		o.notifiers[session] = &sessionNotifier{}
+	}
+	o.notifiers[session].regs++
 	o.log("OBSERVE[%d]: add registration %s (new count=%d)", len(o.obs), regID, o.accessTokens[accessToken])
 	return true
 }
@@ -276,8 +534,24 @@ func (o *Observations) addRegistration(client coapmux.Client, regID, accessToken
 func (o *Observations) removeRegistration(regID, accessToken string) {
 	o.mu.Lock()
 	defer o.mu.Unlock()
+	if _, ok := o.obs[regID]; !ok {
+		return
+	}
+	if cancel := o.cancels[regID]; cancel != nil {
+		cancel()
+	}
 	delete(o.obs, regID)
+	delete(o.cancels, regID)
 	o.accessTokens[accessToken] -= 1
+	session := registrationSession(regID)
+	if n := o.notifiers[session]; n != nil {
+		if n.regID == regID {
+			n.regID = ""
+		}
+		if n.regs--; n.regs == 0 {
+			delete(o.notifiers, session)
+		}
+	}
 	o.log("OBSERVE[%d]: remove registration %s (new count=%d)", len(o.obs), regID, o.accessTokens[accessToken])
 }
 
@@ -322,5 +596,17 @@ func (w *httpResponseSink) WriteHeader(statusCode int) {
 // replace or update the existing one
 // https://tools.ietf.org/html/rfc7641#section-4.1
 func registrationID(client coapmux.Client, path string, token message.Token) string {
-	return client.RemoteAddr().String() + "/" + path + "@" + token.String()
+	return SessionID(client) + "/" + path + "@" + token.String()
+}
+
+// registrationSession returns the session ID of a registration ID.
+func registrationSession(regID string) string {
+	return regID[:strings.Index(regID, "/")]
+}
+
+// sessionNotifier sends the notifications of the observations of one session.
+type sessionNotifier struct {
+	mu    sync.Mutex // held while a notification waits for the client's ACK or Reset
+	regID string     // the registration of the last notification sent, guarded by Observations.mu
+	regs  int        // the number of registrations on the session, guarded by Observations.mu
 }
@@ -0,0 +1,251 @@
+// Copyright 2021 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package lb
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+)
+
+// DefaultObservationResumeWindow is how long after its last notification an observation can be
+// resumed for.
+const DefaultObservationResumeWindow = 24 * time.Hour
+
+// ObservationRecord is an OBSERVE registration as persisted in an ObservationStore. Connections do not
+// survive the proxy restarting, so observations are resumed when the client registers again for the
+// same path: the long-poll continues from the position of the last notification the client ACKed, with
+// the next sequence number.
+type ObservationRecord struct {
+	// The identity of the client, see ObservationClient. Records are keyed by the client and path.
+	Client string `json:"client"`
+	// The CoAP token of the latest registration
+	Token []byte `json:"token"`
+	// The CoAP path which is observed e.g 7
+	Path string `json:"path"`
+	// The Authorization header of the long-polls
+	AccessToken string `json:"access_token"`
+	// The query of the next long-poll, which has the position of the last notification e.g since=s72594_4483_1934
+	Query string `json:"query"`
+	// The body of the OBSERVE request, which is sent with every long-poll e.g sliding sync lists
+	Body []byte `json:"body,omitempty"`
+	// The sequence number of the last notification
+	Seq uint32 `json:"seq"`
+	// When the record was last written
+	Updated time.Time `json:"updated"`
+}
+
+// ObservationStore persists OBSERVE registrations. Implementations must be safe to call concurrently.
+type ObservationStore interface {
+	// Get returns the record of this client and path, or nil if there isn't one.
+	Get(client, path string) (*ObservationRecord, error)
+	// Put adds the record, replacing any record with the same client and path.
+	Put(rec *ObservationRecord) error
+	// Delete removes the record of this client and path, if there is one.
+	Delete(client, path string) error
+	// All returns every record.
+	All() ([]*ObservationRecord, error)
+}
+
+// ObservationClient returns the identity of the client with this access token. Access tokens are per
+// device, and unlike the DTLS session they survive the client reconnecting and the proxy restarting.
+// The identity is a hash so it can be logged.
+func ObservationClient(accessToken string) string {
+	h := sha256.Sum256([]byte(accessToken))
+	return hex.EncodeToString(h[:16])
+}
+
+func observationKey(client, path string) string {
+	return client + "/" + path
+}
+
+// MemoryObservationStore keeps records in memory, so observations can be resumed when clients
+// reconnect but not when the proxy restarts.
+type MemoryObservationStore struct {
+	mu      sync.Mutex
+	records map[string]ObservationRecord
+}
+
+// NewMemoryObservationStore returns an empty MemoryObservationStore.
+func NewMemoryObservationStore() *MemoryObservationStore {
+	return &MemoryObservationStore{
+		records: make(map[string]ObservationRecord),
+	}
+}
+
+func (s *MemoryObservationStore) Get(client, path string) (*ObservationRecord, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	rec, ok := s.records[observationKey(client, path)]
+	if !ok {
+		return nil, nil
+	}
+	return &rec, nil
+}
+
+func (s *MemoryObservationStore) Put(rec *ObservationRecord) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.records[observationKey(rec.Client, rec.Path)] = *rec
+	return nil
+}
+
+func (s *MemoryObservationStore) Delete(client, path string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	delete(s.records, observationKey(client, path))
+	return nil
+}
+
+func (s *MemoryObservationStore) All() ([]*ObservationRecord, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	recs := make([]*ObservationRecord, 0, len(s.records))
+	for _, rec := range s.records {
+		rec := rec
+		recs = append(recs, &rec)
+	}
+	return recs, nil
+}
+
+// FileObservationWriteDelay is how long FileObservationStore waits after a change before it writes the
+// file, so the changes from many notifications are written at once.
+const FileObservationWriteDelay = time.Second
+
+// FileObservationStore keeps records in memory and writes them to a JSON file shortly after they
+// change, so observations can be resumed after the proxy restarts. Changes in the last
+// FileObservationWriteDelay are lost if the proxy crashes, which at worst resumes an observation from
+// an older notification. Call Flush before exiting. The file holds access tokens, so it is only
+// readable by the owner.
+type FileObservationStore struct {
+	path string
+	// guards writing the file, and the fields below
+	mu    sync.Mutex
+	mem   *MemoryObservationStore
+	timer *time.Timer // set while a write is pending
+	err   error       // the error of the last write, returned by the next call
+}
+
+// NewFileObservationStore returns a store which persists records in the file at this path, loading
+// any records already in it.
+func NewFileObservationStore(path string) (*FileObservationStore, error) {
+	s := &FileObservationStore{
+		path: path,
+		mem:  NewMemoryObservationStore(),
+	}
+	data, err := ioutil.ReadFile(path)
+	if os.IsNotExist(err) {
+		return s, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	var recs []*ObservationRecord
+	if err = json.Unmarshal(data, &recs); err != nil {
+		return nil, err
+	}
+	for _, rec := range recs {
+		s.mem.Put(rec)
+	}
+	return s, nil
+}
+
+func (s *FileObservationStore) Get(client, path string) (*ObservationRecord, error) {
+	return s.mem.Get(client, path)
+}
+
+func (s *FileObservationStore) Put(rec *ObservationRecord) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.mem.Put(rec)
+	return s.scheduleWrite()
+}
+
+func (s *FileObservationStore) Delete(client, path string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.mem.Delete(client, path)
+	return s.scheduleWrite()
+}
+
+func (s *FileObservationStore) All() ([]*ObservationRecord, error) {
+	return s.mem.All()
+}
+
+// Flush writes any pending changes to the file now.
+func (s *FileObservationStore) Flush() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.timer != nil {
+		s.timer.Stop()
+		s.timer = nil
+		s.err = s.write()
+	}
+	err := s.err
+	s.err = nil
+	return err
+}
+
+// scheduleWrite writes the file after FileObservationWriteDelay, unless a write is already pending.
+// Returns the error of the last write. Must be called with mu held.
+func (s *FileObservationStore) scheduleWrite() error {
+	if s.timer == nil {
+		s.timer = time.AfterFunc(FileObservationWriteDelay, func() {
+			s.mu.Lock()
+			defer s.mu.Unlock()
+			if s.timer == nil {
+				// Flush has written the file
+				return
+			}
+			s.timer = nil
+			s.err = s.write()
+		})
+	}
+	err := s.err
+	s.err = nil
+	return err
+}
+
+// write replaces the file with the current records. The records are written and synced to a temporary
+// file which is renamed over the file, so a crash never leaves a partial file.
+func (s *FileObservationStore) write() error {
+	recs, _ := s.mem.All()
+	data, err := json.Marshal(recs)
+	if err != nil {
+		return err
+	}
+	f, err := ioutil.TempFile(filepath.Dir(s.path), filepath.Base(s.path)+".tmp")
+	if err != nil {
+		return err
+	}
+	// TempFile creates the file with 0600 permissions
+	if _, err = f.Write(data); err == nil {
+		err = f.Sync()
+	}
+	if err != nil {
+		f.Close()
+		os.Remove(f.Name())
+		return err
+	}
+	if err = f.Close(); err != nil {
+		os.Remove(f.Name())
+		return err
+	}
+	return os.Rename(f.Name(), s.path)
+}
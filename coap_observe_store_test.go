@@ -0,0 +1,350 @@
+// Copyright 2021 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package lb
+
+import (
+	"bytes"
+	"context"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/matrix-org/go-coap/v2/message"
+	"github.com/matrix-org/go-coap/v2/message/codes"
+	coapmux "github.com/matrix-org/go-coap/v2/mux"
+	"github.com/matrix-org/go-coap/v2/tcp"
+	tcppool "github.com/matrix-org/go-coap/v2/tcp/message/pool"
+)
+
+func TestFileObservationStore(t *testing.T) {
+	dir, err := ioutil.TempDir("", "lb-observations")
+	if err != nil {
+		t.Fatalf("TempDir: %s", err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "observations.json")
+
+	store, err := NewFileObservationStore(path)
+	if err != nil {
+		t.Fatalf("NewFileObservationStore: %s", err)
+	}
+	rec := &ObservationRecord{
+		Client:      ObservationClient("Bearer abc"),
+		Token:       []byte{1, 2, 3},
+		Path:        "7",
+		AccessToken: "Bearer abc",
+		Query:       "since=s1&timeout=10000",
+		Seq:         4,
+		Updated:     time.Now().Round(time.Second).UTC(),
+	}
+	other := &ObservationRecord{
+		Client: ObservationClient("Bearer def"),
+		Path:   "7",
+	}
+	for _, r := range []*ObservationRecord{rec, other} {
+		if err = store.Put(r); err != nil {
+			t.Fatalf("Put: %s", err)
+		}
+	}
+	if err = store.Delete(other.Client, other.Path); err != nil {
+		t.Fatalf("Delete: %s", err)
+	}
+	// changes are written together after a delay
+	if _, err = os.Stat(path); !os.IsNotExist(err) {
+		t.Errorf("the file was written before the delay: %v", err)
+	}
+	if err = store.Flush(); err != nil {
+		t.Fatalf("Flush: %s", err)
+	}
+	info, err := os.Stat(path)
+	if err != nil {
+		t.Fatalf("Stat: %s", err)
+	}
+	if info.Mode().Perm() != 0600 {
+		t.Errorf("file has permissions %v want 0600", info.Mode().Perm())
+	}
+
+	// the records are loaded again e.g when the proxy restarts
+	store, err = NewFileObservationStore(path)
+	if err != nil {
+		t.Fatalf("NewFileObservationStore: %s", err)
+	}
+	got, err := store.Get(rec.Client, rec.Path)
+	if err != nil {
+		t.Fatalf("Get: %s", err)
+	}
+	if !reflect.DeepEqual(got, rec) {
+		t.Errorf("Get got %+v want %+v", got, rec)
+	}
+	if got, _ = store.Get(other.Client, other.Path); got != nil {
+		t.Errorf("Get returned a deleted record: %+v", got)
+	}
+	all, _ := store.All()
+	if len(all) != 1 {
+		t.Errorf("All got %d records want 1", len(all))
+	}
+}
+
+func TestObservationsPruneStore(t *testing.T) {
+	ob := NewObservations(http.NotFoundHandler(), NewCBORCodecV1(true), nil)
+	ob.Store.Put(&ObservationRecord{Client: "a", Path: "7", Updated: time.Now()})
+	ob.Store.Put(&ObservationRecord{Client: "b", Path: "7", Updated: time.Now().Add(-2 * DefaultObservationResumeWindow)})
+	n, err := ob.PruneStore()
+	if err != nil {
+		t.Fatalf("PruneStore: %s", err)
+	}
+	if n != 1 {
+		t.Errorf("PruneStore got %d resumable want 1", n)
+	}
+	if rec, _ := ob.Store.Get("b", "7"); rec != nil {
+		t.Errorf("PruneStore kept an expired record")
+	}
+}
+
+// TestObservationsResumeAfterRestart checks that an observation carries on from the last notification
+// when the client registers again with a proxy which has restarted.
+func TestObservationsResumeAfterRestart(t *testing.T) {
+	dir, err := ioutil.TempDir("", "lb-observations")
+	if err != nil {
+		t.Fatalf("TempDir: %s", err)
+	}
+	defer os.RemoveAll(dir)
+	storePath := filepath.Join(dir, "observations.json")
+	codec := NewCBORCodecV1(true)
+	client := ObservationClient("Bearer abc")
+
+	type notification struct {
+		code codes.Code
+		seq  uint32
+		body string
+	}
+	// start runs a proxy whose homeserver returns the next_batch in `nextBatch` for each since, and
+	// blocks for any other since. Returns the since of each long-poll and the notifications.
+	start := func(nextBatch map[string]string) (*Observations, chan string, chan notification, func()) {
+		store, err := NewFileObservationStore(storePath)
+		if err != nil {
+			t.Fatalf("NewFileObservationStore: %s", err)
+		}
+		polls := make(chan string, 5)
+		ob := NewSyncObservations(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+			since := req.URL.Query().Get("since")
+			polls <- since
+			next, ok := nextBatch[since]
+			if !ok {
+				<-req.Context().Done()
+				return
+			}
+			if next == "" {
+				res, _ := codec.JSONToCBOR(bytes.NewBufferString(`{"errcode":"M_UNKNOWN_TOKEN"}`))
+				w.WriteHeader(401)
+				w.Write(res)
+				return
+			}
+			res, err := codec.JSONToCBOR(bytes.NewBufferString(`{"next_batch":"` + next + `"}`))
+			if err != nil {
+				t.Errorf("JSONToCBOR: %s", err)
+			}
+			w.WriteHeader(200)
+			w.Write(res)
+		}), NewCoAPPathV1(), codec)
+		ob.Store = store
+		server := NewCoAPHTTP(NewCoAPPathV1())
+		router := coapmux.NewRouter()
+		router.DefaultHandle(server.CoAPHTTPHandler(http.NotFoundHandler(), ob))
+
+		l := NewWebSocketListener()
+		srv := httptest.NewServer(l)
+		ignoreErrors := tcp.WithErrors(func(err error) {})
+		coapServer := tcp.NewServer(tcp.WithMux(router), ignoreErrors)
+		go coapServer.Serve(l)
+		srvURL, _ := url.Parse(srv.URL)
+		conn, err := DialWebSocket(&url.URL{Scheme: "coap+ws", Host: srvURL.Host}, nil)
+		if err != nil {
+			t.Fatalf("DialWebSocket: %s", err)
+		}
+		cc := tcp.Client(conn, ignoreErrors)
+		notifications := make(chan notification, 5)
+		_, err = cc.Observe(context.Background(), "/7", func(msg *tcppool.Message) {
+			seq, err := msg.Observe()
+			if err != nil {
+				// the response to the registration
+				return
+			}
+			var body []byte
+			if msg.Body() != nil {
+				body, _ = codec.CBORToJSON(msg.Body())
+			}
+			notifications <- notification{code: msg.Code(), seq: seq, body: string(body)}
+		}, message.Option{ID: OptionIDAccessToken, Value: []byte("abc")})
+		if err != nil {
+			t.Fatalf("Observe: %s", err)
+		}
+		return ob, polls, notifications, func() {
+			if err := store.Flush(); err != nil {
+				t.Errorf("Flush: %s", err)
+			}
+			cc.Close()
+			coapServer.Stop()
+			srv.Close()
+			l.Close()
+		}
+	}
+	wantPoll := func(polls chan string, want string) {
+		t.Helper()
+		select {
+		case since := <-polls:
+			if since != want {
+				t.Errorf("long-poll got since %q want %q", since, want)
+			}
+		case <-time.After(5 * time.Second):
+			t.Fatalf("timed out waiting for long-poll with since %q", want)
+		}
+	}
+	wantNotification := func(notifications chan notification, want notification) {
+		t.Helper()
+		select {
+		case n := <-notifications:
+			if n != want {
+				t.Errorf("got notification %+v want %+v", n, want)
+			}
+		case <-time.After(5 * time.Second):
+			t.Fatalf("timed out waiting for notification %+v", want)
+		}
+	}
+
+	_, polls, notifications, stop := start(map[string]string{"": "s1"})
+	wantPoll(polls, "")
+	wantNotification(notifications, notification{code: codes.Content, seq: 2, body: `{"next_batch":"s1"}`})
+	// the position is stored before the next long-poll
+	wantPoll(polls, "s1")
+	stop()
+
+	ob, polls, notifications, stop := start(map[string]string{"s1": "s2", "s2": ""})
+	defer stop()
+	if n, err := ob.PruneStore(); err != nil || n != 1 {
+		t.Errorf("PruneStore got %d, %v want 1 resumable observation", n, err)
+	}
+	// the client didn't send a since, so the observation resumes from the stored one
+	wantPoll(polls, "s1")
+	wantNotification(notifications, notification{code: codes.Content, seq: 3, body: `{"next_batch":"s2"}`})
+	// errors end the observation, so it can't be resumed
+	wantPoll(polls, "s2")
+	wantNotification(notifications, notification{code: codes.Unauthorized, seq: 4, body: `{"errcode":"M_UNKNOWN_TOKEN"}`})
+	for i := 0; i < 50; i++ {
+		if rec, _ := ob.Store.Get(client, "7"); rec == nil {
+			return
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	t.Errorf("the observation was still stored after it ended with an error")
+}
+
+// TestObservationsEndAll checks that EndAll tells clients to register again, and keeps the position of
+// the last notification each client ACKed so the observation resumes when they do.
+func TestObservationsEndAll(t *testing.T) {
+	codec := NewCBORCodecV1(true)
+	polls := make(chan string, 5)
+	ob := NewSyncObservations(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		since := req.URL.Query().Get("since")
+		polls <- since
+		if since != "" {
+			<-req.Context().Done()
+			return
+		}
+		res, err := codec.JSONToCBOR(bytes.NewBufferString(`{"next_batch":"s1"}`))
+		if err != nil {
+			t.Errorf("JSONToCBOR: %s", err)
+		}
+		w.WriteHeader(200)
+		w.Write(res)
+	}), NewCoAPPathV1(), codec)
+	server := NewCoAPHTTP(NewCoAPPathV1())
+	router := coapmux.NewRouter()
+	router.DefaultHandle(server.CoAPHTTPHandler(http.NotFoundHandler(), ob))
+
+	l := NewWebSocketListener()
+	srv := httptest.NewServer(l)
+	defer srv.Close()
+	defer l.Close()
+	ignoreErrors := tcp.WithErrors(func(err error) {})
+	coapServer := tcp.NewServer(tcp.WithMux(router), ignoreErrors)
+	defer coapServer.Stop()
+	go coapServer.Serve(l)
+	srvURL, _ := url.Parse(srv.URL)
+	conn, err := DialWebSocket(&url.URL{Scheme: "coap+ws", Host: srvURL.Host}, nil)
+	if err != nil {
+		t.Fatalf("DialWebSocket: %s", err)
+	}
+	cc := tcp.Client(conn, ignoreErrors)
+	defer cc.Close()
+	notifications := make(chan codes.Code, 5)
+	_, err = cc.Observe(context.Background(), "/7", func(msg *tcppool.Message) {
+		if _, err := msg.Observe(); err == nil {
+			notifications <- msg.Code()
+		}
+	}, message.Option{ID: OptionIDAccessToken, Value: []byte("abc")})
+	if err != nil {
+		t.Fatalf("Observe: %s", err)
+	}
+	wantNotification := func(want codes.Code) {
+		t.Helper()
+		select {
+		case code := <-notifications:
+			if code != want {
+				t.Errorf("got notification %v want %v", code, want)
+			}
+		case <-time.After(5 * time.Second):
+			t.Fatalf("timed out waiting for notification %v", want)
+		}
+	}
+	wantNotification(codes.Content)
+	for _, want := range []string{"", "s1"} {
+		select {
+		case since := <-polls:
+			if since != want {
+				t.Errorf("long-poll got since %q want %q", since, want)
+			}
+		case <-time.After(5 * time.Second):
+			t.Fatalf("timed out waiting for long-poll with since %q", want)
+		}
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	ob.EndAll(ctx, codes.ServiceUnavailable)
+	if ctx.Err() != nil {
+		t.Fatalf("EndAll timed out")
+	}
+	wantNotification(codes.ServiceUnavailable)
+	rec, _ := ob.Store.Get(ObservationClient("Bearer abc"), "7")
+	if rec == nil || !strings.Contains(rec.Query, "since=s1") || rec.Seq != 2 {
+		t.Errorf("stored observation got %+v want it to resume after the ACKed notification", rec)
+	}
+	// and clients which register while the observations are ending are told to register again
+	res, err := cc.Get(context.Background(), "/7", message.Option{ID: message.Observe, Value: []byte{}}, message.Option{ID: OptionIDAccessToken, Value: []byte("abc")})
+	if err != nil {
+		t.Fatalf("Get: %s", err)
+	}
+	if res.Code() != codes.ServiceUnavailable {
+		t.Errorf("registration got code %v want %v", res.Code(), codes.ServiceUnavailable)
+	}
+}
@@ -16,47 +16,68 @@ package lb
 
 import (
 	"net/http"
-	"strings"
 
 	"github.com/tidwall/gjson"
 )
 
-// NewSyncObservations returns an Observations capable of processing Matrix /sync requests
+// The template of /sync in the v1 path mappings, which every spec version of /sync maps to.
+const syncTemplate = "/_matrix/client/r0/sync"
+
+// The templates of sliding sync (MSC3575) and simplified sliding sync (MSC4186) in the v2 path mappings.
+const (
+	slidingSyncTemplate           = "/_matrix/client/unstable/org.matrix.msc3575/sync"
+	simplifiedSlidingSyncTemplate = "/_matrix/client/unstable/org.matrix.simplified_msc3575/sync"
+)
+
+// syncPosition is where a sync endpoint puts the position of the response, and which query parameter
+// the next request sends it in.
+type syncPosition struct {
+	// the field of the response body
+	field string
+	// the query parameter of the next request
+	query string
+}
+
+// syncPositions are the sync endpoints which can be observed.
+var syncPositions = map[string]syncPosition{
+	syncTemplate:                  {field: "next_batch", query: "since"},
+	slidingSyncTemplate:           {field: "pos", query: "pos"},
+	simplifiedSlidingSyncTemplate: {field: "pos", query: "pos"},
+}
+
+// NewSyncObservations returns an Observations capable of processing Matrix /sync requests, and
+// sliding sync requests. Sliding sync requests have a body, which is sent again with every long-poll.
 func NewSyncObservations(next http.Handler, c *CoAPPath, codec *CBORCodec) *Observations {
-	return NewObservations(next, codec, func(path string, prev, curr []byte) bool {
-		path = c.CoAPPathToHTTPPath(path)
-		if strings.HasPrefix(path, "/") {
-			path = path[1:]
-		}
-		if path != "_matrix/client/r0/sync" {
+	ob := NewObservations(next, codec, func(path string, prev, curr []byte) bool {
+		pos, ok := syncPositions[c.Template(path)]
+		if !ok {
 			return true
 		}
 		if prev == nil && curr != nil {
 			return true
 		}
 		// if there are different tokens then there has been an update
-		p := gjson.GetBytes(prev, "next_batch")
-		c := gjson.GetBytes(curr, "next_batch")
+		p := gjson.GetBytes(prev, pos.field)
+		c := gjson.GetBytes(curr, pos.field)
 		return !(p.Str == c.Str)
 
 	}, func(path string, prevRespBody []byte, req *http.Request) *http.Request {
-		path = c.CoAPPathToHTTPPath(path)
-		if strings.HasPrefix(path, "/") {
-			path = path[1:]
-		}
-		if path != "_matrix/client/r0/sync" {
+		pos, ok := syncPositions[c.Template(path)]
+		if !ok {
 			return req
 		}
-		r := gjson.GetBytes(prevRespBody, "next_batch")
+		r := gjson.GetBytes(prevRespBody, pos.field)
 		if !r.Exists() {
 			return req
 		}
 		u := req.URL
 		vals := u.Query()
-		vals.Set("since", r.Str)
+		vals.Set(pos.query, r.Str)
 		vals.Set("timeout", "10000") // 10s timeout
 		u.RawQuery = vals.Encode()
 		req.URL = u
 		return req
 	})
+	ob.ObservablePaths = []string{syncTemplate, slidingSyncTemplate, simplifiedSlidingSyncTemplate}
+	return ob
 }
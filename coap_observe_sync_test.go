@@ -0,0 +1,139 @@
+// Copyright 2021 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package lb
+
+import (
+	"bytes"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+	"time"
+
+	"github.com/matrix-org/go-coap/v2/message/codes"
+	coapmux "github.com/matrix-org/go-coap/v2/mux"
+	"github.com/matrix-org/go-coap/v2/tcp"
+	tcppool "github.com/matrix-org/go-coap/v2/tcp/message/pool"
+)
+
+func TestSlidingSyncObservations(t *testing.T) {
+	paths := NewCoAPPathV2()
+	ob := NewSyncObservations(http.NotFoundHandler(), paths, NewCBORCodecV2(true))
+	for _, httpPath := range []string{slidingSyncTemplate, simplifiedSlidingSyncTemplate} {
+		path := paths.HTTPPathToCoapPath(httpPath)
+		req, _ := http.NewRequest("POST", "https://localhost"+httpPath+"?conn_id=main", nil)
+		req = ob.updateFns[0](path, nil, req)
+		if req.URL.Query().Get("pos") != "" {
+			t.Errorf("%s: first long-poll has a pos", httpPath)
+		}
+		req = ob.updateFns[0](path, []byte(`{"pos":"5","lists":{}}`), req)
+		query := req.URL.Query()
+		if query.Get("pos") != "5" || query.Get("timeout") == "" || query.Get("conn_id") != "main" {
+			t.Errorf("%s: got query %s want pos=5, a timeout and conn_id=main", httpPath, req.URL.RawQuery)
+		}
+		if query.Get("since") != "" {
+			t.Errorf("%s: got since=%s", httpPath, query.Get("since"))
+		}
+		if !ob.hasUpdatedFn(path, []byte(`{"pos":"5"}`), []byte(`{"pos":"6"}`)) {
+			t.Errorf("%s: new pos was not an update", httpPath)
+		}
+		if ob.hasUpdatedFn(path, []byte(`{"pos":"5"}`), []byte(`{"pos":"5"}`)) {
+			t.Errorf("%s: same pos was an update", httpPath)
+		}
+	}
+}
+
+// TestSlidingSyncObserveResendsBody checks that every long-poll of an OBSERVE request with a body sends
+// the body, and the pos of the previous response.
+func TestSlidingSyncObserveResendsBody(t *testing.T) {
+	codec := NewCBORCodecV2(true)
+	paths := NewCoAPPathV2()
+	server := NewCoAPHTTP(paths)
+	reqBody := `{"lists":{"all":{"ranges":[[0,19]],"timeline_limit":1}}}`
+	type longPoll struct {
+		pos  string
+		body string
+	}
+	polls := make(chan longPoll, 2)
+	ob := NewSyncObservations(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		body, err := ioutil.ReadAll(req.Body)
+		if err != nil {
+			t.Errorf("failed to read long-poll body: %s", err)
+		}
+		pos := req.URL.Query().Get("pos")
+		select {
+		case polls <- longPoll{pos: pos, body: string(body)}:
+		default:
+			// stop long-polling
+			<-req.Context().Done()
+			return
+		}
+		res, err := codec.JSONToCBOR(bytes.NewBufferString(`{"pos":"` + pos + `1"}`))
+		if err != nil {
+			t.Errorf("JSONToCBOR: %s", err)
+		}
+		w.WriteHeader(200)
+		w.Write(res)
+	}), paths, codec)
+	router := coapmux.NewRouter()
+	router.DefaultHandle(server.CoAPHTTPHandler(http.NotFoundHandler(), ob))
+
+	l := NewWebSocketListener()
+	defer l.Close()
+	srv := httptest.NewServer(l)
+	defer srv.Close()
+	ignoreErrors := tcp.WithErrors(func(err error) {})
+	coapServer := tcp.NewServer(tcp.WithMux(router), ignoreErrors)
+	defer coapServer.Stop()
+	go coapServer.Serve(l)
+	srvURL, _ := url.Parse(srv.URL)
+	conn, err := DialWebSocket(&url.URL{Scheme: "coap+ws", Host: srvURL.Host}, nil)
+	if err != nil {
+		t.Fatalf("DialWebSocket: %s", err)
+	}
+	cc := tcp.Client(conn, ignoreErrors)
+	defer cc.Close()
+
+	req, _ := http.NewRequest("POST", "https://localhost"+simplifiedSlidingSyncTemplate, bytes.NewBufferString(reqBody))
+	req.Header.Set("Content-Type", "application/json")
+	err = server.HTTPRequestToCoAPTCP(req, func(msg *tcppool.Message) error {
+		msg.SetObserve(0)
+		res, err := cc.Do(msg)
+		if err != nil {
+			return err
+		}
+		if res.Code() != codes.Content {
+			t.Errorf("OBSERVE got code %v want %v", res.Code(), codes.Content)
+		}
+		return nil
+	})
+	if err != nil {
+		t.Fatalf("HTTPRequestToCoAPTCP: %s", err)
+	}
+	for i, wantPos := range []string{"", "1"} {
+		select {
+		case poll := <-polls:
+			if poll.pos != wantPos {
+				t.Errorf("long-poll %d: got pos %q want %q", i, poll.pos, wantPos)
+			}
+			if poll.body != reqBody {
+				t.Errorf("long-poll %d: got body %s want %s", i, poll.body, reqBody)
+			}
+		case <-time.After(5 * time.Second):
+			t.Fatalf("timed out waiting for long-poll %d", i)
+		}
+	}
+}
@@ -0,0 +1,134 @@
+// Copyright 2021 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package lb
+
+import (
+	"bytes"
+	"context"
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/matrix-org/go-coap/v2/message"
+	"github.com/matrix-org/go-coap/v2/message/codes"
+	coapmux "github.com/matrix-org/go-coap/v2/mux"
+	coapnet "github.com/matrix-org/go-coap/v2/net"
+	"github.com/matrix-org/go-coap/v2/net/blockwise"
+	"github.com/matrix-org/go-coap/v2/udp"
+	"github.com/matrix-org/go-coap/v2/udp/client"
+	udpmessage "github.com/matrix-org/go-coap/v2/udp/message"
+	"github.com/matrix-org/go-coap/v2/udp/message/pool"
+)
+
+// TestObservationsReset checks that a client which rejects a notification with a Reset message, e.g
+// because it has forgotten the observation, stops the long-poll and doesn't ACK the notification.
+func TestObservationsReset(t *testing.T) {
+	codec := NewCBORCodecV1(true)
+	polls := make(chan string, 5)
+	cancelled := make(chan string, 5)
+	registered := make(chan struct{})
+	ob := NewSyncObservations(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		since := req.URL.Query().Get("since")
+		polls <- since
+		if since != "" {
+			<-req.Context().Done()
+			cancelled <- since
+			return
+		}
+		// otherwise the notification can arrive before the response to the registration
+		<-registered
+		res, err := codec.JSONToCBOR(bytes.NewBufferString(`{"next_batch":"s1"}`))
+		if err != nil {
+			t.Errorf("JSONToCBOR: %s", err)
+		}
+		w.WriteHeader(200)
+		w.Write(res)
+	}), NewCoAPPathV1(), codec)
+	server := NewCoAPHTTP(NewCoAPPathV1())
+	router := coapmux.NewRouter()
+	router.DefaultHandle(server.CoAPHTTPHandler(http.NotFoundHandler(), ob))
+	muxHandler := client.HandlerFuncToMux(router)
+	resets := make(chan bool, 5)
+
+	l, err := coapnet.NewListenUDP("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("NewListenUDP: %s", err)
+	}
+	defer l.Close()
+	ignoreErrors := udp.WithErrors(func(err error) {})
+	// go-coap sends blockwise messages with a message ID of 0, which clients answer from their cache of
+	// responses, and remembers the token of blockwise requests, so clients would ACK the notification.
+	noBlockwise := udp.WithBlockwise(false, blockwise.SZX1024, time.Minute)
+	coapServer := udp.NewServer(udp.WithHandlerFunc(func(w *client.ResponseWriter, r *pool.Message) {
+		if r.Type() == udpmessage.Reset {
+			resets <- ob.HandleReset(w.ClientConn())
+			return
+		}
+		muxHandler(w, r)
+	}), ignoreErrors, noBlockwise)
+	defer coapServer.Stop()
+	go coapServer.Serve(l)
+	cc, err := udp.Dial(l.LocalAddr().String(), ignoreErrors, noBlockwise)
+	if err != nil {
+		t.Fatalf("Dial: %s", err)
+	}
+	defer cc.Close()
+
+	// register without an observation handler, so the client resets the first notification
+	req, err := client.NewGetRequest(context.Background(), "/7", message.Option{ID: OptionIDAccessToken, Value: []byte("abc")})
+	if err != nil {
+		t.Fatalf("NewGetRequest: %s", err)
+	}
+	req.SetObserve(0)
+	res, err := cc.Do(req)
+	if err != nil {
+		t.Fatalf("Do: %s", err)
+	}
+	if res.Code() != codes.Content {
+		t.Fatalf("registration got code %v want %v", res.Code(), codes.Content)
+	}
+	close(registered)
+
+	select {
+	case reset := <-resets:
+		if !reset {
+			t.Fatalf("HandleReset didn't find the notification")
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatalf("timed out waiting for the client to reset the notification")
+	}
+	select {
+	case since := <-polls:
+		if since != "" {
+			t.Fatalf("first long-poll got since %q want none", since)
+		}
+	default:
+		t.Fatalf("no long-poll before the notification")
+	}
+	// the notification wasn't ACKed, so the long-poll with its since must not run, or must be cancelled
+	select {
+	case since := <-polls:
+		select {
+		case <-cancelled:
+		case <-time.After(5 * time.Second):
+			t.Fatalf("long-poll with since %q wasn't cancelled", since)
+		}
+	case <-time.After(2 * time.Second):
+	}
+	rec, _ := ob.Store.Get(ObservationClient("Bearer abc"), "7")
+	if rec == nil || rec.Seq != 1 {
+		t.Errorf("stored observation got %+v want it to resume before the reset notification", rec)
+	}
+}
@@ -17,8 +17,8 @@ package lb
 import (
 	"bytes"
 	"fmt"
-	"net/url"
 	"regexp"
+	"sort"
 	"strconv"
 	"strings"
 )
@@ -33,7 +33,11 @@ import (
 type CoAPPath struct {
 	pathMappings     map[string]string
 	longPathMappings map[string]string
-	regexpsToCodes   map[*routeRegexp]string
+	trie             *pathTrie
+	// templates which can't go in the trie, sorted by template
+	regexps []*routeRegexp
+	// enum code -> the variables of its template
+	vars map[string]*templateVars
 }
 
 // NewCoAPPath makes a CoAPPath with the path mappings given. `pathMappings`
@@ -45,15 +49,31 @@ type CoAPPath struct {
 // variables. These variables are important to determine what the CoAP path output should be and MUST
 // be enclosed in {} (you cannot use $).
 //
+// Variables can have a pattern like gorilla/mux e.g {txnId:[0-9]+}, which values must match in both
+// directions. Patterns match the percent-encoded path. A variable whose pattern can match a '/' can
+// span several path segments: it is sent as a single CoAP path segment with its '/'s escaped, unless
+// it is the last thing in the template, in which case each of its segments is a CoAP path segment e.g
+//   "n": "/_matrix/client/r0/pushrules/{scope}/{kind}/{ruleId:.+}/actions"
+//   "t": "/_matrix/media/r0/download/{serverName}/{mediaId}/{path:.*}"
+//
+// Enum codes must be single URI-safe path segments. Templates which can match the same HTTP path
+// are rejected, unless one is more specific than the other (it has literal segments where the other
+// has variables) in which case the more specific template wins. The error lists each problem with an
+// example path.
+//
 // Users of this library should prefer NewCoAPPathV1 which sets up all the enum paths for you. This
 // function is exposed for bleeding edge or custom enums.
 func NewCoAPPath(pathMappings map[string]string) (*CoAPPath, error) {
 	c := CoAPPath{
 		pathMappings:     pathMappings,
 		longPathMappings: make(map[string]string),
-		regexpsToCodes:   make(map[*routeRegexp]string),
+		trie:             newPathTrie(),
+		vars:             make(map[string]*templateVars),
 	}
 
+	if err := validatePathMappings(pathMappings); err != nil {
+		return nil, err
+	}
 	for k, v := range c.pathMappings {
 		_, ok := c.longPathMappings[v]
 		if ok {
@@ -65,15 +85,33 @@ func NewCoAPPath(pathMappings map[string]string) (*CoAPPath, error) {
 		if err != nil {
 			return nil, fmt.Errorf("failed to init regexp for path " + v + " : " + err.Error())
 		}
-		c.regexpsToCodes[rxp] = k
+		if c.vars[k], err = newTemplateVars(rxp); err != nil {
+			return nil, fmt.Errorf("failed to parse variables of path " + v + " : " + err.Error())
+		}
+		if !c.trie.add(v, k) {
+			c.regexps = append(c.regexps, rxp)
+		}
 	}
+	sort.Slice(c.regexps, func(i, j int) bool {
+		return c.regexps[i].template < c.regexps[j].template
+	})
 
 	return &c, nil
 }
 
+// Mappings returns a copy of the path mappings, keyed by enum code.
+func (c *CoAPPath) Mappings() map[string]string {
+	mappings := make(map[string]string, len(c.pathMappings))
+	for code, tpl := range c.pathMappings {
+		mappings[code] = tpl
+	}
+	return mappings
+}
+
 // CoAPPathToHTTPPath converts a coap path to a full HTTP path e.g
 // converts /7 into /_matrix/client/r0/sync
-// Returns the input path if this is not a coap enum path
+// Returns the input path if this is not a coap enum path, or if a variable doesn't match its pattern.
+// Path segments can be percent-encoded, and are percent-encoded in the HTTP path.
 func (c *CoAPPath) CoAPPathToHTTPPath(p string) string {
 	path := p
 	if !strings.HasPrefix(p, "/") {
@@ -83,47 +121,118 @@ func (c *CoAPPath) CoAPPathToHTTPPath(p string) string {
 	if len(segments) < 2 {
 		return p
 	}
-	pattern := c.pathMappings[segments[1]]
+	code, marker := segments[1], ""
+	hasMarker := false
+	if i := strings.IndexByte(code, versionMarkerSeparator); i != -1 {
+		code, marker, hasMarker = code[:i], code[i+1:], true
+	}
+	pattern := c.pathMappings[code]
 	if pattern == "" {
 		return p
 	}
-	if len(segments) > 2 {
-		// there are user params to replace
-		httpSegments := strings.Split(pattern, "/")
-		coapSegIndex := 2
-		for i := range httpSegments {
-			if coapSegIndex >= len(segments) {
-				break
+	if !strings.Contains(pattern, "{") && !hasMarker {
+		return pattern
+	}
+	// replace the variables with the user params. Missing params are empty, e.g the state key of
+	// /_matrix/client/r0/rooms/{roomId}/state/{eventType}/{stateKey}
+	tv := c.vars[code]
+	params := segments[2:]
+	var b strings.Builder
+	for i, v := range tv.vars {
+		b.WriteString(tv.literals[i])
+		val := ""
+		if v.tail {
+			vals := make([]string, len(params))
+			for j := range params {
+				vals[j] = escapePathSegment(params[j])
 			}
-			if strings.HasPrefix(httpSegments[i], "{") {
-				httpSegments[i] = url.PathEscape(segments[coapSegIndex])
-				coapSegIndex++
+			val = strings.Join(vals, "/")
+			params = nil
+		} else if len(params) > 0 {
+			val = params[0]
+			params = params[1:]
+			if v.multiSegment {
+				val = escapeMultiSegment(val)
+			} else {
+				val = escapePathSegment(val)
 			}
 		}
-		return strings.Join(httpSegments, "/")
+		if v.validator != nil && !v.validator.MatchString(val) {
+			return p
+		}
+		b.WriteString(val)
+	}
+	b.WriteString(tv.literals[len(tv.literals)-1])
+	if !hasMarker {
+		return b.String()
+	}
+	version, ok := parseVersionMarker(marker)
+	if !ok || !isVersionSegment(strings.Split(pattern, "/")[1:], 2) {
+		return p
+	}
+	httpSegments := strings.Split(b.String(), "/")
+	httpSegments[3] = version
+	return strings.Join(httpSegments, "/")
+}
+
+// Template returns the HTTP path template which this HTTP or CoAP path maps to, or "" if it isn't
+// mapped to an enum path. All spec versions of a path return the same template e.g
+// /_matrix/client/v3/sync returns /_matrix/client/r0/sync.
+func (c *CoAPPath) Template(p string) string {
+	path := p
+	if !strings.HasPrefix(p, "/") {
+		path = "/" + p
+	}
+	code := path[1:]
+	if i := strings.IndexAny(code, "/~"); i != -1 {
+		code = code[:i]
+	}
+	if tpl, ok := c.pathMappings[code]; ok {
+		return tpl
+	}
+	if tpl := c.trie.matchTemplate(path); tpl != "" {
+		return tpl
+	}
+	for _, r := range c.regexps {
+		if r.regexp.MatchString(path) {
+			return r.template
+		}
 	}
-	return pattern
+	return ""
 }
 
 // HTTPPathToCoapPath converts an HTTP path into a coap path e.g
 // converts /_matrix/client/r0/sync into /7
-// Returns the input path if this path isn't mapped to a coap enum path
+// Returns the input path if this path isn't mapped to a coap enum path. The HTTP path should be
+// percent-encoded (see url.URL.EscapedPath) so variables containing a '/' can be told apart from
+// several path segments. If several templates match,
+// the most specific one wins: literal segments are preferred over variables, from left to right.
+// Other spec versions of a template map to the same enum path with a version marker e.g
+// /_matrix/client/v3/sync becomes /7~3.
 func (c *CoAPPath) HTTPPathToCoapPath(p string) string {
 	path := p
 	if !strings.HasPrefix(p, "/") {
 		path = "/" + p
 	}
-	// TODO: This could be made more efficient eg prefix trees
-	for r, code := range c.regexpsToCodes {
+	if coapPath, ok := c.trie.coapPath(path); ok {
+		return coapPath
+	}
+	for _, r := range c.regexps {
 		if !r.regexp.MatchString(path) {
 			continue
 		}
+		code := c.longPathMappings[r.template]
+		vars := c.vars[code].vars
 		// extract values: the first 2 values are 0, len(path) so skip them
 		var userParams []string
 		matches := r.regexp.FindStringSubmatchIndex(path)
 		if len(matches) > 2 {
 			for i := 2; i < len(matches); i += 2 {
 				val := path[matches[i]:matches[i+1]]
+				if v := vars[i/2-1]; v.multiSegment && !v.tail {
+					// keep the value in one CoAP path segment
+					val = strings.ReplaceAll(val, "/", "%2F")
+				}
 				userParams = append(userParams, val)
 			}
 		}
@@ -15,7 +15,15 @@
 package lb
 
 import (
+	"context"
+	"fmt"
+	"net/http"
+	"reflect"
+	"strings"
 	"testing"
+
+	"github.com/matrix-org/go-coap/v2/message"
+	"github.com/matrix-org/go-coap/v2/udp/message/pool"
 )
 
 func TestPaths(t *testing.T) {
@@ -37,6 +45,15 @@ func TestPaths(t *testing.T) {
 			http: "/_matrix/client/r0/user/@frank:localhost/account_data/im.vector.setting.breadcrumbs",
 			code: "/r/@frank:localhost/im.vector.setting.breadcrumbs",
 		},
+		// media
+		{
+			http: "/_matrix/media/r0/download/localhost/abcdef",
+			code: "/w/localhost/abcdef",
+		},
+		{
+			http: "/_matrix/media/r0/download/localhost/abcdef/cat.png",
+			code: "/x/localhost/abcdef/cat.png",
+		},
 	}
 	for _, tc := range cases {
 		gotHTTP := c.CoAPPathToHTTPPath(tc.code)
@@ -68,13 +85,13 @@ func TestPathsURLEncoding(t *testing.T) {
 		t.Errorf("CoAPPathToHTTPPath %s got %s want %s", code, got, decodedHTTP)
 	}
 	// If we feed it %xx vals they should be retained literally - basically HTTPPathToCoapPath should never encode
-	// because we expect to be using http.Request.Path not http.Request.RawPath
+	// or decode, as the caller decides whether to use the escaped path
 	got = c.HTTPPathToCoapPath(encodedHTTP)
 	if got != encodedCode {
 		t.Errorf("HTTPPathToCoapPath %s got %s want %s", encodedCode, got, code)
 	}
 	// If we feed it %-encodable vals they should not be encoded - basically HTTPPathToCoapPath should never encode
-	// because we expect to be using http.Request.Path not http.Request.RawPath
+	// or decode, as the caller decides whether to use the escaped path
 	got = c.HTTPPathToCoapPath(decodedHTTP)
 	if got != code {
 		t.Errorf("HTTPPathToCoapPath %s got %s want %s", encodedHTTP, got, code)
@@ -113,3 +130,416 @@ func TestInvalidCodePaths(t *testing.T) {
 		}
 	}
 }
+
+// Test that the trie gives the same results as matching the template regexps.
+func TestPathsTrieMatchesRegexps(t *testing.T) {
+	c, err := NewCoAPPath(coapv1pathMappings)
+	if err != nil {
+		t.Fatalf(err.Error())
+	}
+	if len(c.regexps) != 0 {
+		t.Errorf("%d v1 templates are not in the trie", len(c.regexps))
+	}
+	var rxps []*routeRegexp
+	for _, tpl := range coapv1pathMappings {
+		rxp, err := newRouteRegexp(tpl)
+		if err != nil {
+			t.Fatalf("newRouteRegexp: %s", err)
+		}
+		rxps = append(rxps, rxp)
+	}
+	for code, tpl := range coapv1pathMappings {
+		segments := strings.Split(tpl, "/")
+		var vals []string
+		for i := range segments {
+			if strings.HasPrefix(segments[i], "{") {
+				segments[i] = fmt.Sprintf("val%d", i)
+				vals = append(vals, segments[i])
+			}
+		}
+		httpPath := strings.Join(segments, "/")
+		want := "/" + strings.Join(append([]string{code}, vals...), "/")
+		// a trailing slash is optional
+		httpPath = strings.TrimSuffix(httpPath, "/")
+		for _, path := range []string{httpPath, httpPath + "/"} {
+			var matched []string
+			for _, rxp := range rxps {
+				if rxp.regexp.MatchString(path) {
+					matched = append(matched, rxp.template)
+				}
+			}
+			if len(matched) != 1 {
+				t.Errorf("%s: matched %d templates: %v", path, len(matched), matched)
+			}
+			if got := c.HTTPPathToCoapPath(path); got != want {
+				t.Errorf("HTTPPathToCoapPath(%s) got %s want %s", path, got, want)
+			}
+		}
+	}
+}
+
+func TestPathsMostSpecific(t *testing.T) {
+	mappings := map[string]string{
+		"a": "/x/{id}",
+		"b": "/x/literal",
+		"c": "/x/{id}/y",
+		"e": "/x/{id}/{other}",
+	}
+	cases := map[string]string{
+		"/x/literal":   "/b",
+		"/x/literal/":  "/b",
+		"/x/foo":       "/a/foo",
+		"/x/literal/y": "/c/literal",
+		"/x/foo/y":     "/c/foo",
+		"/x/foo/bar":   "/e/foo/bar",
+		"/x//y":        "/x//y",
+		"/x":           "/x",
+		"/x/foo/bar/z": "/x/foo/bar/z",
+	}
+	// templates are added in a random order, so make sure the result doesn't depend on it
+	for i := 0; i < 20; i++ {
+		c, err := NewCoAPPath(mappings)
+		if err != nil {
+			t.Fatalf(err.Error())
+		}
+		for path, want := range cases {
+			if got := c.HTTPPathToCoapPath(path); got != want {
+				t.Errorf("HTTPPathToCoapPath(%s) got %s want %s", path, got, want)
+			}
+		}
+	}
+}
+
+func TestPathsNoAllocs(t *testing.T) {
+	c, err := NewCoAPPath(coapv1pathMappings)
+	if err != nil {
+		t.Fatalf(err.Error())
+	}
+	// only the returned path is allocated
+	allocs := testing.AllocsPerRun(100, func() {
+		c.HTTPPathToCoapPath("/_matrix/client/r0/rooms/!foo:localhost/send/m.room.message/txn1")
+	})
+	if allocs > 1 {
+		t.Errorf("HTTPPathToCoapPath allocated %v times", allocs)
+	}
+	allocs = testing.AllocsPerRun(100, func() {
+		c.HTTPPathToCoapPath("/_matrix/client/unknown/path")
+	})
+	if allocs != 0 {
+		t.Errorf("HTTPPathToCoapPath allocated %v times for an unmapped path", allocs)
+	}
+}
+
+func BenchmarkHTTPPathToCoapPath(b *testing.B) {
+	c, err := NewCoAPPath(coapv1pathMappings)
+	if err != nil {
+		b.Fatalf(err.Error())
+	}
+	b.ReportAllocs()
+	for i := 0; i < b.N; i++ {
+		c.HTTPPathToCoapPath("/_matrix/client/r0/rooms/!foo:localhost/send/m.room.message/txn1")
+	}
+}
+
+func TestPathMappingValidation(t *testing.T) {
+	cases := []struct {
+		name     string
+		mappings map[string]string
+		// substrings of the problems, or empty if the mappings are valid
+		wantProblems []string
+	}{
+		{
+			name:     "v1",
+			mappings: coapv1pathMappings,
+		},
+		{
+			name: "more specific",
+			mappings: map[string]string{
+				"a": "/x/{id}",
+				"b": "/x/literal",
+			},
+		},
+		{
+			name: "same shape",
+			mappings: map[string]string{
+				"a": "/x/{id}",
+				"b": "/x/{other}",
+			},
+			wantProblems: []string{"match the same paths e.g /x/id"},
+		},
+		{
+			name: "trailing slash",
+			mappings: map[string]string{
+				"a": "/x/",
+				"b": "/x",
+			},
+			wantProblems: []string{"match the same paths e.g /x"},
+		},
+		{
+			name: "neither more specific",
+			mappings: map[string]string{
+				"c": "/x/{id}/y",
+				"d": "/x/literal/{z}",
+			},
+			wantProblems: []string{"d and c: /x/literal/{z} and /x/{id}/y both match /x/literal/y and neither is more specific"},
+		},
+		{
+			name: "custom pattern",
+			mappings: map[string]string{
+				"a": "/x/{id:[a-z]+}",
+				"b": "/x/{other}",
+			},
+			wantProblems: []string{"a and b: /x/{id:[a-z]+} and /x/{other} both match /x/other"},
+		},
+		{
+			name: "unsafe codes",
+			mappings: map[string]string{
+				"a/b": "/a",
+				"%":   "/b",
+				"..":  "/c",
+				"":    "/d",
+			},
+			wantProblems: []string{`"a/b": the enum code`, `"%": the enum code`, `"..": the enum code`, `"": the enum code`},
+		},
+		{
+			name: "code is an HTTP path segment",
+			mappings: map[string]string{
+				"_matrix": "/_matrix/client/versions",
+			},
+			wantProblems: []string{"_matrix: the enum code for /_matrix/client/versions is the first segment of an HTTP path"},
+		},
+	}
+	for _, tc := range cases {
+		_, err := NewCoAPPath(tc.mappings)
+		if len(tc.wantProblems) == 0 {
+			if err != nil {
+				t.Errorf("%s: NewCoAPPath returned error: %s", tc.name, err)
+			}
+			continue
+		}
+		pmErr, ok := err.(*PathMappingError)
+		if !ok {
+			t.Errorf("%s: got error %v want PathMappingError", tc.name, err)
+			continue
+		}
+		if len(pmErr.Problems) != len(tc.wantProblems) {
+			t.Errorf("%s: got %d problems want %d: %s", tc.name, len(pmErr.Problems), len(tc.wantProblems), err)
+		}
+		for _, want := range tc.wantProblems {
+			if !strings.Contains(err.Error(), want) {
+				t.Errorf("%s: error does not contain %q: %s", tc.name, want, err)
+			}
+		}
+	}
+}
+
+func TestPathsEmptyStateKey(t *testing.T) {
+	c, err := NewCoAPPath(coapv1pathMappings)
+	if err != nil {
+		t.Fatalf(err.Error())
+	}
+	httpPath := "/_matrix/client/r0/rooms/!foo:localhost/state/m.room.name/"
+	code := "/8/!foo:localhost/m.room.name"
+	if got := c.HTTPPathToCoapPath(httpPath); got != code {
+		t.Errorf("HTTPPathToCoapPath(%s) got %s want %s", httpPath, got, code)
+	}
+	if got := c.CoAPPathToHTTPPath(code); got != "/_matrix/client/r0/rooms/%21foo:localhost/state/m.room.name/" {
+		t.Errorf("CoAPPathToHTTPPath(%s) got %s", code, got)
+	}
+	// a template which ends here wins over an empty variable
+	if got := c.HTTPPathToCoapPath("/_matrix/client/r0/devices/"); got != "/d" {
+		t.Errorf("HTTPPathToCoapPath(/_matrix/client/r0/devices/) got %s want /d", got)
+	}
+}
+
+func TestPathsVariablePatterns(t *testing.T) {
+	c, err := NewCoAPPath(map[string]string{
+		"a": "/_matrix/client/r0/pushrules/{scope}/{kind}/{ruleId:.+}/actions",
+		"b": "/_matrix/client/r0/rooms/{roomId}/send/{eventType}/{txnId:[0-9]+}",
+		"c": "/_matrix/media/r0/download/{serverName}/{mediaId}/{path:.*}",
+		"d": "/_matrix/client/r0/rooms/{roomId}/state/{eventType}/{stateKey}",
+	})
+	if err != nil {
+		t.Fatalf("NewCoAPPath: %s", err)
+	}
+	cases := []struct {
+		httpPath string
+		coapPath string
+	}{
+		// a multi-segment variable is one CoAP path segment
+		{
+			httpPath: "/_matrix/client/r0/pushrules/global/override/a/b/actions",
+			coapPath: "/a/global/override/a%2Fb",
+		},
+		{
+			httpPath: "/_matrix/client/r0/pushrules/global/override/.m.rule.master/actions",
+			coapPath: "/a/global/override/.m.rule.master",
+		},
+		{
+			httpPath: "/_matrix/client/r0/rooms/!foo:bar/send/m.room.message/123",
+			coapPath: "/b/!foo:bar/m.room.message/123",
+		},
+		// a tail variable is several CoAP path segments
+		{
+			httpPath: "/_matrix/media/r0/download/example.com/abc/dir/file%20name.png",
+			coapPath: "/c/example.com/abc/dir/file%20name.png",
+		},
+		// reserved characters are escaped in a single-segment variable
+		{
+			httpPath: "/_matrix/client/r0/rooms/!foo:bar/state/m.type/a%2Fb%3Fc",
+			coapPath: "/d/!foo:bar/m.type/a%2Fb%3Fc",
+		},
+	}
+	for _, tc := range cases {
+		if got := c.HTTPPathToCoapPath(tc.httpPath); got != tc.coapPath {
+			t.Errorf("HTTPPathToCoapPath(%s) got %s want %s", tc.httpPath, got, tc.coapPath)
+		}
+		want := strings.Replace(tc.httpPath, "!foo", "%21foo", 1)
+		if got := c.CoAPPathToHTTPPath(tc.coapPath); got != want {
+			t.Errorf("CoAPPathToHTTPPath(%s) got %s want %s", tc.coapPath, got, want)
+		}
+	}
+	// values must match their pattern in both directions
+	for _, p := range []string{
+		"/_matrix/client/r0/rooms/!foo:bar/send/m.room.message/txn",
+		"/b/!foo:bar/m.room.message/txn",
+		"/b/!foo:bar/m.room.message",
+	} {
+		if got := c.HTTPPathToCoapPath(p); got != p {
+			t.Errorf("HTTPPathToCoapPath(%s) got %s want it unchanged", p, got)
+		}
+		if got := c.CoAPPathToHTTPPath(p); got != p {
+			t.Errorf("CoAPPathToHTTPPath(%s) got %s want it unchanged", p, got)
+		}
+	}
+	// CoAP path segments which aren't escaped are escaped in the HTTP path
+	if got := c.CoAPPathToHTTPPath("/d/!foo:bar/m.type/a b"); got != "/_matrix/client/r0/rooms/%21foo:bar/state/m.type/a%20b" {
+		t.Errorf("CoAPPathToHTTPPath got %s", got)
+	}
+}
+
+func TestPathsVariablesOverCoAP(t *testing.T) {
+	paths, err := NewCoAPPath(map[string]string{
+		"c": "/_matrix/media/r0/download/{serverName}/{mediaId}/{path:.*}",
+		"d": "/_matrix/client/r0/rooms/{roomId}/state/{eventType}/{stateKey}",
+	})
+	if err != nil {
+		t.Fatalf("NewCoAPPath: %s", err)
+	}
+	co := NewCoAPHTTP(paths)
+	for _, tc := range []struct {
+		httpPath string
+		options  []string
+	}{
+		{
+			httpPath: "/_matrix/client/r0/rooms/%21foo:bar/state/m.type/a%2Fb",
+			options:  []string{"d", "!foo:bar", "m.type", "a/b"},
+		},
+		{
+			httpPath: "/_matrix/media/r0/download/example.com/abc/1/2/3/4/5/6/7/8/9",
+			options:  []string{"c", "example.com", "abc", "1", "2", "3", "4", "5", "6", "7", "8", "9"},
+		},
+	} {
+		req, err := http.NewRequest("GET", "https://localhost"+tc.httpPath, nil)
+		if err != nil {
+			t.Fatalf("NewRequest: %s", err)
+		}
+		var got *http.Request
+		err = co.HTTPRequestToCoAP(req, func(msg *pool.Message) error {
+			options := make([]string, 16)
+			n, err := msg.Options().GetStrings(message.URIPath, options)
+			if err != nil {
+				return err
+			}
+			if !reflect.DeepEqual(options[:n], tc.options) {
+				t.Errorf("%s: got Uri-Path %q want %q", tc.httpPath, options[:n], tc.options)
+			}
+			r, err := pool.ConvertTo(msg)
+			if err != nil {
+				return err
+			}
+			r.Context = context.Background()
+			got = co.CoAPToHTTPRequest(r)
+			return nil
+		})
+		if err != nil {
+			t.Fatalf("HTTPRequestToCoAP: %s", err)
+		}
+		if got.URL.EscapedPath() != tc.httpPath {
+			t.Errorf("round trip: got %s want %s", got.URL.EscapedPath(), tc.httpPath)
+		}
+	}
+}
+
+func TestPathsSpecVersions(t *testing.T) {
+	c, err := NewCoAPPath(coapv1pathMappings)
+	if err != nil {
+		t.Fatalf(err.Error())
+	}
+	cases := []struct {
+		http string
+		code string
+	}{
+		{http: "/_matrix/client/r0/sync", code: "/7"},
+		{http: "/_matrix/client/v3/sync", code: "/7~3"},
+		{http: "/_matrix/client/v1/sync", code: "/7~1"},
+		{http: "/_matrix/client/unstable/sync", code: "/7~u"},
+		{http: "/_matrix/client/v3/rooms/!foo:localhost/send/m.room.message/txn1", code: "/9~3/!foo:localhost/m.room.message/txn1"},
+		{http: "/_matrix/media/v3/download/localhost/abcdef", code: "/w~3/localhost/abcdef"},
+		// not versioned
+		{http: "/_matrix/client/versions", code: "/0"},
+	}
+	for _, tc := range cases {
+		if got := c.HTTPPathToCoapPath(tc.http); got != tc.code {
+			t.Errorf("HTTPPathToCoapPath(%s) got %s want %s", tc.http, got, tc.code)
+		}
+		if got := c.CoAPPathToHTTPPath(tc.code); got != strings.Replace(tc.http, "!", "%21", 1) {
+			t.Errorf("CoAPPathToHTTPPath(%s) got %s want %s", tc.code, got, tc.http)
+		}
+		if got, want := c.Template(tc.http), c.Template(tc.code); got == "" || got != want {
+			t.Errorf("Template(%s) got %q, Template(%s) got %q", tc.http, got, tc.code, want)
+		}
+	}
+	if got := c.Template("/_matrix/client/v3/sync"); got != "/_matrix/client/r0/sync" {
+		t.Errorf("Template of v3 sync got %s", got)
+	}
+	// bad markers, and markers on templates without a spec version
+	for _, code := range []string{"/7~x", "/7~", "/0~3"} {
+		if got := c.CoAPPathToHTTPPath(code); got != code {
+			t.Errorf("CoAPPathToHTTPPath(%s) got %s want it unchanged", code, got)
+		}
+	}
+	// a version which isn't a spec version isn't aliased
+	if got := c.HTTPPathToCoapPath("/_matrix/client/x3/sync"); got != "/_matrix/client/x3/sync" {
+		t.Errorf("HTTPPathToCoapPath with a bad version got %s", got)
+	}
+
+	_, err = NewCoAPPath(map[string]string{
+		"a": "/_matrix/client/r0/x",
+		"b": "/_matrix/client/v3/x",
+	})
+	if err == nil || !strings.Contains(err.Error(), "match the same paths e.g /_matrix/client/r0/x") {
+		t.Errorf("templates for two spec versions of a path: got error %v", err)
+	}
+}
+
+func TestSyncObservationsSpecVersions(t *testing.T) {
+	c, err := NewCoAPPath(coapv1pathMappings)
+	if err != nil {
+		t.Fatalf(err.Error())
+	}
+	ob := NewSyncObservations(http.NotFoundHandler(), c, NewCBORCodecV1(true))
+	for _, path := range []string{"7", "7~3"} {
+		req, _ := http.NewRequest("GET", "https://localhost/_matrix/client/v3/sync", nil)
+		req = ob.updateFns[0](path, []byte(`{"next_batch":"s1"}`), req)
+		if got := req.URL.Query().Get("since"); got != "s1" {
+			t.Errorf("%s: got since=%q want s1", path, got)
+		}
+		if !ob.hasUpdatedFn(path, []byte(`{"next_batch":"s1"}`), []byte(`{"next_batch":"s2"}`)) {
+			t.Errorf("%s: new next_batch was not an update", path)
+		}
+		if ob.hasUpdatedFn(path, []byte(`{"next_batch":"s1"}`), []byte(`{"next_batch":"s1"}`)) {
+			t.Errorf("%s: same next_batch was an update", path)
+		}
+	}
+}
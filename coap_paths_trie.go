@@ -0,0 +1,212 @@
+// Copyright 2021 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package lb
+
+import (
+	"strings"
+)
+
+// maxTrieVars is the most variables a template in the trie can have. Matching records where each
+// variable is in an array of this size, so it doesn't allocate.
+const maxTrieVars = 8
+
+// pathTrie matches HTTP paths against templates one path segment at a time. At each segment a literal
+// match is tried before a variable, and the search backtracks if the literal branch fails, so the most
+// specific template always wins regardless of the order templates were added in. Variables match a
+// whole non-empty segment, like the default [^/]+ pattern, and a trailing slash is ignored. The
+// exception is a path which ends in a slash where no template ends: a template with one more variable
+// matches, with that variable empty.
+//
+// The spec version segment of /_matrix/{api}/{version}/... templates is stored separately from other
+// literals, so the template matches every spec version e.g r0, v3 and unstable.
+type pathTrie struct {
+	literals map[string]*pathTrie
+	variable *pathTrie
+	versions *pathTrie
+	// the enum code and template which end here, if any
+	code     string
+	template string
+	terminal bool
+	// the spec version of the template which ends here, if it has one
+	version string
+}
+
+// trieMatch is where the variables and spec version are in a matched path, as [start, end) indexes.
+type trieMatch struct {
+	vars    [maxTrieVars][2]int
+	version [2]int
+}
+
+func newPathTrie() *pathTrie {
+	return &pathTrie{
+		literals: make(map[string]*pathTrie),
+	}
+}
+
+// trieSegments returns the segments of the template, and false if the template cannot be added to the
+// trie because a variable is only part of a segment or has a custom pattern.
+func trieSegments(tpl string) ([]string, bool) {
+	tpl = strings.TrimSuffix(tpl, "/")
+	if !strings.HasPrefix(tpl, "/") {
+		return nil, false
+	}
+	segments := strings.Split(tpl[1:], "/")
+	numVars := 0
+	for _, seg := range segments {
+		if !strings.ContainsAny(seg, "{}") {
+			if seg == "" {
+				// a variable couldn't match this so neither can a literal
+				return nil, false
+			}
+			continue
+		}
+		if !strings.HasPrefix(seg, "{") || strings.Index(seg, "}") != len(seg)-1 || strings.Contains(seg, ":") {
+			return nil, false
+		}
+		numVars++
+	}
+	return segments, numVars <= maxTrieVars
+}
+
+// add the template to the trie. Returns false if the template cannot be added, see trieSegments.
+func (t *pathTrie) add(tpl, code string) bool {
+	segments, ok := trieSegments(tpl)
+	if !ok {
+		return false
+	}
+	node := t
+	version := ""
+	for i, seg := range segments {
+		if isVersionSegment(segments, i) {
+			if node.versions == nil {
+				node.versions = newPathTrie()
+			}
+			node = node.versions
+			version = seg
+			continue
+		}
+		if strings.HasPrefix(seg, "{") {
+			if node.variable == nil {
+				node.variable = newPathTrie()
+			}
+			node = node.variable
+			continue
+		}
+		child := node.literals[seg]
+		if child == nil {
+			child = newPathTrie()
+			node.literals[seg] = child
+		}
+		node = child
+	}
+	node.code = code
+	node.template = tpl
+	node.terminal = true
+	node.version = version
+	return true
+}
+
+// match the path from pos, which is the index of a '/' or the end of the path. The start and end of
+// each variable and the spec version are written to m. Returns the node the template ends at and the
+// number of variables, or nil if no template matches.
+func (t *pathTrie) match(path string, pos int, m *trieMatch, numVars int) (*pathTrie, int) {
+	if pos == len(path) || pos == len(path)-1 {
+		// the end of the path, or a trailing slash
+		if t.terminal {
+			return t, numVars
+		}
+		if pos == len(path)-1 && t.variable != nil && t.variable.terminal {
+			// an empty final variable e.g the state key in /rooms/{roomId}/state/{eventType}/ which
+			// is left out of the CoAP path
+			return t.variable, numVars
+		}
+		if pos == len(path) {
+			return nil, 0
+		}
+	}
+	start := pos + 1
+	end := strings.IndexByte(path[start:], '/')
+	if end == -1 {
+		end = len(path)
+	} else {
+		end += start
+	}
+	if start == end {
+		// an empty segment, which nothing matches
+		return nil, 0
+	}
+	if child := t.literals[path[start:end]]; child != nil {
+		if node, n := child.match(path, end, m, numVars); node != nil {
+			return node, n
+		}
+	}
+	if t.versions != nil && IsSpecVersion(path[start:end]) {
+		m.version = [2]int{start, end}
+		if node, n := t.versions.match(path, end, m, numVars); node != nil {
+			return node, n
+		}
+	}
+	if t.variable != nil {
+		m.vars[numVars] = [2]int{start, end}
+		if node, n := t.variable.match(path, end, m, numVars+1); node != nil {
+			return node, n
+		}
+	}
+	return nil, 0
+}
+
+// coapPath returns the CoAP path for the HTTP path, and false if no template in the trie matches.
+// The path must begin with a '/'.
+func (t *pathTrie) coapPath(path string) (string, bool) {
+	var m trieMatch
+	node, numVars := t.match(path, 0, &m, 0)
+	if node == nil {
+		return "", false
+	}
+	marker := ""
+	if version := path[m.version[0]:m.version[1]]; version != node.version {
+		marker = versionMarker(version)
+	}
+	size := 1 + len(node.code)
+	if marker != "" {
+		size += 1 + len(marker)
+	}
+	for i := 0; i < numVars; i++ {
+		size += 1 + m.vars[i][1] - m.vars[i][0]
+	}
+	var b strings.Builder
+	b.Grow(size)
+	b.WriteByte('/')
+	b.WriteString(node.code)
+	if marker != "" {
+		b.WriteByte(versionMarkerSeparator)
+		b.WriteString(marker)
+	}
+	for i := 0; i < numVars; i++ {
+		b.WriteByte('/')
+		b.WriteString(path[m.vars[i][0]:m.vars[i][1]])
+	}
+	return b.String(), true
+}
+
+// matchTemplate returns the template which matches the path, or "" if none do.
+func (t *pathTrie) matchTemplate(path string) string {
+	var m trieMatch
+	node, _ := t.match(path, 0, &m, 0)
+	if node == nil {
+		return ""
+	}
+	return node.template
+}
@@ -72,4 +72,19 @@ var coapv1pathMappings = map[string]string{
 	"s": "/_matrix/client/r0/user/{userId}/rooms/{roomId}/account_data/{type}",
 	"t": "/_matrix/client/r0/rooms/{roomId}/context/{eventId}",
 	"u": "/_matrix/client/r0/rooms/{roomId}/report/{eventId}",
+	"v": "/_matrix/media/r0/upload",
+	"w": "/_matrix/media/r0/download/{serverName}/{mediaId}",
+	"x": "/_matrix/media/r0/download/{serverName}/{mediaId}/{fileName}",
+	"y": "/_matrix/media/r0/thumbnail/{serverName}/{mediaId}",
+	"z": "/_matrix/media/r0/config",
+}
+
+// coapv1NonConfirmable are the enum paths and methods which can be sent as Non-confirmable messages.
+// These are ephemeral updates which are cheap to lose, and which the client does not need the
+// response for.
+var coapv1NonConfirmable = map[string][]string{
+	"Y": {"PUT"},  // typing
+	"Z": {"POST"}, // receipt
+	"a": {"POST"}, // read_markers
+	"b": {"PUT"},  // presence
 }
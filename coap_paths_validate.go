@@ -0,0 +1,210 @@
+// Copyright 2021 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package lb
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+)
+
+// PathMappingError is returned by NewCoAPPath when path mappings are invalid or ambiguous.
+type PathMappingError struct {
+	// Each problem found, with an example path where relevant. Sorted.
+	Problems []string
+}
+
+func (e *PathMappingError) Error() string {
+	return "invalid path mappings:\n  " + strings.Join(e.Problems, "\n  ")
+}
+
+// isURISafeCode returns true if the enum code is a single path segment made of unreserved URI
+// characters, so it never needs escaping. ~ is also unreserved, but it separates the code from the
+// spec version marker. https://datatracker.ietf.org/doc/html/rfc3986#section-2.3
+func isURISafeCode(code string) bool {
+	if code == "" || code == "." || code == ".." {
+		return false
+	}
+	for i := 0; i < len(code); i++ {
+		c := code[i]
+		switch {
+		case c >= 'a' && c <= 'z', c >= 'A' && c <= 'Z', c >= '0' && c <= '9':
+		case c == '-' || c == '.' || c == '_':
+		default:
+			return false
+		}
+	}
+	return true
+}
+
+// pathTemplate is a template split into segments, with variables replaced by "{}" and the spec
+// version by "{version}".
+type pathTemplate struct {
+	code     string
+	template string
+	segments []string
+	// the original segments, for building example paths
+	raw []string
+}
+
+// overlap returns an example path both templates match, and whether either is more specific.
+// Returns "" if no path matches both.
+func (a *pathTemplate) overlap(b *pathTemplate) (example string, aMoreSpecific, bMoreSpecific bool) {
+	if len(a.segments) != len(b.segments) {
+		return "", false, false
+	}
+	example = ""
+	for i := range a.segments {
+		aVar, bVar := a.segments[i] == "{}", b.segments[i] == "{}"
+		switch {
+		case !aVar && !bVar:
+			if a.segments[i] != b.segments[i] {
+				return "", false, false
+			}
+			example += "/" + a.raw[i]
+		case aVar && bVar:
+			example += "/" + strings.Trim(a.raw[i], "{}")
+		case aVar:
+			bMoreSpecific = true
+			example += "/" + b.segments[i]
+		default:
+			aMoreSpecific = true
+			example += "/" + a.segments[i]
+		}
+	}
+	return example, aMoreSpecific, bMoreSpecific
+}
+
+// examplePath returns a path the template matches, with each variable replaced by its name.
+func examplePath(tpl string) string {
+	idxs, err := braceIndices(tpl)
+	if err != nil {
+		return tpl
+	}
+	var b strings.Builder
+	end := 0
+	for i := 0; i < len(idxs); i += 2 {
+		b.WriteString(tpl[end:idxs[i]])
+		name := strings.SplitN(tpl[idxs[i]+1:idxs[i+1]-1], ":", 2)[0]
+		b.WriteString(name)
+		end = idxs[i+1]
+	}
+	b.WriteString(tpl[end:])
+	return b.String()
+}
+
+// validatePathMappings checks that every enum code is URI-safe and that no HTTP path could map to more
+// than one enum path, other than where one template is more specific than the other.
+func validatePathMappings(pathMappings map[string]string) error {
+	var problems []string
+	var templates []*pathTemplate
+	var regexps []*routeRegexp
+	firstSegments := make(map[string]bool)
+	for code, tpl := range pathMappings {
+		if !strings.HasPrefix(tpl, "/") {
+			problems = append(problems, fmt.Sprintf("%s: template %s must begin with /", code, tpl))
+			continue
+		}
+		firstSegments[strings.SplitN(tpl[1:], "/", 2)[0]] = true
+		if segments, ok := trieSegments(tpl); ok {
+			t := &pathTemplate{
+				code:     code,
+				template: tpl,
+				raw:      segments,
+				segments: make([]string, len(segments)),
+			}
+			for i, seg := range segments {
+				if strings.HasPrefix(seg, "{") {
+					seg = "{}"
+				} else if isVersionSegment(segments, i) {
+					// every spec version of a template is mapped to the same enum path
+					seg = "{version}"
+				}
+				t.segments[i] = seg
+			}
+			templates = append(templates, t)
+		} else if rxp, err := newRouteRegexp(tpl); err == nil {
+			regexps = append(regexps, rxp)
+		}
+	}
+	for code, tpl := range pathMappings {
+		if !isURISafeCode(code) {
+			problems = append(problems, fmt.Sprintf("%q: the enum code for %s must be a single path segment of unreserved URI characters other than ~", code, tpl))
+		} else if firstSegments[code] {
+			problems = append(problems, fmt.Sprintf("%s: the enum code for %s is the first segment of an HTTP path, so paths like /%s/... would be mapped", code, tpl, code))
+		}
+	}
+	sort.Slice(templates, func(i, j int) bool {
+		return templates[i].template < templates[j].template
+	})
+	for i, a := range templates {
+		for _, b := range templates[i+1:] {
+			example, aMoreSpecific, bMoreSpecific := a.overlap(b)
+			if example == "" {
+				continue
+			}
+			switch {
+			case !aMoreSpecific && !bMoreSpecific:
+				problems = append(problems, fmt.Sprintf(
+					"%s and %s: %s and %s match the same paths e.g %s", a.code, b.code, a.template, b.template, example,
+				))
+			case aMoreSpecific && bMoreSpecific:
+				problems = append(problems, fmt.Sprintf(
+					"%s and %s: %s and %s both match %s and neither is more specific", a.code, b.code, a.template, b.template, example,
+				))
+			}
+		}
+	}
+	// templates which can't be split into segments are checked against an example path of every other
+	// template, and the other way round, which finds most overlaps
+	for _, rxp := range regexps {
+		for code, tpl := range pathMappings {
+			if tpl == rxp.template {
+				continue
+			}
+			other, err := newRouteRegexp(tpl)
+			if err != nil {
+				continue
+			}
+			example := examplePath(tpl)
+			if !rxp.regexp.MatchString(example) {
+				example = examplePath(rxp.template)
+				if !other.regexp.MatchString(example) {
+					continue
+				}
+			}
+			problems = append(problems, fmt.Sprintf(
+				"%s and %s: %s and %s both match %s", pathMappingCode(pathMappings, rxp.template), code, rxp.template, tpl, example,
+			))
+		}
+	}
+	if len(problems) == 0 {
+		return nil
+	}
+	sort.Strings(problems)
+	return &PathMappingError{
+		Problems: problems,
+	}
+}
+
+// pathMappingCode returns the enum code of the template.
+func pathMappingCode(pathMappings map[string]string, tpl string) string {
+	for code, t := range pathMappings {
+		if t == tpl {
+			return code
+		}
+	}
+	return ""
+}
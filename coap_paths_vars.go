@@ -0,0 +1,162 @@
+// Copyright 2021 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package lb
+
+import (
+	"net/url"
+	"regexp"
+	"regexp/syntax"
+	"strings"
+)
+
+// pathVar is a {name} or {name:pattern} variable in a path template.
+type pathVar struct {
+	name string
+	// checks the value in the HTTP path, or nil if the variable has the default pattern
+	validator *regexp.Regexp
+	// the pattern can match a '/', so the value can span several HTTP path segments
+	multiSegment bool
+	// a multi-segment variable at the end of the template. Each HTTP path segment of the value is a
+	// CoAP path segment. The '/'s in the value of other multi-segment variables are escaped, so the
+	// value is a single CoAP path segment.
+	tail bool
+}
+
+// templateVars is a path template split into its variables and the literal text around them.
+type templateVars struct {
+	// the text before each variable, then the text after the last variable
+	literals []string
+	vars     []pathVar
+}
+
+// newTemplateVars splits the template into variables and literals.
+func newTemplateVars(rxp *routeRegexp) (*templateVars, error) {
+	idxs, err := braceIndices(rxp.template)
+	if err != nil {
+		return nil, err
+	}
+	tv := &templateVars{
+		vars: make([]pathVar, len(idxs)/2),
+	}
+	end := 0
+	for i := 0; i < len(idxs); i += 2 {
+		tv.literals = append(tv.literals, rxp.template[end:idxs[i]])
+		end = idxs[i+1]
+		v := pathVar{
+			name: rxp.varsN[i/2],
+		}
+		if parts := strings.SplitN(rxp.template[idxs[i]+1:end-1], ":", 2); len(parts) == 2 {
+			v.validator = rxp.varsR[i/2]
+			v.multiSegment, err = patternMatchesSlash(parts[1])
+			if err != nil {
+				return nil, err
+			}
+		}
+		tv.vars[i/2] = v
+	}
+	rest := rxp.template[end:]
+	tv.literals = append(tv.literals, rest)
+	if n := len(tv.vars); n > 0 && tv.vars[n-1].multiSegment && strings.TrimSuffix(rest, "/") == "" {
+		tv.vars[n-1].tail = true
+	}
+	return tv, nil
+}
+
+// patternMatchesSlash returns true if the regexp pattern can match a string containing a '/'.
+func patternMatchesSlash(pattern string) (bool, error) {
+	re, err := syntax.Parse(pattern, syntax.Perl)
+	if err != nil {
+		return false, err
+	}
+	return regexpMatchesSlash(re), nil
+}
+
+func regexpMatchesSlash(re *syntax.Regexp) bool {
+	switch re.Op {
+	case syntax.OpAnyChar, syntax.OpAnyCharNotNL:
+		return true
+	case syntax.OpLiteral:
+		for _, r := range re.Rune {
+			if r == '/' {
+				return true
+			}
+		}
+	case syntax.OpCharClass:
+		// pairs of inclusive ranges
+		for i := 0; i+1 < len(re.Rune); i += 2 {
+			if re.Rune[i] <= '/' && '/' <= re.Rune[i+1] {
+				return true
+			}
+		}
+	}
+	for _, sub := range re.Sub {
+		if regexpMatchesSlash(sub) {
+			return true
+		}
+	}
+	return false
+}
+
+// escapePathSegment percent-encodes a path segment so it can go in an HTTP path. Segments which are
+// already percent-encoded are not encoded twice.
+func escapePathSegment(seg string) string {
+	if unescaped, err := url.PathUnescape(seg); err == nil {
+		seg = unescaped
+	}
+	return url.PathEscape(seg)
+}
+
+// escapeMultiSegment percent-encodes the value of a multi-segment variable, other than its '/'s.
+func escapeMultiSegment(val string) string {
+	return strings.ReplaceAll(escapePathSegment(val), "%2F", "/")
+}
+
+// rewriteVars returns the CoAP path with the value of each single-segment variable replaced by what fn
+// returns for it. Returns the input path if it isn't an enum path.
+func (c *CoAPPath) rewriteVars(coapPath string, fn func(name, val string) string) string {
+	path := coapPath
+	if !strings.HasPrefix(path, "/") {
+		path = "/" + path
+	}
+	segments := strings.Split(path, "/")
+	if len(segments) < 3 {
+		return coapPath
+	}
+	code := segments[1]
+	if i := strings.IndexByte(code, versionMarkerSeparator); i != -1 {
+		code = code[:i]
+	}
+	tv, ok := c.vars[code]
+	if !ok {
+		return coapPath
+	}
+	changed := false
+	for i, v := range tv.vars {
+		if v.tail || i+2 >= len(segments) {
+			break
+		}
+		if v.multiSegment {
+			continue
+		}
+		if val := fn(v.name, segments[i+2]); val != segments[i+2] {
+			segments[i+2] = val
+			changed = true
+		}
+	}
+	if !changed {
+		return coapPath
+	}
+	return strings.Join(segments, "/")
+}
@@ -0,0 +1,70 @@
+// Copyright 2021 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package lb
+
+// The enum paths of a family of spec versions are shared, so /_matrix/client/r0/sync and
+// /_matrix/client/v3/sync are both sent as enum path 7. When the client uses a different spec version
+// to the template, the enum code is followed by a marker so the original prefix can be rebuilt e.g
+// /7~3 is /_matrix/client/v3/sync. The markers are:
+//
+//	r0       => r
+//	unstable => u
+//	vN       => N
+const versionMarkerSeparator = '~'
+
+// IsSpecVersion returns true if this path segment is a Matrix spec version e.g r0, v3 or unstable.
+func IsSpecVersion(seg string) bool {
+	if seg == "r0" || seg == "unstable" {
+		return true
+	}
+	if len(seg) < 2 || seg[0] != 'v' {
+		return false
+	}
+	for i := 1; i < len(seg); i++ {
+		if seg[i] < '0' || seg[i] > '9' {
+			return false
+		}
+	}
+	return true
+}
+
+// isVersionSegment returns true if the i'th segment of the path is the spec version of a
+// /_matrix/{api}/{version}/... path. segments must not include the empty segment before the leading /.
+func isVersionSegment(segments []string, i int) bool {
+	return i == 2 && len(segments) > 2 && segments[0] == "_matrix" && IsSpecVersion(segments[2])
+}
+
+// versionMarker returns the marker for the spec version.
+func versionMarker(version string) string {
+	switch version {
+	case "r0":
+		return "r"
+	case "unstable":
+		return "u"
+	}
+	return version[1:]
+}
+
+// parseVersionMarker returns the spec version for the marker, and false if it isn't a marker.
+func parseVersionMarker(marker string) (string, bool) {
+	switch marker {
+	case "r":
+		return "r0", true
+	case "u":
+		return "unstable", true
+	}
+	version := "v" + marker
+	return version, IsSpecVersion(version)
+}
@@ -0,0 +1,88 @@
+// Copyright 2021 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package lb
+
+import (
+	"net"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+
+	"github.com/matrix-org/go-coap/v2/message"
+)
+
+const ctxValForwardProxy = "ctxValForwardProxy"
+
+// forwardProxyTarget returns the scheme and host (with port if one was given) of a request which uses
+// the Proxy-Uri or Proxy-Scheme options, or ok=false if the request isn't for a forward proxy.
+// https://datatracker.ietf.org/doc/html/rfc7252#section-5.10.2
+func forwardProxyTarget(opts message.Options) (scheme, host string, ok bool) {
+	if proxyURI, err := opts.GetString(message.ProxyURI); err == nil {
+		u, err := url.Parse(proxyURI)
+		if err != nil {
+			return "", "", true
+		}
+		return u.Scheme, u.Host, true
+	}
+	scheme, err := opts.GetString(message.ProxyScheme)
+	if err != nil {
+		return "", "", false
+	}
+	host, _ = opts.GetString(message.URIHost)
+	if port, err := opts.GetUint32(message.URIPort); err == nil {
+		host = net.JoinHostPort(host, strconv.FormatUint(uint64(port), 10))
+	}
+	return scheme, host, true
+}
+
+// forwardProxyAllowed returns true if this scheme and host are in ProxyHosts.
+func (co *CoAPHTTP) forwardProxyAllowed(scheme, host string) bool {
+	if scheme != "https" && scheme != "http" {
+		// we only speak HTTP to the upstream, not CoAP
+		return false
+	}
+	host = strings.ToLower(host)
+	hostname := host
+	if h, _, err := net.SplitHostPort(host); err == nil {
+		hostname = h
+	}
+	for _, allowed := range co.ProxyHosts {
+		allowed = strings.ToLower(allowed)
+		if allowed == host || allowed == hostname {
+			return true
+		}
+	}
+	return false
+}
+
+// forwardProxyURL returns the base URL and the path and query of a forward proxy request in Proxy-Uri.
+// Paths can be HTTP paths or CoAP enum paths.
+func (co *CoAPHTTP) forwardProxyURL(proxyURI string) (base, path, rawQuery string, err error) {
+	u, err := url.Parse(proxyURI)
+	if err != nil {
+		return "", "", "", err
+	}
+	path = co.Paths.CoAPPathToHTTPPath(u.EscapedPath())
+	return u.Scheme + "://" + u.Host, path, u.RawQuery, nil
+}
+
+// IsForwardProxyRequest returns true if the HTTP request made by CoAPToHTTPRequest is for the host in
+// its URL because the client used the Proxy-Uri or Proxy-Scheme options, rather than for the server
+// which received it.
+func IsForwardProxyRequest(req *http.Request) bool {
+	isProxy, _ := req.Context().Value(ctxValForwardProxy).(bool)
+	return isProxy
+}
@@ -0,0 +1,338 @@
+// Copyright 2021 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package lb
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+
+	"github.com/matrix-org/go-coap/v2/message"
+	"github.com/matrix-org/go-coap/v2/message/codes"
+	coapmux "github.com/matrix-org/go-coap/v2/mux"
+	"github.com/matrix-org/go-coap/v2/tcp"
+	tcppool "github.com/matrix-org/go-coap/v2/tcp/message/pool"
+	"github.com/matrix-org/go-coap/v2/udp/message/pool"
+)
+
+func TestForwardProxy(t *testing.T) {
+	server := NewCoAPHTTP(NewCoAPPathV1())
+	server.ProxyHosts = []string{"hs1.example.com", "hs2.example.com:8448"}
+	var gotURL string
+	router := coapmux.NewRouter()
+	router.DefaultHandle(server.CoAPHTTPHandler(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		if !IsForwardProxyRequest(req) {
+			t.Errorf("%s is not a forward proxy request", req.URL)
+		}
+		gotURL = strings.TrimSuffix(req.URL.String(), "?")
+		w.WriteHeader(200)
+		w.Write([]byte("{}"))
+	}), nil))
+
+	l := NewWebSocketListener()
+	defer l.Close()
+	srv := httptest.NewServer(l)
+	defer srv.Close()
+	ignoreErrors := tcp.WithErrors(func(err error) {})
+	coapServer := tcp.NewServer(tcp.WithMux(router), ignoreErrors)
+	defer coapServer.Stop()
+	go coapServer.Serve(l)
+	srvURL, _ := url.Parse(srv.URL)
+	conn, err := DialWebSocket(&url.URL{Scheme: "coap+ws", Host: srvURL.Host}, nil)
+	if err != nil {
+		t.Fatalf("DialWebSocket: %s", err)
+	}
+	cc := tcp.Client(conn, ignoreErrors)
+	defer cc.Close()
+
+	client := NewCoAPHTTP(NewCoAPPathV1())
+	client.SendProxyScheme = true
+	cases := []struct {
+		url        string
+		wantStatus int
+	}{
+		{url: "https://hs1.example.com/_matrix/client/r0/sync?since=s1", wantStatus: 200},
+		{url: "https://hs1.example.com:8448/_matrix/client/versions", wantStatus: 200},
+		{url: "https://hs2.example.com:8448/_matrix/client/versions", wantStatus: 200},
+		// only port 8448 is allowed
+		{url: "https://hs2.example.com/_matrix/client/versions", wantStatus: 502},
+		{url: "https://evil.example.com/_matrix/client/versions", wantStatus: 502},
+		{url: "http://127.0.0.1:8008/_matrix/client/versions", wantStatus: 502},
+	}
+	for _, tc := range cases {
+		gotURL = ""
+		req, _ := http.NewRequest("GET", tc.url, nil)
+		var res *http.Response
+		err = client.HTTPRequestToCoAPTCP(req, func(msg *tcppool.Message) error {
+			coapRes, err := cc.Do(msg)
+			if err != nil {
+				return err
+			}
+			res = client.CoAPTCPToHTTPResponse(coapRes)
+			return nil
+		})
+		if err != nil {
+			t.Fatalf("%s: HTTPRequestToCoAPTCP: %s", tc.url, err)
+		}
+		if res.StatusCode != tc.wantStatus {
+			t.Errorf("%s: got status %d want %d", tc.url, res.StatusCode, tc.wantStatus)
+		}
+		if tc.wantStatus == 200 && gotURL != tc.url {
+			t.Errorf("%s: forwarded to %s", tc.url, gotURL)
+		}
+		if tc.wantStatus != 200 && gotURL != "" {
+			t.Errorf("%s: forwarded to %s but should have been rejected", tc.url, gotURL)
+		}
+	}
+}
+
+func TestForwardProxyURI(t *testing.T) {
+	co := NewCoAPHTTP(NewCoAPPathV1())
+	cases := []struct {
+		proxyURI string
+		want     string
+	}{
+		{
+			proxyURI: "https://hs1.example.com/_matrix/client/r0/join/%23room:example.com?server_name=example.com",
+			want:     "https://hs1.example.com/_matrix/client/r0/join/%23room:example.com?server_name=example.com",
+		},
+		// enum paths can be used to save bytes
+		{
+			proxyURI: "https://hs1.example.com/L/%23room:example.com",
+			want:     "https://hs1.example.com/_matrix/client/r0/join/%23room:example.com?",
+		},
+	}
+	for _, tc := range cases {
+		msg := pool.AcquireMessage(nil)
+		msg.SetCode(codes.POST)
+		msg.SetOptionString(message.ProxyURI, tc.proxyURI)
+		r, err := pool.ConvertTo(msg)
+		if err != nil {
+			t.Fatalf("ConvertTo: %s", err)
+		}
+		req := co.CoAPToHTTPRequest(r)
+		if req == nil {
+			t.Fatalf("%s: CoAPToHTTPRequest returned nil", tc.proxyURI)
+		}
+		if got := req.URL.String(); got != tc.want {
+			t.Errorf("%s: got %s want %s", tc.proxyURI, got, tc.want)
+		}
+		if !IsForwardProxyRequest(req) {
+			t.Errorf("%s: not a forward proxy request", tc.proxyURI)
+		}
+		pool.ReleaseMessage(msg)
+	}
+}
+
+// TestForwardProxyAccessTokens checks that the access token a client uses with the proxy's own homeserver is
+// never sent to a homeserver it forwards requests to.
+func TestForwardProxyAccessTokens(t *testing.T) {
+	server := NewCoAPHTTP(NewCoAPPathV1())
+	server.ProxyHosts = []string{"hs2.example.com"}
+	gotAuth := make(map[string]string)
+	router := coapmux.NewRouter()
+	router.DefaultHandle(server.CoAPHTTPHandler(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		gotAuth[req.URL.Host] = req.Header.Get("Authorization")
+		w.WriteHeader(200)
+		w.Write([]byte("{}"))
+	}), nil))
+
+	l := NewWebSocketListener()
+	defer l.Close()
+	srv := httptest.NewServer(l)
+	defer srv.Close()
+	ignoreErrors := tcp.WithErrors(func(err error) {})
+	coapServer := tcp.NewServer(tcp.WithMux(router), ignoreErrors)
+	defer coapServer.Stop()
+	go coapServer.Serve(l)
+	srvURL, _ := url.Parse(srv.URL)
+	conn, err := DialWebSocket(&url.URL{Scheme: "coap+ws", Host: srvURL.Host}, nil)
+	if err != nil {
+		t.Fatalf("DialWebSocket: %s", err)
+	}
+	cc := tcp.Client(conn, ignoreErrors)
+	defer cc.Close()
+
+	client := NewCoAPHTTP(NewCoAPPathV1())
+	client.SendProxyScheme = true
+	// send returns the response code and the alias issued in the response, if any
+	send := func(rawURL, authHeader string, alias []byte) (codes.Code, []byte) {
+		t.Helper()
+		req, _ := http.NewRequest("GET", rawURL, nil)
+		if authHeader != "" {
+			req.Header.Set("Authorization", authHeader)
+		}
+		var code codes.Code
+		var issued []byte
+		err := client.HTTPRequestToCoAPTCP(req, func(msg *tcppool.Message) error {
+			if req.URL.Host == "localhost" {
+				// the proxy's own homeserver
+				msg.Remove(message.ProxyScheme)
+				msg.Remove(message.URIHost)
+			}
+			if alias != nil {
+				msg.SetOptionBytes(OptionIDAccessTokenAlias, alias)
+			}
+			res, err := cc.Do(msg)
+			if err != nil {
+				return err
+			}
+			code = res.Code()
+			if a, err := res.Options().GetBytes(OptionIDAccessTokenAlias); err == nil {
+				issued = append([]byte(nil), a...)
+			}
+			return nil
+		})
+		if err != nil {
+			t.Fatalf("%s: HTTPRequestToCoAPTCP: %s", rawURL, err)
+		}
+		return code, issued
+	}
+	// the session learns the access token for the proxy's own homeserver and is issued an alias for it
+	code, alias := send("https://localhost/_matrix/client/r0/sync", "Bearer local_token", nil)
+	if code != codes.Content {
+		t.Fatalf("local request got %v want %v", code, codes.Content)
+	}
+	if alias == nil {
+		t.Fatalf("no alias was issued for the local access token")
+	}
+
+	// requests without an access token are forwarded without one
+	if code, _ := send("https://hs2.example.com/_matrix/client/r0/sync", "", nil); code != codes.Content {
+		t.Errorf("forwarded request got %v want %v", code, codes.Content)
+	}
+	if got := gotAuth["hs2.example.com"]; got != "" {
+		t.Errorf("forwarded request was sent the session's access token: %q", got)
+	}
+	// aliases can't be used to send the token to another homeserver
+	gotAuth = make(map[string]string)
+	if code, _ := send("https://hs2.example.com/_matrix/client/r0/sync", "", alias); code != codes.Unauthorized {
+		t.Errorf("forwarded request with an alias got %v want %v", code, codes.Unauthorized)
+	}
+	if _, ok := gotAuth["hs2.example.com"]; ok {
+		t.Errorf("forwarded request with an alias was sent upstream")
+	}
+	// full tokens are forwarded, but not remembered for the proxy's own homeserver
+	if code, issued := send("https://hs2.example.com/_matrix/client/r0/sync", "Bearer remote_token", nil); code != codes.Content || issued != nil {
+		t.Errorf("forwarded request got %v and alias %x, want %v and no alias", code, issued, codes.Content)
+	}
+	if got := gotAuth["hs2.example.com"]; got != "Bearer remote_token" {
+		t.Errorf("forwarded request got access token %q want %q", got, "Bearer remote_token")
+	}
+	if code, _ := send("https://localhost/_matrix/client/r0/sync", "", nil); code != codes.Content {
+		t.Errorf("local request got %v want %v", code, codes.Content)
+	}
+	if got := gotAuth["localhost"]; got != "Bearer local_token" {
+		t.Errorf("local request got access token %q want %q", got, "Bearer local_token")
+	}
+}
+
+// TestVirtualHostAccessTokens checks that a session which sends requests to several homeservers with the
+// Uri-Host option never sends the access token of one homeserver to another.
+func TestVirtualHostAccessTokens(t *testing.T) {
+	server := NewCoAPHTTP(NewCoAPPathV1())
+	gotAuth := make(map[string]string)
+	router := coapmux.NewRouter()
+	router.DefaultHandle(server.CoAPHTTPHandler(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		gotAuth[req.URL.Host] = req.Header.Get("Authorization")
+		w.WriteHeader(200)
+		w.Write([]byte("{}"))
+	}), nil))
+
+	l := NewWebSocketListener()
+	defer l.Close()
+	srv := httptest.NewServer(l)
+	defer srv.Close()
+	ignoreErrors := tcp.WithErrors(func(err error) {})
+	coapServer := tcp.NewServer(tcp.WithMux(router), ignoreErrors)
+	defer coapServer.Stop()
+	go coapServer.Serve(l)
+	srvURL, _ := url.Parse(srv.URL)
+	conn, err := DialWebSocket(&url.URL{Scheme: "coap+ws", Host: srvURL.Host}, nil)
+	if err != nil {
+		t.Fatalf("DialWebSocket: %s", err)
+	}
+	cc := tcp.Client(conn, ignoreErrors)
+	defer cc.Close()
+
+	client := NewCoAPHTTP(NewCoAPPathV1())
+	client.SendURIHost = true
+	// send returns the response code and the alias issued in the response, if any
+	send := func(host, authHeader string, alias []byte) (codes.Code, []byte) {
+		t.Helper()
+		req, _ := http.NewRequest("GET", "https://"+host+"/_matrix/client/r0/sync", nil)
+		if authHeader != "" {
+			req.Header.Set("Authorization", authHeader)
+		}
+		var code codes.Code
+		var issued []byte
+		err := client.HTTPRequestToCoAPTCP(req, func(msg *tcppool.Message) error {
+			if alias != nil {
+				msg.SetOptionBytes(OptionIDAccessTokenAlias, alias)
+			}
+			res, err := cc.Do(msg)
+			if err != nil {
+				return err
+			}
+			code = res.Code()
+			if a, err := res.Options().GetBytes(OptionIDAccessTokenAlias); err == nil {
+				issued = append([]byte(nil), a...)
+			}
+			return nil
+		})
+		if err != nil {
+			t.Fatalf("%s: HTTPRequestToCoAPTCP: %s", host, err)
+		}
+		return code, issued
+	}
+	code, alias1 := send("hs1.example.com", "Bearer hs1_token", nil)
+	if code != codes.Content || alias1 == nil {
+		t.Fatalf("hs1 request got %v and alias %x, want %v and an alias", code, alias1, codes.Content)
+	}
+
+	// the token for hs1 isn't added to requests for hs2
+	if code, _ := send("hs2.example.com", "", nil); code != codes.Content {
+		t.Errorf("hs2 request got %v want %v", code, codes.Content)
+	}
+	if got := gotAuth["hs2.example.com"]; got != "" {
+		t.Errorf("hs2 request was sent the access token of hs1: %q", got)
+	}
+	// nor can the alias for it be used with hs2
+	delete(gotAuth, "hs2.example.com")
+	if code, _ := send("hs2.example.com", "", alias1); code != codes.Unauthorized {
+		t.Errorf("hs2 request with the alias of hs1 got %v want %v", code, codes.Unauthorized)
+	}
+	if _, ok := gotAuth["hs2.example.com"]; ok {
+		t.Errorf("hs2 request with the alias of hs1 was sent upstream")
+	}
+
+	// each host has its own token
+	if code, _ := send("hs2.example.com", "Bearer hs2_token", nil); code != codes.Content {
+		t.Errorf("hs2 request got %v want %v", code, codes.Content)
+	}
+	for host, want := range map[string]string{"hs1.example.com": "Bearer hs1_token", "hs2.example.com": "Bearer hs2_token"} {
+		if code, _ := send(host, "", nil); code != codes.Content {
+			t.Errorf("%s request got %v want %v", host, code, codes.Content)
+		}
+		if got := gotAuth[host]; got != want {
+			t.Errorf("%s request got access token %q want %q", host, got, want)
+		}
+	}
+	if code, _ := send("hs1.example.com", "", alias1); code != codes.Content || gotAuth["hs1.example.com"] != "Bearer hs1_token" {
+		t.Errorf("hs1 request with its alias got %v and access token %q", code, gotAuth["hs1.example.com"])
+	}
+}
@@ -0,0 +1,154 @@
+// Copyright 2021 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package lb
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+)
+
+// CoAPQuery handles mapping to and from HTTP query parameters and CoAP Uri-Query options.
+// The mapping function converts things like:
+//
+//	?since=s72594_4483_1934&set_presence=offline  =>  Uri-Query: 0=s72594_4483_1934, Uri-Query: 4=0
+//
+// Query keys are replaced with their enum code. Values of enumerated keys (e.g set_presence) are
+// replaced with their enum code too, other values are sent as they are. A nil *CoAPQuery sends
+// queries as they are.
+type CoAPQuery struct {
+	// enum code -> query key
+	keys map[string]string
+	// query key -> enum code
+	keyCodes map[string]string
+	// query key -> enum code -> value
+	values map[string]map[string]string
+	// query key -> value -> enum code
+	valueCodes map[string]map[string]string
+}
+
+// NewCoAPQuery makes a CoAPQuery with the query mappings given. `keys` MUST be in the form:
+//
+//	{
+//	   "1": "since"
+//	}
+//
+// where the keys are the enum codes and the values are the query keys. `values` maps query keys to
+// their enumerated values, in the same form:
+//
+//	{
+//	   "set_presence": { "0": "offline" }
+//	}
+//
+// Only the values of keys in `keys` can be enumerated. Enum codes cannot contain '=' or '&', and key
+// codes cannot be the same as a query key, so an enum code is never mistaken for a query key.
+//
+// Users of this library should prefer NewCoAPQueryV1 which sets up all the enum keys for you. This
+// function is exposed for bleeding edge or custom enums.
+func NewCoAPQuery(keys map[string]string, values map[string]map[string]string) (*CoAPQuery, error) {
+	q := CoAPQuery{
+		keys:       keys,
+		keyCodes:   make(map[string]string, len(keys)),
+		values:     values,
+		valueCodes: make(map[string]map[string]string, len(values)),
+	}
+	var problems []string
+	for code, key := range keys {
+		if !isQueryCode(code) {
+			problems = append(problems, fmt.Sprintf("key code %q must be non-empty and not contain '=' or '&'", code))
+		}
+		if other, ok := q.keyCodes[key]; ok {
+			problems = append(problems, fmt.Sprintf("key %q has codes %q and %q", key, code, other))
+		}
+		if _, ok := keys[key]; ok {
+			problems = append(problems, fmt.Sprintf("key %q is also a key code", key))
+		}
+		q.keyCodes[key] = code
+	}
+	for key, vals := range values {
+		if _, ok := q.keyCodes[key]; !ok {
+			problems = append(problems, fmt.Sprintf("values are enumerated for key %q which has no code", key))
+		}
+		q.valueCodes[key] = make(map[string]string, len(vals))
+		for code, val := range vals {
+			if !isQueryCode(code) {
+				problems = append(problems, fmt.Sprintf("value code %q of key %q must be non-empty and not contain '=' or '&'", code, key))
+			}
+			if other, ok := q.valueCodes[key][val]; ok {
+				problems = append(problems, fmt.Sprintf("value %q of key %q has codes %q and %q", val, key, code, other))
+			}
+			q.valueCodes[key][val] = code
+		}
+	}
+	if len(problems) > 0 {
+		// map iteration order is random, so sort for a stable error
+		sort.Strings(problems)
+		return nil, fmt.Errorf("bad query mappings: %s", strings.Join(problems, "; "))
+	}
+	return &q, nil
+}
+
+// Keys returns a copy of the query key mappings, keyed by enum code.
+func (q *CoAPQuery) Keys() map[string]string {
+	keys := make(map[string]string, len(q.keys))
+	for code, key := range q.keys {
+		keys[code] = key
+	}
+	return keys
+}
+
+func isQueryCode(code string) bool {
+	return code != "" && !strings.ContainsAny(code, "=&")
+}
+
+// Encode returns the Uri-Query option for this query key and value.
+func (q *CoAPQuery) Encode(key, value string) string {
+	if q == nil {
+		return key + "=" + value
+	}
+	code, ok := q.keyCodes[key]
+	if !ok {
+		return key + "=" + value
+	}
+	if valCode, ok := q.valueCodes[key][value]; ok {
+		return code + "=" + valCode
+	}
+	if _, ok := q.values[key][value]; ok {
+		// the value is the same as the code for a different value, so send the key as it is, which
+		// tells Decode not to look the value up
+		return key + "=" + value
+	}
+	return code + "=" + value
+}
+
+// Decode returns the query key and value for this Uri-Query option. Returns false if the option is
+// not in the form key=value.
+func (q *CoAPQuery) Decode(option string) (key, value string, ok bool) {
+	kvs := strings.SplitN(option, "=", 2)
+	if len(kvs) != 2 {
+		return "", "", false
+	}
+	key, value = kvs[0], kvs[1]
+	if q == nil {
+		return key, value, true
+	}
+	if k, ok := q.keys[key]; ok {
+		key = k
+		if v, ok := q.values[key][value]; ok {
+			value = v
+		}
+	}
+	return key, value, true
+}
@@ -0,0 +1,141 @@
+// Copyright 2021 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package lb
+
+import (
+	"context"
+	"net/http"
+	"net/url"
+	"reflect"
+	"sort"
+	"strings"
+	"testing"
+
+	"github.com/matrix-org/go-coap/v2/udp/message/pool"
+)
+
+func TestCoAPQuery(t *testing.T) {
+	q, err := NewCoAPQuery(map[string]string{
+		"1": "since",
+		"2": "set_presence",
+	}, map[string]map[string]string{
+		"set_presence": {
+			"o": "offline",
+			"u": "unavailable",
+		},
+	})
+	if err != nil {
+		t.Fatalf("NewCoAPQuery: %s", err)
+	}
+	cases := []struct {
+		key    string
+		value  string
+		option string
+	}{
+		{key: "since", value: "s72594_4483_1934", option: "1=s72594_4483_1934"},
+		{key: "set_presence", value: "offline", option: "2=o"},
+		{key: "set_presence", value: "online", option: "2=online"},
+		// the value is a code for a different value, so the key is sent as it is
+		{key: "set_presence", value: "u", option: "set_presence=u"},
+		{key: "limit", value: "5", option: "limit=5"},
+		{key: "since", value: "a=b", option: "1=a=b"},
+		{key: "limit", value: "", option: "limit="},
+	}
+	for _, tc := range cases {
+		option := q.Encode(tc.key, tc.value)
+		if option != tc.option {
+			t.Errorf("Encode(%s, %s): got %s want %s", tc.key, tc.value, option, tc.option)
+		}
+		key, value, ok := q.Decode(option)
+		if !ok || key != tc.key || value != tc.value {
+			t.Errorf("Decode(%s): got %s=%s (%v) want %s=%s", option, key, value, ok, tc.key, tc.value)
+		}
+	}
+	if _, _, ok := q.Decode("malformed"); ok {
+		t.Errorf("Decode: accepted an option without '='")
+	}
+	var none *CoAPQuery
+	if option := none.Encode("since", "x"); option != "since=x" {
+		t.Errorf("nil Encode: got %s want since=x", option)
+	}
+	if key, value, ok := none.Decode("1=x"); !ok || key != "1" || value != "x" {
+		t.Errorf("nil Decode: got %s=%s (%v) want 1=x", key, value, ok)
+	}
+}
+
+func TestCoAPQueryValidation(t *testing.T) {
+	_, err := NewCoAPQuery(map[string]string{
+		"a=": "since",
+		"1":  "timeout",
+		"2":  "timeout",
+		"3":  "1",
+	}, map[string]map[string]string{
+		"dir": {"b": "backwards"},
+		"1":   {"": "x"},
+	})
+	if err == nil {
+		t.Fatalf("NewCoAPQuery: accepted bad mappings")
+	}
+	for _, want := range []string{
+		`key code "a=" must be non-empty`,
+		`key "timeout" has codes`,
+		`key "1" is also a key code`,
+		`values are enumerated for key "dir" which has no code`,
+		`value code "" of key "1" must be non-empty`,
+	} {
+		if !strings.Contains(err.Error(), want) {
+			t.Errorf("error %q does not contain %q", err, want)
+		}
+	}
+	if _, err := NewCoAPQuery(coapv1QueryKeys, coapv1QueryValues); err != nil {
+		t.Errorf("v1 query mappings are invalid: %s", err)
+	}
+}
+
+func TestCoAPHTTPQueries(t *testing.T) {
+	co := NewCoAPHTTP(NewCoAPPathV1())
+	co.Queries = NewCoAPQueryV1()
+	rawURL := "https://localhost/_matrix/client/r0/rooms/!foo:bar/messages?dir=b&from=t1-2&limit=20&filter=" +
+		url.QueryEscape(`{"lazy_load_members":true}`) + "&custom=1&custom=2"
+	req, err := http.NewRequest("GET", rawURL, nil)
+	if err != nil {
+		t.Fatalf("NewRequest: %s", err)
+	}
+	var got *http.Request
+	err = co.HTTPRequestToCoAP(req, func(msg *pool.Message) error {
+		queries, err := msg.Options().Queries()
+		if err != nil {
+			return err
+		}
+		sort.Strings(queries)
+		want := []string{"2=0", "5=t1-2", "7=b", "8=20", "custom=1", "custom=2"}
+		if !reflect.DeepEqual(queries, want) {
+			t.Errorf("Uri-Query: got %v want %v", queries, want)
+		}
+		r, err := pool.ConvertTo(msg)
+		if err != nil {
+			return err
+		}
+		r.Context = context.Background()
+		got = co.CoAPToHTTPRequest(r)
+		return nil
+	})
+	if err != nil {
+		t.Fatalf("HTTPRequestToCoAP: %s", err)
+	}
+	if !reflect.DeepEqual(got.URL.Query(), req.URL.Query()) {
+		t.Errorf("round trip: got query %v want %v", got.URL.Query(), req.URL.Query())
+	}
+}
@@ -0,0 +1,89 @@
+// Copyright 2021 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package lb
+
+var coapv1QueryKeys = map[string]string{
+	// /sync
+	"0": "since",
+	"1": "timeout",
+	"2": "filter",
+	"3": "full_state",
+	"4": "set_presence",
+	// /messages, /context, /keys/changes, /notifications
+	"5": "from",
+	"6": "to",
+	"7": "dir",
+	"8": "limit",
+	// /members
+	"9":  "at",
+	"10": "membership",
+	"11": "not_membership",
+	// /join, /publicRooms
+	"12": "server_name",
+	"13": "server",
+	// /notifications, /search
+	"14": "only",
+	"15": "next_batch",
+	// media
+	"16": "width",
+	"17": "height",
+	"18": "method",
+	"19": "allow_remote",
+	"20": "filename",
+	// /register
+	"21": "kind",
+}
+
+var coapv1QueryValues = map[string]map[string]string{
+	"full_state": {
+		"0": "false",
+		"1": "true",
+	},
+	"set_presence": {
+		"0": "offline",
+		"1": "online",
+		"2": "unavailable",
+	},
+	"membership": {
+		"0": "join",
+		"1": "invite",
+		"2": "leave",
+		"3": "ban",
+		"4": "knock",
+	},
+	"not_membership": {
+		"0": "join",
+		"1": "invite",
+		"2": "leave",
+		"3": "ban",
+		"4": "knock",
+	},
+	"filter": {
+		// Element and other clients lazy load members when paginating
+		"0": `{"lazy_load_members":true}`,
+	},
+	"method": {
+		"0": "crop",
+		"1": "scale",
+	},
+	"allow_remote": {
+		"0": "false",
+		"1": "true",
+	},
+	"kind": {
+		"0": "user",
+		"1": "guest",
+	},
+}
@@ -0,0 +1,66 @@
+// Copyright 2021 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package lb
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"sync"
+)
+
+const (
+	ctxValSessionID  = "ctxValSessionID"
+	ctxValServerName = "ctxValServerName"
+)
+
+var sessionIDMu sync.Mutex
+
+// SessionClient is a CoAP connection which can hold per-session state, e.g a mux.Client or a
+// udp/client.ClientConn.
+type SessionClient interface {
+	Context() context.Context
+	SetContextValue(key interface{}, val interface{})
+}
+
+// SessionID returns an identifier for the DTLS session of this client, which should be used instead
+// of the remote address to key per-session state.
+//
+// Addresses change whenever a mobile client's NAT binding does. DTLS Connection IDs (RFC 9146) let a
+// session survive this, but no release of pion/dtls v2 implements them (they were added in v3, which
+// go-coap does not support), so a new address still means a new session and this is a random
+// identifier for the session. Clients should resume with a session ticket instead, see SessionTickets.
+// Once Connection IDs can be negotiated, this should return the Connection ID so state follows the
+// client to its new address.
+func SessionID(cc SessionClient) string {
+	sessionIDMu.Lock()
+	defer sessionIDMu.Unlock()
+	if id, ok := cc.Context().Value(ctxValSessionID).(string); ok {
+		return id
+	}
+	b := make([]byte, 8)
+	_, _ = rand.Read(b)
+	id := hex.EncodeToString(b)
+	cc.SetContextValue(ctxValSessionID, id)
+	return id
+}
+
+// SetServerName remembers the server name the client asked for in the TLS handshake (SNI), which
+// CoAPToHTTPRequest uses as the host of requests without a Uri-Host option.
+func SetServerName(cc SessionClient, serverName string) {
+	if serverName != "" {
+		cc.SetContextValue(ctxValServerName, serverName)
+	}
+}
@@ -0,0 +1,71 @@
+// Copyright 2021 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package lb
+
+import (
+	"context"
+	"sync"
+	"testing"
+)
+
+// lockedSessionClient is a sessionClient which is safe to use concurrently, like a real connection.
+type lockedSessionClient struct {
+	mu sync.Mutex
+	sessionClient
+}
+
+func (c *lockedSessionClient) Context() context.Context {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.sessionClient.Context()
+}
+
+func (c *lockedSessionClient) SetContextValue(key interface{}, val interface{}) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.sessionClient.SetContextValue(key, val)
+}
+
+func TestSessionID(t *testing.T) {
+	a := &lockedSessionClient{sessionClient: sessionClient{ctx: context.Background()}}
+	b := &lockedSessionClient{sessionClient: sessionClient{ctx: context.Background()}}
+
+	// every caller of a session gets the same ID, even when they race to make it
+	ids := make(chan string, 10)
+	var wg sync.WaitGroup
+	for i := 0; i < cap(ids); i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			ids <- SessionID(a)
+		}()
+	}
+	wg.Wait()
+	close(ids)
+	id := SessionID(a)
+	if id == "" {
+		t.Fatalf("SessionID returned an empty ID")
+	}
+	for got := range ids {
+		if got != id {
+			t.Errorf("SessionID returned %s and %s for the same session", got, id)
+		}
+	}
+
+	// other sessions get other IDs, e.g the new session of a client which reconnects from the same address
+	if SessionID(b) == id {
+		t.Errorf("SessionID returned %s for two sessions", id)
+	}
+}
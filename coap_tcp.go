@@ -0,0 +1,51 @@
+// Copyright 2021 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package lb
+
+import (
+	"fmt"
+
+	"github.com/matrix-org/go-coap/v2/message"
+	"github.com/matrix-org/go-coap/v2/message/codes"
+	"github.com/matrix-org/go-coap/v2/tcp"
+	tcpmessage "github.com/matrix-org/go-coap/v2/tcp/message"
+	"github.com/matrix-org/go-coap/v2/tcp/message/pool"
+)
+
+// TCPMaxMessageSize is the largest message sent or received over CoAP over TCP, for
+// tcp.WithMaxMessageSize. go-coap fills BERT blocks with as many whole KiB as fit in the maximum
+// message size, so the spare 1023 bytes leave room for the header and options of each block.
+const TCPMaxMessageSize = 64*1024 + 1023
+
+// SendBlockwiseCSM tells the peer that this connection can use blockwise transfers, including BERT.
+// go-coap only uses blockwise transfers over TCP once the peer's Capabilities and Settings Message
+// has the Block-Wise-Transfer option, but never sends it, so without this a body must fit in a
+// single message. Connections must use TCPMaxMessageSize. Call it before sending any requests or responses e.g straight after dialling, or
+// in tcp.WithOnNewClientConn. Clients only use blockwise transfers once the server's CSM arrives,
+// which they can wait for with a Ping as the server sends its CSM first.
+// https://datatracker.ietf.org/doc/html/rfc8323#section-5.3.2
+func SendBlockwiseCSM(cc *tcp.ClientConn) error {
+	token, err := message.GetToken()
+	if err != nil {
+		return fmt.Errorf("cannot get token: %w", err)
+	}
+	msg := pool.AcquireMessage(cc.Context())
+	defer pool.ReleaseMessage(msg)
+	msg.SetCode(codes.CSM)
+	msg.SetToken(token)
+	msg.SetOptionUint32(tcpmessage.MaxMessageSize, TCPMaxMessageSize)
+	msg.SetOptionBytes(tcpmessage.BlockWiseTransfer, []byte{})
+	return cc.Session().WriteMessage(msg)
+}
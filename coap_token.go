@@ -0,0 +1,105 @@
+// Copyright 2021 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package lb
+
+import (
+	"context"
+	"crypto/rand"
+	"fmt"
+	"sync"
+
+	"github.com/matrix-org/go-coap/v2/message"
+)
+
+// DefaultTokenLength is the length in bytes of CoAP tokens made by NewCoAPHTTP.
+const DefaultTokenLength = 4
+
+const ctxValTokenAllocator = "ctxValTokenAllocator"
+
+// WithTokenAllocator returns a copy of ctx which makes HTTPRequestToCoAP acquire the token of a request
+// with this context from `tokens` instead of CoAPHTTP.Tokens. Tokens only need to be unique on a
+// connection, so clients with several connections should give each its own allocator.
+func WithTokenAllocator(ctx context.Context, tokens *TokenAllocator) context.Context {
+	return context.WithValue(ctx, ctxValTokenAllocator, tokens)
+}
+
+// TokenAllocator hands out random CoAP tokens of a fixed length. Tokens are tracked until they
+// are released, and a token will never be handed out again whilst it is outstanding. This
+// means short tokens can be used safely, as long as there are far fewer outstanding requests
+// than possible tokens. TokenAllocator is safe to use concurrently.
+//
+// Tokens are random rather than sequential so they cannot be predicted by anyone who can see
+// (or guess) the tokens used on other connections.
+// https://datatracker.ietf.org/doc/html/rfc7252#section-5.3.1
+type TokenAllocator struct {
+	length      int
+	max         int
+	mu          sync.Mutex
+	outstanding map[string]struct{}
+}
+
+// NewTokenAllocator makes a token allocator which hands out tokens of `length` bytes, which must be
+// between 1 and 8 inclusive.
+func NewTokenAllocator(length int) (*TokenAllocator, error) {
+	if length < 1 || length > message.MaxTokenSize {
+		return nil, fmt.Errorf("token length must be between 1 and %d, got %d", message.MaxTokenSize, length)
+	}
+	// Only allow half the token space to be outstanding at once, else finding a free token
+	// by picking randomly could take a long time.
+	max := 1 << 30
+	if length < 4 {
+		max = (1 << (8 * uint(length))) / 2
+	}
+	return &TokenAllocator{
+		length:      length,
+		max:         max,
+		outstanding: make(map[string]struct{}),
+	}, nil
+}
+
+// Acquire returns a new token which is not currently outstanding. The token MUST be released via
+// Release when the request or observation which used it has finished.
+func (a *TokenAllocator) Acquire() (message.Token, error) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	if len(a.outstanding) >= a.max {
+		return nil, fmt.Errorf("too many outstanding tokens: %d", len(a.outstanding))
+	}
+	for {
+		token := make(message.Token, a.length)
+		if _, err := rand.Read(token); err != nil {
+			return nil, fmt.Errorf("failed to generate token: %w", err)
+		}
+		if _, exists := a.outstanding[string(token)]; exists {
+			continue
+		}
+		a.outstanding[string(token)] = struct{}{}
+		return token, nil
+	}
+}
+
+// Release makes the token available to be handed out again.
+func (a *TokenAllocator) Release(token message.Token) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	delete(a.outstanding, string(token))
+}
+
+// Outstanding returns the number of tokens which have been acquired but not released.
+func (a *TokenAllocator) Outstanding() int {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	return len(a.outstanding)
+}
@@ -0,0 +1,126 @@
+// Copyright 2021 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package lb
+
+import (
+	"context"
+	"net/http"
+	"sync"
+	"testing"
+
+	"github.com/matrix-org/go-coap/v2/udp/message/pool"
+)
+
+func TestTokenAllocatorNoReuseWhileOutstanding(t *testing.T) {
+	a, err := NewTokenAllocator(1)
+	if err != nil {
+		t.Fatalf("NewTokenAllocator: %s", err)
+	}
+	// half of the 1 byte token space can be outstanding at once
+	seen := make(map[string]bool)
+	for i := 0; i < 128; i++ {
+		token, err := a.Acquire()
+		if err != nil {
+			t.Fatalf("Acquire %d: %s", i, err)
+		}
+		if len(token) != 1 {
+			t.Fatalf("Acquire: got token length %d want 1", len(token))
+		}
+		if seen[string(token)] {
+			t.Fatalf("Acquire: token %v handed out twice whilst outstanding", token)
+		}
+		seen[string(token)] = true
+	}
+	if _, err = a.Acquire(); err == nil {
+		t.Fatalf("Acquire: expected error when too many tokens are outstanding")
+	}
+	for token := range seen {
+		a.Release([]byte(token))
+	}
+	if a.Outstanding() != 0 {
+		t.Fatalf("Outstanding: got %d want 0", a.Outstanding())
+	}
+	if _, err = a.Acquire(); err != nil {
+		t.Fatalf("Acquire after Release: %s", err)
+	}
+}
+
+func TestTokenAllocatorConcurrent(t *testing.T) {
+	a, err := NewTokenAllocator(2)
+	if err != nil {
+		t.Fatalf("NewTokenAllocator: %s", err)
+	}
+	var wg sync.WaitGroup
+	var mu sync.Mutex
+	live := make(map[string]bool)
+	for i := 0; i < 16; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for j := 0; j < 500; j++ {
+				token, err := a.Acquire()
+				if err != nil {
+					t.Errorf("Acquire: %s", err)
+					return
+				}
+				mu.Lock()
+				if live[string(token)] {
+					t.Errorf("Acquire: token %v is already live", token)
+				}
+				live[string(token)] = true
+				mu.Unlock()
+
+				mu.Lock()
+				delete(live, string(token))
+				mu.Unlock()
+				a.Release(token)
+			}
+		}()
+	}
+	wg.Wait()
+}
+
+func TestTokenAllocatorBadLength(t *testing.T) {
+	for _, length := range []int{0, 9} {
+		if _, err := NewTokenAllocator(length); err == nil {
+			t.Errorf("NewTokenAllocator(%d): expected error", length)
+		}
+	}
+}
+
+func TestHTTPRequestToCoAPTokenAllocator(t *testing.T) {
+	co := NewCoAPHTTP(NewCoAPPathV1())
+	conn, err := NewTokenAllocator(2)
+	if err != nil {
+		t.Fatalf("NewTokenAllocator: %s", err)
+	}
+	req, _ := http.NewRequest("GET", "https://example.com/_matrix/client/r0/sync", nil)
+	req = req.WithContext(WithTokenAllocator(context.Background(), conn))
+	err = co.HTTPRequestToCoAP(req, func(msg *pool.Message) error {
+		if len(msg.Token()) != 2 {
+			t.Errorf("got token %v want one from the allocator of the request", msg.Token())
+		}
+		if conn.Outstanding() != 1 || co.Tokens.Outstanding() != 0 {
+			t.Errorf("got %d outstanding tokens on the request allocator and %d on CoAPHTTP.Tokens, want 1 and 0", conn.Outstanding(), co.Tokens.Outstanding())
+		}
+		return nil
+	})
+	if err != nil {
+		t.Fatalf("HTTPRequestToCoAP: %s", err)
+	}
+	if conn.Outstanding() != 0 {
+		t.Errorf("the token was not released")
+	}
+}
@@ -0,0 +1,419 @@
+// Copyright 2021 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package lb
+
+// The v2 dictionary covers the stable client-server API. It is a superset of v1: every v1 code has the same
+// meaning in v2, so anything encoded with v1 decodes the same with v2. Codes which are in use must never
+// change. New entries can be found with cmd/specgen e.g `specgen -spec ... -base coap_v2.go -diff`.
+
+var coapv2pathMappings = map[string]string{
+	"0": "/_matrix/client/versions",
+	"1": "/_matrix/client/r0/login",
+	"2": "/_matrix/client/r0/capabilities",
+	"3": "/_matrix/client/r0/logout",
+	"4": "/_matrix/client/r0/register",
+	"5": "/_matrix/client/r0/user/{userId}/filter",
+	"6": "/_matrix/client/r0/user/{userId}/filter/{filterId}",
+	"7": "/_matrix/client/r0/sync",
+	"8": "/_matrix/client/r0/rooms/{roomId}/state/{eventType}/{stateKey}",
+	"9": "/_matrix/client/r0/rooms/{roomId}/send/{eventType}/{txnId}",
+	"A": "/_matrix/client/r0/rooms/{roomId}/event/{eventId}",
+	"B": "/_matrix/client/r0/rooms/{roomId}/state",
+	"C": "/_matrix/client/r0/rooms/{roomId}/members",
+	"D": "/_matrix/client/r0/rooms/{roomId}/joined_members",
+	"E": "/_matrix/client/r0/rooms/{roomId}/messages",
+	"F": "/_matrix/client/r0/rooms/{roomId}/redact/{eventId}/{txnId}",
+	"G": "/_matrix/client/r0/createRoom",
+	"H": "/_matrix/client/r0/directory/room/{roomAlias}",
+	"I": "/_matrix/client/r0/joined_rooms",
+	"J": "/_matrix/client/r0/rooms/{roomId}/invite",
+	"K": "/_matrix/client/r0/rooms/{roomId}/join",
+	"L": "/_matrix/client/r0/join/{roomIdOrAlias}",
+	"M": "/_matrix/client/r0/rooms/{roomId}/leave",
+	"N": "/_matrix/client/r0/rooms/{roomId}/forget",
+	"O": "/_matrix/client/r0/rooms/{roomId}/kick",
+	"P": "/_matrix/client/r0/rooms/{roomId}/ban",
+	"Q": "/_matrix/client/r0/rooms/{roomId}/unban",
+	"R": "/_matrix/client/r0/directory/list/room/{roomId}",
+	"S": "/_matrix/client/r0/publicRooms",
+	"T": "/_matrix/client/r0/user_directory/search",
+	"U": "/_matrix/client/r0/profile/{userId}/displayname",
+	"V": "/_matrix/client/r0/profile/{userId}/avatar_url",
+	"W": "/_matrix/client/r0/profile/{userId}",
+	"X": "/_matrix/client/r0/voip/turnServer",
+	"Y": "/_matrix/client/r0/rooms/{roomId}/typing/{userId}",
+	"Z": "/_matrix/client/r0/rooms/{roomId}/receipt/{receiptType}/{eventId}",
+	"a": "/_matrix/client/r0/rooms/{roomId}/read_markers",
+	"b": "/_matrix/client/r0/presence/{userId}/status",
+	"c": "/_matrix/client/r0/sendToDevice/{eventType}/{txnId}",
+	"d": "/_matrix/client/r0/devices",
+	"e": "/_matrix/client/r0/devices/{deviceId}",
+	"f": "/_matrix/client/r0/delete_devices",
+	"g": "/_matrix/client/r0/keys/upload",
+	"h": "/_matrix/client/r0/keys/query",
+	"i": "/_matrix/client/r0/keys/claim",
+	"j": "/_matrix/client/r0/keys/changes",
+	"k": "/_matrix/client/r0/pushers",
+	"l": "/_matrix/client/r0/pushers/set",
+	"m": "/_matrix/client/r0/notifications",
+	"n": "/_matrix/client/r0/pushrules/",
+	"o": "/_matrix/client/r0/search",
+	"p": "/_matrix/client/r0/user/{userId}/rooms/{roomId}/tags",
+	"q": "/_matrix/client/r0/user/{userId}/rooms/{roomId}/tags/{tag}",
+	"r": "/_matrix/client/r0/user/{userId}/account_data/{type}",
+	"s": "/_matrix/client/r0/user/{userId}/rooms/{roomId}/account_data/{type}",
+	"t": "/_matrix/client/r0/rooms/{roomId}/context/{eventId}",
+	"u": "/_matrix/client/r0/rooms/{roomId}/report/{eventId}",
+	"v": "/_matrix/media/r0/upload",
+	"w": "/_matrix/media/r0/download/{serverName}/{mediaId}",
+	"x": "/_matrix/media/r0/download/{serverName}/{mediaId}/{fileName}",
+	"y": "/_matrix/media/r0/thumbnail/{serverName}/{mediaId}",
+	"z": "/_matrix/media/r0/config",
+	// added in v2
+	"00": "/_matrix/client/unstable/org.matrix.msc3575/sync",
+	"01": "/_matrix/client/unstable/org.matrix.simplified_msc3575/sync",
+	"02": "/_matrix/client/v3/account/whoami",
+	"03": "/_matrix/client/v3/user/{userId}/openid/request_token",
+	"04": "/_matrix/client/v3/rooms/{roomId}/aliases",
+	"05": "/_matrix/client/v1/rooms/{roomId}/relations/{eventId}",
+	"06": "/_matrix/client/v1/rooms/{roomId}/relations/{eventId}/{relType}",
+	"07": "/_matrix/client/v1/rooms/{roomId}/relations/{eventId}/{relType}/{eventType}",
+	"08": "/_matrix/client/v1/rooms/{roomId}/threads",
+	"09": "/_matrix/client/v1/rooms/{roomId}/hierarchy",
+	"0A": "/_matrix/client/v1/rooms/{roomId}/timestamp_to_event",
+	"0B": "/_matrix/client/v3/knock/{roomIdOrAlias}",
+	"0C": "/_matrix/client/v3/rooms/{roomId}/upgrade",
+	"0D": "/_matrix/client/v3/keys/device_signing/upload",
+	"0E": "/_matrix/client/v3/keys/signatures/upload",
+	"0F": "/_matrix/client/v3/room_keys/version",
+	"0G": "/_matrix/client/v3/room_keys/version/{version}",
+	"0H": "/_matrix/client/v3/room_keys/keys",
+	"0I": "/_matrix/client/v3/room_keys/keys/{roomId}",
+	"0J": "/_matrix/client/v3/room_keys/keys/{roomId}/{sessionId}",
+	"0K": "/_matrix/client/v3/pushrules/{scope}/{kind}/{ruleId}",
+	"0L": "/_matrix/client/v3/pushrules/{scope}/{kind}/{ruleId}/enabled",
+	"0M": "/_matrix/client/v3/pushrules/{scope}/{kind}/{ruleId}/actions",
+	"0N": "/_matrix/client/v3/account/password",
+	"0O": "/_matrix/client/v3/account/deactivate",
+	"0P": "/_matrix/client/v3/account/3pid",
+	"0Q": "/_matrix/client/v3/refresh",
+	"0R": "/_matrix/client/v1/login/get_token",
+	"0S": "/_matrix/client/v1/media/config",
+	"0T": "/_matrix/client/v1/media/download/{serverName}/{mediaId}",
+	"0U": "/_matrix/client/v1/media/download/{serverName}/{mediaId}/{fileName}",
+	"0V": "/_matrix/client/v1/media/thumbnail/{serverName}/{mediaId}",
+	"0W": "/_matrix/client/v1/media/preview_url",
+	"0X": "/_matrix/media/v1/create",
+	"0Y": "/_matrix/media/v3/upload/{serverName}/{mediaId}",
+}
+
+var cborv2Keys = map[string]int{
+	"event_id":                    1,
+	"type":                        2,
+	"content":                     3,
+	"state_key":                   4,
+	"room_id":                     5,
+	"sender":                      6,
+	"user_id":                     7,
+	"origin_server_ts":            8,
+	"unsigned":                    9,
+	"prev_content":                10,
+	"state":                       11,
+	"timeline":                    12,
+	"events":                      13,
+	"limited":                     14,
+	"prev_batch":                  15,
+	"transaction_id":              16,
+	"age":                         17,
+	"redacted_because":            18,
+	"next_batch":                  19,
+	"presence":                    20,
+	"avatar_url":                  21,
+	"account_data":                22,
+	"rooms":                       23,
+	"join":                        24,
+	"membership":                  25,
+	"displayname":                 26,
+	"body":                        27,
+	"msgtype":                     28,
+	"format":                      29,
+	"formatted_body":              30,
+	"ephemeral":                   31,
+	"invite_state":                32,
+	"leave":                       33,
+	"third_party_invite":          34,
+	"is_direct":                   35,
+	"hashes":                      36,
+	"signatures":                  37,
+	"depth":                       38,
+	"prev_events":                 39,
+	"prev_state":                  40,
+	"auth_events":                 41,
+	"origin":                      42,
+	"creator":                     43,
+	"join_rule":                   44,
+	"history_visibility":          45,
+	"ban":                         46,
+	"events_default":              47,
+	"kick":                        48,
+	"redact":                      49,
+	"state_default":               50,
+	"users":                       51,
+	"users_default":               52,
+	"reason":                      53,
+	"visibility":                  54,
+	"room_alias_name":             55,
+	"name":                        56,
+	"topic":                       57,
+	"invite":                      58,
+	"invite_3pid":                 59,
+	"room_version":                60,
+	"creation_content":            61,
+	"initial_state":               62,
+	"preset":                      63,
+	"servers":                     64,
+	"identifier":                  65,
+	"user":                        66,
+	"medium":                      67,
+	"address":                     68,
+	"password":                    69,
+	"token":                       70,
+	"device_id":                   71,
+	"initial_device_display_name": 72,
+	"access_token":                73,
+	"home_server":                 74,
+	"well_known":                  75,
+	"base_url":                    76,
+	"device_lists":                77,
+	"to_device":                   78,
+	"peek":                        79,
+	"last_seen_ip":                80,
+	"display_name":                81,
+	"typing":                      82,
+	"last_seen_ts":                83,
+	"algorithm":                   84,
+	"sender_key":                  85,
+	"session_id":                  86,
+	"ciphertext":                  87,
+	"one_time_keys":               88,
+	"timeout":                     89,
+	"recent_rooms":                90,
+	"chunk":                       91,
+	"m.fully_read":                92,
+	"device_keys":                 93,
+	"failures":                    94,
+	"device_display_name":         95,
+	"prev_sender":                 96,
+	"replaces_state":              97,
+	"changed":                     98,
+	"unstable_features":           99,
+	"versions":                    100,
+	"devices":                     101,
+	"errcode":                     102,
+	"error":                       103,
+	"room_alias":                  104,
+	// added in v2
+	"pos":                              105,
+	"conn_id":                          106,
+	"txn_id":                           107,
+	"lists":                            108,
+	"room_subscriptions":               109,
+	"unsubscribe_rooms":                110,
+	"extensions":                       111,
+	"ranges":                           112,
+	"required_state":                   113,
+	"timeline_limit":                   114,
+	"filters":                          115,
+	"is_dm":                            116,
+	"is_encrypted":                     117,
+	"is_invite":                        118,
+	"spaces":                           119,
+	"room_types":                       120,
+	"not_room_types":                   121,
+	"room_name_like":                   122,
+	"not_tags":                         123,
+	"sort":                             124,
+	"slow_get_all_rooms":               125,
+	"bump_event_types":                 126,
+	"include_old_rooms":                127,
+	"ops":                              128,
+	"op":                               129,
+	"range":                            130,
+	"room_ids":                         131,
+	"index":                            132,
+	"count":                            133,
+	"initial":                          134,
+	"heroes":                           135,
+	"num_live":                         136,
+	"joined_count":                     137,
+	"invited_count":                    138,
+	"bump_stamp":                       139,
+	"expanded_timeline":                140,
+	"avatar":                           141,
+	"e2ee":                             142,
+	"receipts":                         143,
+	"m.relates_to":                     144,
+	"rel_type":                         145,
+	"m.in_reply_to":                    146,
+	"is_falling_back":                  147,
+	"key":                              148,
+	"m.new_content":                    149,
+	"m.mentions":                       150,
+	"user_ids":                         151,
+	"room":                             152,
+	"recursion_depth":                  153,
+	"latest_event":                     154,
+	"current_user_participated":        155,
+	"m.thread":                         156,
+	"children_state":                   157,
+	"room_type":                        158,
+	"world_readable":                   159,
+	"guest_can_join":                   160,
+	"num_joined_members":               161,
+	"canonical_alias":                  162,
+	"via":                              163,
+	"suggested":                        164,
+	"order":                            165,
+	"is_guest":                         166,
+	"token_type":                       167,
+	"matrix_server_name":               168,
+	"expires_in":                       169,
+	"aliases":                          170,
+	"unread_notifications":             171,
+	"notification_count":               172,
+	"highlight_count":                  173,
+	"unread_thread_notifications":      174,
+	"summary":                          175,
+	"m.heroes":                         176,
+	"m.joined_member_count":            177,
+	"m.invited_member_count":           178,
+	"device_one_time_keys_count":       179,
+	"device_unused_fallback_key_types": 180,
+	"signed_curve25519":                181,
+	"m.read":                           182,
+	"m.read.private":                   183,
+	"ts":                               184,
+	"thread_id":                        185,
+	"master_key":                       186,
+	"self_signing_key":                 187,
+	"user_signing_key":                 188,
+	"usage":                            189,
+	"keys":                             190,
+	"fallback_keys":                    191,
+	"fallback":                         192,
+	"curve25519":                       193,
+	"ed25519":                          194,
+	"session_key":                      195,
+	"sender_claimed_keys":              196,
+	"forwarding_curve25519_key_chain":  197,
+	"m.federate":                       198,
+	"predecessor":                      199,
+	"replacement_room":                 200,
+	"new_version":                      201,
+	"new_password":                     202,
+	"logout_devices":                   203,
+	"auth":                             204,
+	"session":                          205,
+	"threepids":                        206,
+	"content_uri":                      207,
+	"unused_expires_at":                208,
+	"m.upload.size":                    209,
+	"redacts":                          210,
+	"m.relations":                      211,
+	"flows":                            212,
+	"refresh_token":                    213,
+	"expires_in_ms":                    214,
+	"login_token":                      215,
+	"lazy_load_members":                216,
+	"include_redundant_members":        217,
+	"not_senders":                      218,
+	"not_types":                        219,
+	"senders":                          220,
+	"types":                            221,
+	"not_rooms":                        222,
+	"contains_url":                     223,
+	"event_fields":                     224,
+	"event_format":                     225,
+	"actions":                          226,
+	"conditions":                       227,
+	"default":                          228,
+	"rule_id":                          229,
+	"pattern":                          230,
+	"kind":                             231,
+	"global":                           232,
+	"enabled":                          233,
+	"first_message_index":              234,
+	"forwarded_count":                  235,
+	"is_verified":                      236,
+	"session_data":                     237,
+	"etag":                             238,
+	"backup_version":                   239,
+	"auth_data":                        240,
+}
+
+var coapv2QueryKeys = map[string]string{
+	"0":  "since",
+	"1":  "timeout",
+	"2":  "filter",
+	"3":  "full_state",
+	"4":  "set_presence",
+	"5":  "from",
+	"6":  "to",
+	"7":  "dir",
+	"8":  "limit",
+	"9":  "at",
+	"10": "membership",
+	"11": "not_membership",
+	"12": "server_name",
+	"13": "server",
+	"14": "only",
+	"15": "next_batch",
+	"16": "width",
+	"17": "height",
+	"18": "method",
+	"19": "allow_remote",
+	"20": "filename",
+	"21": "kind",
+	// added in v2
+	"22": "pos",
+	"23": "recurse",
+	"24": "include",
+	"25": "suggested_only",
+	"26": "max_depth",
+	"27": "ts",
+	"28": "animated",
+	"29": "timeout_ms",
+	"30": "url",
+}
+
+// coapv2QueryValues are the values of the v2 query keys, in addition to coapv1QueryValues.
+var coapv2QueryValues = map[string]map[string]string{
+	"recurse": {
+		"0": "false",
+		"1": "true",
+	},
+	"include": {
+		"0": "all",
+		"1": "participated",
+	},
+	"suggested_only": {
+		"0": "false",
+		"1": "true",
+	},
+	"animated": {
+		"0": "false",
+		"1": "true",
+	},
+}
@@ -0,0 +1,288 @@
+// Copyright 2021 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package lb
+
+import (
+	"context"
+	"crypto/tls"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"sync"
+
+	"golang.org/x/net/websocket"
+)
+
+// WebSocketProtocol is the WebSocket subprotocol for CoAP.
+// https://datatracker.ietf.org/doc/html/rfc8323#section-4.1
+const WebSocketProtocol = "coap"
+
+// WebSocketPath is the well-known path which CoAP over WebSockets is served on.
+// https://datatracker.ietf.org/doc/html/rfc8323#section-8.4
+const WebSocketPath = "/.well-known/coap"
+
+// The ports the proxy listens on for CoAP over TLS and CoAP over secure WebSockets by default, which
+// clients fall back to if they can't use DTLS e.g because UDP is blocked.
+const (
+	DefaultTCPPort       = 8449
+	DefaultWebSocketPort = 8450
+)
+
+// ErrListenerClosed is returned when accepting connections on a closed WebSocketListener.
+var ErrListenerClosed = errors.New("listener closed")
+
+// NewWebSocketConn wraps a WebSocket so it can be used as the connection for CoAP over TCP e.g
+// with tcp.Client. CoAP over WebSockets uses the same message format as CoAP over TCP, except
+// each message is a single binary WebSocket message and so there is no length field:
+//    The message format shown in Figure 10 is the same as the CoAP over
+//    TCP message format (see Section 3.2) with one change: the Length
+//    (Len) field MUST be set to zero, because the WebSocket frame contains
+//    the length.
+// https://datatracker.ietf.org/doc/html/rfc8323#section-5.2
+func NewWebSocketConn(ws *websocket.Conn) net.Conn {
+	ws.PayloadType = websocket.BinaryFrame
+	return &webSocketConn{
+		Conn:   ws,
+		closed: make(chan struct{}),
+	}
+}
+
+// DialWebSocket connects to a CoAP over WebSockets server e.g coaps+ws://example.com:8443 and
+// returns a connection suitable for tcp.Client.
+func DialWebSocket(target *url.URL, tlsConfig *tls.Config) (net.Conn, error) {
+	wsURL := url.URL{
+		Scheme: "wss",
+		Host:   target.Host,
+		Path:   WebSocketPath,
+	}
+	if target.Scheme == "coap+ws" {
+		wsURL.Scheme = "ws"
+	}
+	config, err := websocket.NewConfig(wsURL.String(), "https://"+target.Host)
+	if err != nil {
+		return nil, err
+	}
+	config.Protocol = []string{WebSocketProtocol}
+	config.TlsConfig = tlsConfig
+	ws, err := websocket.DialConfig(config)
+	if err != nil {
+		return nil, err
+	}
+	return NewWebSocketConn(ws), nil
+}
+
+type webSocketConn struct {
+	*websocket.Conn
+	// CoAP over TCP bytes which have been received but not read yet
+	readBuf []byte
+	// CoAP over TCP bytes which have been written but do not make up a whole message yet
+	writeBuf  []byte
+	closed    chan struct{}
+	closeOnce sync.Once
+}
+
+func (c *webSocketConn) Read(p []byte) (int, error) {
+	if len(c.readBuf) == 0 {
+		var frame []byte
+		if err := websocket.Message.Receive(c.Conn, &frame); err != nil {
+			return 0, err
+		}
+		msg, err := webSocketToTCP(frame)
+		if err != nil {
+			return 0, err
+		}
+		c.readBuf = msg
+	}
+	n := copy(p, c.readBuf)
+	c.readBuf = c.readBuf[n:]
+	return n, nil
+}
+
+func (c *webSocketConn) Write(p []byte) (int, error) {
+	c.writeBuf = append(c.writeBuf, p...)
+	for {
+		frame, n := tcpToWebSocket(c.writeBuf)
+		if n == 0 {
+			return len(p), nil
+		}
+		if err := websocket.Message.Send(c.Conn, frame); err != nil {
+			return 0, err
+		}
+		c.writeBuf = c.writeBuf[n:]
+	}
+}
+
+// RemoteAddr returns the address of the peer. For server connections the WebSocket address is the
+// Origin of the client, which may be missing, so use the address of the HTTP request instead.
+func (c *webSocketConn) RemoteAddr() net.Addr {
+	if req := c.Conn.Request(); req != nil {
+		if addr, err := net.ResolveTCPAddr("tcp", req.RemoteAddr); err == nil {
+			return addr
+		}
+	}
+	return c.Conn.RemoteAddr()
+}
+
+func (c *webSocketConn) Close() error {
+	c.closeOnce.Do(func() {
+		close(c.closed)
+	})
+	return c.Conn.Close()
+}
+
+// tcpLengthExtension returns how many extended length bytes follow the first byte of a
+// CoAP over TCP message, and the value to add to them.
+// https://datatracker.ietf.org/doc/html/rfc8323#section-3.2
+func tcpLengthExtension(nibble byte) (int, int) {
+	switch nibble {
+	case 13:
+		return 1, 13
+	case 14:
+		return 2, 269
+	case 15:
+		return 4, 65805
+	default:
+		return 0, 0
+	}
+}
+
+// tcpToWebSocket converts the first CoAP over TCP message in b to a WebSocket message. Returns
+// the number of bytes of b which were used, which is 0 if b does not contain a whole message yet.
+func tcpToWebSocket(b []byte) ([]byte, int) {
+	if len(b) == 0 {
+		return nil, 0
+	}
+	tkl := int(b[0] & 0x0f)
+	extLen, offset := tcpLengthExtension(b[0] >> 4)
+	if len(b) < 1+extLen {
+		return nil, 0
+	}
+	length := int(b[0] >> 4)
+	switch extLen {
+	case 1:
+		length = int(b[1]) + offset
+	case 2:
+		length = int(binary.BigEndian.Uint16(b[1:3])) + offset
+	case 4:
+		length = int(binary.BigEndian.Uint32(b[1:5])) + offset
+	}
+	// Len | TKL, extended length, code, token, options and payload
+	total := 1 + extLen + 1 + tkl + length
+	if len(b) < total {
+		return nil, 0
+	}
+	frame := make([]byte, 0, total-extLen)
+	frame = append(frame, byte(tkl))
+	frame = append(frame, b[1+extLen:total]...)
+	return frame, total
+}
+
+// webSocketToTCP converts a WebSocket message to a CoAP over TCP message.
+func webSocketToTCP(frame []byte) ([]byte, error) {
+	if len(frame) == 0 {
+		return nil, fmt.Errorf("empty CoAP over WebSockets message")
+	}
+	if frame[0]>>4 != 0 {
+		return nil, fmt.Errorf("CoAP over WebSockets message has non-zero length field")
+	}
+	tkl := int(frame[0] & 0x0f)
+	if len(frame) < 2+tkl {
+		return nil, fmt.Errorf("CoAP over WebSockets message is too short: %d bytes", len(frame))
+	}
+	// everything after the code and token
+	length := len(frame) - 2 - tkl
+	var header []byte
+	switch {
+	case length < 13:
+		header = []byte{byte(length<<4) | byte(tkl)}
+	case length < 269:
+		header = []byte{13<<4 | byte(tkl), byte(length - 13)}
+	case length < 65805:
+		header = []byte{14<<4 | byte(tkl), 0, 0}
+		binary.BigEndian.PutUint16(header[1:], uint16(length-269))
+	default:
+		header = []byte{15<<4 | byte(tkl), 0, 0, 0, 0}
+		binary.BigEndian.PutUint32(header[1:], uint32(length-65805))
+	}
+	return append(header, frame[1:]...), nil
+}
+
+// WebSocketListener accepts CoAP over WebSockets connections. It is an http.Handler which should be
+// served on WebSocketPath, and can be used as the listener for a CoAP over TCP server e.g tcp.Server.
+type WebSocketListener struct {
+	conns     chan net.Conn
+	closed    chan struct{}
+	closeOnce sync.Once
+}
+
+// NewWebSocketListener makes a listener which accepts connections from ServeHTTP.
+func NewWebSocketListener() *WebSocketListener {
+	return &WebSocketListener{
+		conns:  make(chan net.Conn),
+		closed: make(chan struct{}),
+	}
+}
+
+// ServeHTTP upgrades the request to a WebSocket and blocks until the connection is closed.
+func (l *WebSocketListener) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	s := websocket.Server{
+		Handshake: func(config *websocket.Config, req *http.Request) error {
+			for _, p := range config.Protocol {
+				if p == WebSocketProtocol {
+					config.Protocol = []string{WebSocketProtocol}
+					return nil
+				}
+			}
+			return fmt.Errorf("missing subprotocol %s", WebSocketProtocol)
+		},
+		Handler: func(ws *websocket.Conn) {
+			conn := NewWebSocketConn(ws).(*webSocketConn)
+			select {
+			case l.conns <- conn:
+			case <-l.closed:
+				return
+			}
+			// the WebSocket is closed when this function returns, so wait for CoAP to finish with it
+			select {
+			case <-conn.closed:
+			case <-l.closed:
+			}
+		},
+	}
+	s.ServeHTTP(w, req)
+}
+
+// AcceptWithContext waits for the next WebSocket connection.
+func (l *WebSocketListener) AcceptWithContext(ctx context.Context) (net.Conn, error) {
+	select {
+	case conn := <-l.conns:
+		return conn, nil
+	case <-l.closed:
+		return nil, ErrListenerClosed
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+}
+
+// Close the listener. Connections which have already been accepted are closed.
+func (l *WebSocketListener) Close() error {
+	l.closeOnce.Do(func() {
+		close(l.closed)
+	})
+	return nil
+}
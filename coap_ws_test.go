@@ -0,0 +1,117 @@
+// Copyright 2021 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package lb
+
+import (
+	"bytes"
+	"context"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+
+	"github.com/matrix-org/go-coap/v2/message"
+	"github.com/matrix-org/go-coap/v2/message/codes"
+	coapmux "github.com/matrix-org/go-coap/v2/mux"
+	"github.com/matrix-org/go-coap/v2/tcp"
+	tcppool "github.com/matrix-org/go-coap/v2/tcp/message/pool"
+)
+
+func TestWebSocketFraming(t *testing.T) {
+	// cover every size of the TCP length field
+	for _, size := range []int{0, 5, 100, 1000, 70000} {
+		msg := tcppool.AcquireMessage(context.Background())
+		msg.SetCode(codes.POST)
+		msg.SetToken([]byte{1, 2, 3})
+		msg.SetPath("/7")
+		msg.SetContentFormat(message.AppCBOR)
+		msg.SetBody(bytes.NewReader(bytes.Repeat([]byte("a"), size)))
+		data, err := msg.Marshal()
+		if err != nil {
+			t.Fatalf("Marshal: %s", err)
+		}
+		// include part of the next message to check only one message is converted
+		frame, n := tcpToWebSocket(append(data, data[:3]...))
+		if n != len(data) {
+			t.Fatalf("size %d: tcpToWebSocket used %d bytes want %d", size, n, len(data))
+		}
+		if frame[0]>>4 != 0 {
+			t.Fatalf("size %d: tcpToWebSocket did not zero the length field", size)
+		}
+		if _, n = tcpToWebSocket(data[:len(data)-1]); n != 0 {
+			t.Fatalf("size %d: tcpToWebSocket converted a partial message", size)
+		}
+		got, err := webSocketToTCP(frame)
+		if err != nil {
+			t.Fatalf("size %d: webSocketToTCP: %s", size, err)
+		}
+		if !bytes.Equal(got, data) {
+			t.Fatalf("size %d: round trip mismatch", size)
+		}
+		tcppool.ReleaseMessage(msg)
+	}
+}
+
+func TestCoAPOverWebSocket(t *testing.T) {
+	co := NewCoAPHTTP(NewCoAPPathV1())
+	router := coapmux.NewRouter()
+	router.DefaultHandle(co.CoAPHTTPHandler(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		if req.URL.Path != "/_matrix/client/versions" {
+			t.Errorf("got path %s want /_matrix/client/versions", req.URL.Path)
+		}
+		w.WriteHeader(200)
+		w.Write([]byte("hello"))
+	}), nil))
+
+	l := NewWebSocketListener()
+	defer l.Close()
+	srv := httptest.NewServer(l)
+	defer srv.Close()
+	// errors are expected when the connections are closed at the end of the test
+	ignoreErrors := tcp.WithErrors(func(err error) {})
+	coapServer := tcp.NewServer(tcp.WithMux(router), ignoreErrors)
+	defer coapServer.Stop()
+	go coapServer.Serve(l)
+
+	srvURL, _ := url.Parse(srv.URL)
+	conn, err := DialWebSocket(&url.URL{Scheme: "coap+ws", Host: srvURL.Host}, nil)
+	if err != nil {
+		t.Fatalf("DialWebSocket: %s", err)
+	}
+	cc := tcp.Client(conn, ignoreErrors)
+	defer cc.Close()
+
+	req, _ := http.NewRequest("GET", "https://localhost/_matrix/client/versions", nil)
+	var res *http.Response
+	err = co.HTTPRequestToCoAPTCP(req, func(msg *tcppool.Message) error {
+		coapRes, err := cc.Do(msg)
+		if err != nil {
+			return err
+		}
+		res = co.CoAPTCPToHTTPResponse(coapRes)
+		return nil
+	})
+	if err != nil {
+		t.Fatalf("HTTPRequestToCoAPTCP: %s", err)
+	}
+	if res.StatusCode != 200 {
+		t.Fatalf("got status %d want 200", res.StatusCode)
+	}
+	body, _ := ioutil.ReadAll(res.Body)
+	if string(body) != "hello" {
+		t.Fatalf("got body %q want hello", string(body))
+	}
+}
@@ -0,0 +1,116 @@
+// Copyright 2021 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package lb
+
+import (
+	"bytes"
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"math/big"
+	"time"
+
+	piondtls "github.com/pion/dtls/v2"
+)
+
+// The cipher suites to use with each DTLS authentication mode, most preferred first. CoAP mandates
+// the CCM_8 suites, which also have the smallest per-record overhead.
+// https://datatracker.ietf.org/doc/html/rfc7252#section-9.1.3
+var (
+	PSKCipherSuites = []piondtls.CipherSuiteID{
+		piondtls.TLS_PSK_WITH_AES_128_CCM_8,
+		piondtls.TLS_PSK_WITH_AES_128_GCM_SHA256,
+	}
+	RawPublicKeyCipherSuites = []piondtls.CipherSuiteID{
+		piondtls.TLS_ECDHE_ECDSA_WITH_AES_128_CCM_8,
+		piondtls.TLS_ECDHE_ECDSA_WITH_AES_128_GCM_SHA256,
+	}
+)
+
+// NewRawPublicKeyCertificate makes a certificate for the raw public key mode, where clients pin the
+// public key of the proxy instead of verifying a certificate chain.
+//
+// pion/dtls does not negotiate raw public keys (RFC 7250), so the key is sent in the smallest
+// self-signed certificate which will parse: Ed25519 with no names or extensions, which is around
+// 200 bytes compared to several kilobytes for a typical web PKI chain. Clients must only look at
+// the public key, which VerifyPinnedPublicKey does.
+func NewRawPublicKeyCertificate(key ed25519.PrivateKey) (tls.Certificate, error) {
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		NotBefore:    time.Unix(0, 0),
+		// the latest date which can be encoded: https://datatracker.ietf.org/doc/html/rfc5280#section-4.1.2.5
+		NotAfter: time.Date(9999, 12, 31, 23, 59, 59, 0, time.UTC),
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, key.Public(), key)
+	if err != nil {
+		return tls.Certificate{}, err
+	}
+	return tls.Certificate{
+		Certificate: [][]byte{der},
+		PrivateKey:  key,
+	}, nil
+}
+
+// VerifyPinnedPublicKey returns a function for the VerifyPeerCertificate field of a DTLS or TLS config
+// which accepts the peer only if its certificate has this Ed25519 public key. Nothing else in the
+// certificate is checked, so InsecureSkipVerify should also be set to skip chain verification.
+func VerifyPinnedPublicKey(pub ed25519.PublicKey) func(rawCerts [][]byte, verifiedChains [][]*x509.Certificate) error {
+	return func(rawCerts [][]byte, verifiedChains [][]*x509.Certificate) error {
+		if len(rawCerts) == 0 {
+			return errors.New("no certificate presented")
+		}
+		cert, err := x509.ParseCertificate(rawCerts[0])
+		if err != nil {
+			return err
+		}
+		got, ok := cert.PublicKey.(ed25519.PublicKey)
+		if !ok || !bytes.Equal(got, pub) {
+			return fmt.Errorf("public key does not match the pinned key %x", []byte(pub))
+		}
+		return nil
+	}
+}
+
+// ParseEd25519PrivateKey parses a hex encoded Ed25519 seed (32 bytes) or private key (64 bytes).
+func ParseEd25519PrivateKey(hexKey string) (ed25519.PrivateKey, error) {
+	b, err := hex.DecodeString(hexKey)
+	if err != nil {
+		return nil, err
+	}
+	switch len(b) {
+	case ed25519.SeedSize:
+		return ed25519.NewKeyFromSeed(b), nil
+	case ed25519.PrivateKeySize:
+		return ed25519.PrivateKey(b), nil
+	default:
+		return nil, fmt.Errorf("Ed25519 private key must be %d or %d bytes, got %d", ed25519.SeedSize, ed25519.PrivateKeySize, len(b))
+	}
+}
+
+// ParseEd25519PublicKey parses a hex encoded Ed25519 public key.
+func ParseEd25519PublicKey(hexKey string) (ed25519.PublicKey, error) {
+	b, err := hex.DecodeString(hexKey)
+	if err != nil {
+		return nil, err
+	}
+	if len(b) != ed25519.PublicKeySize {
+		return nil, fmt.Errorf("Ed25519 public key must be %d bytes, got %d", ed25519.PublicKeySize, len(b))
+	}
+	return ed25519.PublicKey(b), nil
+}
@@ -0,0 +1,111 @@
+// Copyright 2021 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package lb
+
+import (
+	"context"
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/tls"
+	"net"
+	"testing"
+	"time"
+
+	piondtls "github.com/pion/dtls/v2"
+)
+
+// handshake runs a DTLS handshake over loopback, returning the client error.
+func handshake(t *testing.T, serverConfig, clientConfig *piondtls.Config) error {
+	t.Helper()
+	l, err := piondtls.Listen("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)}, serverConfig)
+	if err != nil {
+		t.Fatalf("Listen: %s", err)
+	}
+	defer l.Close()
+	go func() {
+		conn, err := l.Accept()
+		if err == nil {
+			conn.Close()
+		}
+	}()
+	// failed handshakes time out rather than being rejected, so don't wait long
+	clientConfig.ConnectContextMaker = func() (context.Context, func()) {
+		return context.WithTimeout(context.Background(), 2*time.Second)
+	}
+	conn, err := piondtls.Dial("udp", l.Addr().(*net.UDPAddr), clientConfig)
+	if err != nil {
+		return err
+	}
+	return conn.Close()
+}
+
+func TestDTLSRawPublicKey(t *testing.T) {
+	pub, priv, _ := ed25519.GenerateKey(rand.Reader)
+	cert, err := NewRawPublicKeyCertificate(priv)
+	if err != nil {
+		t.Fatalf("NewRawPublicKeyCertificate: %s", err)
+	}
+	if len(cert.Certificate[0]) > 256 {
+		t.Errorf("certificate is %d bytes, want it to be as small as possible", len(cert.Certificate[0]))
+	}
+	serverConfig := &piondtls.Config{
+		Certificates: []tls.Certificate{cert},
+		CipherSuites: RawPublicKeyCipherSuites,
+	}
+	err = handshake(t, serverConfig, &piondtls.Config{
+		InsecureSkipVerify:    true,
+		VerifyPeerCertificate: VerifyPinnedPublicKey(pub),
+		CipherSuites:          RawPublicKeyCipherSuites,
+	})
+	if err != nil {
+		t.Fatalf("handshake with pinned key failed: %s", err)
+	}
+	otherPub, _, _ := ed25519.GenerateKey(rand.Reader)
+	err = handshake(t, serverConfig, &piondtls.Config{
+		InsecureSkipVerify:    true,
+		VerifyPeerCertificate: VerifyPinnedPublicKey(otherPub),
+		CipherSuites:          RawPublicKeyCipherSuites,
+	})
+	if err == nil {
+		t.Fatalf("handshake succeeded with the wrong pinned key")
+	}
+}
+
+func TestDTLSPSK(t *testing.T) {
+	keys := map[string][]byte{
+		"alice": []byte("alice's secret"),
+	}
+	serverConfig := &piondtls.Config{
+		PSK: func(identity []byte) ([]byte, error) {
+			return keys[string(identity)], nil
+		},
+		CipherSuites: PSKCipherSuites,
+	}
+	clientConfig := func(key []byte) *piondtls.Config {
+		return &piondtls.Config{
+			PSK: func(hint []byte) ([]byte, error) {
+				return key, nil
+			},
+			PSKIdentityHint: []byte("alice"),
+			CipherSuites:    PSKCipherSuites,
+		}
+	}
+	if err := handshake(t, serverConfig, clientConfig(keys["alice"])); err != nil {
+		t.Fatalf("handshake with PSK failed: %s", err)
+	}
+	if err := handshake(t, serverConfig, clientConfig([]byte("wrong"))); err == nil {
+		t.Fatalf("handshake succeeded with the wrong PSK")
+	}
+}
@@ -0,0 +1,243 @@
+// Copyright 2021 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package lb
+
+import (
+	"bytes"
+	"crypto/cipher"
+	"crypto/rand"
+	"errors"
+	"sync"
+	"time"
+
+	"github.com/fxamacker/cbor/v2"
+	"github.com/matrix-org/go-coap/v2/message"
+	"github.com/matrix-org/go-coap/v2/message/codes"
+	coapmux "github.com/matrix-org/go-coap/v2/mux"
+	piondtls "github.com/pion/dtls/v2"
+	"golang.org/x/crypto/chacha20poly1305"
+)
+
+// SessionTicketPath is the path clients POST to in order to get a session ticket for the current
+// DTLS session.
+const SessionTicketPath = "/.well-known/lb-ticket"
+
+// DefaultSessionTicketLifetime is how long session tickets can be used to resume a session for.
+const DefaultSessionTicketLifetime = 7 * 24 * time.Hour
+
+// The RFC 5705 exporter label for the resumption secret. Labels which are not registered with IANA
+// must begin with EXPERIMENTAL.
+const resumptionSecretLabel = "EXPERIMENTAL-matrix-lb-resumption"
+
+const ctxValResumptionSecret = "ctxValResumptionSecret"
+
+var sessionTicketAAD = []byte("matrix-lb-ticket")
+
+// ErrInvalidSessionTicket is returned when a session ticket cannot be decrypted or has expired.
+var ErrInvalidSessionTicket = errors.New("invalid or expired session ticket")
+
+// ErrSessionTicketUsed is returned when a session ticket has already been used to resume a session.
+var ErrSessionTicketUsed = errors.New("session ticket already used")
+
+// sessionTicket is the plaintext of a session ticket, which only the proxy can read.
+type sessionTicket struct {
+	Expires     int64  `cbor:"1,keyasint"`
+	Secret      []byte `cbor:"2,keyasint"`
+	AccessToken string `cbor:"3,keyasint,omitempty"`
+	// The host the access token was sent to
+	Host string `cbor:"4,keyasint,omitempty"`
+	// Random, so the proxy can remember which tickets have been used
+	ID []byte `cbor:"5,keyasint"`
+}
+
+// SessionTickets lets clients resume a DTLS session without a full handshake, e.g after a mobile app
+// restarts.
+//
+// pion/dtls does not support abbreviated handshakes, so sessions are resumed using a PSK handshake
+// instead, which has no certificates or key exchange. At any point during a session, the client can
+// ask for a ticket, which is the resumption secret of the session (an RFC 5705 exporter value both
+// sides can compute) and the access token in use for the host of the request, encrypted with a key only the proxy knows. To
+// resume, the client sends the ticket as its PSK identity and uses the resumption secret as the PSK.
+// The proxy decrypts the ticket to find the PSK and restores the access token, so the client does
+// not need to send it again.
+//
+// Each ticket resumes one session, so a ticket copied from a client can't be used once the client has
+// resumed with it. Used tickets are remembered in memory until they expire, so a ticket which was used
+// before the proxy restarted can be used once more.
+type SessionTickets struct {
+	aead     cipher.AEAD
+	lifetime time.Duration
+	mu       sync.Mutex
+	used     map[string]int64 // ticket ID -> when the ticket expires
+}
+
+// NewSessionTickets makes session tickets encrypted with this 32 byte key. Tickets issued with a
+// different key can't be used, so the key should be persisted if tickets must survive the proxy
+// restarting.
+func NewSessionTickets(key []byte, lifetime time.Duration) (*SessionTickets, error) {
+	aead, err := chacha20poly1305.New(key)
+	if err != nil {
+		return nil, err
+	}
+	return &SessionTickets{
+		aead:     aead,
+		lifetime: lifetime,
+		used:     make(map[string]int64),
+	}, nil
+}
+
+// ResumptionSecret returns the secret used to resume this DTLS session, which is the same for the
+// client and server.
+func ResumptionSecret(state *piondtls.State) ([]byte, error) {
+	return state.ExportKeyingMaterial(resumptionSecretLabel, nil, 32)
+}
+
+func (t *SessionTickets) issue(secret []byte, host, accessToken string) ([]byte, error) {
+	id := make([]byte, 16)
+	if _, err := rand.Read(id); err != nil {
+		return nil, err
+	}
+	plaintext, err := cbor.Marshal(sessionTicket{
+		Expires:     time.Now().Add(t.lifetime).Unix(),
+		Secret:      secret,
+		AccessToken: accessToken,
+		Host:        host,
+		ID:          id,
+	})
+	if err != nil {
+		return nil, err
+	}
+	nonce := make([]byte, t.aead.NonceSize())
+	if _, err = rand.Read(nonce); err != nil {
+		return nil, err
+	}
+	return t.aead.Seal(nonce, nonce, plaintext, sessionTicketAAD), nil
+}
+
+func (t *SessionTickets) open(ticket []byte) (*sessionTicket, error) {
+	n := t.aead.NonceSize()
+	if len(ticket) < n {
+		return nil, ErrInvalidSessionTicket
+	}
+	plaintext, err := t.aead.Open(nil, ticket[:n], ticket[n:], sessionTicketAAD)
+	if err != nil {
+		return nil, ErrInvalidSessionTicket
+	}
+	var st sessionTicket
+	if err = cbor.Unmarshal(plaintext, &st); err != nil {
+		return nil, ErrInvalidSessionTicket
+	}
+	if time.Now().Unix() > st.Expires || len(st.ID) == 0 {
+		return nil, ErrInvalidSessionTicket
+	}
+	return &st, nil
+}
+
+// isUsed returns true if a session has been resumed with this ticket.
+func (t *SessionTickets) isUsed(st *sessionTicket) bool {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	_, used := t.used[string(st.ID)]
+	return used
+}
+
+// markUsed remembers that a session has been resumed with this ticket, forgetting tickets which have
+// expired. Returns false if the ticket was already used.
+func (t *SessionTickets) markUsed(st *sessionTicket) bool {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if _, used := t.used[string(st.ID)]; used {
+		return false
+	}
+	now := time.Now().Unix()
+	for id, expires := range t.used {
+		if now > expires {
+			delete(t.used, id)
+		}
+	}
+	t.used[string(st.ID)] = st.Expires
+	return true
+}
+
+// PSK is a pion/dtls PSK callback which returns the resumption secret of a session ticket, unless it
+// has been used. Use PSKCipherSuites alongside the certificate cipher suites so clients can do either
+// handshake.
+func (t *SessionTickets) PSK(identity []byte) ([]byte, error) {
+	st, err := t.open(identity)
+	if err != nil {
+		return nil, err
+	}
+	// The ticket is only marked as used by StartSession, once the handshake proves the client knows
+	// the secret: the ticket is sent in the clear, so anyone watching could use it up otherwise.
+	if t.isUsed(st) {
+		return nil, ErrSessionTicketUsed
+	}
+	return st.Secret, nil
+}
+
+// StartSession should be called when a DTLS session is established. It remembers the resumption
+// secret so a ticket can be issued later, and restores the access token if the session was resumed
+// from a ticket. Returns ErrSessionTicketUsed if another session was resumed with the same ticket
+// during the handshake, in which case the connection should be closed.
+func (t *SessionTickets) StartSession(cc SessionClient, state *piondtls.State) error {
+	secret, err := ResumptionSecret(state)
+	if err != nil {
+		return nil
+	}
+	cc.SetContextValue(ctxValResumptionSecret, secret)
+	if len(state.IdentityHint) == 0 {
+		return nil
+	}
+	st, err := t.open(state.IdentityHint)
+	if err != nil {
+		// a PSK which isn't a ticket
+		return nil
+	}
+	if !t.markUsed(st) {
+		return ErrSessionTicketUsed
+	}
+	if st.AccessToken != "" {
+		sessionAuthFor(cc).setAccessToken(st.Host, st.AccessToken)
+	}
+	return nil
+}
+
+// handleSessionTicket issues a ticket for the session of the client. Returns false if the request is
+// not for a ticket.
+func (co *CoAPHTTP) handleSessionTicket(w coapmux.ResponseWriter, r *coapmux.Message) bool {
+	if path, _ := r.Options.Path(); "/"+path != SessionTicketPath {
+		return false
+	}
+	if r.Code != codes.POST {
+		w.SetResponse(codes.MethodNotAllowed, message.TextPlain, nil)
+		return true
+	}
+	ctx := w.Client().Context()
+	secret, ok := ctx.Value(ctxValResumptionSecret).([]byte)
+	if !ok {
+		// not a DTLS session, or StartSession wasn't called
+		w.SetResponse(codes.NotFound, message.TextPlain, nil)
+		return true
+	}
+	host := requestHost(r.Options, ctx)
+	ticket, err := co.SessionTickets.issue(secret, host, sessionAuthFor(w.Client()).accessToken(host))
+	if err != nil {
+		co.log("failed to issue session ticket: %s", err)
+		w.SetResponse(codes.InternalServerError, message.TextPlain, nil)
+		return true
+	}
+	w.SetResponse(codes.Changed, message.AppOctets, bytes.NewReader(ticket))
+	return true
+}
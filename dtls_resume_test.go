@@ -0,0 +1,215 @@
+// Copyright 2021 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package lb
+
+import (
+	"bytes"
+	"context"
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/tls"
+	"net"
+	"testing"
+	"time"
+
+	piondtls "github.com/pion/dtls/v2"
+)
+
+type sessionClient struct {
+	ctx context.Context
+}
+
+func (c *sessionClient) Context() context.Context {
+	return c.ctx
+}
+
+func (c *sessionClient) SetContextValue(key interface{}, val interface{}) {
+	c.ctx = context.WithValue(c.ctx, key, val)
+}
+
+func newSessionTickets(t *testing.T, lifetime time.Duration) *SessionTickets {
+	t.Helper()
+	key := make([]byte, 32)
+	_, _ = rand.Read(key)
+	tickets, err := NewSessionTickets(key, lifetime)
+	if err != nil {
+		t.Fatalf("NewSessionTickets: %s", err)
+	}
+	return tickets
+}
+
+// connect runs a DTLS handshake over loopback, returning the client and server connection states.
+func connect(t *testing.T, serverConfig, clientConfig *piondtls.Config) (client, server piondtls.State) {
+	t.Helper()
+	l, err := piondtls.Listen("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)}, serverConfig)
+	if err != nil {
+		t.Fatalf("Listen: %s", err)
+	}
+	defer l.Close()
+	serverState := make(chan piondtls.State, 1)
+	go func() {
+		conn, err := l.Accept()
+		if err != nil {
+			close(serverState)
+			return
+		}
+		serverState <- conn.(*piondtls.Conn).ConnectionState()
+		conn.Close()
+	}()
+	clientConfig.ConnectContextMaker = func() (context.Context, func()) {
+		return context.WithTimeout(context.Background(), 2*time.Second)
+	}
+	conn, err := piondtls.Dial("udp", l.Addr().(*net.UDPAddr), clientConfig)
+	if err != nil {
+		t.Fatalf("Dial: %s", err)
+	}
+	defer conn.Close()
+	return conn.ConnectionState(), <-serverState
+}
+
+func TestSessionTickets(t *testing.T) {
+	tickets := newSessionTickets(t, time.Hour)
+	secret := []byte("resumption secret")
+	ticket, err := tickets.issue(secret, "example.org", "token")
+	if err != nil {
+		t.Fatalf("issue: %s", err)
+	}
+	st, err := tickets.open(ticket)
+	if err != nil {
+		t.Fatalf("open: %s", err)
+	}
+	if !bytes.Equal(st.Secret, secret) || st.AccessToken != "token" || st.Host != "example.org" {
+		t.Errorf("open returned %+v", st)
+	}
+	psk, err := tickets.PSK(ticket)
+	if err != nil || !bytes.Equal(psk, secret) {
+		t.Errorf("PSK returned %x, %v", psk, err)
+	}
+	// once a session is resumed with it, the ticket can't be used again until it expires
+	if !tickets.markUsed(st) {
+		t.Fatalf("markUsed: got false for an unused ticket")
+	}
+	if _, err = tickets.PSK(ticket); err != ErrSessionTicketUsed {
+		t.Errorf("PSK of a used ticket: got %v want %v", err, ErrSessionTicketUsed)
+	}
+	if tickets.markUsed(st) {
+		t.Errorf("markUsed: got true for a used ticket")
+	}
+
+	ticket[len(ticket)-1] ^= 1
+	if _, err = tickets.open(ticket); err != ErrInvalidSessionTicket {
+		t.Errorf("open tampered ticket: got %v want %v", err, ErrInvalidSessionTicket)
+	}
+	ticket, _ = tickets.issue(secret, "", "")
+	if _, err = newSessionTickets(t, time.Hour).open(ticket); err != ErrInvalidSessionTicket {
+		t.Errorf("open ticket with a different key: got %v want %v", err, ErrInvalidSessionTicket)
+	}
+	expired := newSessionTickets(t, -time.Minute)
+	ticket, _ = expired.issue(secret, "", "")
+	if _, err = expired.open(ticket); err != ErrInvalidSessionTicket {
+		t.Errorf("open expired ticket: got %v want %v", err, ErrInvalidSessionTicket)
+	}
+}
+
+func TestSessionTicketResumption(t *testing.T) {
+	tickets := newSessionTickets(t, time.Hour)
+	pub, priv, _ := ed25519.GenerateKey(rand.Reader)
+	cert, err := NewRawPublicKeyCertificate(priv)
+	if err != nil {
+		t.Fatalf("NewRawPublicKeyCertificate: %s", err)
+	}
+	serverConfig := &piondtls.Config{
+		Certificates: []tls.Certificate{cert},
+		PSK:          tickets.PSK,
+		CipherSuites: append(append([]piondtls.CipherSuiteID{}, RawPublicKeyCipherSuites...), PSKCipherSuites...),
+	}
+
+	// full handshake, then the client sends its access token and asks for a ticket
+	clientState, serverState := connect(t, serverConfig, &piondtls.Config{
+		InsecureSkipVerify:    true,
+		VerifyPeerCertificate: VerifyPinnedPublicKey(pub),
+		CipherSuites:          RawPublicKeyCipherSuites,
+	})
+	server := &sessionClient{ctx: context.Background()}
+	if err = tickets.StartSession(server, &serverState); err != nil {
+		t.Fatalf("StartSession: %s", err)
+	}
+	if server.ctx.Value(ctxValAccessToken) != nil {
+		t.Fatalf("access token set on a full handshake")
+	}
+	sessionAuthFor(server).setAccessToken("example.org", "token")
+	serverSecret := server.ctx.Value(ctxValResumptionSecret).([]byte)
+	ticket, err := tickets.issue(serverSecret, "example.org", sessionAuthFor(server).accessToken("example.org"))
+	if err != nil {
+		t.Fatalf("issue: %s", err)
+	}
+	secret, err := ResumptionSecret(&clientState)
+	if err != nil {
+		t.Fatalf("ResumptionSecret: %s", err)
+	}
+	if !bytes.Equal(secret, serverSecret) {
+		t.Fatalf("client and server resumption secrets differ")
+	}
+
+	// resume with the ticket
+	_, serverState = connect(t, serverConfig, &piondtls.Config{
+		PSK: func(hint []byte) ([]byte, error) {
+			return secret, nil
+		},
+		PSKIdentityHint: ticket,
+		CipherSuites:    PSKCipherSuites,
+	})
+	server = &sessionClient{ctx: context.Background()}
+	if err = tickets.StartSession(server, &serverState); err != nil {
+		t.Fatalf("StartSession: %s", err)
+	}
+	auth := sessionAuthFor(server)
+	if got := auth.accessToken("example.org"); got != "token" {
+		t.Errorf("resumed session access token: got %v want token", got)
+	}
+	if got := auth.accessToken("other.example.org"); got != "" {
+		t.Errorf("resumed session access token for another host: got %v want none", got)
+	}
+
+	// another session resumed with the ticket during the handshake
+	if err = tickets.StartSession(&sessionClient{ctx: context.Background()}, &serverState); err != ErrSessionTicketUsed {
+		t.Errorf("StartSession with a used ticket: got %v want %v", err, ErrSessionTicketUsed)
+	}
+	// and the ticket can't be used to resume again
+	resumeConfig := &piondtls.Config{
+		PSK: func(hint []byte) ([]byte, error) {
+			return secret, nil
+		},
+		PSKIdentityHint: ticket,
+		CipherSuites:    PSKCipherSuites,
+		ConnectContextMaker: func() (context.Context, func()) {
+			return context.WithTimeout(context.Background(), time.Second)
+		},
+	}
+	l, err := piondtls.Listen("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)}, serverConfig)
+	if err != nil {
+		t.Fatalf("Listen: %s", err)
+	}
+	defer l.Close()
+	go func() {
+		if conn, err := l.Accept(); err == nil {
+			conn.Close()
+		}
+	}()
+	if conn, err := piondtls.Dial("udp", l.Addr().(*net.UDPAddr), resumeConfig); err == nil {
+		conn.Close()
+		t.Errorf("resumed a session with a used ticket")
+	}
+}
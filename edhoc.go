@@ -0,0 +1,673 @@
+// Copyright 2021 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package lb
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"errors"
+	"fmt"
+	"io"
+	"sync"
+	"time"
+
+	"github.com/fxamacker/cbor/v2"
+	"github.com/matrix-org/go-coap/v2/message"
+	"golang.org/x/crypto/curve25519"
+	"golang.org/x/crypto/hkdf"
+)
+
+// EDHOCPath is the path clients send EDHOC messages to. https://datatracker.ietf.org/doc/html/rfc9528#appendix-A.2
+const EDHOCPath = "/.well-known/edhoc"
+
+// EDHOC cipher suites which are supported. Both use X25519 and SHA-256.
+// https://datatracker.ietf.org/doc/html/rfc9528#section-10.2
+const (
+	EDHOCSuiteAESCCM           = 0
+	EDHOCSuiteChaCha20Poly1305 = 4
+)
+
+// edhocMethodStaticDH is method 3, where both parties authenticate with static Diffie-Hellman keys.
+const edhocMethodStaticDH = 3
+
+// Content formats for EDHOC messages. Requests are sent with EDHOCRequestContentFormat as they are
+// prefixed with a connection identifier. https://datatracker.ietf.org/doc/html/rfc9528#section-10.9
+const (
+	EDHOCRequestContentFormat = message.MediaType(65) // application/cid-edhoc+cbor-seq
+	edhocContentFormat        = message.MediaType(64) // application/edhoc+cbor-seq
+)
+
+// edhocSessionTimeout is how long the responder waits for message_3.
+const edhocSessionTimeout = time.Minute
+
+// edhocMaxSessions limits the number of handshakes the responder has in progress.
+const edhocMaxSessions = 1000
+
+type edhocSuite struct {
+	aead   oscoreAlgorithm // used for message_3 and the OSCORE context
+	macLen int
+}
+
+var edhocSuites = map[int]edhocSuite{
+	EDHOCSuiteAESCCM:           {aead: oscoreAlgorithms[AlgAESCCM16_64_128], macLen: 8},
+	EDHOCSuiteChaCha20Poly1305: {aead: oscoreAlgorithms[AlgChaCha20Poly1305], macLen: 16},
+}
+
+// the suite whose application AEAD is the given OSCORE algorithm
+var edhocSuiteForAlg = map[int]int{
+	AlgAESCCM16_64_128:  EDHOCSuiteAESCCM,
+	AlgChaCha20Poly1305: EDHOCSuiteChaCha20Poly1305,
+}
+
+// Credentials must encode the same way on both sides, as they are hashed.
+var edhocEncMode, _ = cbor.CoreDetEncOptions().EncMode()
+
+// EDHOCKey is an X25519 key pair.
+type EDHOCKey struct {
+	Private []byte
+	Public  []byte
+}
+
+// GenerateEDHOCKey makes a new random key pair.
+func GenerateEDHOCKey() (*EDHOCKey, error) {
+	priv := make([]byte, curve25519.ScalarSize)
+	if _, err := rand.Read(priv); err != nil {
+		return nil, err
+	}
+	return EDHOCKeyFromPrivate(priv)
+}
+
+// EDHOCKeyFromPrivate makes the key pair for this private key.
+func EDHOCKeyFromPrivate(priv []byte) (*EDHOCKey, error) {
+	if len(priv) != curve25519.ScalarSize {
+		return nil, fmt.Errorf("edhoc: private key must be %d bytes", curve25519.ScalarSize)
+	}
+	pub, err := curve25519.X25519(priv, curve25519.Basepoint)
+	if err != nil {
+		return nil, err
+	}
+	return &EDHOCKey{
+		Private: priv,
+		Public:  pub,
+	}, nil
+}
+
+// edhocCOSEKey is an OKP COSE_Key. https://datatracker.ietf.org/doc/html/rfc9053#section-7.2
+type edhocCOSEKey struct {
+	Kty int    `cbor:"1,keyasint"`
+	Crv int    `cbor:"-1,keyasint"`
+	X   []byte `cbor:"-2,keyasint"`
+}
+
+// edhocCCS is a CWT Claims Set holding a public key, which is sent by value as the credential.
+// https://datatracker.ietf.org/doc/html/rfc9528#section-3.5.2
+type edhocCCS struct {
+	Sub string `cbor:"2,keyasint"`
+	Cnf struct {
+		Key edhocCOSEKey `cbor:"1,keyasint"`
+	} `cbor:"8,keyasint"`
+}
+
+// edhocCredential returns CRED_x and ID_CRED_x for a public key.
+func edhocCredential(pub []byte) (cred, idCred []byte, err error) {
+	var ccs edhocCCS
+	ccs.Cnf.Key = edhocCOSEKey{
+		Kty: 1, // OKP
+		Crv: 4, // X25519
+		X:   pub,
+	}
+	cred, err = edhocEncMode.Marshal(ccs)
+	if err != nil {
+		return nil, nil, err
+	}
+	// 14 is kccs, which holds the credential by value
+	idCred, err = edhocEncMode.Marshal(map[int]cbor.RawMessage{14: cred})
+	if err != nil {
+		return nil, nil, err
+	}
+	return cred, idCred, nil
+}
+
+// parseEDHOCCredential returns CRED_x and its public key from ID_CRED_x.
+func parseEDHOCCredential(idCred cbor.RawMessage) (cred, pub []byte, err error) {
+	var m map[int]cbor.RawMessage
+	if err = cbor.Unmarshal(idCred, &m); err != nil {
+		return nil, nil, fmt.Errorf("edhoc: malformed ID_CRED: %w", err)
+	}
+	cred, ok := m[14]
+	if !ok {
+		return nil, nil, errors.New("edhoc: ID_CRED does not contain a credential by value")
+	}
+	var ccs edhocCCS
+	if err = cbor.Unmarshal(cred, &ccs); err != nil {
+		return nil, nil, fmt.Errorf("edhoc: malformed credential: %w", err)
+	}
+	if ccs.Cnf.Key.Kty != 1 || ccs.Cnf.Key.Crv != 4 || len(ccs.Cnf.Key.X) != curve25519.PointSize {
+		return nil, nil, errors.New("edhoc: credential is not an X25519 key")
+	}
+	return cred, ccs.Cnf.Key.X, nil
+}
+
+// cborSeq encodes each item and concatenates them into a CBOR sequence. cbor.RawMessage items are
+// included as they are.
+func cborSeq(items ...interface{}) ([]byte, error) {
+	var buf bytes.Buffer
+	for _, item := range items {
+		b, err := edhocEncMode.Marshal(item)
+		if err != nil {
+			return nil, err
+		}
+		buf.Write(b)
+	}
+	return buf.Bytes(), nil
+}
+
+// decodeCBORSeq decodes a CBOR sequence into the items given, returning the number of bytes used.
+func decodeCBORSeq(data []byte, items ...interface{}) (int, error) {
+	r := bytes.NewReader(data)
+	dec := cbor.NewDecoder(r)
+	for _, item := range items {
+		if err := dec.Decode(item); err != nil {
+			return 0, fmt.Errorf("edhoc: malformed message: %w", err)
+		}
+	}
+	return dec.NumBytesRead(), nil
+}
+
+// encodeConnID encodes a connection identifier, which is an integer if it is a single byte which is
+// the encoding of one. https://datatracker.ietf.org/doc/html/rfc9528#section-3.3.2
+func encodeConnID(id []byte) cbor.RawMessage {
+	if len(id) == 1 && (id[0] <= 0x17 || (id[0] >= 0x20 && id[0] <= 0x37)) {
+		return cbor.RawMessage{id[0]}
+	}
+	b, _ := edhocEncMode.Marshal(id)
+	return b
+}
+
+func decodeConnID(raw cbor.RawMessage) ([]byte, error) {
+	if len(raw) == 1 && (raw[0] <= 0x17 || (raw[0] >= 0x20 && raw[0] <= 0x37)) {
+		return []byte{raw[0]}, nil
+	}
+	var id []byte
+	if err := cbor.Unmarshal(raw, &id); err != nil {
+		return nil, fmt.Errorf("edhoc: malformed connection identifier: %w", err)
+	}
+	return id, nil
+}
+
+func edhocHash(items ...interface{}) ([]byte, error) {
+	seq, err := cborSeq(items...)
+	if err != nil {
+		return nil, err
+	}
+	h := sha256.Sum256(seq)
+	return h[:], nil
+}
+
+func edhocExtract(salt, ikm []byte) []byte {
+	return hkdf.Extract(sha256.New, ikm, salt)
+}
+
+// edhocKDF is EDHOC_KDF. https://datatracker.ietf.org/doc/html/rfc9528#section-4.1.2
+func edhocKDF(prk []byte, label int, context []byte, length int) ([]byte, error) {
+	info, err := cborSeq(label, context, length)
+	if err != nil {
+		return nil, err
+	}
+	out := make([]byte, length)
+	if _, err = io.ReadFull(hkdf.Expand(sha256.New, prk, info), out); err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+// edhocKeys holds the keys derived as the handshake progresses.
+type edhocKeys struct {
+	suite   edhocSuite
+	th2     []byte
+	th3     []byte
+	prk3e2m []byte
+	prk4e3m []byte
+}
+
+// deriveMessage2Keys derives PRK_2e, KEYSTREAM_2 and PRK_3e2m.
+func (k *edhocKeys) deriveMessage2Keys(gY, message1, gXY, gRX []byte, plaintextLen int) (keystream []byte, err error) {
+	hash1 := sha256.Sum256(message1)
+	if k.th2, err = edhocHash(gY, hash1[:]); err != nil {
+		return nil, err
+	}
+	prk2e := edhocExtract(k.th2, gXY)
+	if keystream, err = edhocKDF(prk2e, 0, k.th2, plaintextLen); err != nil {
+		return nil, err
+	}
+	salt3e2m, err := edhocKDF(prk2e, 1, k.th2, sha256.Size)
+	if err != nil {
+		return nil, err
+	}
+	k.prk3e2m = edhocExtract(salt3e2m, gRX)
+	return keystream, nil
+}
+
+func (k *edhocKeys) mac2(cR []byte, idCredR, credR []byte) ([]byte, error) {
+	context, err := cborSeq(encodeConnID(cR), cbor.RawMessage(idCredR), k.th2, cbor.RawMessage(credR))
+	if err != nil {
+		return nil, err
+	}
+	return edhocKDF(k.prk3e2m, 2, context, k.suite.macLen)
+}
+
+// deriveMessage3Keys derives TH_3, K_3 and IV_3.
+func (k *edhocKeys) deriveMessage3Keys(plaintext2, credR []byte) (key, iv []byte, err error) {
+	if k.th3, err = edhocHash(k.th2, cbor.RawMessage(plaintext2), cbor.RawMessage(credR)); err != nil {
+		return nil, nil, err
+	}
+	if key, err = edhocKDF(k.prk3e2m, 3, k.th3, k.suite.aead.keyLen); err != nil {
+		return nil, nil, err
+	}
+	if iv, err = edhocKDF(k.prk3e2m, 4, k.th3, k.suite.aead.nonceLen); err != nil {
+		return nil, nil, err
+	}
+	return key, iv, nil
+}
+
+func (k *edhocKeys) mac3(gIY, idCredI, credI []byte) ([]byte, error) {
+	salt4e3m, err := edhocKDF(k.prk3e2m, 5, k.th3, sha256.Size)
+	if err != nil {
+		return nil, err
+	}
+	k.prk4e3m = edhocExtract(salt4e3m, gIY)
+	context, err := cborSeq(cbor.RawMessage(idCredI), k.th3, cbor.RawMessage(credI))
+	if err != nil {
+		return nil, err
+	}
+	return edhocKDF(k.prk4e3m, 6, context, k.suite.macLen)
+}
+
+func (k *edhocKeys) encrypt0AAD() ([]byte, error) {
+	return edhocEncMode.Marshal([]interface{}{"Encrypt0", []byte{}, k.th3})
+}
+
+// oscoreContext derives the OSCORE security context once the handshake has finished.
+// https://datatracker.ietf.org/doc/html/rfc9528#appendix-A.1
+func (k *edhocKeys) oscoreContext(plaintext3, credI, senderID, recipientID []byte) (*OSCOREContext, error) {
+	th4, err := edhocHash(k.th3, cbor.RawMessage(plaintext3), cbor.RawMessage(credI))
+	if err != nil {
+		return nil, err
+	}
+	prkOut, err := edhocKDF(k.prk4e3m, 7, th4, sha256.Size)
+	if err != nil {
+		return nil, err
+	}
+	prkExporter, err := edhocKDF(prkOut, 10, []byte{}, sha256.Size)
+	if err != nil {
+		return nil, err
+	}
+	masterSecret, err := edhocKDF(prkExporter, 0, []byte{}, k.suite.aead.keyLen)
+	if err != nil {
+		return nil, err
+	}
+	masterSalt, err := edhocKDF(prkExporter, 1, []byte{}, 8)
+	if err != nil {
+		return nil, err
+	}
+	return NewOSCOREContext(k.suite.aead.id, masterSecret, masterSalt, senderID, recipientID, nil)
+}
+
+func xorBytes(a, b []byte) []byte {
+	out := make([]byte, len(a))
+	for i := range a {
+		out[i] = a[i] ^ b[i]
+	}
+	return out
+}
+
+// EDHOCHandshake establishes an OSCORE security context with the proxy, whose public key is pinned.
+// The client has no long-term identity so it uses a new key for every handshake: it authenticates
+// using its access token as usual. `post` sends an EDHOC message to EDHOCPath with the content format
+// EDHOCRequestContentFormat and returns the response payload.
+// https://datatracker.ietf.org/doc/html/rfc9528
+func EDHOCHandshake(alg int, serverPublicKey []byte, post func(payload []byte) ([]byte, error)) (*OSCOREContext, error) {
+	suiteID, ok := edhocSuiteForAlg[alg]
+	if !ok {
+		return nil, fmt.Errorf("edhoc: unsupported algorithm %d", alg)
+	}
+	keys := &edhocKeys{suite: edhocSuites[suiteID]}
+	ephemeral, err := GenerateEDHOCKey()
+	if err != nil {
+		return nil, err
+	}
+	static, err := GenerateEDHOCKey()
+	if err != nil {
+		return nil, err
+	}
+	cI := []byte{0}
+
+	// message_1 = (METHOD, SUITES_I, G_X, C_I)
+	message1, err := cborSeq(edhocMethodStaticDH, suiteID, ephemeral.Public, encodeConnID(cI))
+	if err != nil {
+		return nil, err
+	}
+	res, err := post(append([]byte{0xf5}, message1...))
+	if err != nil {
+		return nil, err
+	}
+
+	// message_2 = G_Y || CIPHERTEXT_2
+	var gYCiphertext2 []byte
+	if _, err = decodeCBORSeq(res, &gYCiphertext2); err != nil {
+		return nil, err
+	}
+	if len(gYCiphertext2) <= curve25519.PointSize {
+		return nil, errors.New("edhoc: message_2 is too short")
+	}
+	gY := gYCiphertext2[:curve25519.PointSize]
+	ciphertext2 := gYCiphertext2[curve25519.PointSize:]
+	gXY, err := curve25519.X25519(ephemeral.Private, gY)
+	if err != nil {
+		return nil, err
+	}
+	gRX, err := curve25519.X25519(ephemeral.Private, serverPublicKey)
+	if err != nil {
+		return nil, err
+	}
+	keystream, err := keys.deriveMessage2Keys(gY, message1, gXY, gRX, len(ciphertext2))
+	if err != nil {
+		return nil, err
+	}
+	plaintext2 := xorBytes(ciphertext2, keystream)
+	var rawCR, idCredR cbor.RawMessage
+	var mac2 []byte
+	if _, err = decodeCBORSeq(plaintext2, &rawCR, &idCredR, &mac2); err != nil {
+		return nil, err
+	}
+	cR, err := decodeConnID(rawCR)
+	if err != nil {
+		return nil, err
+	}
+	credR, pubR, err := parseEDHOCCredential(idCredR)
+	if err != nil {
+		return nil, err
+	}
+	if !hmac.Equal(pubR, serverPublicKey) {
+		return nil, errors.New("edhoc: server public key does not match the pinned key")
+	}
+	wantMAC2, err := keys.mac2(cR, idCredR, credR)
+	if err != nil {
+		return nil, err
+	}
+	if !hmac.Equal(mac2, wantMAC2) {
+		return nil, errors.New("edhoc: MAC_2 verification failed")
+	}
+
+	// message_3 = CIPHERTEXT_3
+	k3, iv3, err := keys.deriveMessage3Keys(plaintext2, credR)
+	if err != nil {
+		return nil, err
+	}
+	credI, idCredI, err := edhocCredential(static.Public)
+	if err != nil {
+		return nil, err
+	}
+	gIY, err := curve25519.X25519(static.Private, gY)
+	if err != nil {
+		return nil, err
+	}
+	mac3, err := keys.mac3(gIY, idCredI, credI)
+	if err != nil {
+		return nil, err
+	}
+	plaintext3, err := cborSeq(cbor.RawMessage(idCredI), mac3)
+	if err != nil {
+		return nil, err
+	}
+	aead, err := keys.suite.aead.newAEAD(k3)
+	if err != nil {
+		return nil, err
+	}
+	aad, err := keys.encrypt0AAD()
+	if err != nil {
+		return nil, err
+	}
+	message3, err := cborSeq(aead.Seal(nil, iv3, plaintext3, aad))
+	if err != nil {
+		return nil, err
+	}
+	if _, err = post(append(encodeConnID(cR), message3...)); err != nil {
+		return nil, err
+	}
+	return keys.oscoreContext(plaintext3, credI, cR, cI)
+}
+
+// edhocResponderSession is a handshake waiting for message_3.
+type edhocResponderSession struct {
+	keys    *edhocKeys
+	k3      []byte
+	iv3     []byte
+	y       []byte
+	cI      []byte
+	expires time.Time
+}
+
+// edhocResponder is the proxy side of EDHOC, adding a security context to the server when the
+// handshake completes.
+type edhocResponder struct {
+	key    *EDHOCKey
+	server *OSCOREServer
+
+	mu       sync.Mutex
+	sessions map[string]*edhocResponderSession // keyed on C_R
+}
+
+// SetEDHOCKey lets clients establish security contexts using EDHOC, authenticating the proxy with
+// this key. Clients must be configured with the public key.
+func (s *OSCOREServer) SetEDHOCKey(key *EDHOCKey) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.edhoc = &edhocResponder{
+		key:      key,
+		server:   s,
+		sessions: make(map[string]*edhocResponderSession),
+	}
+}
+
+// handle processes message_1 or message_3, returning the response payload.
+func (r *edhocResponder) handle(payload []byte) ([]byte, error) {
+	if len(payload) == 0 {
+		return nil, errors.New("edhoc: empty message")
+	}
+	if payload[0] == 0xf5 {
+		return r.handleMessage1(payload[1:])
+	}
+	var rawCR cbor.RawMessage
+	n, err := decodeCBORSeq(payload, &rawCR)
+	if err != nil {
+		return nil, err
+	}
+	cR, err := decodeConnID(rawCR)
+	if err != nil {
+		return nil, err
+	}
+	return nil, r.handleMessage3(cR, payload[n:])
+}
+
+func (r *edhocResponder) handleMessage1(message1 []byte) ([]byte, error) {
+	var method, suiteID int
+	var gX []byte
+	var rawCI cbor.RawMessage
+	if _, err := decodeCBORSeq(message1, &method, &suiteID, &gX, &rawCI); err != nil {
+		return nil, err
+	}
+	if method != edhocMethodStaticDH {
+		return nil, fmt.Errorf("edhoc: unsupported method %d", method)
+	}
+	suite, ok := edhocSuites[suiteID]
+	if !ok {
+		return nil, fmt.Errorf("edhoc: unsupported cipher suite %d", suiteID)
+	}
+	cI, err := decodeConnID(rawCI)
+	if err != nil {
+		return nil, err
+	}
+	cR, err := r.allocateConnID()
+	if err != nil {
+		return nil, err
+	}
+	ephemeral, err := GenerateEDHOCKey()
+	if err != nil {
+		return nil, err
+	}
+	gXY, err := curve25519.X25519(ephemeral.Private, gX)
+	if err != nil {
+		return nil, err
+	}
+	gRX, err := curve25519.X25519(r.key.Private, gX)
+	if err != nil {
+		return nil, err
+	}
+	credR, idCredR, err := edhocCredential(r.key.Public)
+	if err != nil {
+		return nil, err
+	}
+	keys := &edhocKeys{suite: suite}
+
+	// the length of PLAINTEXT_2 is needed to derive the keystream, and the MAC has a fixed length
+	plaintext2Len := len(encodeConnID(cR)) + len(idCredR)
+	placeholder, err := edhocEncMode.Marshal(make([]byte, suite.macLen))
+	if err != nil {
+		return nil, err
+	}
+	plaintext2Len += len(placeholder)
+	keystream, err := keys.deriveMessage2Keys(ephemeral.Public, message1, gXY, gRX, plaintext2Len)
+	if err != nil {
+		return nil, err
+	}
+	mac2, err := keys.mac2(cR, idCredR, credR)
+	if err != nil {
+		return nil, err
+	}
+	plaintext2, err := cborSeq(encodeConnID(cR), cbor.RawMessage(idCredR), mac2)
+	if err != nil {
+		return nil, err
+	}
+	k3, iv3, err := keys.deriveMessage3Keys(plaintext2, credR)
+	if err != nil {
+		return nil, err
+	}
+	ciphertext2 := xorBytes(plaintext2, keystream)
+
+	r.mu.Lock()
+	if _, exists := r.sessions[string(cR)]; exists {
+		r.mu.Unlock()
+		return nil, errors.New("edhoc: connection identifier collision")
+	}
+	r.sessions[string(cR)] = &edhocResponderSession{
+		keys:    keys,
+		k3:      k3,
+		iv3:     iv3,
+		y:       ephemeral.Private,
+		cI:      cI,
+		expires: time.Now().Add(edhocSessionTimeout),
+	}
+	r.mu.Unlock()
+	return cborSeq(append(append([]byte{}, ephemeral.Public...), ciphertext2...))
+}
+
+func (r *edhocResponder) handleMessage3(cR, message3 []byte) error {
+	r.mu.Lock()
+	sess, ok := r.sessions[string(cR)]
+	delete(r.sessions, string(cR))
+	r.mu.Unlock()
+	if !ok || time.Now().After(sess.expires) {
+		return errors.New("edhoc: unknown or expired session")
+	}
+	keys := sess.keys
+	var ciphertext3 []byte
+	if _, err := decodeCBORSeq(message3, &ciphertext3); err != nil {
+		return err
+	}
+	aead, err := keys.suite.aead.newAEAD(sess.k3)
+	if err != nil {
+		return err
+	}
+	aad, err := keys.encrypt0AAD()
+	if err != nil {
+		return err
+	}
+	plaintext3, err := aead.Open(nil, sess.iv3, ciphertext3, aad)
+	if err != nil {
+		return errors.New("edhoc: message_3 decryption failed")
+	}
+	var idCredI cbor.RawMessage
+	var mac3 []byte
+	if _, err = decodeCBORSeq(plaintext3, &idCredI, &mac3); err != nil {
+		return err
+	}
+	credI, pubI, err := parseEDHOCCredential(idCredI)
+	if err != nil {
+		return err
+	}
+	gIY, err := curve25519.X25519(sess.y, pubI)
+	if err != nil {
+		return err
+	}
+	wantMAC3, err := keys.mac3(gIY, idCredI, credI)
+	if err != nil {
+		return err
+	}
+	if !hmac.Equal(mac3, wantMAC3) {
+		return errors.New("edhoc: MAC_3 verification failed")
+	}
+	ctx, err := keys.oscoreContext(plaintext3, credI, sess.cI, cR)
+	if err != nil {
+		return err
+	}
+	r.server.AddContext(ctx)
+	return nil
+}
+
+// allocateConnID picks a C_R which is not in use by a security context or another handshake, and so
+// can be used as the kid of the client. Short identifiers are preferred as they are sent in every request.
+func (r *edhocResponder) allocateConnID() ([]byte, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	now := time.Now()
+	for id, sess := range r.sessions {
+		if now.After(sess.expires) {
+			delete(r.sessions, id)
+		}
+	}
+	if len(r.sessions) >= edhocMaxSessions {
+		return nil, errors.New("edhoc: too many handshakes in progress")
+	}
+	// the longest ID which fits in the nonce of every suite
+	for length := 1; length <= 6; length++ {
+		for attempt := 0; attempt < 8; attempt++ {
+			id := make([]byte, length)
+			if _, err := rand.Read(id); err != nil {
+				return nil, err
+			}
+			if _, exists := r.sessions[string(id)]; exists {
+				continue
+			}
+			if r.server.hasRecipientID(id) {
+				continue
+			}
+			return id, nil
+		}
+	}
+	return nil, errors.New("edhoc: no connection identifiers available")
+}
@@ -0,0 +1,47 @@
+// Copyright 2021 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package lb
+
+import (
+	"testing"
+)
+
+func TestEDHOCHandshake(t *testing.T) {
+	for _, alg := range []int{AlgAESCCM16_64_128, AlgChaCha20Poly1305} {
+		key, err := GenerateEDHOCKey()
+		if err != nil {
+			t.Fatalf("GenerateEDHOCKey: %s", err)
+		}
+		server := NewOSCOREServer(DefaultOSCOREContexts)
+		server.SetEDHOCKey(key)
+		post := func(payload []byte) ([]byte, error) {
+			return server.edhoc.handle(payload)
+		}
+		client, err := EDHOCHandshake(alg, key.Public, post)
+		if err != nil {
+			t.Fatalf("alg %d: EDHOCHandshake: %s", alg, err)
+		}
+		if len(server.contexts) != 1 {
+			t.Fatalf("alg %d: got %d server contexts want 1", alg, len(server.contexts))
+		}
+		roundTrip(t, client, server)
+
+		// the client must reject a server which doesn't have the pinned key
+		other, _ := GenerateEDHOCKey()
+		if _, err = EDHOCHandshake(alg, other.Public, post); err == nil {
+			t.Fatalf("alg %d: EDHOCHandshake succeeded with the wrong server key", alg)
+		}
+	}
+}
@@ -35,6 +35,20 @@ func NewCBORCodecV1(canonical bool) *CBORCodec {
 	return c
 }
 
+// NewCBORCodecV2 creates a v2 codec capable of converting JSON <--> CBOR, see NewCBORCodecV1. The v2
+// keys are a superset of the v1 keys, and JSON numbers which are integers are sent as CBOR integers,
+// so this can decode CBOR from v1 peers but v1 peers can't always decode its output. See
+// OptionIDDictionary.
+func NewCBORCodecV2(canonical bool) *CBORCodec {
+	c, err := NewCBORCodec(cborv2Keys, canonical)
+	if err != nil {
+		// this should never happen as the key map is static
+		panic("failed to create cbor v2 codec: " + err.Error())
+	}
+	c.integers = true
+	return c
+}
+
 // CBORToJSONHandler transparently wraps JSON http handlers to accept and produce CBOR.
 // It wraps the provided `next` handler and modifies it in two ways:
 //
@@ -75,3 +89,55 @@ func NewCoAPPathV1() *CoAPPath {
 	}
 	return p
 }
+
+// NewCoAPPathV2 creates CoAP enum path mappings for version 2, which adds the endpoints of the stable
+// spec such as /relations, /threads and /hierarchy to version 1. Version 1 enum paths are unchanged.
+func NewCoAPPathV2() *CoAPPath {
+	p, err := NewCoAPPath(coapv2pathMappings)
+	if err != nil {
+		// this shouldn't be possible as the key map is static
+		panic("failed to create coap v2 paths: " + err.Error())
+	}
+	return p
+}
+
+// NewCoAPQueryV1 creates CoAP query mappings for version 1. This allows conversion between HTTP
+// query parameters and CoAP Uri-Query options such as:
+//   ?since=s72594_4483_1934&set_presence=offline
+//   0=s72594_4483_1934, 4=0
+func NewCoAPQueryV1() *CoAPQuery {
+	q, err := NewCoAPQuery(coapv1QueryKeys, coapv1QueryValues)
+	if err != nil {
+		// this shouldn't be possible as the key map is static
+		panic("failed to create coap v1 queries: " + err.Error())
+	}
+	return q
+}
+
+// NewCoAPQueryV2 creates CoAP query mappings for version 2. Version 1 query keys and values are unchanged.
+func NewCoAPQueryV2() *CoAPQuery {
+	values := make(map[string]map[string]string, len(coapv1QueryValues)+len(coapv2QueryValues))
+	for k, v := range coapv1QueryValues {
+		values[k] = v
+	}
+	for k, v := range coapv2QueryValues {
+		values[k] = v
+	}
+	q, err := NewCoAPQuery(coapv2QueryKeys, values)
+	if err != nil {
+		// this shouldn't be possible as the key map is static
+		panic("failed to create coap v2 queries: " + err.Error())
+	}
+	return q
+}
+
+// NonConfirmableV1 returns the version 1 policy for which requests are sent as Non-confirmable
+// messages, for use with CoAPHTTP.NonConfirmable. This policy refers to the enum paths in
+// NewCoAPPathV1, which are the same in NewCoAPPathV2.
+func NonConfirmableV1() map[string][]string {
+	policy := make(map[string][]string, len(coapv1NonConfirmable))
+	for code, methods := range coapv1NonConfirmable {
+		policy[code] = append([]string{}, methods...)
+	}
+	return policy
+}
@@ -17,20 +17,20 @@ package mobile
 
 import (
 	"bytes"
-	"context"
+	"crypto/x509"
+	"encoding/hex"
+	"fmt"
 	"io"
 	"io/ioutil"
+	"net"
 	"net/http"
 	"net/url"
-	"strings"
 	"sync"
 	"time"
 
-	"github.com/matrix-org/go-coap/v2/dtls"
 	"github.com/matrix-org/go-coap/v2/message"
-	"github.com/matrix-org/go-coap/v2/net/blockwise"
-	"github.com/matrix-org/go-coap/v2/udp/client"
-	"github.com/matrix-org/go-coap/v2/udp/message/pool"
+	"github.com/matrix-org/go-coap/v2/message/codes"
+	basepool "github.com/matrix-org/go-coap/v2/message/pool"
 	"github.com/matrix-org/lb"
 	piondtls "github.com/pion/dtls/v2"
 	"github.com/sirupsen/logrus"
@@ -76,8 +76,9 @@ type ConnectionParams struct {
 	// If set, enables /sync OBSERVE requests, meaning the server will push traffic to the client
 	// rather than relying on long-polling. Client implementations need no changes for this feature
 	// to work. Using OBSERVE carries risks as client syncing state is now stored server-side. If the
-	// server gets restarted, it will lose its OBSERVE subscriptions, meaning clients will not be pushed
-	// events. Enabling this will reduce idle bandwidth costs by 50% (~160 bytes CoAP keep-alive packets
+	// server gets restarted without persisting its OBSERVE subscriptions (see the proxy's -observe-store),
+	// it will lose them, meaning clients will not be pushed events until they reconnect and observe
+	// again. Enabling this will reduce idle bandwidth costs by 50% (~160 bytes CoAP keep-alive packets
 	// vs ~320 bytes with long-polling). Therefore, enabling this is most useful when used with very
 	// quiet accounts, as there are no savings when the connection is not idle.
 	ObserveEnabled bool
@@ -93,6 +94,39 @@ type ConnectionParams struct {
 	// back fake /sync responses (with no data and the same sync token) after a certain amount of time when waiting
 	// for OBSERVE data.
 	ObserveNoResponseTimeoutSecs int
+	// The length in bytes of CoAP tokens used for requests, between 1 and 8. Every request and response
+	// carries the token, so shorter tokens save bandwidth. Tokens are unique per connection whilst a
+	// request is outstanding, so this only needs to be large enough for the number of concurrent requests.
+	TokenLength int
+	// If the server can't be reached using CoAP over DTLS (e.g because UDP is blocked), the client
+	// falls back to CoAP over TLS on this port of the same host, then to CoAP over secure WebSockets
+	// on WebSocketFallbackPort. These default to the ports the proxy listens on by default, and can be
+	// set to 0 to disable each fallback. Both transports are reliable, so the transmission parameters
+	// above do not apply to them.
+	TCPFallbackPort       int
+	WebSocketFallbackPort int
+	// If set, DTLS authenticates with this pre-shared key (hex encoded) and PSK identity instead of a
+	// certificate. The fallback transports cannot use pre-shared keys.
+	PSK         string
+	PSKIdentity string
+	// If set, the proxy must present this hex encoded Ed25519 public key instead of a certificate which
+	// is valid for the host. This is much smaller on the wire than a certificate chain.
+	ServerPublicKey string
+	// If set, requests are protected end-to-end with OSCORE so they can only be read by the proxy, even
+	// if they pass through untrusted CoAP proxies. Set the hex encoded public key of the proxy, which is
+	// used to establish a security context using EDHOC. OBSERVE is not used when OSCORE is enabled.
+	OSCOREServerPublicKey string
+	// The COSE AEAD algorithm to use with OSCORE: 10 (AES-CCM-16-64-128) has less overhead but cannot
+	// protect messages larger than 64KiB, 24 (ChaCha20/Poly1305) has no such limit and is the default.
+	OSCOREAlgorithm int
+	// If set, every request says which host it is for, so a single proxy can serve several homeservers.
+	// This costs the length of the host name in each request, and is not needed when the proxy only
+	// serves one homeserver.
+	SendHost bool
+	// If set, requests for every homeserver are sent to the proxy at this host:port, which forwards them
+	// to the homeserver in the request URL. The proxy must allow forwarding to the homeserver. OBSERVE is
+	// not used when this is set.
+	ProxyAddress string
 }
 
 var activeConnectionParams = ConnectionParams{
@@ -108,16 +142,59 @@ var activeConnectionParams = ConnectionParams{
 	TransmissionMaxRetransmits:   4,
 	ObserveBufferSize:            50,
 	ObserveNoResponseTimeoutSecs: 5,
+	TokenLength:                  2,
+	OSCOREAlgorithm:              lb.DefaultOSCOREAlgorithm,
+	TCPFallbackPort:              lb.DefaultTCPPort,
+	WebSocketFallbackPort:        lb.DefaultWebSocketPort,
 }
 
 const (
-	ctxValObserveSync     = "ctxValObserveSync"
-	ctxValSentAccessToken = "ctxValSentAccessToken"
+	ctxValObserveSync        = "ctxValObserveSync"
+	ctxValSentAccessToken    = "ctxValSentAccessToken"
+	ctxValAccessTokenAliases = "ctxValAccessTokenAliases"
+	ctxValTokens             = "ctxValTokens"
+	ctxValOSCORE             = "ctxValOSCORE"
+	ctxValIDHandles          = "ctxValIDHandles"
+	ctxValDictionary         = "ctxValDictionary"
 )
 
 var dc *dtlsClients = newDTLSClients()
-var cborCodec *lb.CBORCodec = lb.NewCBORCodecV1(false)
-var coapHTTP *lb.CoAPHTTP = lb.NewCoAPHTTP(lb.NewCoAPPathV1())
+
+// Requests are encoded with the dictionary version negotiated on their connection. Responses are
+// decoded with the newest version, which decodes every older version too.
+var cborCodecs = map[int]*lb.CBORCodec{
+	lb.DictionaryV1: lb.NewCBORCodecV1(false),
+	lb.DictionaryV2: lb.NewCBORCodecV2(false),
+}
+var coapHTTPs = map[int]*lb.CoAPHTTP{
+	lb.DictionaryV1: newCoAPHTTP(lb.NewCoAPPathV1(), lb.NewCoAPQueryV1()),
+	lb.DictionaryV2: newCoAPHTTP(lb.NewCoAPPathV2(), lb.NewCoAPQueryV2()),
+}
+var cborCodec *lb.CBORCodec = cborCodecs[lb.DictionaryV2]
+var coapHTTP *lb.CoAPHTTP = coapHTTPs[lb.DictionaryV2]
+
+func newCoAPHTTP(paths *lb.CoAPPath, queries *lb.CoAPQuery) *lb.CoAPHTTP {
+	co := lb.NewCoAPHTTP(paths)
+	co.NonConfirmable = lb.NonConfirmableV1()
+	co.Queries = queries
+	return co
+}
+
+// dictionaryForConn returns the dictionary negotiation of the connection.
+func dictionaryForConn(conn coapConn) *lb.DictionaryNegotiation {
+	d, ok := conn.Context().Value(ctxValDictionary).(*lb.DictionaryNegotiation)
+	if !ok {
+		// connections made by getClientForHost always have one, so this is only hit by connections
+		// we didn't make. Return one which never offers a newer version.
+		return lb.NewDictionaryNegotiation(lb.DictionaryV1)
+	}
+	return d
+}
+
+// coapHTTPForConn returns the CoAPHTTP which encodes requests with the dictionary version of the connection.
+func coapHTTPForConn(conn coapConn) *lb.CoAPHTTP {
+	return coapHTTPs[dictionaryForConn(conn).Version()]
+}
 
 // Params returns the current connection parameters.
 func Params() *ConnectionParams {
@@ -127,6 +204,10 @@ func Params() *ConnectionParams {
 // SetParams changes the connection parameters to those given. Closes all DTLS connections.
 func SetParams(cp *ConnectionParams) {
 	activeConnectionParams = *cp
+	for _, co := range coapHTTPs {
+		co.SendURIHost = cp.SendHost
+		co.SendProxyScheme = cp.ProxyAddress != ""
+	}
 	dc.closeAllConns()
 }
 
@@ -136,6 +217,8 @@ type Response struct {
 	Code int
 	// Body is the HTTP response body as a string
 	Body string
+	// ContentType is the Content-Type of the file downloaded by DownloadMedia
+	ContentType string
 }
 
 // SendRequest sends a CoAP request to the target hsURL. All of these parameters should be treated
@@ -145,57 +228,40 @@ type Response struct {
 //
 // This function will block until the response is returned, or the request times out.
 func SendRequest(method, hsURL, token, body string) *Response {
-	logrus.Infof("DTLS SendRequest -> %s %s", method, hsURL)
-
-	// convert JSON to CBOR
-	var reqBody io.ReadSeeker
-	if body != "" {
-		cborBody, err := cborCodec.JSONToCBOR(bytes.NewBufferString(body))
-		if err != nil {
-			logrus.WithError(err).Error("Failed to convert HTTP request body from JSON to CBOR")
-			return nil // send request normally
-		}
-		reqBody = bytes.NewReader(cborBody)
-	}
+	logrus.Infof("CoAP SendRequest -> %s %s", method, hsURL)
 
 	// convert HTTP params into an HTTP request
-	req, err := http.NewRequest(method, hsURL, reqBody)
+	req, err := http.NewRequest(method, hsURL, nil)
 	if err != nil {
 		logrus.WithError(err).Error("Failed to create HTTP request from params")
 		return nil
 	}
-	if reqBody != nil {
-		req.Header.Set("Content-Type", "application/cbor")
-	}
 
-	// fetch a DTLS client (either cached or makes a new conn)
-	u, err := url.Parse(hsURL)
-	if err != nil {
-		logrus.WithError(err).Error("Failed to parse HS URL")
-		return nil
-	}
-	if u.Host == "" {
-		logrus.WithField("url", hsURL).Error("HS URL missing host")
-		return nil
-	}
-	conn, err := dc.getClientForHost(u.Host)
-	if err != nil {
-		logrus.WithError(err).Errorf("Failed to get DTLS client for host %s", u.Host)
+	u := req.URL
+	conn, host := connForRequest(req, token)
+	if conn == nil {
 		return nil
 	}
 
-	// Check if we've sent an access token and set it if we need to
-	sentAccessToken := conn.Context().Value(ctxValSentAccessToken)
-	if sentAccessToken == nil || sentAccessToken != token {
-		req.Header.Set("Authorization", "Bearer "+token)
-		conn.SetContextValue(ctxValSentAccessToken, token)
+	// convert JSON to CBOR, with the keys the server knows
+	var reqBody io.ReadSeeker
+	if body != "" {
+		cborBody, err := cborCodecs[dictionaryForConn(conn).Version()].JSONToCBOR(bytes.NewBufferString(body))
+		if err != nil {
+			logrus.WithError(err).Error("Failed to convert HTTP request body from JSON to CBOR")
+			return nil // send request normally
+		}
+		reqBody = bytes.NewReader(cborBody)
+		req.Body = ioutil.NopCloser(reqBody)
+		req.ContentLength = int64(len(cborBody))
+		req.Header.Set("Content-Type", "application/cbor")
 	}
 
 	// Check for /sync OBSERVE requests
-	if activeConnectionParams.ObserveEnabled && strings.Contains(u.Path, "/_matrix/client/r0/sync") {
+	if activeConnectionParams.ObserveEnabled && !oscoreEnabled() && activeConnectionParams.ProxyAddress == "" && coapHTTP.Paths.Template(u.Path) == "/_matrix/client/r0/sync" {
 		queries := u.Query()
 		since := u.Query().Get("since")
-		ch := observe(conn, coapHTTP.Paths.HTTPPathToCoapPath("/_matrix/client/r0/sync"), token, queries)
+		ch := observe(conn, coapHTTPForConn(conn).Paths.HTTPPathToCoapPath(u.EscapedPath()), token, queries)
 		if ch == nil {
 			return nil
 		}
@@ -221,61 +287,200 @@ func SendRequest(method, hsURL, token, body string) *Response {
 	}
 
 	// send the request
-	var res *pool.Message
-	err = coapHTTP.HTTPRequestToCoAP(req, func(msg *pool.Message) error {
-		res, err = conn.Do(msg)
-		return err
-	})
+	res, err := roundTrip(conn, host, req, reqBody, token)
+	if err != nil {
+		return nil
+	}
+	if res == nil {
+		// this was a Non-confirmable request which we don't wait on, so pretend it worked
+		logrus.Infof("Sent %s %s as Non-confirmable", method, u.Path)
+		return &Response{
+			Code: 200,
+			Body: "{}",
+		}
+	}
+	logrus.Infof("Got response code: %v", res.code)
+
+	httpRes := res.http
+	// convert CBOR to JSON
+	resBody, err := cborCodec.CBORToJSON(httpRes.Body)
+	if err != nil {
+		logrus.WithError(err).Error("Failed to read response body")
+		return nil
+	}
+
+	return &Response{
+		Code: httpRes.StatusCode,
+		Body: string(resBody),
+	}
+}
+
+// connForRequest returns the connection to send the request on, making a new connection if there
+// isn't one, and sets the access token if it hasn't been sent on the connection. Returns <nil> if it
+// is not possible to connect.
+func connForRequest(req *http.Request, token string) (conn coapConn, host string) {
+	if req.URL.Host == "" {
+		logrus.WithField("url", req.URL.String()).Error("HS URL missing host")
+		return nil, ""
+	}
+	// fetch a DTLS client (either cached or makes a new conn)
+	host = dialHost(req.URL)
+	conn, err := dc.getClientForHost(host)
+	if err != nil {
+		logrus.WithError(err).Errorf("Failed to get DTLS client for host %s", host)
+		return nil, ""
+	}
+
+	setAccessToken(conn, req, token)
+	return conn, host
+}
+
+// setAccessToken sets the access token on the request if it hasn't been sent on the connection.
+func setAccessToken(conn coapConn, req *http.Request, token string) {
+	sentAccessToken := conn.Context().Value(ctxValSentAccessToken)
+	if sentAccessToken == nil || sentAccessToken != token {
+		req.Header.Set("Authorization", "Bearer "+token)
+		conn.SetContextValue(ctxValSentAccessToken, token)
+	}
+}
+
+// roundTrip sends the request on the connection, reconnecting if the connection was closed and
+// retrying with the full access token if the alias was rejected, or with the full IDs if a room, user
+// or event ID handle was rejected. reqBody is the body of req, which
+// is resent when retrying. Returns a <nil> response for Non-confirmable requests.
+func roundTrip(conn coapConn, host string, req *http.Request, reqBody io.ReadSeeker, token string) (*coapResponse, error) {
+	res, used, err := do(conn, req, token)
 	if err != nil {
 		logrus.WithError(err).Error("Failed to convert HTTP request to CoAP or to send request")
 
-		if dc.isConnClosed(u.Host) {
+		if dc.isConnClosed(host) {
 			logrus.Warn("Connection is closed, re-establishing")
-			conn, err = dc.getClientForHost(u.Host)
+			conn, err = dc.getClientForHost(host)
 			if err != nil {
-				logrus.WithError(err).Errorf("Failed to get DTLS client for host %s", u.Host)
-				return nil
+				logrus.WithError(err).Errorf("Failed to get DTLS client for host %s", host)
+				return nil, err
 			}
 			req.Header.Set("Authorization", "Bearer "+token)
 			conn.SetContextValue(ctxValSentAccessToken, token)
-			if reqBody != nil {
-				_, _ = reqBody.Seek(0, 0)
-				req.Body = ioutil.NopCloser(reqBody)
-			}
-			err = coapHTTP.HTTPRequestToCoAP(req, func(msg *pool.Message) error {
-				res, err = conn.Do(msg)
-				return err
-			})
+			resetBody(req, reqBody)
+			res, used, err = do(conn, req, token)
 			if err != nil {
 				logrus.WithError(err).Error("Still failed to convert HTTP request to CoAP or to send request")
-				return nil
+				return nil, err
 			}
 			// continue parsing the response
 		} else {
-			return nil
+			return nil, err
+		}
+	}
+	if res == nil {
+		return nil, nil
+	}
+	if used.idHandles && res.code == codes.PreconditionFailed {
+		// the server doesn't know a handle, so retry once with the full IDs. The handles were
+		// forgotten when the response was received.
+		logrus.Warn("ID handle was rejected, retrying with the full IDs")
+		resetBody(req, reqBody)
+		res, used, err = do(conn, req, token)
+		if err != nil {
+			logrus.WithError(err).Error("Failed to resend request with the full IDs")
+			return nil, err
+		}
+	}
+	if used.alias && res.code == codes.Unauthorized {
+		// the server may have forgotten the alias, so retry once with the full access token. The
+		// alias was forgotten when the response was received.
+		logrus.Warn("Access token alias was rejected, retrying with the full access token")
+		req.Header.Set("Authorization", "Bearer "+token)
+		resetBody(req, reqBody)
+		res, _, err = do(conn, req, token)
+		if err != nil {
+			logrus.WithError(err).Error("Failed to resend request with the full access token")
+			return nil, err
 		}
 	}
-	logrus.Infof("Got response code: %v", res.Code())
+	return res, nil
+}
 
-	// convert CoAP to HTTP and return the response
-	httpRes := coapHTTP.CoAPToHTTPResponse(res)
-	if httpRes == nil {
-		return nil
+// resetBody rewinds the body of the request so it can be sent again.
+func resetBody(req *http.Request, reqBody io.ReadSeeker) {
+	if reqBody == nil {
+		return
 	}
-	// convert CBOR to JSON
-	resBody, err := cborCodec.CBORToJSON(httpRes.Body)
-	if err != nil {
-		logrus.WithError(err).Error("Failed to read response body")
-		return nil
+	_, _ = reqBody.Seek(0, io.SeekStart)
+	if rc, ok := reqBody.(io.ReadCloser); ok {
+		// keep files seekable so they are still sent one block at a time
+		req.Body = rc
+	} else {
+		req.Body = ioutil.NopCloser(reqBody)
 	}
+}
 
-	return &Response{
-		Code: httpRes.StatusCode,
-		Body: string(resBody),
+// sentCompressed says which of the server issued aliases and handles were sent in a request.
+type sentCompressed struct {
+	alias     bool
+	idHandles bool
+}
+
+// do sends the HTTP request as CoAP on this connection. If the server has issued an alias for the
+// access token then the alias is sent instead of the access token, and if it has issued handles for
+// IDs in the path then the handles are sent instead of the IDs. Returns which were sent.
+// Returns a <nil> response if the request was sent Non-confirmable, as there is no response. These
+// requests never use an alias or ID handles: the server doesn't respond, so nobody would see the
+// error if it had forgotten one. Like other requests, they only carry the access token if
+// connForRequest set it, otherwise the server uses the one already sent on the connection.
+func do(conn coapConn, req *http.Request, token string) (res *coapResponse, used sentCompressed, err error) {
+	aliases := aliasesForConn(conn)
+	handles, hasHandles := conn.Context().Value(ctxValIDHandles).(*lb.IDHandles)
+	dictionary := dictionaryForConn(conn)
+	if tokens, ok := conn.Context().Value(ctxValTokens).(*lb.TokenAllocator); ok {
+		// use a short token which is unique on this connection
+		req = req.WithContext(lb.WithTokenAllocator(req.Context(), tokens))
 	}
+	var offeredDictionary bool
+	res, err = conn.send(req, func(msg *basepool.Message) error {
+		if msg.HasOption(message.NoResponse) {
+			offeredDictionary = dictionary.Offer(msg)
+			return nil
+		}
+		if alias := aliases.get(token); alias != nil && msg.HasOption(lb.OptionIDAccessToken) {
+			msg.Remove(lb.OptionIDAccessToken)
+			msg.SetOptionBytes(lb.OptionIDAccessTokenAlias, alias)
+			used.alias = true
+		}
+		if hasHandles {
+			used.idHandles = coapHTTPForConn(conn).ApplyIDHandles(msg, handles)
+		}
+		offeredDictionary = dictionary.Offer(msg)
+		return nil
+	})
+	if err != nil {
+		return nil, sentCompressed{}, err
+	}
+	if res == nil {
+		return nil, used, nil
+	}
+	if hasHandles {
+		if used.idHandles && res.code == codes.PreconditionFailed {
+			handles.Forget()
+		}
+		handles.Learn(res.opts)
+	}
+	if offeredDictionary {
+		dictionary.Learn(res.code, res.opts)
+	}
+	switch {
+	case res.code == codes.Unauthorized:
+		aliases.remove(token)
+	case lb.IsLogoutPath(req.URL.Path):
+		aliases.remove(token)
+	case res.alias != nil:
+		aliases.set(token, res.alias)
+	}
+	return res, used, nil
 }
 
-func observe(conn *client.ClientConn, path, token string, queries url.Values) chan *Response {
+func observe(conn coapConn, path, token string, queries url.Values) chan *Response {
 	ctx := conn.Context()
 	if ctx.Value(ctxValObserveSync) != nil {
 		logrus.Infof("Observe: connection already observing; returning existing channel")
@@ -291,21 +496,51 @@ func observe(conn *client.ClientConn, path, token string, queries url.Values) ch
 			Value: []byte(token),
 		},
 	}
+	if alias := aliasesForConn(conn).get(token); alias != nil {
+		opts[0] = message.Option{
+			ID:    lb.OptionIDAccessTokenAlias,
+			Value: alias,
+		}
+	}
 	for k, v := range queries {
 		opts = append(opts, message.Option{
 			ID:    message.URIQuery,
-			Value: []byte(k + "=" + v[0]),
+			Value: []byte(coapHTTPForConn(conn).Queries.Encode(k, v[0])),
 		})
 	}
-	_, err := conn.Observe(context.Background(), path, func(req *pool.Message) {
-		// convert CoAP to HTTP and return the response
-		httpRes := coapHTTP.CoAPToHTTPResponse(req)
-		if httpRes == nil {
-			logrus.Warnf("Observe: failed to convert CoAP to HTTP for message %+v\n", req)
-			return
+	// the observation keeps its token until it ends, so take it from the connection's allocator
+	// rather than picking one which requests on the connection could be given too
+	tokens, hasTokens := conn.Context().Value(ctxValTokens).(*lb.TokenAllocator)
+	var obsToken message.Token
+	var err error
+	if hasTokens {
+		obsToken, err = tokens.Acquire()
+	} else {
+		obsToken, err = message.GetToken()
+	}
+	if err != nil {
+		logrus.WithError(err).Errorf("Observe: failed to get token to observe path %s", path)
+		conn.SetContextValue(ctxValObserveSync, nil)
+		return nil
+	}
+	err = conn.observe(path, obsToken, func(res *coapResponse) {
+		httpRes := res.http
+		if res.code>>5 != 2 {
+			// the proxy ends the observation with an error e.g if the access token was logged out, so
+			// observe again on the next /sync
+			logrus.Infof("Observe: observation of %s ended with code %v", path, res.code)
+			conn.SetContextValue(ctxValObserveSync, nil)
+			if hasTokens {
+				tokens.Release(obsToken)
+			}
+			if res.code == codes.ServiceUnavailable {
+				// the proxy is shutting down, so observe again on a new connection once it is back,
+				// which resumes from the last notification
+				go conn.Close()
+			}
 		}
 		if httpRes.Body == nil {
-			logrus.Infof("Observe: ignoring nil response body from message %+v", req)
+			logrus.Infof("Observe: ignoring nil response body from message with code %v", res.code)
 			return
 		}
 		// convert CBOR to JSON
@@ -323,43 +558,92 @@ func observe(conn *client.ClientConn, path, token string, queries url.Values) ch
 	}, opts...)
 	if err != nil {
 		logrus.WithError(err).Errorf("Observe: failed to observe path %s", path)
+		conn.SetContextValue(ctxValObserveSync, nil)
+		if hasTokens {
+			tokens.Release(obsToken)
+		}
 		return nil
 	}
 	return ch
 }
 
+// dtlsClients holds a connection per host. Connections are DTLS unless the client had to fall back to
+// another transport.
 type dtlsClients struct {
-	dtlsConfig *piondtls.Config
-	conns      map[string]*client.ClientConn // host -> conn
-	mu         sync.Mutex
+	dtlsConfig    *piondtls.Config
+	conns         map[string]coapConn    // host -> conn
+	downloadConns map[string]coapConn    // host -> conn without blockwise transfers, see DownloadMedia
+	resumptions   map[string]*resumption // host -> imported session to resume
+	mu            sync.Mutex
 }
 
 func newDTLSClients() *dtlsClients {
-	dtlsConfig := &piondtls.Config{
-		InsecureSkipVerify: activeConnectionParams.InsecureSkipVerify,
-		FlightInterval:     time.Duration(activeConnectionParams.FlightIntervalSecs) * time.Second,
-	}
 	return &dtlsClients{
-		dtlsConfig: dtlsConfig,
-		conns:      make(map[string]*client.ClientConn),
+		dtlsConfig:    newDTLSConfig(),
+		conns:         make(map[string]coapConn),
+		downloadConns: make(map[string]coapConn),
+		resumptions:   make(map[string]*resumption),
 	}
 }
 
 func (c *dtlsClients) closeAllConns() {
-	var conns []*client.ClientConn
+	var conns []coapConn
 	c.mu.Lock()
 	for _, con := range c.conns {
 		conns = append(conns, con)
 	}
+	for _, con := range c.downloadConns {
+		conns = append(conns, con)
+	}
 	c.mu.Unlock()
 	for _, con := range conns {
 		con.Close()
 	}
 	// refresh the dtls config
-	c.dtlsConfig = &piondtls.Config{
+	c.dtlsConfig = newDTLSConfig()
+}
+
+// newDTLSConfig makes a DTLS config from the active connection parameters.
+func newDTLSConfig() *piondtls.Config {
+	cfg := &piondtls.Config{
 		InsecureSkipVerify: activeConnectionParams.InsecureSkipVerify,
 		FlightInterval:     time.Duration(activeConnectionParams.FlightIntervalSecs) * time.Second,
 	}
+	if activeConnectionParams.PSK != "" {
+		key, err := hex.DecodeString(activeConnectionParams.PSK)
+		if err != nil {
+			logrus.WithError(err).Error("PSK is not hex encoded, ignoring it")
+		} else {
+			cfg.PSK = func(hint []byte) ([]byte, error) {
+				return key, nil
+			}
+			cfg.PSKIdentityHint = []byte(activeConnectionParams.PSKIdentity)
+			cfg.CipherSuites = lb.PSKCipherSuites
+			return cfg
+		}
+	}
+	if verify := verifyServerPublicKey(); verify != nil {
+		cfg.InsecureSkipVerify = true
+		cfg.VerifyPeerCertificate = verify
+		cfg.CipherSuites = lb.RawPublicKeyCipherSuites
+	}
+	return cfg
+}
+
+// verifyServerPublicKey returns a function which checks the server has the pinned ServerPublicKey, or
+// <nil> if no key is pinned.
+func verifyServerPublicKey() func(rawCerts [][]byte, verifiedChains [][]*x509.Certificate) error {
+	if activeConnectionParams.ServerPublicKey == "" {
+		return nil
+	}
+	pub, err := lb.ParseEd25519PublicKey(activeConnectionParams.ServerPublicKey)
+	if err != nil {
+		logrus.WithError(err).Error("ServerPublicKey is invalid, rejecting all servers")
+		return func(rawCerts [][]byte, verifiedChains [][]*x509.Certificate) error {
+			return err
+		}
+	}
+	return lb.VerifyPinnedPublicKey(pub)
 }
 
 func (c *dtlsClients) isConnClosed(host string) bool {
@@ -369,44 +653,180 @@ func (c *dtlsClients) isConnClosed(host string) bool {
 	return !ok
 }
 
-func (c *dtlsClients) getClientForHost(host string) (*client.ClientConn, error) {
+func (c *dtlsClients) getClientForHost(host string) (coapConn, error) {
+	return c.getClient(c.conns, host, true)
+}
+
+// getDownloadClientForHost returns the connection for streaming media downloads from the host. go-coap
+// reassembles blockwise transfers in memory, so this connection doesn't use them and the client asks
+// for each block itself.
+func (c *dtlsClients) getDownloadClientForHost(host string) (coapConn, error) {
+	return c.getClient(c.downloadConns, host, false)
+}
+
+// getClient returns the connection to the host in conns, dialling a new one if there isn't one.
+func (c *dtlsClients) getClient(conns map[string]coapConn, host string, blockwiseTransfers bool) (coapConn, error) {
 	c.mu.Lock()
 	defer c.mu.Unlock()
-	co, ok := c.conns[host]
+	co, ok := conns[host]
 	if ok {
 		return co, nil
 	}
-	co, err := dtls.Dial(
-		host, c.dtlsConfig, dtls.WithHeartBeat(time.Duration(activeConnectionParams.HeartbeatTimeoutSecs)*time.Second),
-		dtls.WithKeepAlive(uint32(activeConnectionParams.KeepAliveMaxRetries), time.Duration(activeConnectionParams.KeepAliveTimeoutSecs)*time.Second, func(cc interface {
-			Close() error
-			Context() context.Context
-		}) {
-			return
-		}),
-		dtls.WithTransmission(
-			// FIXME? https://github.com/plgd-dev/go-coap/issues/226
-			time.Duration(activeConnectionParams.TransmissionNStart)*time.Second,
-			time.Duration(activeConnectionParams.TransmissionACKTimeoutSecs)*time.Second,
-			activeConnectionParams.TransmissionMaxRetransmits,
-		),
-		// long blockwise timeout to handle large sync responses which take a huge number of blocks
-		dtls.WithBlockwise(true, blockwise.SZX1024, 2*time.Minute),
-		dtls.WithLogger(&logger{}),
-	)
+	tokens, err := lb.NewTokenAllocator(activeConnectionParams.TokenLength)
+	if err != nil {
+		return nil, err
+	}
+	co, err = c.dial(host, blockwiseTransfers)
+	if err == nil && oscoreEnabled() {
+		var oscore *lb.OSCOREContext
+		if oscore, err = newOSCOREContext(co); err != nil {
+			co.Close()
+			return nil, err
+		}
+		co.SetContextValue(ctxValOSCORE, oscore)
+	}
 	if err == nil {
-		c.conns[host] = co
+		conns[host] = co
+		co.SetContextValue(ctxValAccessTokenAliases, &accessTokenAliases{
+			aliases: make(map[string][]byte),
+		})
+		co.SetContextValue(ctxValTokens, tokens)
+		co.SetContextValue(ctxValIDHandles, lb.NewIDHandles())
+		co.SetContextValue(ctxValDictionary, lb.NewDictionaryNegotiation(lb.DictionaryV2))
 		// delete the entry when the connection is closed so we'll make a new one
 		co.AddOnClose(func() {
 			c.mu.Lock()
 			defer c.mu.Unlock()
-			delete(c.conns, host)
+			delete(conns, host)
 			logrus.Infof("Removed dead connection for host %s", host)
 		})
 	}
 	return co, err
 }
 
+// dial connects to the host using CoAP over DTLS. If that fails, the client falls back to CoAP over TLS
+// and then CoAP over WebSockets, if enabled. Returns the error from the last transport tried.
+func (c *dtlsClients) dial(host string, blockwiseTransfers bool) (coapConn, error) {
+	co, err := c.dialDTLS(host, blockwiseTransfers)
+	if err == nil {
+		return co, nil
+	}
+	if activeConnectionParams.TCPFallbackPort != 0 {
+		logrus.WithError(err).Warnf("Failed to connect to %s over DTLS, falling back to TLS", host)
+		co, err = dialTCP(host, blockwiseTransfers)
+		if err == nil {
+			return co, nil
+		}
+	}
+	if activeConnectionParams.WebSocketFallbackPort != 0 {
+		logrus.WithError(err).Warnf("Failed to connect to %s, falling back to WebSockets", host)
+		co, err = dialWebSocket(host, blockwiseTransfers)
+		if err == nil {
+			return co, nil
+		}
+	}
+	return nil, err
+}
+
+// dialDTLS connects to the host using CoAP over DTLS, resuming an imported session if there is one.
+// Only the connection for requests resumes it: connections for downloads always do a full handshake.
+func (c *dtlsClients) dialDTLS(host string, blockwiseTransfers bool) (coapConn, error) {
+	if res := c.resumptions[host]; res != nil && blockwiseTransfers {
+		// tickets are only used once, and if resuming fails we need a full handshake anyway
+		delete(c.resumptions, host)
+		co, err := c.dialDTLSWithConfig(host, res.dtlsConfig(c.dtlsConfig), blockwiseTransfers)
+		if err == nil {
+			logrus.Infof("Resumed DTLS session with %s", host)
+			// the server restored the access token from the ticket
+			co.SetContextValue(ctxValSentAccessToken, res.AccessToken)
+			return co, nil
+		}
+		logrus.WithError(err).Warnf("Failed to resume DTLS session with %s, doing a full handshake", host)
+	}
+	return c.dialDTLSWithConfig(host, c.dtlsConfig, blockwiseTransfers)
+}
+
+func (c *dtlsClients) dialDTLSWithConfig(host string, dtlsConfig *piondtls.Config, blockwiseTransfers bool) (coapConn, error) {
+	// dial the DTLS connection ourselves rather than with dtls.Dial, as it is needed to export the session
+	sock, err := net.Dial("udp", host)
+	if err != nil {
+		return nil, err
+	}
+	dtlsConn, err := piondtls.Client(sock, dtlsConfig)
+	if err != nil {
+		sock.Close()
+		return nil, err
+	}
+	return newDTLSClientConn(dtlsConn, blockwiseTransfers), nil
+}
+
+// dialHost returns the host to connect to for requests to this URL.
+func dialHost(u *url.URL) string {
+	if activeConnectionParams.ProxyAddress != "" {
+		return activeConnectionParams.ProxyAddress
+	}
+	return u.Host
+}
+
+func oscoreEnabled() bool {
+	return activeConnectionParams.OSCOREServerPublicKey != ""
+}
+
+// newOSCOREContext makes a security context with the proxy, running EDHOC on this connection if needed.
+func newOSCOREContext(conn coapConn) (*lb.OSCOREContext, error) {
+	alg := activeConnectionParams.OSCOREAlgorithm
+	serverKey, err := hex.DecodeString(activeConnectionParams.OSCOREServerPublicKey)
+	if err != nil {
+		return nil, fmt.Errorf("OSCOREServerPublicKey is not hex encoded: %w", err)
+	}
+	return lb.EDHOCHandshake(alg, serverKey, func(payload []byte) ([]byte, error) {
+		code, body, err := conn.post(lb.EDHOCPath, lb.EDHOCRequestContentFormat, payload)
+		if err != nil {
+			return nil, err
+		}
+		if code != codes.Changed {
+			return nil, fmt.Errorf("EDHOC request failed: %v", code)
+		}
+		return body, nil
+	})
+}
+
+// accessTokenAliases holds the aliases the server has issued for access tokens on a single connection.
+type accessTokenAliases struct {
+	mu      sync.Mutex
+	aliases map[string][]byte // access token -> alias
+}
+
+func aliasesForConn(conn coapConn) *accessTokenAliases {
+	aliases, ok := conn.Context().Value(ctxValAccessTokenAliases).(*accessTokenAliases)
+	if !ok {
+		// connections made by getClientForHost always have aliases, so this is only hit by
+		// connections we didn't make. Return an empty set which is not stored anywhere.
+		return &accessTokenAliases{
+			aliases: make(map[string][]byte),
+		}
+	}
+	return aliases
+}
+
+func (a *accessTokenAliases) get(token string) []byte {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	return a.aliases[token]
+}
+
+func (a *accessTokenAliases) set(token string, alias []byte) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	a.aliases[token] = alias
+}
+
+func (a *accessTokenAliases) remove(token string) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	delete(a.aliases, token)
+}
+
 type logger struct{}
 
 func (l *logger) Printf(format string, v ...interface{}) {
@@ -12,7 +12,7 @@ require (
 	github.com/matrix-org/lb v0.0.0-20210916112413-984a54a5343a
 	github.com/modern-go/concurrent v0.0.0-20180306012644-bacd9c7ef1dd // indirect
 	github.com/pion/dtls/v2 v2.0.10-0.20210502094952-3dc563b9aede
-	github.com/plgd-dev/kit v0.0.0-20210614190235-99984a49de48 // indirect
+	github.com/plgd-dev/kit v0.0.0-20210614190235-99984a49de48
 	github.com/sirupsen/logrus v1.8.1
 	github.com/tidwall/sjson v1.2.2 // indirect
 	go.uber.org/atomic v1.9.0 // indirect
@@ -0,0 +1,221 @@
+// Copyright 2021 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package mobile
+
+import (
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+
+	"github.com/matrix-org/go-coap/v2/message"
+	basepool "github.com/matrix-org/go-coap/v2/message/pool"
+	"github.com/matrix-org/go-coap/v2/net/blockwise"
+	"github.com/matrix-org/lb"
+	"github.com/sirupsen/logrus"
+)
+
+// UploadMedia uploads the file at filePath with this Content-Type. hsURL is the full upload URL e.g
+// https://example.com/_matrix/media/r0/upload?filename=cat.png. The file is sent one block at a time
+// so it is never held in memory. Returns the JSON response, or <nil> if there was an error in which
+// case clients should upload the file over HTTP.
+func UploadMedia(hsURL, token, contentType, filePath string) *Response {
+	logrus.Infof("CoAP UploadMedia -> %s", hsURL)
+	f, err := os.Open(filePath)
+	if err != nil {
+		logrus.WithError(err).Error("Failed to open file to upload")
+		return nil
+	}
+	defer f.Close()
+	req, err := http.NewRequest("POST", hsURL, nil)
+	if err != nil {
+		logrus.WithError(err).Error("Failed to create HTTP request from params")
+		return nil
+	}
+	// *os.File is seekable, so the body is read block by block as it is sent
+	req.Body = f
+	req.Header.Set("Content-Type", contentType)
+
+	conn, host := connForRequest(req, token)
+	if conn == nil {
+		return nil
+	}
+	res, err := roundTrip(conn, host, req, f, token)
+	if err != nil || res == nil {
+		return nil
+	}
+	logrus.Infof("Got response code: %v", res.code)
+	resBody, err := cborCodec.CBORToJSON(res.http.Body)
+	if err != nil {
+		logrus.WithError(err).Error("Failed to read response body")
+		return nil
+	}
+	return &Response{
+		Code: res.http.StatusCode,
+		Body: string(resBody),
+	}
+}
+
+// DownloadMedia downloads the media at hsURL e.g https://example.com/_matrix/media/r0/download/example.com/abc
+// and writes it to filePath. Each block is written to the file as it arrives so the media is never
+// held in memory, unless OSCORE is enabled. The returned Response has the Content-Type of the media
+// and an empty body, or the JSON error if the download failed. Returns <nil> if there was an error in
+// which case clients should download the file over HTTP.
+func DownloadMedia(hsURL, token, filePath string) *Response {
+	logrus.Infof("CoAP DownloadMedia -> %s", hsURL)
+	req, err := http.NewRequest("GET", hsURL, nil)
+	if err != nil {
+		logrus.WithError(err).Error("Failed to create HTTP request from params")
+		return nil
+	}
+	var res *coapResponse
+	if oscoreEnabled() {
+		// OSCORE protects the whole response before it is split into blocks, so no block can be
+		// read until they have all arrived
+		res, err = downloadWhole(req, token, filePath)
+	} else {
+		res, err = downloadBlocks(req, token, filePath)
+	}
+	if err != nil {
+		logrus.WithError(err).Error("Failed to download media")
+		return nil
+	}
+	if res == nil {
+		return nil
+	}
+	logrus.Infof("Got response code: %v", res.code)
+	if !isMediaResponse(res) {
+		// an error, which is JSON converted to CBOR
+		resBody, err := cborCodec.CBORToJSON(res.http.Body)
+		if err != nil {
+			logrus.WithError(err).Error("Failed to read response body")
+			return nil
+		}
+		return &Response{
+			Code: res.http.StatusCode,
+			Body: string(resBody),
+		}
+	}
+	return &Response{
+		Code:        res.http.StatusCode,
+		ContentType: res.http.Header.Get("Content-Type"),
+	}
+}
+
+// isMediaResponse returns true if the response is the downloaded media, rather than an error.
+func isMediaResponse(res *coapResponse) bool {
+	contentType := res.http.Header.Get("Content-Type")
+	return res.http.StatusCode >= 200 && res.http.StatusCode < 300 && !lb.IsJSONContentType(contentType) && contentType != "application/cbor"
+}
+
+// downloadWhole sends the request on the connection for requests, which reassembles the response in
+// memory, then writes the media to filePath. Returns <nil> if it is not possible to connect.
+func downloadWhole(req *http.Request, token, filePath string) (*coapResponse, error) {
+	conn, host := connForRequest(req, token)
+	if conn == nil {
+		return nil, nil
+	}
+	res, err := roundTrip(conn, host, req, nil, token)
+	if err != nil || res == nil || !isMediaResponse(res) {
+		return res, err
+	}
+	f, err := os.Create(filePath)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	if _, err = io.Copy(f, res.http.Body); err != nil {
+		return nil, err
+	}
+	return res, nil
+}
+
+// downloadBlocks asks for each block of the media in turn on the download connection to the host,
+// writing it to filePath as it arrives. Every block is asked for with the same token, so the proxy
+// sends the next block of the response it already has. Returns the response to the first block, or
+// <nil> if it is not possible to connect.
+func downloadBlocks(req *http.Request, token, filePath string) (*coapResponse, error) {
+	if req.URL.Host == "" {
+		return nil, fmt.Errorf("HS URL missing host: %s", req.URL)
+	}
+	host := dialHost(req.URL)
+	conn, err := dc.getDownloadClientForHost(host)
+	if err != nil {
+		logrus.WithError(err).Errorf("Failed to get DTLS client for host %s", host)
+		return nil, nil
+	}
+	setAccessToken(conn, req, token)
+	// not a short token from the connection's TokenAllocator: the proxy keeps the response for this
+	// token after the last block is sent, so a later download which reused it would get this media
+	blockToken, err := message.GetToken()
+	if err != nil {
+		return nil, err
+	}
+	szx := blockwise.SZX1024
+	if conn.Transport() != "udp" {
+		// the transport is reliable, so the proxy sends BERT blocks of many KiB
+		szx = blockwise.SZXBERT
+	}
+
+	var first *coapResponse
+	var f *os.File
+	var written int64
+	for {
+		block, err := blockwise.EncodeBlockOption(szx, written/szx.Size(), false)
+		if err != nil {
+			return nil, err
+		}
+		res, err := conn.send(req, func(msg *basepool.Message) error {
+			msg.SetToken(blockToken)
+			msg.SetOptionUint32(message.Block2, block)
+			return nil
+		})
+		if err != nil {
+			return nil, err
+		}
+		if first == nil {
+			if !isMediaResponse(res) {
+				return res, nil
+			}
+			first = res
+			if f, err = os.Create(filePath); err != nil {
+				return nil, err
+			}
+			defer f.Close()
+			// the proxy has the response now, so the rest of the blocks don't need the access token
+			req.Header.Del("Authorization")
+		} else if res.code != first.code {
+			return nil, fmt.Errorf("block at offset %d: got code %v want %v", written, res.code, first.code)
+		}
+		more := false
+		if res.hasBlock2 {
+			var num int64
+			if szx, num, more, err = blockwise.DecodeBlockOption(res.block2); err != nil {
+				return nil, err
+			}
+			if num*szx.Size() != written {
+				return nil, fmt.Errorf("got block at offset %d want %d", num*szx.Size(), written)
+			}
+		}
+		n, err := io.Copy(f, res.http.Body)
+		if err != nil {
+			return nil, err
+		}
+		written += n
+		if !more {
+			return first, nil
+		}
+	}
+}
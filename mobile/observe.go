@@ -0,0 +1,303 @@
+// Copyright 2021 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package mobile
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/matrix-org/go-coap/v2/dtls"
+	"github.com/matrix-org/go-coap/v2/message"
+	"github.com/matrix-org/go-coap/v2/message/codes"
+	basepool "github.com/matrix-org/go-coap/v2/message/pool"
+	coapnet "github.com/matrix-org/go-coap/v2/net"
+	"github.com/matrix-org/go-coap/v2/net/blockwise"
+	"github.com/matrix-org/go-coap/v2/net/monitor/inactivity"
+	coapobservation "github.com/matrix-org/go-coap/v2/net/observation"
+	"github.com/matrix-org/go-coap/v2/tcp"
+	tcppool "github.com/matrix-org/go-coap/v2/tcp/message/pool"
+	"github.com/matrix-org/go-coap/v2/udp/client"
+	udpmessage "github.com/matrix-org/go-coap/v2/udp/message"
+	"github.com/matrix-org/go-coap/v2/udp/message/pool"
+	"github.com/matrix-org/lb"
+	piondtls "github.com/pion/dtls/v2"
+	kitsync "github.com/plgd-dev/kit/sync"
+	"github.com/sirupsen/logrus"
+)
+
+// go-coap's Observe always picks a new 8 byte token for the observation, rather than a short one from
+// the connection's TokenAllocator. So connections are made here rather than with dtls.Client and
+// tcp.Client, which keep the handlers and requests of observations to themselves: these connections
+// keep them, so observe can register an observation with its own token. The requests are needed to
+// ask for the rest of a notification which is sent blockwise.
+
+func coapErrors(err error) {
+	logrus.WithError(err).Warn("CoAP connection error")
+}
+
+func coapGoPool(f func()) error {
+	go f()
+	return nil
+}
+
+// keepAliveMonitor pings the server when the connection is idle, like dtls.WithKeepAlive and
+// tcp.WithKeepAlive.
+func keepAliveMonitor(asyncPing func(cc inactivity.ClientConn, receivePong func()) (func(), error)) inactivity.Monitor {
+	keepalive := inactivity.NewKeepAlive(uint32(activeConnectionParams.KeepAliveMaxRetries), func(cc inactivity.ClientConn) {}, asyncPing)
+	timeout := time.Duration(activeConnectionParams.KeepAliveTimeoutSecs) * time.Second
+	return inactivity.NewInactivityMonitor(timeout/time.Duration(activeConnectionParams.KeepAliveMaxRetries+1), keepalive.OnInactive)
+}
+
+// newDTLSClientConn is dtls.Client with the options the client uses.
+func newDTLSClientConn(dtlsConn *piondtls.Conn, blockwiseTransfers bool) *udpConn {
+	c := &udpConn{
+		dtlsConn:            dtlsConn,
+		observationHandlers: client.NewHandlerContainer(),
+		observationRequests: kitsync.NewMap(),
+	}
+	var bw *blockwise.BlockWise
+	if blockwiseTransfers {
+		// long blockwise timeout to handle large sync responses which take a huge number of blocks
+		bw = blockwise.NewBlockWise(func(ctx context.Context) blockwise.Message {
+			msg := pool.AcquireMessage(ctx)
+			msg.SetType(udpmessage.Confirmable)
+			return msg
+		}, func(msg blockwise.Message) {
+			pool.ReleaseMessage(msg.(*pool.Message))
+		}, 2*time.Minute, coapErrors, false, func(token message.Token) (blockwise.Message, bool) {
+			req, ok := c.observationRequests.LoadWithFunc(token.String(), func(v interface{}) interface{} {
+				r := v.(*pool.Message)
+				msg := pool.AcquireMessage(r.Context())
+				msg.ResetOptionsTo(r.Options())
+				msg.SetCode(r.Code())
+				msg.SetToken(r.Token())
+				msg.SetMessageID(r.MessageID())
+				return msg
+			})
+			if !ok {
+				return nil, false
+			}
+			return req.(blockwise.Message), true
+		}, &logger{})
+	}
+	monitor := keepAliveMonitor(func(cc inactivity.ClientConn, receivePong func()) (func(), error) {
+		return cc.(*client.ClientConn).AsyncPing(receivePong)
+	})
+	conn := coapnet.NewConn(dtlsConn,
+		coapnet.WithHeartBeat(time.Duration(activeConnectionParams.HeartbeatTimeoutSecs)*time.Second),
+		coapnet.WithOnReadTimeout(func() error {
+			monitor.CheckInactivity(c.ClientConn)
+			return nil
+		}),
+	)
+	c.ClientConn = client.NewClientConn(
+		dtls.NewSession(context.Background(), conn, 64*1024, true),
+		c.observationHandlers, c.observationRequests,
+		// FIXME? https://github.com/plgd-dev/go-coap/issues/226
+		time.Duration(activeConnectionParams.TransmissionNStart)*time.Second,
+		time.Duration(activeConnectionParams.TransmissionACKTimeoutSecs)*time.Second,
+		activeConnectionParams.TransmissionMaxRetransmits,
+		client.NewObservationHandler(c.observationHandlers, func(w *client.ResponseWriter, r *pool.Message) {
+			switch r.Code() {
+			case codes.POST, codes.PUT, codes.GET, codes.DELETE:
+				w.SetResponse(codes.NotFound, message.TextPlain, nil)
+			}
+		}),
+		blockwise.SZX1024, bw, coapGoPool, coapErrors, udpmessage.GetMID, monitor, &logger{},
+	)
+	go func() {
+		if err := c.Run(); err != nil {
+			coapErrors(err)
+		}
+	}()
+	return c
+}
+
+// newTCPClientConn is tcp.Client with the options the client uses. go-coap reassembles blockwise
+// transfers in memory, so connections which fetch each block themselves turn them off.
+func newTCPClientConn(netConn net.Conn, transport string, blockwiseTransfers bool) *tcpConn {
+	c := &tcpConn{
+		transport:           transport,
+		observationHandlers: tcp.NewHandlerContainer(),
+		observationRequests: kitsync.NewMap(),
+	}
+	var bw *blockwise.BlockWise
+	if blockwiseTransfers {
+		bw = blockwise.NewBlockWise(func(ctx context.Context) blockwise.Message {
+			return tcppool.AcquireMessage(ctx)
+		}, func(msg blockwise.Message) {
+			tcppool.ReleaseMessage(msg.(*tcppool.Message))
+		}, 2*time.Minute, coapErrors, false, func(token message.Token) (blockwise.Message, bool) {
+			req, ok := c.observationRequests.LoadWithFunc(token.String(), func(v interface{}) interface{} {
+				r := v.(message.Message)
+				msg := tcppool.AcquireMessage(r.Context)
+				msg.ResetOptionsTo(r.Options)
+				msg.SetCode(r.Code)
+				msg.SetToken(r.Token)
+				return msg
+			})
+			if !ok {
+				return nil, false
+			}
+			return req.(blockwise.Message), true
+		}, nil)
+	}
+	monitor := keepAliveMonitor(func(cc inactivity.ClientConn, receivePong func()) (func(), error) {
+		return cc.(*tcp.ClientConn).AsyncPing(receivePong)
+	})
+	conn := coapnet.NewConn(netConn,
+		coapnet.WithHeartBeat(time.Duration(activeConnectionParams.HeartbeatTimeoutSecs)*time.Second),
+		coapnet.WithOnReadTimeout(func() error {
+			monitor.CheckInactivity(c.ClientConn)
+			return nil
+		}),
+	)
+	session := tcp.NewSession(context.Background(), conn,
+		tcp.NewObservationHandler(c.observationHandlers, func(w *tcp.ResponseWriter, r *tcppool.Message) {
+			switch r.Code() {
+			case codes.POST, codes.PUT, codes.GET, codes.DELETE:
+				w.SetResponse(codes.NotFound, message.TextPlain, nil)
+			}
+		}),
+		// the transport is reliable so large responses can be sent as BERT blocks, which need fewer round trips
+		lb.TCPMaxMessageSize, coapGoPool, coapErrors, blockwise.SZXBERT, bw, false, false, true, monitor,
+	)
+	c.ClientConn = tcp.NewClientConn(session, c.observationHandlers, c.observationRequests)
+	go func() {
+		if err := c.Run(); err != nil {
+			coapErrors(err)
+		}
+	}()
+	return c
+}
+
+// tokenObservation calls fn for the notifications of an observation made with a token from the
+// connection's TokenAllocator.
+type tokenObservation struct {
+	fn        func(res *coapResponse)
+	mu        sync.Mutex
+	seq       uint32
+	lastEvent time.Time
+}
+
+// notify calls fn with the notification, unless it is older than one already received. Returns false
+// if the notification ends the observation.
+// https://datatracker.ietf.org/doc/html/rfc7641#section-3.4
+func (o *tokenObservation) notify(msg *basepool.Message, httpRes *http.Response) bool {
+	if seq, err := msg.Observe(); err == nil {
+		now := time.Now()
+		o.mu.Lock()
+		fresh := coapobservation.ValidSequenceNumber(o.seq, seq, o.lastEvent, now)
+		if fresh {
+			o.seq = seq
+			o.lastEvent = now
+		}
+		o.mu.Unlock()
+		if !fresh {
+			return true
+		}
+	}
+	if res, err := newCoAPResponse(msg, httpRes); err == nil {
+		o.fn(res)
+	}
+	return msg.Code() == codes.Content
+}
+
+func (c *udpConn) observe(path string, token message.Token, fn func(res *coapResponse), opts ...message.Option) error {
+	req, err := client.NewGetRequest(context.Background(), path, opts...)
+	if err != nil {
+		return err
+	}
+	req.SetToken(token)
+	req.SetObserve(0)
+	o := &tokenObservation{fn: fn}
+	stop := func() {
+		c.observationHandlers.Pop(token)
+		if req, ok := c.observationRequests.PullOut(token.String()); ok {
+			pool.ReleaseMessage(req.(*pool.Message))
+		}
+	}
+	// register before sending, so notifications which overtake the response aren't reset
+	c.observationRequests.Store(token.String(), req)
+	err = c.observationHandlers.Insert(token, func(w *client.ResponseWriter, r *pool.Message) {
+		if !o.notify(r.Message, coapHTTP.CoAPToHTTPResponse(r)) {
+			stop()
+		}
+	})
+	if err != nil {
+		stop()
+		return err
+	}
+	res, err := c.Do(req)
+	if err != nil {
+		stop()
+		return err
+	}
+	defer pool.ReleaseMessage(res)
+	if !o.notify(res.Message, coapHTTP.CoAPToHTTPResponse(res)) {
+		stop()
+		return fmt.Errorf("unexpected response code %v", res.Code())
+	}
+	return nil
+}
+
+func (c *tcpConn) observe(path string, token message.Token, fn func(res *coapResponse), opts ...message.Option) error {
+	req, err := tcp.NewGetRequest(context.Background(), path, opts...)
+	if err != nil {
+		return err
+	}
+	defer tcppool.ReleaseMessage(req)
+	req.SetToken(token)
+	req.SetObserve(0)
+	options, err := req.Options().Clone()
+	if err != nil {
+		return err
+	}
+	o := &tokenObservation{fn: fn}
+	stop := func() {
+		c.observationHandlers.Pop(token)
+		c.observationRequests.Delete(token.String())
+	}
+	c.observationRequests.Store(token.String(), message.Message{
+		Context: req.Context(),
+		Token:   token,
+		Code:    req.Code(),
+		Options: options,
+	})
+	err = c.observationHandlers.Insert(token, func(w *tcp.ResponseWriter, r *tcppool.Message) {
+		if !o.notify(r.Message, coapHTTP.CoAPTCPToHTTPResponse(r)) {
+			stop()
+		}
+	})
+	if err != nil {
+		stop()
+		return err
+	}
+	res, err := c.Do(req)
+	if err != nil {
+		stop()
+		return err
+	}
+	defer tcppool.ReleaseMessage(res)
+	if !o.notify(res.Message, coapHTTP.CoAPTCPToHTTPResponse(res)) {
+		stop()
+		return fmt.Errorf("unexpected response code %v", res.Code())
+	}
+	return nil
+}
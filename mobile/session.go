@@ -0,0 +1,129 @@
+// Copyright 2021 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package mobile
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"net/url"
+
+	"github.com/matrix-org/go-coap/v2/message"
+	"github.com/matrix-org/go-coap/v2/message/codes"
+	"github.com/matrix-org/lb"
+	piondtls "github.com/pion/dtls/v2"
+	"github.com/sirupsen/logrus"
+)
+
+// resumption is everything needed to resume a DTLS session with a host.
+type resumption struct {
+	Host        string `json:"host"`
+	Ticket      []byte `json:"ticket"`
+	Secret      []byte `json:"secret"`
+	AccessToken string `json:"access_token,omitempty"`
+}
+
+// dtlsConfig returns a DTLS config which resumes the session. The base config supplies the
+// connection parameters which aren't to do with authentication.
+func (r *resumption) dtlsConfig(base *piondtls.Config) *piondtls.Config {
+	secret := r.Secret
+	return &piondtls.Config{
+		PSK: func(hint []byte) ([]byte, error) {
+			return secret, nil
+		},
+		PSKIdentityHint: r.Ticket,
+		CipherSuites:    lb.PSKCipherSuites,
+		FlightInterval:  base.FlightInterval,
+	}
+}
+
+// ExportSession returns the DTLS session with the host in hsURL as an opaque string, which can be
+// passed to ImportSession after the app restarts to resume the session without a full handshake.
+// The access token in use is restored when the session is resumed, so it isn't sent again.
+// The string contains secrets and should be stored as securely as the access token. Returns an
+// empty string if the session can't be exported, e.g because it isn't over DTLS or the server
+// doesn't issue session tickets.
+func ExportSession(hsURL string) string {
+	session, err := exportSession(hsURL)
+	if err != nil {
+		logrus.WithError(err).Errorf("Failed to export session for %s", hsURL)
+		return ""
+	}
+	return session
+}
+
+func exportSession(hsURL string) (string, error) {
+	u, err := url.Parse(hsURL)
+	if err != nil {
+		return "", err
+	}
+	host := dialHost(u)
+	conn, err := dc.getClientForHost(host)
+	if err != nil {
+		return "", err
+	}
+	udp, ok := conn.(*udpConn)
+	if !ok {
+		return "", fmt.Errorf("only DTLS sessions can be exported, connected over %s", conn.Transport())
+	}
+	code, ticket, err := conn.post(lb.SessionTicketPath, message.AppOctets, nil)
+	if err != nil {
+		return "", err
+	}
+	if code != codes.Changed {
+		return "", fmt.Errorf("server responded with %v", code)
+	}
+	state := udp.dtlsConn.ConnectionState()
+	secret, err := lb.ResumptionSecret(&state)
+	if err != nil {
+		return "", err
+	}
+	// the ticket has the token the server last saw, which is the one we last sent
+	accessToken, _ := conn.Context().Value(ctxValSentAccessToken).(string)
+	b, err := json.Marshal(resumption{
+		Host:        host,
+		Ticket:      ticket,
+		Secret:      secret,
+		AccessToken: accessToken,
+	})
+	if err != nil {
+		return "", err
+	}
+	return base64.RawURLEncoding.EncodeToString(b), nil
+}
+
+// ImportSession imports a session returned by ExportSession. The next connection to the host will
+// try to resume the session, falling back to a full handshake if that fails. Sessions can only be
+// resumed once, so export the session again once connected. Returns false if the session is invalid.
+func ImportSession(session string) bool {
+	b, err := base64.RawURLEncoding.DecodeString(session)
+	if err != nil {
+		logrus.WithError(err).Error("Failed to import session")
+		return false
+	}
+	var r resumption
+	if err = json.Unmarshal(b, &r); err != nil {
+		logrus.WithError(err).Error("Failed to import session")
+		return false
+	}
+	if r.Host == "" || len(r.Ticket) == 0 || len(r.Secret) == 0 {
+		logrus.Error("Failed to import session: missing fields")
+		return false
+	}
+	dc.mu.Lock()
+	defer dc.mu.Unlock()
+	dc.resumptions[r.Host] = &r
+	return true
+}
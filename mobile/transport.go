@@ -0,0 +1,297 @@
+// Copyright 2021 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package mobile
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"strconv"
+	"time"
+
+	"github.com/matrix-org/go-coap/v2/message"
+	"github.com/matrix-org/go-coap/v2/message/codes"
+	basepool "github.com/matrix-org/go-coap/v2/message/pool"
+	"github.com/matrix-org/go-coap/v2/tcp"
+	tcppool "github.com/matrix-org/go-coap/v2/tcp/message/pool"
+	"github.com/matrix-org/go-coap/v2/udp/client"
+	udpmessage "github.com/matrix-org/go-coap/v2/udp/message"
+	"github.com/matrix-org/go-coap/v2/udp/message/pool"
+	"github.com/matrix-org/lb"
+	piondtls "github.com/pion/dtls/v2"
+	kitsync "github.com/plgd-dev/kit/sync"
+)
+
+// coapConn is a CoAP connection to a server over DTLS, TLS or WebSockets.
+type coapConn interface {
+	Context() context.Context
+	SetContextValue(key interface{}, val interface{})
+	Close() error
+	AddOnClose(f func())
+	// The transport in use e.g "udp"
+	Transport() string
+	// send the HTTP request as CoAP, calling prepare on the message before it is sent. Returns a
+	// <nil> response if the request was sent without waiting for a response.
+	send(req *http.Request, prepare func(msg *basepool.Message) error) (*coapResponse, error)
+	// observe the path with this token, calling fn for each notification until one ends the observation
+	observe(path string, token message.Token, fn func(res *coapResponse), opts ...message.Option) error
+	// post the payload to the path, returning the response code and payload. Used for EDHOC and session tickets.
+	post(path string, contentFormat message.MediaType, payload []byte) (codes.Code, []byte, error)
+}
+
+// coapResponse is a CoAP response converted to HTTP, independent of the transport it arrived on.
+type coapResponse struct {
+	code codes.Code
+	// the access token alias the server issued, if any
+	alias []byte
+	// the options the client learns from e.g the room, user and event ID handles the server issued
+	opts message.Options
+	// the Block2 option, if the response is one block of the body
+	block2    uint32
+	hasBlock2 bool
+	http      *http.Response
+}
+
+func newCoAPResponse(msg *basepool.Message, httpRes *http.Response) (*coapResponse, error) {
+	if httpRes == nil {
+		return nil, fmt.Errorf("cannot convert CoAP response code %v to HTTP", msg.Code())
+	}
+	res := &coapResponse{
+		code: msg.Code(),
+		http: httpRes,
+	}
+	if alias, err := msg.GetOptionBytes(lb.OptionIDAccessTokenAlias); err == nil && len(alias) > 0 {
+		res.alias = alias
+	}
+	if block2, err := msg.GetOptionUint32(message.Block2); err == nil {
+		res.block2 = block2
+		res.hasBlock2 = true
+	}
+	for _, opt := range msg.Options() {
+		if opt.ID == lb.OptionIDIDHandle || opt.ID == lb.OptionIDDictionary {
+			// the message is returned to the pool, so copy the value
+			res.opts = append(res.opts, message.Option{
+				ID:    opt.ID,
+				Value: append([]byte(nil), opt.Value...),
+			})
+		}
+	}
+	return res, nil
+}
+
+// protectRequest protects the message with OSCORE if the connection has a security context. Returns
+// <nil> if the message is not protected.
+func protectRequest(conn coapConn, msg *basepool.Message) (*lb.OSCORERequest, error) {
+	oscore, ok := conn.Context().Value(ctxValOSCORE).(*lb.OSCOREContext)
+	if !ok {
+		return nil, nil
+	}
+	return oscore.ProtectRequest(msg)
+}
+
+// unprotectResponse decrypts the response to a protected request. If the proxy could not decrypt the
+// request (e.g because it restarted and forgot the security context) the connection is closed, so the
+// next connection makes a new security context.
+func unprotectResponse(conn coapConn, protected *lb.OSCORERequest, msg *basepool.Message) error {
+	if protected == nil {
+		return nil
+	}
+	if err := protected.UnprotectResponse(msg); err != nil {
+		conn.Close()
+		return fmt.Errorf("failed to unprotect OSCORE response with code %v: %w", msg.Code(), err)
+	}
+	return nil
+}
+
+func readBody(msg *basepool.Message) ([]byte, error) {
+	if msg.Body() == nil {
+		return nil, nil
+	}
+	return msg.ReadBody()
+}
+
+// udpConn is CoAP over DTLS, made with newDTLSClientConn
+type udpConn struct {
+	*client.ClientConn
+	dtlsConn            *piondtls.Conn
+	observationHandlers *client.HandlerContainer
+	observationRequests *kitsync.Map
+}
+
+func (c *udpConn) AddOnClose(f func()) {
+	c.ClientConn.AddOnClose(f)
+}
+
+func (c *udpConn) Transport() string {
+	return "udp"
+}
+
+func (c *udpConn) send(req *http.Request, prepare func(msg *basepool.Message) error) (res *coapResponse, err error) {
+	err = coapHTTPForConn(c).HTTPRequestToCoAP(req, func(msg *pool.Message) error {
+		if err := prepare(msg.Message); err != nil {
+			return err
+		}
+		protected, err := protectRequest(c, msg.Message)
+		if err != nil {
+			return err
+		}
+		if msg.Type() == udpmessage.NonConfirmable {
+			// fire and forget: the server won't send a response
+			return c.WriteMessage(msg)
+		}
+		coapRes, err := c.Do(msg)
+		if err != nil {
+			return err
+		}
+		if err = unprotectResponse(c, protected, coapRes.Message); err != nil {
+			return err
+		}
+		res, err = newCoAPResponse(coapRes.Message, coapHTTP.CoAPToHTTPResponse(coapRes))
+		return err
+	})
+	return res, err
+}
+
+func (c *udpConn) post(path string, contentFormat message.MediaType, payload []byte) (codes.Code, []byte, error) {
+	res, err := c.Post(context.Background(), path, contentFormat, bytes.NewReader(payload))
+	if err != nil {
+		return 0, nil, err
+	}
+	defer pool.ReleaseMessage(res)
+	body, err := readBody(res.Message)
+	return res.Code(), body, err
+}
+
+// tcpConn is CoAP over TLS or secure WebSockets, made with newTCPClientConn
+type tcpConn struct {
+	*tcp.ClientConn
+	transport           string
+	observationHandlers *tcp.HandlerContainer
+	observationRequests *kitsync.Map
+}
+
+func (c *tcpConn) AddOnClose(f func()) {
+	c.ClientConn.AddOnClose(f)
+}
+
+func (c *tcpConn) Transport() string {
+	return c.transport
+}
+
+func (c *tcpConn) send(req *http.Request, prepare func(msg *basepool.Message) error) (res *coapResponse, err error) {
+	err = coapHTTPForConn(c).HTTPRequestToCoAPTCP(req, func(msg *tcppool.Message) error {
+		if err := prepare(msg.Message); err != nil {
+			return err
+		}
+		protected, err := protectRequest(c, msg.Message)
+		if err != nil {
+			return err
+		}
+		if msg.HasOption(message.NoResponse) {
+			// the server won't send a response, so don't wait for one
+			return c.WriteMessage(msg)
+		}
+		coapRes, err := c.Do(msg)
+		if err != nil {
+			return err
+		}
+		if err = unprotectResponse(c, protected, coapRes.Message); err != nil {
+			return err
+		}
+		res, err = newCoAPResponse(coapRes.Message, coapHTTP.CoAPTCPToHTTPResponse(coapRes))
+		return err
+	})
+	return res, err
+}
+
+func (c *tcpConn) post(path string, contentFormat message.MediaType, payload []byte) (codes.Code, []byte, error) {
+	res, err := c.Post(context.Background(), path, contentFormat, bytes.NewReader(payload))
+	if err != nil {
+		return 0, nil, err
+	}
+	defer tcppool.ReleaseMessage(res)
+	body, err := readBody(res.Message)
+	return res.Code(), body, err
+}
+
+// newTCPConn makes a connection with newTCPClientConn, then sends the CSM which allows the proxy to
+// use blockwise transfers and waits for the proxy's CSM so the first request can use them too.
+func newTCPConn(netConn net.Conn, transport string, blockwiseTransfers bool) (coapConn, error) {
+	c := newTCPClientConn(netConn, transport, blockwiseTransfers)
+	cc := c.ClientConn
+	err := lb.SendBlockwiseCSM(cc)
+	if err == nil {
+		ctx, cancel := context.WithTimeout(context.Background(), time.Duration(activeConnectionParams.KeepAliveTimeoutSecs)*time.Second)
+		defer cancel()
+		// the proxy sends its CSM before anything else, so it has arrived once the pong has
+		err = cc.Ping(ctx)
+	}
+	if err != nil {
+		cc.Close()
+		return nil, err
+	}
+	return c, nil
+}
+
+// dialTCP connects to the host using CoAP over TLS on TCPFallbackPort.
+func dialTCP(host string, blockwiseTransfers bool) (coapConn, error) {
+	hostname, _, err := net.SplitHostPort(host)
+	if err != nil {
+		hostname = host
+	}
+	tlsConfig := &tls.Config{
+		InsecureSkipVerify: activeConnectionParams.InsecureSkipVerify,
+		// https://datatracker.ietf.org/doc/html/rfc8323#section-8.2
+		NextProtos: []string{"coap"},
+	}
+	if verify := verifyServerPublicKey(); verify != nil {
+		tlsConfig.InsecureSkipVerify = true
+		tlsConfig.VerifyPeerCertificate = verify
+	}
+	target := net.JoinHostPort(hostname, strconv.Itoa(activeConnectionParams.TCPFallbackPort))
+	conn, err := tls.DialWithDialer(&net.Dialer{Timeout: 3 * time.Second}, "tcp", target, tlsConfig)
+	if err != nil {
+		return nil, err
+	}
+	return newTCPConn(conn, "tcp", blockwiseTransfers)
+}
+
+// dialWebSocket connects to the host using CoAP over secure WebSockets on WebSocketFallbackPort.
+func dialWebSocket(host string, blockwiseTransfers bool) (coapConn, error) {
+	hostname, _, err := net.SplitHostPort(host)
+	if err != nil {
+		hostname = host
+	}
+	tlsConfig := &tls.Config{
+		InsecureSkipVerify: activeConnectionParams.InsecureSkipVerify,
+	}
+	if verify := verifyServerPublicKey(); verify != nil {
+		tlsConfig.InsecureSkipVerify = true
+		tlsConfig.VerifyPeerCertificate = verify
+	}
+	target := &url.URL{
+		Scheme: "coaps+ws",
+		Host:   net.JoinHostPort(hostname, strconv.Itoa(activeConnectionParams.WebSocketFallbackPort)),
+	}
+	conn, err := lb.DialWebSocket(target, tlsConfig)
+	if err != nil {
+		return nil, err
+	}
+	return newTCPConn(conn, "ws", blockwiseTransfers)
+}
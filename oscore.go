@@ -0,0 +1,724 @@
+// Copyright 2021 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package lb
+
+import (
+	"bytes"
+	"container/list"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/sha256"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"sync"
+
+	"github.com/fxamacker/cbor/v2"
+	"github.com/matrix-org/go-coap/v2/message"
+	"github.com/matrix-org/go-coap/v2/message/codes"
+	basepool "github.com/matrix-org/go-coap/v2/message/pool"
+	coapmux "github.com/matrix-org/go-coap/v2/mux"
+	"github.com/pion/dtls/v2/pkg/crypto/ccm"
+	"golang.org/x/crypto/chacha20poly1305"
+	"golang.org/x/crypto/hkdf"
+)
+
+// OptionIDOSCORE is the OSCORE option. https://datatracker.ietf.org/doc/html/rfc8613#section-2
+const OptionIDOSCORE = message.OptionID(9)
+
+// COSE algorithm identifiers for the AEAD algorithms which can be used with OSCORE.
+// https://www.iana.org/assignments/cose/cose.xhtml#algorithms
+const (
+	// AES-CCM-16-64-128 is mandatory to implement and has the smallest overhead (8 bytes), but cannot
+	// protect messages larger than 64KiB.
+	AlgAESCCM16_64_128 = 10
+	// ChaCha20/Poly1305 has a larger overhead (16 bytes) but no practical limit on message size.
+	AlgChaCha20Poly1305 = 24
+)
+
+// DefaultOSCOREAlgorithm is the algorithm clients use unless told otherwise. Responses such as an
+// initial /sync can be larger than 64KiB, which AES-CCM-16-64-128 cannot protect.
+const DefaultOSCOREAlgorithm = AlgChaCha20Poly1305
+
+// DefaultOSCOREContexts is a sensible number of security contexts for an OSCOREServer to hold.
+const DefaultOSCOREContexts = 10000
+
+// codeFETCH is the FETCH method, which go-coap does not define. https://datatracker.ietf.org/doc/html/rfc8132
+const codeFETCH = codes.Code(5)
+
+// oscoreMaxSequenceNumber is the largest Sender Sequence Number. https://datatracker.ietf.org/doc/html/rfc8613#section-7.2.1
+const oscoreMaxSequenceNumber = 1<<40 - 1
+
+var (
+	// ErrOSCOREContextNotFound is returned when there is no security context for a protected request.
+	ErrOSCOREContextNotFound = errors.New("oscore: security context not found")
+	// ErrOSCOREReplay is returned when a protected request has been received before.
+	ErrOSCOREReplay = errors.New("oscore: replay detected")
+	// ErrOSCOREDecryptionFailed is returned when a protected message cannot be decrypted.
+	ErrOSCOREDecryptionFailed = errors.New("oscore: decryption failed")
+	// ErrOSCORENotProtected is returned when a response to a protected request is not protected.
+	ErrOSCORENotProtected = errors.New("oscore: message is not protected")
+)
+
+// Options which are visible to proxies (Class U). All other options are encrypted (Class E).
+// Observe and No-Response are both, so the proxy can act on them.
+// https://datatracker.ietf.org/doc/html/rfc8613#section-4.1
+var oscoreOuterOptions = map[message.OptionID]bool{
+	message.URIHost:     true,
+	message.URIPort:     true,
+	message.ProxyURI:    true,
+	message.ProxyScheme: true,
+	// blockwise transfer of the protected message is done by the transport
+	message.Block1: true,
+	message.Block2: true,
+	message.Size1:  true,
+	message.Size2:  true,
+}
+var oscoreInnerAndOuterOptions = map[message.OptionID]bool{
+	message.Observe:    true,
+	message.NoResponse: true,
+}
+
+type oscoreAlgorithm struct {
+	id       int
+	keyLen   int
+	nonceLen int
+	newAEAD  func(key []byte) (cipher.AEAD, error)
+}
+
+var oscoreAlgorithms = map[int]oscoreAlgorithm{
+	AlgAESCCM16_64_128: {
+		id:       AlgAESCCM16_64_128,
+		keyLen:   16,
+		nonceLen: 13,
+		newAEAD: func(key []byte) (cipher.AEAD, error) {
+			block, err := aes.NewCipher(key)
+			if err != nil {
+				return nil, err
+			}
+			return ccm.NewCCM(block, 8, 13)
+		},
+	},
+	AlgChaCha20Poly1305: {
+		id:       AlgChaCha20Poly1305,
+		keyLen:   chacha20poly1305.KeySize,
+		nonceLen: chacha20poly1305.NonceSize,
+		newAEAD:  chacha20poly1305.New,
+	},
+}
+
+// OSCOREContext is an OSCORE security context shared between a client and the proxy. Requests
+// protected with it can only be read by the other party, even if they pass through untrusted
+// CoAP proxies. https://datatracker.ietf.org/doc/html/rfc8613#section-3
+type OSCOREContext struct {
+	alg         oscoreAlgorithm
+	senderID    []byte
+	recipientID []byte
+	idContext   []byte
+	sender      cipher.AEAD
+	recipient   cipher.AEAD
+	commonIV    []byte
+
+	mu     sync.Mutex
+	seq    uint64
+	replay replayWindow
+}
+
+// NewOSCOREContext derives a security context from a master secret. The sender ID of one party is the
+// recipient ID of the other. The master salt and ID context are optional.
+// https://datatracker.ietf.org/doc/html/rfc8613#section-3.2
+func NewOSCOREContext(alg int, masterSecret, masterSalt, senderID, recipientID, idContext []byte) (*OSCOREContext, error) {
+	a, ok := oscoreAlgorithms[alg]
+	if !ok {
+		return nil, fmt.Errorf("oscore: unsupported algorithm %d", alg)
+	}
+	maxIDLen := a.nonceLen - 6
+	if len(senderID) > maxIDLen || len(recipientID) > maxIDLen {
+		return nil, fmt.Errorf("oscore: sender and recipient IDs must be at most %d bytes", maxIDLen)
+	}
+	c := &OSCOREContext{
+		alg:         a,
+		senderID:    append([]byte{}, senderID...),
+		recipientID: append([]byte{}, recipientID...),
+		idContext:   idContext,
+	}
+	senderKey, err := c.derive(masterSecret, masterSalt, c.senderID, "Key", a.keyLen)
+	if err != nil {
+		return nil, err
+	}
+	recipientKey, err := c.derive(masterSecret, masterSalt, c.recipientID, "Key", a.keyLen)
+	if err != nil {
+		return nil, err
+	}
+	c.commonIV, err = c.derive(masterSecret, masterSalt, []byte{}, "IV", a.nonceLen)
+	if err != nil {
+		return nil, err
+	}
+	if c.sender, err = a.newAEAD(senderKey); err != nil {
+		return nil, err
+	}
+	if c.recipient, err = a.newAEAD(recipientKey); err != nil {
+		return nil, err
+	}
+	return c, nil
+}
+
+func (c *OSCOREContext) derive(masterSecret, masterSalt, id []byte, typ string, length int) ([]byte, error) {
+	var idContext interface{}
+	if c.idContext != nil {
+		idContext = c.idContext
+	}
+	info, err := cbor.Marshal([]interface{}{id, idContext, c.alg.id, typ, length})
+	if err != nil {
+		return nil, err
+	}
+	out := make([]byte, length)
+	if _, err = io.ReadFull(hkdf.New(sha256.New, masterSecret, masterSalt, info), out); err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+// nonce computes the AEAD nonce. https://datatracker.ietf.org/doc/html/rfc8613#section-5.2
+func (c *OSCOREContext) nonce(idPIV, piv []byte) []byte {
+	n := len(c.commonIV)
+	nonce := make([]byte, n)
+	nonce[0] = byte(len(idPIV))
+	copy(nonce[1+(n-6)-len(idPIV):], idPIV)
+	copy(nonce[n-len(piv):], piv)
+	for i := range nonce {
+		nonce[i] ^= c.commonIV[i]
+	}
+	return nonce
+}
+
+// aad computes the additional authenticated data. https://datatracker.ietf.org/doc/html/rfc8613#section-5.4
+func (c *OSCOREContext) aad(requestKid, requestPIV []byte) ([]byte, error) {
+	externalAAD, err := cbor.Marshal([]interface{}{
+		1, []int{c.alg.id}, append([]byte{}, requestKid...), append([]byte{}, requestPIV...), []byte{},
+	})
+	if err != nil {
+		return nil, err
+	}
+	return cbor.Marshal([]interface{}{"Encrypt0", []byte{}, externalAAD})
+}
+
+func (c *OSCOREContext) nextPIV() ([]byte, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.seq > oscoreMaxSequenceNumber {
+		return nil, errors.New("oscore: sender sequence numbers exhausted, a new security context is required")
+	}
+	piv := encodePIV(c.seq)
+	c.seq++
+	return piv, nil
+}
+
+// encodePIV encodes a sequence number as a Partial IV, which is the shortest big-endian encoding.
+func encodePIV(seq uint64) []byte {
+	var piv []byte
+	for seq > 0 {
+		piv = append([]byte{byte(seq)}, piv...)
+		seq >>= 8
+	}
+	if len(piv) == 0 {
+		piv = []byte{0}
+	}
+	return piv
+}
+
+func decodePIV(piv []byte) uint64 {
+	var seq uint64
+	for _, b := range piv {
+		seq = seq<<8 | uint64(b)
+	}
+	return seq
+}
+
+// OSCORERequest is a request which has been protected by ProtectRequest, used to read the response.
+type OSCORERequest struct {
+	ctx   *OSCOREContext
+	kid   []byte
+	piv   []byte
+	nonce []byte
+}
+
+// ProtectRequest encrypts the request in place, so only the code, token and options which proxies
+// need to see are left in the clear.
+func (c *OSCOREContext) ProtectRequest(msg *basepool.Message) (*OSCORERequest, error) {
+	payload, err := readPoolBody(msg)
+	if err != nil {
+		return nil, err
+	}
+	piv, err := c.nextPIV()
+	if err != nil {
+		return nil, err
+	}
+	req := &OSCORERequest{
+		ctx:   c,
+		kid:   c.senderID,
+		piv:   piv,
+		nonce: c.nonce(c.senderID, piv),
+	}
+	outerCode := codes.POST
+	if msg.HasOption(message.Observe) {
+		outerCode = codeFETCH
+	}
+	optValue := encodeOSCOREOption(piv, c.idContext, c.senderID, true)
+	ciphertext, outer, err := c.seal(c.sender, req.nonce, c.senderID, piv, msg.Code(), msg.Options(), payload, optValue)
+	if err != nil {
+		return nil, err
+	}
+	msg.SetCode(outerCode)
+	msg.ResetOptionsTo(outer)
+	msg.SetBody(bytes.NewReader(ciphertext))
+	return req, nil
+}
+
+// UnprotectResponse decrypts the response to this request in place.
+func (r *OSCORERequest) UnprotectResponse(msg *basepool.Message) error {
+	optValue, err := msg.GetOptionBytes(OptionIDOSCORE)
+	if err != nil {
+		return ErrOSCORENotProtected
+	}
+	piv, _, _, err := decodeOSCOREOption(optValue)
+	if err != nil {
+		return err
+	}
+	nonce := r.nonce
+	if piv != nil {
+		// the server used its own sequence number e.g for a notification
+		nonce = r.ctx.nonce(r.ctx.recipientID, piv)
+	}
+	ciphertext, err := readPoolBody(msg)
+	if err != nil {
+		return err
+	}
+	code, opts, payload, err := r.ctx.open(r.ctx.recipient, nonce, r.kid, r.piv, ciphertext, msg.Options())
+	if err != nil {
+		return err
+	}
+	msg.SetCode(code)
+	msg.ResetOptionsTo(opts)
+	msg.SetBody(bytes.NewReader(payload))
+	return nil
+}
+
+// seal encrypts the code, Class E options and payload, returning the ciphertext and the outer options.
+func (c *OSCOREContext) seal(aead cipher.AEAD, nonce, requestKid, requestPIV []byte, code codes.Code, opts message.Options, payload []byte, optValue []byte) ([]byte, message.Options, error) {
+	var inner, outer message.Options
+	for _, o := range opts {
+		switch {
+		case o.ID == OptionIDOSCORE:
+			continue
+		case oscoreOuterOptions[o.ID]:
+			outer = outer.Add(o)
+		case oscoreInnerAndOuterOptions[o.ID]:
+			outer = outer.Add(o)
+			inner = inner.Add(o)
+		default:
+			inner = inner.Add(o)
+		}
+	}
+	outer = outer.Set(message.Option{ID: OptionIDOSCORE, Value: optValue})
+	// https://datatracker.ietf.org/doc/html/rfc8613#section-5.3
+	optsLen, _ := inner.Marshal(nil)
+	plaintext := make([]byte, 1+optsLen, 1+optsLen+1+len(payload))
+	plaintext[0] = byte(code)
+	if _, err := inner.Marshal(plaintext[1:]); err != nil {
+		return nil, nil, err
+	}
+	if len(payload) > 0 {
+		plaintext = append(plaintext, 0xff)
+		plaintext = append(plaintext, payload...)
+	}
+	if c.alg.id == AlgAESCCM16_64_128 && len(plaintext) > 0xffff {
+		return nil, nil, fmt.Errorf("oscore: message is too large for AES-CCM-16-64-128 (%d bytes), use ChaCha20/Poly1305", len(plaintext))
+	}
+	aad, err := c.aad(requestKid, requestPIV)
+	if err != nil {
+		return nil, nil, err
+	}
+	return aead.Seal(nil, nonce, plaintext, aad), outer, nil
+}
+
+// open decrypts the ciphertext, returning the inner code, options and payload. Options which are
+// only sent in the clear are kept from the outer options.
+func (c *OSCOREContext) open(aead cipher.AEAD, nonce, requestKid, requestPIV, ciphertext []byte, outerOpts message.Options) (codes.Code, message.Options, []byte, error) {
+	aad, err := c.aad(requestKid, requestPIV)
+	if err != nil {
+		return 0, nil, nil, err
+	}
+	plaintext, err := aead.Open(nil, nonce, ciphertext, aad)
+	if err != nil || len(plaintext) == 0 {
+		return 0, nil, nil, ErrOSCOREDecryptionFailed
+	}
+	code := codes.Code(plaintext[0])
+	opts := make(message.Options, 0, 32)
+	n, err := opts.Unmarshal(plaintext[1:], message.CoapOptionDefs)
+	if err != nil {
+		return 0, nil, nil, fmt.Errorf("oscore: malformed inner options: %w", err)
+	}
+	payload := plaintext[1+n:]
+	for _, o := range outerOpts {
+		if oscoreOuterOptions[o.ID] {
+			opts = opts.Add(o)
+		}
+	}
+	return code, opts, payload, nil
+}
+
+// encodeOSCOREOption encodes the value of the OSCORE option. https://datatracker.ietf.org/doc/html/rfc8613#section-6.1
+func encodeOSCOREOption(piv, kidContext, kid []byte, hasKid bool) []byte {
+	if len(piv) == 0 && kidContext == nil && !hasKid {
+		return []byte{}
+	}
+	flags := byte(len(piv))
+	if hasKid {
+		flags |= 0x08
+	}
+	if kidContext != nil {
+		flags |= 0x10
+	}
+	value := append([]byte{flags}, piv...)
+	if kidContext != nil {
+		value = append(value, byte(len(kidContext)))
+		value = append(value, kidContext...)
+	}
+	if hasKid {
+		value = append(value, kid...)
+	}
+	return value
+}
+
+// decodeOSCOREOption decodes the value of the OSCORE option. The kid is <nil> if it is not present.
+func decodeOSCOREOption(value []byte) (piv, kidContext, kid []byte, err error) {
+	if len(value) == 0 {
+		return nil, nil, nil, nil
+	}
+	flags := value[0]
+	if flags&0xe0 != 0 {
+		return nil, nil, nil, fmt.Errorf("oscore: reserved flags set in option")
+	}
+	n := int(flags & 0x07)
+	if n > 5 || len(value) < 1+n {
+		return nil, nil, nil, fmt.Errorf("oscore: malformed Partial IV in option")
+	}
+	if n > 0 {
+		piv = value[1 : 1+n]
+	}
+	rest := value[1+n:]
+	if flags&0x10 != 0 {
+		if len(rest) < 1 || len(rest) < 1+int(rest[0]) {
+			return nil, nil, nil, fmt.Errorf("oscore: malformed kid context in option")
+		}
+		kidContext = rest[1 : 1+int(rest[0])]
+		rest = rest[1+int(rest[0]):]
+	}
+	if flags&0x08 != 0 {
+		kid = append([]byte{}, rest...)
+	}
+	return piv, kidContext, kid, nil
+}
+
+func readPoolBody(msg *basepool.Message) ([]byte, error) {
+	if msg.Body() == nil {
+		return nil, nil
+	}
+	return msg.ReadBody()
+}
+
+// replayWindow is a sliding window of the sequence numbers which have been received.
+// https://datatracker.ietf.org/doc/html/rfc8613#section-7.4
+type replayWindow struct {
+	seen    bool
+	highest uint64
+	bitmap  uint32 // bit i is set if highest-i has been received
+}
+
+func (w *replayWindow) isReplay(seq uint64) bool {
+	if !w.seen || seq > w.highest {
+		return false
+	}
+	diff := w.highest - seq
+	if diff >= 32 {
+		// too old to tell, so reject it
+		return true
+	}
+	return w.bitmap&(1<<diff) != 0
+}
+
+func (w *replayWindow) add(seq uint64) {
+	if !w.seen {
+		w.seen = true
+		w.highest = seq
+		w.bitmap = 1
+		return
+	}
+	if seq > w.highest {
+		shift := seq - w.highest
+		if shift >= 32 {
+			w.bitmap = 0
+		} else {
+			w.bitmap <<= shift
+		}
+		w.bitmap |= 1
+		w.highest = seq
+		return
+	}
+	w.bitmap |= 1 << (w.highest - seq)
+}
+
+// oscoreExchange is a protected request received by the server, used to protect the response.
+type oscoreExchange struct {
+	ctx   *OSCOREContext
+	kid   []byte
+	piv   []byte
+	nonce []byte
+}
+
+type oscoreContextKey struct {
+	idContext string
+	kid       string
+}
+
+// OSCOREServer holds the security contexts the proxy shares with clients, and decrypts requests and
+// encrypts responses on their behalf. Contexts are made by AddContext, or established by clients using
+// EDHOC if SetEDHOCKey has been called. Every client has its own master secret, so no client can read
+// the requests of another.
+type OSCOREServer struct {
+	// If true, requests which are not protected by OSCORE are rejected. EDHOC requests are always allowed.
+	Required bool
+
+	mu          sync.Mutex
+	contexts    map[oscoreContextKey]*list.Element
+	order       *list.List // least recently used first
+	maxContexts int
+	edhoc       *edhocResponder
+}
+
+// NewOSCOREServer makes a server which holds up to `maxContexts` security contexts. When there are too
+// many, the least recently used context is forgotten and its client must establish a new one.
+func NewOSCOREServer(maxContexts int) *OSCOREServer {
+	return &OSCOREServer{
+		contexts:    make(map[oscoreContextKey]*list.Element),
+		order:       list.New(),
+		maxContexts: maxContexts,
+	}
+}
+
+// AddContext adds a server security context, whose recipient ID is the sender ID of the client.
+func (s *OSCOREServer) AddContext(c *OSCOREContext) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.add(c)
+}
+
+func (s *OSCOREServer) add(c *OSCOREContext) {
+	key := oscoreContextKey{string(c.idContext), string(c.recipientID)}
+	if el, ok := s.contexts[key]; ok {
+		s.order.Remove(el)
+	}
+	for len(s.contexts) >= s.maxContexts && s.order.Len() > 0 {
+		oldest := s.order.Remove(s.order.Front()).(*OSCOREContext)
+		delete(s.contexts, oscoreContextKey{string(oldest.idContext), string(oldest.recipientID)})
+	}
+	s.contexts[key] = s.order.PushBack(c)
+}
+
+// hasRecipientID returns true if a context without an ID Context uses this recipient ID.
+func (s *OSCOREServer) hasRecipientID(id []byte) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	_, ok := s.contexts[oscoreContextKey{"", string(id)}]
+	return ok
+}
+
+// lookup the context for this request.
+func (s *OSCOREServer) lookup(idContext, kid []byte) (*OSCOREContext, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	el, ok := s.contexts[oscoreContextKey{string(idContext), string(kid)}]
+	if !ok {
+		return nil, ErrOSCOREContextNotFound
+	}
+	s.order.MoveToBack(el)
+	return el.Value.(*OSCOREContext), nil
+}
+
+// unprotectRequest decrypts the request, returning the inner request.
+func (s *OSCOREServer) unprotectRequest(r *message.Message) (*message.Message, *oscoreExchange, error) {
+	optValue, err := r.Options.GetBytes(OptionIDOSCORE)
+	if err != nil {
+		return nil, nil, ErrOSCORENotProtected
+	}
+	piv, kidContext, kid, err := decodeOSCOREOption(optValue)
+	if err != nil {
+		return nil, nil, err
+	}
+	if piv == nil || kid == nil {
+		return nil, nil, fmt.Errorf("oscore: request is missing the Partial IV or kid")
+	}
+	c, err := s.lookup(kidContext, kid)
+	if err != nil {
+		return nil, nil, err
+	}
+	seq := decodePIV(piv)
+	c.mu.Lock()
+	replayed := c.replay.isReplay(seq)
+	c.mu.Unlock()
+	if replayed {
+		return nil, nil, ErrOSCOREReplay
+	}
+	var ciphertext []byte
+	if r.Body != nil {
+		if ciphertext, err = ioutil.ReadAll(r.Body); err != nil {
+			return nil, nil, err
+		}
+	}
+	nonce := c.nonce(kid, piv)
+	code, opts, payload, err := c.open(c.recipient, nonce, kid, piv, ciphertext, r.Options)
+	if err != nil {
+		return nil, nil, err
+	}
+	c.mu.Lock()
+	// check again in case the same request was decrypted concurrently
+	replayed = c.replay.isReplay(seq)
+	c.replay.add(seq)
+	c.mu.Unlock()
+	if replayed {
+		return nil, nil, ErrOSCOREReplay
+	}
+	inner := &message.Message{
+		Code:    code,
+		Token:   r.Token,
+		Options: opts,
+		Body:    bytes.NewReader(payload),
+		Context: r.Context,
+	}
+	return inner, &oscoreExchange{
+		ctx:   c,
+		kid:   kid,
+		piv:   piv,
+		nonce: nonce,
+	}, nil
+}
+
+// protectResponse encrypts the response with the nonce of the request, so no Partial IV is sent.
+// https://datatracker.ietf.org/doc/html/rfc8613#section-8.3
+func (e *oscoreExchange) protectResponse(code codes.Code, opts message.Options, payload []byte) ([]byte, message.Options, error) {
+	return e.ctx.seal(e.ctx.sender, e.nonce, e.kid, e.piv, code, opts, payload, []byte{})
+}
+
+// oscoreResponseWriter encrypts responses to protected requests.
+type oscoreResponseWriter struct {
+	coapmux.ResponseWriter
+	exchange *oscoreExchange
+	logger   Logger
+}
+
+func (w *oscoreResponseWriter) SetResponse(code codes.Code, contentFormat message.MediaType, d io.ReadSeeker, opts ...message.Option) error {
+	inner := message.Options{}
+	for _, o := range opts {
+		inner = inner.Add(o)
+	}
+	var payload []byte
+	if d != nil {
+		var err error
+		payload, err = ioutil.ReadAll(d)
+		if err != nil {
+			return err
+		}
+		buf := make([]byte, 4)
+		inner, _, _ = inner.SetContentFormat(buf, contentFormat)
+	}
+	ciphertext, outer, err := w.exchange.protectResponse(code, inner, payload)
+	if err != nil {
+		if w.logger != nil {
+			w.logger.Printf("failed to protect OSCORE response: %s", err)
+		}
+		return w.ResponseWriter.SetResponse(codes.InternalServerError, message.TextPlain, nil)
+	}
+	// The outer code is always 2.04 Changed: https://datatracker.ietf.org/doc/html/rfc8613#section-4.2
+	// go-coap adds Content-Format and ETag options for the ciphertext, which the client ignores.
+	return w.ResponseWriter.SetResponse(codes.Changed, message.AppOctets, bytes.NewReader(ciphertext), outer...)
+}
+
+// oscoreErrorCode returns the unprotected error response for a request which could not be decrypted.
+// https://datatracker.ietf.org/doc/html/rfc8613#section-8.2
+func oscoreErrorCode(err error) codes.Code {
+	switch err {
+	case ErrOSCOREContextNotFound, ErrOSCOREReplay:
+		return codes.Unauthorized
+	default:
+		return codes.BadRequest
+	}
+}
+
+// handleOSCORE decrypts protected requests, returning the inner request and a ResponseWriter which
+// encrypts the response. Returns false if the request has been handled.
+func (co *CoAPHTTP) handleOSCORE(w coapmux.ResponseWriter, r *coapmux.Message) (coapmux.ResponseWriter, *coapmux.Message, bool) {
+	if r.Options.HasOption(OptionIDOSCORE) {
+		inner, exchange, err := co.OSCORE.unprotectRequest(r.Message)
+		if err != nil {
+			co.log("failed to unprotect OSCORE request: %s", err)
+			w.SetResponse(oscoreErrorCode(err), message.TextPlain, nil)
+			return nil, nil, false
+		}
+		// Notifications would need their own sequence numbers from the server, so observe
+		// requests are served once: clients should long-poll instead.
+		inner.Options = inner.Options.Remove(message.Observe)
+		return &oscoreResponseWriter{
+			ResponseWriter: w,
+			exchange:       exchange,
+			logger:         co.Log,
+		}, &coapmux.Message{
+			Message:        inner,
+			SequenceNumber: r.SequenceNumber,
+			IsConfirmable:  r.IsConfirmable,
+		}, true
+	}
+	co.OSCORE.mu.Lock()
+	edhoc := co.OSCORE.edhoc
+	co.OSCORE.mu.Unlock()
+	if path, _ := r.Options.Path(); edhoc != nil && "/"+path == EDHOCPath {
+		if r.Code != codes.POST {
+			w.SetResponse(codes.MethodNotAllowed, message.TextPlain, nil)
+			return nil, nil, false
+		}
+		var payload []byte
+		if r.Body != nil {
+			payload, _ = ioutil.ReadAll(r.Body)
+		}
+		res, err := edhoc.handle(payload)
+		if err != nil {
+			co.log("EDHOC handshake with %v failed: %s", w.Client().RemoteAddr(), err)
+			w.SetResponse(codes.BadRequest, message.TextPlain, nil)
+			return nil, nil, false
+		}
+		var body io.ReadSeeker
+		if res != nil {
+			body = bytes.NewReader(res)
+		}
+		w.SetResponse(codes.Changed, edhocContentFormat, body)
+		return nil, nil, false
+	}
+	if co.OSCORE.Required {
+		w.SetResponse(codes.Unauthorized, message.TextPlain, nil)
+		return nil, nil, false
+	}
+	return w, r, true
+}
@@ -0,0 +1,267 @@
+// Copyright 2021 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package lb
+
+import (
+	"bytes"
+	"context"
+	"encoding/hex"
+	"io/ioutil"
+	"testing"
+
+	"github.com/matrix-org/go-coap/v2/message"
+	"github.com/matrix-org/go-coap/v2/message/codes"
+	basepool "github.com/matrix-org/go-coap/v2/message/pool"
+)
+
+// Test vectors from https://datatracker.ietf.org/doc/html/rfc8613#appendix-C.1.1 and C.4
+func TestOSCORETestVectors(t *testing.T) {
+	secret, _ := hex.DecodeString("0102030405060708090a0b0c0d0e0f10")
+	salt, _ := hex.DecodeString("9e7ca92223786340")
+	client, err := NewOSCOREContext(AlgAESCCM16_64_128, secret, salt, []byte{}, []byte{0x01}, nil)
+	if err != nil {
+		t.Fatalf("NewOSCOREContext: %s", err)
+	}
+	if got := hex.EncodeToString(client.commonIV); got != "4622d4dd6d944168eefb54987c" {
+		t.Fatalf("common IV: got %s", got)
+	}
+
+	client.seq = 20
+	msg := basepool.NewMessage()
+	msg.SetCode(codes.GET)
+	msg.SetOptionString(message.URIHost, "localhost")
+	msg.SetPath("tv1")
+	if _, err = client.ProtectRequest(msg); err != nil {
+		t.Fatalf("ProtectRequest: %s", err)
+	}
+	if msg.Code() != codes.POST {
+		t.Errorf("outer code: got %v want POST", msg.Code())
+	}
+	opt, err := msg.GetOptionBytes(OptionIDOSCORE)
+	if err != nil || hex.EncodeToString(opt) != "0914" {
+		t.Errorf("OSCORE option: got %x want 0914", opt)
+	}
+	if host, err := msg.Options().GetString(message.URIHost); err != nil || host != "localhost" {
+		t.Errorf("Uri-Host should be sent in the clear, got %q", host)
+	}
+	if msg.HasOption(message.URIPath) {
+		t.Errorf("Uri-Path should be encrypted")
+	}
+	body, _ := ioutil.ReadAll(msg.Body())
+	if got := hex.EncodeToString(body); got != "612f1092f1776f1c1668b3825e" {
+		t.Errorf("ciphertext: got %s", got)
+	}
+}
+
+// newOSCOREContexts makes the security contexts of a client and the server from this master secret.
+func newOSCOREContexts(t *testing.T, alg int, secret, clientID []byte) (client, server *OSCOREContext) {
+	t.Helper()
+	client, err := NewOSCOREContext(alg, secret, nil, clientID, []byte{}, nil)
+	if err != nil {
+		t.Fatalf("NewOSCOREContext: %s", err)
+	}
+	server, err = NewOSCOREContext(alg, secret, nil, []byte{}, clientID, nil)
+	if err != nil {
+		t.Fatalf("NewOSCOREContext: %s", err)
+	}
+	return client, server
+}
+
+func TestOSCOREClientContexts(t *testing.T) {
+	server := NewOSCOREServer(2)
+	alice, aliceServer := newOSCOREContexts(t, AlgAESCCM16_64_128, []byte("alice's secret"), []byte{0x01})
+	bob, bobServer := newOSCOREContexts(t, AlgAESCCM16_64_128, []byte("bob's secret"), []byte{0x02})
+	server.AddContext(aliceServer)
+	server.AddContext(bobServer)
+	roundTrip(t, alice, server)
+	roundTrip(t, bob, server)
+
+	// a client can't use the context of another client without its secret
+	mallory, _ := newOSCOREContexts(t, AlgAESCCM16_64_128, []byte("alice's secret"), []byte{0x02})
+	// a sequence number bob hasn't used, so it isn't rejected as a replay
+	mallory.seq = 100
+	msg := basepool.NewMessage()
+	msg.SetCode(codes.GET)
+	msg.SetPath("/7")
+	if _, err := mallory.ProtectRequest(msg); err != nil {
+		t.Fatalf("ProtectRequest: %s", err)
+	}
+	if _, _, err := server.unprotectRequest(toMessage(msg)); err != ErrOSCOREDecryptionFailed {
+		t.Fatalf("got %v want ErrOSCOREDecryptionFailed", err)
+	}
+}
+
+func TestOSCOREUnknownContext(t *testing.T) {
+	client, _ := newOSCOREContexts(t, AlgAESCCM16_64_128, []byte("secret"), []byte{0x01})
+	msg := basepool.NewMessage()
+	msg.SetCode(codes.GET)
+	msg.SetPath("/7")
+	if _, err := client.ProtectRequest(msg); err != nil {
+		t.Fatalf("ProtectRequest: %s", err)
+	}
+	// a server with a different secret can't decrypt it
+	server := NewOSCOREServer(2)
+	_, other := newOSCOREContexts(t, AlgAESCCM16_64_128, []byte("other"), []byte{0x01})
+	server.AddContext(other)
+	if _, _, err := server.unprotectRequest(toMessage(msg)); err != ErrOSCOREDecryptionFailed {
+		t.Fatalf("got %v want ErrOSCOREDecryptionFailed", err)
+	}
+	// a server without a context for the client doesn't know it
+	if _, _, err := NewOSCOREServer(2).unprotectRequest(toMessage(msg)); err != ErrOSCOREContextNotFound {
+		t.Fatalf("got %v want ErrOSCOREContextNotFound", err)
+	}
+}
+
+func TestOSCOREReplayWindow(t *testing.T) {
+	var w replayWindow
+	for _, seq := range []uint64{0, 1, 5, 3} {
+		if w.isReplay(seq) {
+			t.Fatalf("%d is not a replay", seq)
+		}
+		w.add(seq)
+	}
+	for _, seq := range []uint64{0, 1, 3, 5} {
+		if !w.isReplay(seq) {
+			t.Fatalf("%d is a replay", seq)
+		}
+	}
+	if w.isReplay(2) || w.isReplay(4) || w.isReplay(6) {
+		t.Fatalf("unseen sequence numbers are not replays")
+	}
+	w.add(100)
+	if !w.isReplay(2) {
+		t.Fatalf("sequence numbers older than the window should be rejected")
+	}
+}
+
+func toMessage(msg *basepool.Message) *message.Message {
+	body, _ := ioutil.ReadAll(msg.Body())
+	msg.SetBody(bytes.NewReader(body))
+	return &message.Message{
+		Code:    msg.Code(),
+		Token:   msg.Token(),
+		Options: msg.Options(),
+		Body:    bytes.NewReader(body),
+		Context: context.Background(),
+	}
+}
+
+// roundTrip sends a protected request from the client to the server and checks the response can be read.
+func roundTrip(t *testing.T, client *OSCOREContext, server *OSCOREServer) {
+	t.Helper()
+	msg := basepool.NewMessage()
+	msg.SetCode(codes.PUT)
+	msg.SetToken([]byte{1, 2})
+	msg.SetPath("/9/!abc:localhost/m.room.message/1")
+	msg.SetOptionBytes(OptionIDAccessTokenAlias, []byte{4})
+	msg.SetContentFormat(message.AppCBOR)
+	msg.SetBody(bytes.NewReader([]byte("hello")))
+	req, err := client.ProtectRequest(msg)
+	if err != nil {
+		t.Fatalf("ProtectRequest: %s", err)
+	}
+	if msg.HasOption(OptionIDAccessTokenAlias) || msg.HasOption(message.URIPath) {
+		t.Fatalf("options were not encrypted: %v", msg.Options())
+	}
+	wire := toMessage(msg)
+	inner, exchange, err := server.unprotectRequest(wire)
+	if err != nil {
+		t.Fatalf("unprotectRequest: %s", err)
+	}
+	if inner.Code != codes.PUT {
+		t.Errorf("inner code: got %v want PUT", inner.Code)
+	}
+	if path, _ := inner.Options.Path(); path != "9/!abc:localhost/m.room.message/1" {
+		t.Errorf("inner path: got %s", path)
+	}
+	if alias, _ := inner.Options.GetBytes(OptionIDAccessTokenAlias); !bytes.Equal(alias, []byte{4}) {
+		t.Errorf("inner access token alias: got %x", alias)
+	}
+	if body, _ := ioutil.ReadAll(inner.Body); string(body) != "hello" {
+		t.Errorf("inner body: got %q", string(body))
+	}
+
+	// replaying the request is rejected
+	if _, _, err = server.unprotectRequest(toMessage(msg)); err != ErrOSCOREReplay {
+		t.Fatalf("replay: got %v want ErrOSCOREReplay", err)
+	}
+
+	ciphertext, outer, err := exchange.protectResponse(codes.Content, nil, []byte("world"))
+	if err != nil {
+		t.Fatalf("protectResponse: %s", err)
+	}
+	res := basepool.NewMessage()
+	res.SetCode(codes.Changed)
+	res.ResetOptionsTo(outer)
+	res.SetBody(bytes.NewReader(ciphertext))
+	if err = req.UnprotectResponse(res); err != nil {
+		t.Fatalf("UnprotectResponse: %s", err)
+	}
+	if res.Code() != codes.Content {
+		t.Errorf("response code: got %v want Content", res.Code())
+	}
+	if body, _ := ioutil.ReadAll(res.Body()); string(body) != "world" {
+		t.Errorf("response body: got %q", string(body))
+	}
+}
+
+// TestOSCORELargeResponse checks that responses larger than 64KiB, such as an initial /sync, can be
+// protected with the default algorithm.
+func TestOSCORELargeResponse(t *testing.T) {
+	body := bytes.Repeat([]byte("a"), 100*1024)
+	for _, tc := range []struct {
+		alg     int
+		wantErr bool
+	}{
+		{alg: DefaultOSCOREAlgorithm},
+		// the length of the plaintext must fit in 2 bytes
+		{alg: AlgAESCCM16_64_128, wantErr: true},
+	} {
+		client, serverCtx := newOSCOREContexts(t, tc.alg, []byte("secret"), []byte{0x01})
+		server := NewOSCOREServer(1)
+		server.AddContext(serverCtx)
+		msg := basepool.NewMessage()
+		msg.SetCode(codes.GET)
+		msg.SetPath("/7")
+		req, err := client.ProtectRequest(msg)
+		if err != nil {
+			t.Fatalf("ProtectRequest: %s", err)
+		}
+		_, exchange, err := server.unprotectRequest(toMessage(msg))
+		if err != nil {
+			t.Fatalf("unprotectRequest: %s", err)
+		}
+		ciphertext, outer, err := exchange.protectResponse(codes.Content, nil, body)
+		if tc.wantErr {
+			if err == nil {
+				t.Errorf("alg %d: protectResponse succeeded with a %d byte body", tc.alg, len(body))
+			}
+			continue
+		}
+		if err != nil {
+			t.Fatalf("alg %d: protectResponse: %s", tc.alg, err)
+		}
+		res := basepool.NewMessage()
+		res.SetCode(codes.Changed)
+		res.ResetOptionsTo(outer)
+		res.SetBody(bytes.NewReader(ciphertext))
+		if err = req.UnprotectResponse(res); err != nil {
+			t.Fatalf("alg %d: UnprotectResponse: %s", tc.alg, err)
+		}
+		if got, _ := ioutil.ReadAll(res.Body()); !bytes.Equal(got, body) {
+			t.Errorf("alg %d: response body: got %d bytes want %d", tc.alg, len(got), len(body))
+		}
+	}
+}
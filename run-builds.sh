@@ -6,3 +6,4 @@ go build ./cmd/coap
 go build ./cmd/proxy
 go build ./cmd/client-proxy
 (cd mobile && go build .) # don't make gomobile bindings as it takes too long
+(cd cmd/specgen && go build .) # has its own module so the library doesn't depend on its YAML parser
@@ -1,3 +1,4 @@
 #!/bin/bash -eux
 
-go test -v .
\ No newline at end of file
+go test -v .
+(cd cmd/specgen && go test -v .)